@@ -0,0 +1,262 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command customize-image builds the image the controller would serve for a
+// host from a base ISO and the host's network data, and writes it to disk,
+// for checking what a host would boot without a cluster.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	metal3iocontroller "github.com/asalkeld/image-customization-controller/controllers/metal3.io"
+	"github.com/asalkeld/image-customization-controller/pkg/imagehandler"
+	"github.com/asalkeld/image-customization-controller/pkg/initrd"
+	metal3iov1alpha1 "github.com/metal3-io/baremetal-operator/apis/metal3.io/v1alpha1"
+)
+
+// namespace is where the PreprovisioningImage and its network data Secret
+// are created in the in-memory cluster.
+const namespace = "default"
+
+// networkDataSecret is the name of the network data Secret.
+const networkDataSecret = "network-data"
+
+// keyValues is a repeatable flag of key=value pairs.
+type keyValues []string
+
+func (kv *keyValues) String() string { return strings.Join(*kv, ",") }
+
+func (kv *keyValues) Set(value string) error {
+	*kv = append(*kv, value)
+	return nil
+}
+
+// networkDataKey returns the Secret key network data read from a file is
+// stored under, unless one is given: that of its format, guessed from the
+// file name.
+func networkDataKey(path string) string {
+	switch ext := filepath.Ext(path); ext {
+	case ".json":
+		return "network_data.json"
+	case ".ign":
+		return "ignition"
+	case ".nmconnection":
+		return filepath.Base(path)
+	}
+	return "nmstate"
+}
+
+// readNetworkData reads network data files, each given as key=path or just
+// path, into the data of a Secret.
+func readNetworkData(files []string) (map[string][]byte, error) {
+	data := map[string][]byte{}
+	for _, file := range files {
+		key, path := "", file
+		if parts := strings.SplitN(file, "=", 2); len(parts) == 2 {
+			key, path = parts[0], parts[1]
+		}
+		if key == "" {
+			key = networkDataKey(path)
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		data[key] = content
+	}
+	return data, nil
+}
+
+func parseAnnotations(values []string) (map[string]string, error) {
+	annotations := map[string]string{}
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%q is not of the form key=value", value)
+		}
+		annotations[parts[0]] = parts[1]
+	}
+	return annotations, nil
+}
+
+// writeImage writes the image served at rawURL by the image server to path.
+func writeImage(server imagehandler.ImageHandler, rawURL, path string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	image, err := server.FileSystem().Open(u.Path)
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, image); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func run() error {
+	var isoFile, output, ignitionOutput, name, arch, kernelArgs string
+	var networkMode, customizationMode, initrdCompression string
+	var networkData, annotationValues keyValues
+	flag.StringVar(&isoFile, "iso", "", "The base RHCOS live ISO. Required.")
+	flag.StringVar(&output, "output", "", "The file the customized image is written to.")
+	flag.StringVar(&ignitionOutput, "ignition-output", "",
+		"The file the content embedded in the image is written to: the ignition config, or the initramfs "+
+			"archive of keyfiles in nm-keyfiles customization mode.")
+	flag.Var(&networkData, "network-data",
+		"A file of network data, as key=path, where key is that of the network data Secret, e.g. nmstate, "+
+			"network_data.json or eth0.nmconnection. The key is guessed from the file name if only a path is given. "+
+			"Can be repeated.")
+	flag.Var(&annotationValues, "annotation",
+		"An annotation of the PreprovisioningImage, as key=value, e.g. image-customization.metal3.io/kernel-args=quiet. "+
+			"Can be repeated.")
+	flag.StringVar(&name, "name", "host", "The name of the PreprovisioningImage.")
+	flag.StringVar(&arch, "arch", "", "The CPU architecture of the host, e.g. x86_64 or aarch64.")
+	flag.StringVar(&kernelArgs, "kernel-args", "",
+		"Space-separated kernel arguments added to the image, as by the controller's kernel-args.")
+	flag.StringVar(&networkMode, "network-mode", string(metal3iocontroller.NetworkModeAuto),
+		"How the host configures the provisioning network: \"dhcp\", \"static\" or \"auto\".")
+	flag.StringVar(&customizationMode, "customization-mode", string(metal3iocontroller.CustomizationModeIgnition),
+		"The content embedded in the image: \"ignition\" or \"nm-keyfiles\".")
+	flag.StringVar(&initrdCompression, "initrd-compression", string(initrd.CompressionNone),
+		"The compression of the initramfs archives embedded in the image: \"none\", \"gzip\" or \"xz\".")
+	opts := zap.Options{}
+	opts.BindFlags(flag.CommandLine)
+	flag.Parse()
+
+	if isoFile == "" {
+		return errors.New("-iso is required")
+	}
+	if output == "" && ignitionOutput == "" {
+		return errors.New("at least one of -output and -ignition-output is required")
+	}
+	mode, err := metal3iocontroller.ParseNetworkMode(networkMode)
+	if err != nil {
+		return err
+	}
+	contentMode, err := metal3iocontroller.ParseCustomizationMode(customizationMode)
+	if err != nil {
+		return err
+	}
+	compression, err := initrd.ParseCompression(initrdCompression)
+	if err != nil {
+		return err
+	}
+	annotations, err := parseAnnotations(annotationValues)
+	if err != nil {
+		return err
+	}
+	data, err := readNetworkData(networkData)
+	if err != nil {
+		return err
+	}
+
+	scheme := k8sruntime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = metal3iov1alpha1.AddToScheme(scheme)
+
+	img := &metal3iov1alpha1.PreprovisioningImage{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Annotations: annotations, UID: "customize-image"},
+		Spec:       metal3iov1alpha1.PreprovisioningImageSpec{Architecture: arch},
+	}
+	objects := []k8sruntime.Object{img}
+	if len(data) > 0 {
+		img.Spec.NetworkDataName = networkDataSecret
+		objects = append(objects, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: networkDataSecret},
+			Data:       data,
+		})
+	}
+	// the controller's pipeline reads the configuration from a cluster
+	cluster := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(objects...).Build()
+
+	log := zap.New(zap.UseFlagOptions(&opts))
+	reconciler := &metal3iocontroller.PreprovisioningImageReconciler{
+		Client:            cluster,
+		APIReader:         cluster,
+		Scheme:            scheme,
+		Log:               log.WithName("customize"),
+		KernelArgs:        strings.Fields(kernelArgs),
+		NetworkMode:       mode,
+		CustomizationMode: contentMode,
+		InitrdCompression: compression,
+		ImageExtension:    ".iso",
+	}
+	ctx := context.Background()
+	spec, err := reconciler.ImageSpecFor(ctx, img)
+	if err != nil {
+		return err
+	}
+
+	if ignitionOutput != "" {
+		if err := os.WriteFile(ignitionOutput, spec.Ignition, 0600); err != nil {
+			return err
+		}
+	}
+	if output == "" {
+		return nil
+	}
+	server := imagehandler.NewImageFileServer(log.WithName("images"), imagehandler.Options{
+		IsoFile: isoFile,
+		BaseURL: "http://localhost",
+	})
+	info, err := server.ServeImage(ctx, spec)
+	if err != nil {
+		return err
+	}
+	if !info.Ready && info.Done != nil {
+		<-info.Done
+		info, err = server.GetImage(ctx, spec.Name)
+		if err != nil {
+			return err
+		}
+	}
+	if info.Error != nil {
+		return info.Error
+	}
+	return writeImage(server, info.URL, output)
+}
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "customize-image:", err)
+		os.Exit(1)
+	}
+}
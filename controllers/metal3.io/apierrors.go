@@ -0,0 +1,91 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+
+	metal3 "github.com/metal3-io/baremetal-operator/apis/metal3.io/v1alpha1"
+)
+
+// apiRetryBackoff bounds the retries of a request failing with a transient
+// API error within a reconcile, before the image is requeued instead.
+var apiRetryBackoff = wait.Backoff{
+	Steps:    3,
+	Duration: 100 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.1,
+}
+
+// isTransientAPIError reports whether a request to the API server failed in
+// a way that is expected to clear by itself: a timeout, throttling, an
+// unavailable or failing API server, or a conflicting update.
+func isTransientAPIError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var netErr net.Error
+	return k8serrors.IsTimeout(err) ||
+		k8serrors.IsServerTimeout(err) ||
+		k8serrors.IsTooManyRequests(err) ||
+		k8serrors.IsServiceUnavailable(err) ||
+		k8serrors.IsInternalError(err) ||
+		k8serrors.IsConflict(err) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		(errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// retryTransientAPIErrors calls fn again while it fails with a transient API
+// error, until apiRetryBackoff is exhausted.
+func retryTransientAPIErrors(fn func() error) error {
+	return retry.OnError(apiRetryBackoff, isTransientAPIError, fn)
+}
+
+// transientAPIErrorDelay returns the delay before reconciling an image again
+// after a transient API error. It grows with the time the image has been in
+// error, as for a missing Secret, but is no shorter than the API server
+// asked clients to wait.
+func transientAPIErrorDelay(err error, status metal3.PreprovisioningImageStatus, delays RetryDelays) time.Duration {
+	delay := getErrorRetryDelay(status, delays)
+	if delay == 0 {
+		delay = delays.MinError
+	}
+	if seconds, ok := k8serrors.SuggestsClientDelay(err); ok && time.Duration(seconds)*time.Second > delay {
+		delay = time.Duration(seconds) * time.Second
+	}
+	return delay
+}
+
+// networkDataSecretError reports a failure to fetch the network data Secret
+// of an image: it is missing, transiently unavailable, or cannot be read.
+func networkDataSecretError(err error) *conditionError {
+	if k8serrors.IsNotFound(err) {
+		return newConditionError(reasonMissingNetworkData, "NetworkData secret not found", err)
+	}
+	if isTransientAPIError(err) {
+		return newConditionError(reasonTransientAPIError, fmt.Sprintf("unable to fetch NetworkData secret, retrying: %v", err), err)
+	}
+	return newConditionError(reasonUnexpectedError, err.Error(), err)
+}
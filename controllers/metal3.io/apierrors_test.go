@@ -0,0 +1,143 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	metal3 "github.com/metal3-io/baremetal-operator/apis/metal3.io/v1alpha1"
+)
+
+// flakyClient fails the first gets of Secrets with a transient error, or
+// every one if failures is negative.
+type flakyClient struct {
+	client.Client
+	failures int
+	gets     int
+}
+
+func (c *flakyClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	if _, ok := obj.(*corev1.Secret); ok {
+		c.gets++
+		if c.failures < 0 || c.gets <= c.failures {
+			return k8serrors.NewTooManyRequests("slow down", 2)
+		}
+	}
+	return c.Client.Get(ctx, key, obj)
+}
+
+func TestReconcileTransientSecretError(t *testing.T) {
+	img, secret := newTestNetworkData("host-0")
+	r, server := newTestReconciler(t, img, secret)
+	flaky := &flakyClient{Client: r.Client, failures: -1}
+	r.Client = flaky
+
+	result, img := reconcileImage(t, r, "host-0")
+	assertError(t, img, reasonTransientAPIError)
+	if result.RequeueAfter < 2*time.Second {
+		t.Errorf("expected a retry after the delay the API server asked for, got %+v", result)
+	}
+	if flaky.gets != apiRetryBackoff.Steps {
+		t.Errorf("expected %d attempts to fetch the Secret, got %d", apiRetryBackoff.Steps, flaky.gets)
+	}
+	server.AssertNoImage(t, testImageName("host-0"))
+}
+
+func TestReconcileTransientSecretErrorRetried(t *testing.T) {
+	img, secret := newTestNetworkData("host-0")
+	r, server := newTestReconciler(t, img, secret)
+	flaky := &flakyClient{Client: r.Client, failures: 1}
+	r.Client = flaky
+
+	_, img = reconcileImage(t, r, "host-0")
+	assertReady(t, img)
+	server.AssertImage(t, testImageName("host-0"))
+}
+
+// conflictingClient reports conflicts for the first patches of statuses, as
+// an API server may when an object is updated concurrently.
+type conflictingClient struct {
+	client.Client
+	conflicts int
+	patches   int
+}
+
+func (c *conflictingClient) Status() client.StatusWriter {
+	return &conflictingStatusWriter{StatusWriter: c.Client.Status(), c: c}
+}
+
+type conflictingStatusWriter struct {
+	client.StatusWriter
+	c *conflictingClient
+}
+
+func (w *conflictingStatusWriter) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	w.c.patches++
+	if w.c.patches <= w.c.conflicts {
+		return k8serrors.NewConflict(schema.GroupResource{Resource: "preprovisioningimages"}, obj.GetName(), nil)
+	}
+	return w.StatusWriter.Patch(ctx, obj, patch, opts...)
+}
+
+func TestPatchStatusRetriesConflict(t *testing.T) {
+	r, server := newTestReconciler(t, newTestImage("host-0"))
+	conflicting := &conflictingClient{Client: r.Client, conflicts: 1}
+	r.Client = conflicting
+
+	_, img := reconcileImage(t, r, "host-0")
+	assertReady(t, img)
+	if conflicting.patches != 2 {
+		t.Errorf("expected the conflicting patch to be retried once, got %d patches", conflicting.patches)
+	}
+	if img.Status.ImageUrl != server.URL(testImageName("host-0")) {
+		t.Errorf("unexpected image URL %q", img.Status.ImageUrl)
+	}
+}
+
+func TestPatchStatusKeepsConcurrentChanges(t *testing.T) {
+	r, _ := newTestReconciler(t, newTestImage("host-0"))
+	ctx := context.Background()
+	img := &metal3.PreprovisioningImage{}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(newTestImage("host-0")), img); err != nil {
+		t.Fatal(err)
+	}
+	original := img.DeepCopy()
+
+	// someone else sets a condition of their own meanwhile
+	other := img.DeepCopy()
+	meta.SetStatusCondition(&other.Status.Conditions, metav1.Condition{
+		Type: "Other", Status: metav1.ConditionTrue, Reason: "Other", LastTransitionTime: metav1.Now(),
+	})
+	if err := r.Status().Update(ctx, other); err != nil {
+		t.Fatal(err)
+	}
+
+	img.Status.ImageUrl = "http://example.com/host-0.iso"
+	meta.SetStatusCondition(&img.Status.Conditions, metav1.Condition{
+		Type: string(metal3.ConditionImageReady), Status: metav1.ConditionTrue, Reason: "Ready", LastTransitionTime: metav1.Now(),
+	})
+	if err := patchStatus(ctx, r.Client, img, original); err != nil {
+		t.Fatal(err)
+	}
+
+	stored := &metal3.PreprovisioningImage{}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(img), stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status.ImageUrl != img.Status.ImageUrl {
+		t.Errorf("URL not written: %q", stored.Status.ImageUrl)
+	}
+	if !meta.IsStatusConditionTrue(stored.Status.Conditions, string(metal3.ConditionImageReady)) {
+		t.Errorf("condition not written: %+v", stored.Status.Conditions)
+	}
+	if !meta.IsStatusConditionTrue(stored.Status.Conditions, "Other") {
+		t.Errorf("concurrently set condition overwritten: %+v", stored.Status.Conditions)
+	}
+}
@@ -0,0 +1,145 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	metal3 "github.com/metal3-io/baremetal-operator/apis/metal3.io/v1alpha1"
+)
+
+// archLabel is the well-known label for a host's architecture, in Go's
+// naming.
+const archLabel = "kubernetes.io/arch"
+
+// baseImageLabel selects one of the image server's named base ISOs for a
+// PreprovisioningImage, instead of the one for its architecture.
+const baseImageLabel = annotationPrefix + "base-image"
+
+// goArchToCPUArch maps Go architecture names, as used in archLabel, to the
+// names reported by hardware inspection.
+var goArchToCPUArch = map[string]string{
+	"amd64":   "x86_64",
+	"arm64":   "aarch64",
+	"ppc64le": "ppc64le",
+	"s390x":   "s390x",
+}
+
+// ParseArchKernelArgs parses semicolon-separated arch=args pairs, where
+// args are space-separated kernel arguments and arch a CPU architecture,
+// e.g. "aarch64=console=ttyAMA0;x86_64=console=ttyS0".
+func ParseArchKernelArgs(value string) (map[string][]string, error) {
+	archArgs := map[string][]string{}
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || !knownCPUArch(parts[0]) {
+			return nil, fmt.Errorf("%q is not of the form arch=args with a known architecture", entry)
+		}
+		archArgs[parts[0]] = append(archArgs[parts[0]], strings.Fields(parts[1])...)
+	}
+	return archArgs, nil
+}
+
+// knownCPUArch reports whether arch is a CPU architecture name as reported
+// by hardware inspection.
+func knownCPUArch(arch string) bool {
+	for _, cpuArch := range goArchToCPUArch {
+		if cpuArch == arch {
+			return true
+		}
+	}
+	return false
+}
+
+// imageArchitecture returns the CPU architecture to build an image for. It
+// is taken from the PreprovisioningImage if set, otherwise from the owning
+// BareMetalHost: its inspected CPU architecture, or failing that its
+// kubernetes.io/arch label. It is empty if none of those is known.
+func (r *PreprovisioningImageReconciler) imageArchitecture(ctx context.Context, img *metal3.PreprovisioningImage) (string, error) {
+	if img.Spec.Architecture != "" {
+		return img.Spec.Architecture, nil
+	}
+
+	host, err := r.owningHost(ctx, img)
+	if host == nil || err != nil {
+		return "", err
+	}
+	return hostArchitecture(host), nil
+}
+
+// hostArchitecture returns the CPU architecture of a BareMetalHost: its
+// inspected one, or failing that its kubernetes.io/arch label.
+func hostArchitecture(host *metal3.BareMetalHost) string {
+	if host.Status.HardwareDetails != nil && host.Status.HardwareDetails.CPU.Arch != "" {
+		return host.Status.HardwareDetails.CPU.Arch
+	}
+	return goArchToCPUArch[host.Labels[archLabel]]
+}
+
+// hostArchChanged passes updates of BareMetalHosts that change the
+// architecture their images are built for, e.g. once inspection detects it,
+// so that an image built before is built again for the right one.
+var hostArchChanged = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		oldHost, ok := e.ObjectOld.(*metal3.BareMetalHost)
+		newHost, ok2 := e.ObjectNew.(*metal3.BareMetalHost)
+		return ok && ok2 && hostArchitecture(oldHost) != hostArchitecture(newHost)
+	},
+	GenericFunc: func(event.GenericEvent) bool { return false },
+}
+
+// owningHost returns the BareMetalHost owning a PreprovisioningImage, or nil
+// if there isn't one.
+func (r *PreprovisioningImageReconciler) owningHost(ctx context.Context, img *metal3.PreprovisioningImage) (*metal3.BareMetalHost, error) {
+	name := owningHostName(img)
+	if name == "" {
+		return nil, nil
+	}
+	host := &metal3.BareMetalHost{}
+	err := r.Get(ctx, client.ObjectKey{Namespace: img.Namespace, Name: name}, host)
+	if k8serrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return host, nil
+}
+
+// owningHostName returns the name of the BareMetalHost owning a
+// PreprovisioningImage, or an empty string if there isn't one.
+func owningHostName(img *metal3.PreprovisioningImage) string {
+	for _, ref := range img.OwnerReferences {
+		gv, err := schema.ParseGroupVersion(ref.APIVersion)
+		if err == nil && gv.Group == metal3.GroupVersion.Group && ref.Kind == "BareMetalHost" {
+			return ref.Name
+		}
+	}
+	return ""
+}
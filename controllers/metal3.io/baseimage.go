@@ -0,0 +1,151 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	"github.com/asalkeld/image-customization-controller/pkg/imagehandler"
+	"github.com/asalkeld/image-customization-controller/pkg/sharding"
+	metal3 "github.com/metal3-io/baremetal-operator/apis/metal3.io/v1alpha1"
+)
+
+// conditionBaseImage records the version of the base ISO an image was built
+// from.
+const conditionBaseImage = "BaseImage"
+
+const (
+	reasonBaseImageCurrent conditionReason = "BaseImageCurrent"
+	reasonBaseImageChanged conditionReason = "BaseImageChanged"
+)
+
+// baseImageWatcher polls the image server for a replaced base ISO, and
+// checks straight away when notified of a change, and triggers a reconcile of
+// every PreprovisioningImage of the shard when it changes, so that they get
+// re-registered under new URLs.
+type baseImageWatcher struct {
+	client   client.Client
+	server   imagehandler.ImageFileServer
+	shard    sharding.Shard
+	interval time.Duration
+	changes  <-chan struct{}
+	events   chan<- event.GenericEvent
+	log      logr.Logger
+}
+
+func (w *baseImageWatcher) Start(ctx context.Context) error {
+	last, err := w.server.BaseImageVersion(ctx)
+	if err != nil {
+		w.log.Error(err, "unable to read base image version")
+	}
+
+	var tick <-chan time.Time
+	if w.interval > 0 {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	cancelRequeue := func() {}
+	defer func() { cancelRequeue() }()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-tick:
+		case <-w.changes:
+		}
+
+		version, err := w.server.BaseImageVersion(ctx)
+		if err != nil {
+			w.log.Error(err, "unable to read base image version")
+			continue
+		}
+		if version == last {
+			continue
+		}
+		w.log.Info("base image changed", "previous", last, "version", version)
+		last = version
+
+		// the controller may be busy, so keep watching while the images
+		// are queued, and start over should the base image change again
+		cancelRequeue()
+		requeueCtx, cancel := context.WithCancel(ctx)
+		cancelRequeue = cancel
+		go w.requeueImages(requeueCtx)
+	}
+}
+
+// requeueImages triggers a reconcile of every PreprovisioningImage of the
+// shard, until ctx is done.
+func (w *baseImageWatcher) requeueImages(ctx context.Context) {
+	images := metal3.PreprovisioningImageList{}
+	if err := w.client.List(ctx, &images); err != nil {
+		w.log.Error(err, "unable to list PreprovisioningImages")
+		return
+	}
+	for i := range images.Items {
+		if !w.shard.Owns(client.ObjectKeyFromObject(&images.Items[i]).String()) {
+			continue
+		}
+		select {
+		case w.events <- event.GenericEvent{Object: &images.Items[i]}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// baseImageMessage is the message of the BaseImage condition of images built
+// from a base image version.
+func baseImageMessage(version string) string {
+	return fmt.Sprintf("Built from base image version %s", version)
+}
+
+func setBaseImageVersion(generation int64, status *metal3.PreprovisioningImageStatus, version string) bool {
+	message := baseImageMessage(version)
+	reason := reasonBaseImageCurrent
+	if cond := meta.FindStatusCondition(status.Conditions, conditionBaseImage); cond != nil {
+		if cond.Message != message {
+			reason = reasonBaseImageChanged
+		} else {
+			reason = conditionReason(cond.Reason)
+		}
+	}
+
+	newStatus := status.DeepCopy()
+	meta.SetStatusCondition(&newStatus.Conditions, metav1.Condition{
+		Type:               conditionBaseImage,
+		Status:             metav1.ConditionTrue,
+		LastTransitionTime: metav1.Now(),
+		ObservedGeneration: generation,
+		Reason:             string(reason),
+		Message:            message,
+	})
+
+	changed := !apiequality.Semantic.DeepEqual(status, newStatus)
+	*status = *newStatus
+	return changed
+}
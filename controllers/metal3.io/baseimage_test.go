@@ -0,0 +1,79 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	"github.com/asalkeld/image-customization-controller/pkg/sharding"
+)
+
+func TestBaseImageWatcherRequeuesShard(t *testing.T) {
+	shard, err := sharding.Parse("0", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var owned, other []client.Object
+	for i := 0; len(owned) < 2 || len(other) < 2; i++ {
+		img := newTestImage(fmt.Sprintf("host-%d", i))
+		if shard.Owns(client.ObjectKeyFromObject(img).String()) {
+			owned = append(owned, img)
+		} else {
+			other = append(other, img)
+		}
+	}
+	r, server := newTestReconciler(t, append(owned, other...)...)
+
+	events := make(chan event.GenericEvent)
+	w := &baseImageWatcher{client: r.Client, server: server, shard: shard, events: events, log: r.Log}
+	done := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer close(done)
+		w.requeueImages(ctx)
+	}()
+
+	requeued := map[string]bool{}
+	for range owned {
+		select {
+		case e := <-events:
+			requeued[e.Object.GetName()] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("images not requeued")
+		}
+	}
+	for _, img := range owned {
+		if !requeued[img.GetName()] {
+			t.Errorf("image %s of the shard not requeued", img.GetName())
+		}
+	}
+	select {
+	case e := <-events:
+		t.Errorf("image %s of another shard requeued", e.Object.GetName())
+	case <-done:
+	}
+	cancel()
+}
+
+func TestBaseImageWatcherRequeueCancelled(t *testing.T) {
+	r, server := newTestReconciler(t, newTestImage("host-0"), newTestImage("host-1"))
+
+	// nothing reads the events, as when the controller is busy
+	w := &baseImageWatcher{client: r.Client, server: server, events: make(chan event.GenericEvent), log: r.Log}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.requeueImages(ctx)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("requeue blocked after being cancelled")
+	}
+}
@@ -0,0 +1,80 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+// The boot menu annotations override the reconciler's BootConfig for a
+// PreprovisioningImage's image.
+const (
+	volumeLabelAnnotation     = annotationPrefix + "volume-label"
+	bootMenuTitleAnnotation   = annotationPrefix + "boot-menu-title"
+	bootMenuDefaultAnnotation = annotationPrefix + "boot-menu-default"
+	bootMenuTimeoutAnnotation = annotationPrefix + "boot-menu-timeout"
+)
+
+// hasBootMenuAnnotations reports whether a PreprovisioningImage overrides
+// the boot configuration.
+func hasBootMenuAnnotations(annotations map[string]string) bool {
+	for _, key := range []string{volumeLabelAnnotation, bootMenuTitleAnnotation, bootMenuDefaultAnnotation, bootMenuTimeoutAnnotation} {
+		if _, ok := annotations[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// bootMenuCustomizer rewrites the volume label and boot menu of the image.
+type bootMenuCustomizer struct {
+	r *PreprovisioningImageReconciler
+}
+
+func (s *bootMenuCustomizer) Name() string { return "BootMenu" }
+
+func (s *bootMenuCustomizer) Customize(ctx context.Context, c *imageCustomization) *conditionError {
+	boot := s.r.BootConfig
+	annotations := c.img.Annotations
+	if label, ok := annotations[volumeLabelAnnotation]; ok {
+		boot.VolumeLabel = label
+	}
+	if title, ok := annotations[bootMenuTitleAnnotation]; ok {
+		boot.MenuTitle = title
+	}
+	for key, setting := range map[string]**int{
+		bootMenuDefaultAnnotation: &boot.MenuDefault,
+		bootMenuTimeoutAnnotation: &boot.MenuTimeout,
+	} {
+		value, ok := annotations[key]
+		if !ok {
+			continue
+		}
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return configurationError(fmt.Errorf("invalid %s annotation %q", key, value))
+		}
+		*setting = &number
+	}
+	if err := boot.Validate(); err != nil {
+		return configurationError(err)
+	}
+	c.boot = boot
+	return nil
+}
@@ -0,0 +1,118 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/asalkeld/image-customization-controller/pkg/ignition"
+)
+
+const (
+	// clusterProxyName is the name of the OpenShift cluster-wide Proxy.
+	clusterProxyName = "cluster"
+
+	// openshiftConfigNamespace holds the ConfigMap referenced as the
+	// Proxy's trusted CA bundle.
+	openshiftConfigNamespace = "openshift-config"
+
+	// trustedCAKey is the ConfigMap key holding the trusted CA bundle.
+	trustedCAKey = "ca-bundle.crt"
+)
+
+// proxyGVK is the OpenShift Proxy kind. It is handled as unstructured data so
+// as not to depend on the OpenShift API.
+var proxyGVK = schema.GroupVersionKind{Group: "config.openshift.io", Version: "v1", Kind: "Proxy"}
+
+func newClusterProxy() *unstructured.Unstructured {
+	proxy := &unstructured.Unstructured{}
+	proxy.SetGroupVersionKind(proxyGVK)
+	return proxy
+}
+
+// clusterProxy returns the effective proxy settings of the OpenShift
+// cluster-wide Proxy and the contents of its trusted CA bundle. Nothing is
+// returned if the Proxy doesn't exist.
+func (r *PreprovisioningImageReconciler) clusterProxy(ctx context.Context) (ignition.ProxyConfig, []byte, error) {
+	proxy := newClusterProxy()
+	err := r.Get(ctx, client.ObjectKey{Name: clusterProxyName}, proxy)
+	if k8serrors.IsNotFound(err) {
+		return ignition.ProxyConfig{}, nil, nil
+	}
+	if err != nil {
+		return ignition.ProxyConfig{}, nil, err
+	}
+
+	// the status holds the settings in effect, including the cluster's
+	// own networks in noProxy
+	config := ignition.ProxyConfig{}
+	config.HTTPProxy, _, _ = unstructured.NestedString(proxy.Object, "status", "httpProxy")
+	config.HTTPSProxy, _, _ = unstructured.NestedString(proxy.Object, "status", "httpsProxy")
+	config.NoProxy, _, _ = unstructured.NestedString(proxy.Object, "status", "noProxy")
+
+	caName := trustedCAName(proxy)
+	if caName == "" {
+		return config, nil, nil
+	}
+	key := client.ObjectKey{Namespace: openshiftConfigNamespace, Name: caName}
+	cm := corev1.ConfigMap{}
+	if err := r.Get(ctx, key, &cm); err != nil {
+		return ignition.ProxyConfig{}, nil, err
+	}
+	bundle, ok := cm.Data[trustedCAKey]
+	if !ok {
+		return ignition.ProxyConfig{}, nil, fmt.Errorf("ConfigMap %s has no %q key", key, trustedCAKey)
+	}
+	return config, []byte(bundle), nil
+}
+
+// trustedCAName returns the name of the ConfigMap referenced as a Proxy's
+// trusted CA bundle.
+func trustedCAName(proxy *unstructured.Unstructured) string {
+	name, _, _ := unstructured.NestedString(proxy.Object, "spec", "trustedCA", "name")
+	return name
+}
+
+// isTrustedCAConfigMap reports whether a ConfigMap is the cluster Proxy's
+// trusted CA bundle.
+func (r *PreprovisioningImageReconciler) isTrustedCAConfigMap(key client.ObjectKey) bool {
+	if !r.UseClusterProxy || key.Namespace != openshiftConfigNamespace {
+		return false
+	}
+	proxy := newClusterProxy()
+	if err := r.Get(context.Background(), client.ObjectKey{Name: clusterProxyName}, proxy); err != nil {
+		return false
+	}
+	return trustedCAName(proxy) == key.Name
+}
+
+// imagesForClusterProxy maps a change to the cluster Proxy to requests for
+// every PreprovisioningImage, since they all embed its settings.
+func (r *PreprovisioningImageReconciler) imagesForClusterProxy(obj client.Object) []reconcile.Request {
+	if obj.GetName() != clusterProxyName {
+		return nil
+	}
+	return r.allImages()
+}
@@ -0,0 +1,80 @@
+package controllers
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	testProxyEnvPath  = "/etc/systemd/system.conf.d/10-default-env.conf"
+	testTrustedCAPath = "/etc/pki/ca-trust/source/anchors/openshift-config-user-ca-bundle.crt"
+)
+
+func TestReconcileClusterProxy(t *testing.T) {
+	r, server := newTestReconciler(t, newTestImage("host-0"), newTestClusterProxy("user-ca-bundle"),
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: openshiftConfigNamespace, Name: "user-ca-bundle"},
+			Data:       map[string]string{trustedCAKey: "proxy CA"},
+		})
+	r.UseClusterProxy = true
+
+	_, img := reconcileImage(t, r, "host-0")
+	assertReady(t, img)
+	spec := server.AssertImage(t, testImageName("host-0"))
+	env, ok := ignitionFile(t, spec.Ignition, testProxyEnvPath)
+	if !ok {
+		t.Fatalf("proxy settings not in ignition %s", spec.Ignition)
+	}
+	for _, setting := range []string{"HTTPS_PROXY=http://proxy.example.com:3128", "no_proxy=.cluster.local,10.0.0.0/16"} {
+		if !strings.Contains(env, setting) {
+			t.Errorf("%s not in proxy settings %q", setting, env)
+		}
+	}
+	if ca, _ := ignitionFile(t, spec.Ignition, testTrustedCAPath); ca != "proxy CA" {
+		t.Errorf("unexpected trusted CA bundle %q", ca)
+	}
+
+	if !r.isTrustedCAConfigMap(client.ObjectKey{Namespace: openshiftConfigNamespace, Name: "user-ca-bundle"}) {
+		t.Error("expected the trusted CA bundle to be recognized")
+	}
+	for _, key := range []client.ObjectKey{
+		{Namespace: openshiftConfigNamespace, Name: "other"},
+		{Namespace: testNamespace, Name: "user-ca-bundle"},
+	} {
+		if r.isTrustedCAConfigMap(key) {
+			t.Errorf("unexpected trusted CA bundle %s", key)
+		}
+	}
+	if requests := r.imagesForClusterProxy(newTestClusterProxy("")); len(requests) != 1 || requests[0].Name != "host-0" {
+		t.Errorf("unexpected requests %v for a change to the cluster Proxy", requests)
+	}
+	other := newTestClusterProxy("")
+	other.SetName("other")
+	if requests := r.imagesForClusterProxy(other); len(requests) != 0 {
+		t.Errorf("unexpected requests %v for a change to another Proxy", requests)
+	}
+}
+
+func TestReconcileClusterProxyMissingCA(t *testing.T) {
+	r, server := newTestReconciler(t, newTestImage("host-0"), newTestClusterProxy("user-ca-bundle"))
+	r.UseClusterProxy = true
+
+	_, img := reconcileImage(t, r, "host-0")
+	assertError(t, img, reasonConfigurationError)
+	server.AssertNoImage(t, testImageName("host-0"))
+}
+
+func TestReconcileNoClusterProxy(t *testing.T) {
+	r, server := newTestReconciler(t, newTestImage("host-0"))
+	r.UseClusterProxy = true
+
+	_, img := reconcileImage(t, r, "host-0")
+	assertReady(t, img)
+	if spec := server.AssertImage(t, testImageName("host-0")); len(spec.Ignition) != 0 {
+		t.Errorf("unexpected ignition %s without a cluster Proxy", spec.Ignition)
+	}
+}
@@ -0,0 +1,127 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/asalkeld/image-customization-controller/pkg/imagehandler"
+	"github.com/asalkeld/image-customization-controller/pkg/tracing"
+)
+
+// formatAnnotation selects the type of image built for a
+// PreprovisioningImage. The only value other than the default live ISO is
+// imagehandler.ImageFormatConfigDrive, a config drive for hosts whose OS
+// image runs cloud-init instead of ignition.
+const formatAnnotation = annotationPrefix + "format"
+
+const (
+	configDriveMetaDataPath    = "openstack/latest/meta_data.json"
+	configDriveNetworkDataPath = "openstack/latest/network_data.json"
+)
+
+// configDriveNetworkDataKeys lists the Secret keys holding OpenStack network
+// data, in priority order. No other network data format can be put on a
+// config drive.
+var configDriveNetworkDataKeys = []string{"network_data.json", "networkData"}
+
+// wantsConfigDrive reports whether a PreprovisioningImage asks for a format
+// other than the live ISO, which the config drive step then validates.
+func wantsConfigDrive(annotations map[string]string) bool {
+	format, ok := annotations[formatAnnotation]
+	return ok && format != string(imagehandler.ImageFormatISO)
+}
+
+// configDriveMetaData is the subset of the OpenStack metadata cloud-init
+// needs from a config drive.
+type configDriveMetaData struct {
+	UUID       string            `json:"uuid"`
+	Name       string            `json:"name"`
+	Hostname   string            `json:"hostname"`
+	PublicKeys map[string]string `json:"public_keys,omitempty"`
+}
+
+// configDriveCustomizer builds the files of a config drive from the image's
+// SSH keys and network data, in place of every other step.
+type configDriveCustomizer struct {
+	r *PreprovisioningImageReconciler
+}
+
+func (s *configDriveCustomizer) Name() string { return "ConfigDrive" }
+
+func (s *configDriveCustomizer) Customize(ctx context.Context, c *imageCustomization) *conditionError {
+	if format := c.img.Annotations[formatAnnotation]; format != string(imagehandler.ImageFormatConfigDrive) {
+		return configurationError(fmt.Errorf("unknown image format %q in %s annotation", format, formatAnnotation))
+	}
+	if s.r.NetworkMode == NetworkModeStatic && c.img.Spec.NetworkDataName == "" {
+		err := errors.New("static network mode requires a NetworkData secret")
+		return newConditionError(reasonMissingNetworkData, err.Error(), err)
+	}
+
+	keys, err := s.r.sshKeys(c.secretManager, c.img)
+	if err != nil {
+		return configurationError(err)
+	}
+	metaData := configDriveMetaData{
+		UUID:     string(c.img.UID),
+		Name:     c.img.Name,
+		Hostname: c.img.Name,
+	}
+	if len(keys) > 0 {
+		metaData.PublicKeys = map[string]string{}
+		for i, key := range keys {
+			metaData.PublicKeys[fmt.Sprintf("key-%d", i)] = key
+		}
+	}
+	content, err := json.Marshal(metaData)
+	if err != nil {
+		return newConditionError(reasonUnexpectedError, err.Error(), err)
+	}
+	files := map[string][]byte{configDriveMetaDataPath: content}
+
+	if s.r.NetworkMode != NetworkModeDHCP {
+		_, span := tracing.Start(ctx, "FetchNetworkDataSecret")
+		secret, err := getNetworkDataSecret(c.secretManager, c.img)
+		tracing.End(span, err)
+		if err != nil {
+			return networkDataSecretError(err)
+		}
+		if secret != nil {
+			key, data := "", []byte(nil)
+			for _, candidate := range configDriveNetworkDataKeys {
+				if value, ok := secret.Data[candidate]; ok {
+					key, data = candidate, value
+					break
+				}
+			}
+			if key == "" {
+				return configurationError(fmt.Errorf("no OpenStack network data found in Secret %s for a config drive", secret.Name))
+			}
+			if !json.Valid(data) {
+				err := redactError(errors.New("network data is not valid JSON"), "network data in key %q of Secret %s has the incorrect format", key, secret.Name)
+				return configurationError(err)
+			}
+			files[configDriveNetworkDataPath] = data
+			c.networkDataSecret, c.networkDataKey = secret, key
+		}
+	}
+	c.configDrive = files
+	return nil
+}
@@ -0,0 +1,333 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/asalkeld/image-customization-controller/pkg/ignition"
+	"github.com/asalkeld/image-customization-controller/pkg/imagehandler"
+	"github.com/asalkeld/image-customization-controller/pkg/tracing"
+	metal3 "github.com/metal3-io/baremetal-operator/apis/metal3.io/v1alpha1"
+	"github.com/metal3-io/baremetal-operator/pkg/secretutils"
+)
+
+// kernelArgsAnnotation holds space-separated kernel arguments added to the
+// image of a PreprovisioningImage, after the cluster-wide ones.
+const kernelArgsAnnotation = annotationPrefix + "kernel-args"
+
+// secretSource reads the secrets an image is built from. AcquireSecret
+// also claims the secret for owner, as secretutils.SecretManager does.
+type secretSource interface {
+	AcquireSecret(key types.NamespacedName, owner client.Object, ownerIsController bool) (*corev1.Secret, error)
+	ObtainSecret(key types.NamespacedName) (*corev1.Secret, error)
+}
+
+// dryRunSecrets reads secrets without claiming them, so that a dry run
+// leaves no owner references behind.
+type dryRunSecrets struct {
+	*secretutils.SecretManager
+}
+
+func (s dryRunSecrets) AcquireSecret(key types.NamespacedName, owner client.Object, ownerIsController bool) (*corev1.Secret, error) {
+	return s.ObtainSecret(key)
+}
+
+// imageCustomization accumulates the content of a PreprovisioningImage's
+// image as it passes through the steps of the customization pipeline.
+type imageCustomization struct {
+	img           *metal3.PreprovisioningImage
+	secretManager secretSource
+
+	// hostIgnition is the ignition content converted from the host's
+	// network data, read from networkDataKey of networkDataSecret. It takes
+	// precedence over everything else merged into the image. In
+	// CustomizationModeKeyfiles it is an initramfs archive of keyfiles
+	// instead, embedded as it is.
+	hostIgnition      []byte
+	networkDataSecret *corev1.Secret
+	networkDataKey    string
+
+	// ignition collects the content added by the steps, and is nil until
+	// one adds some.
+	ignition *ignition.Builder
+
+	// baseImage names the image server's base ISO the image is built
+	// from, the default one for its architecture if empty.
+	baseImage  string
+	kernelArgs []string
+	boot       imagehandler.BootConfig
+	// arch is the CPU architecture the image is built for, empty if
+	// unknown.
+	arch string
+
+	// configDrive holds the files of a config drive, which is built
+	// instead of a live image when set.
+	configDrive map[string][]byte
+}
+
+// ignitionBuilder returns the builder steps add ignition content to.
+func (c *imageCustomization) ignitionBuilder() *ignition.Builder {
+	if c.ignition == nil {
+		c.ignition = ignition.NewBuilder()
+	}
+	return c.ignition
+}
+
+// ignitionContent renders the ignition content of the image, with the host's
+// own content merged last. When no step added anything the host content is
+// returned unchanged.
+func (c *imageCustomization) ignitionContent() ([]byte, error) {
+	if c.ignition == nil {
+		return c.hostIgnition, nil
+	}
+	if c.hostIgnition != nil {
+		hostConfig, err := ignition.Parse(c.hostIgnition)
+		if err != nil {
+			return nil, redactError(err, "cannot merge host network data from Secret %s", c.img.Spec.NetworkDataName)
+		}
+		c.ignition.Merge(hostConfig)
+	}
+	return c.ignition.Build()
+}
+
+// imageSpec describes the image to register under name, with the rendered
+// ignition content.
+func (c *imageCustomization) imageSpec(name string, ignitionContent []byte) imagehandler.ImageSpec {
+	return imagehandler.ImageSpec{
+		Name:        name,
+		Base:        imagehandler.BaseImage{Arch: c.arch, Name: c.baseImage},
+		Ignition:    ignitionContent,
+		KernelArgs:  c.kernelArgs,
+		Boot:        c.boot,
+		ConfigDrive: c.configDrive,
+	}
+}
+
+// imageCustomizer is a step of the customization pipeline, adding one type
+// of content to images. New types of customization are added as steps,
+// without changes to the image server.
+type imageCustomizer interface {
+	// Name identifies the step in traces.
+	Name() string
+	// Customize adds the step's content for an image.
+	Customize(ctx context.Context, c *imageCustomization) *conditionError
+}
+
+// customizers composes the customization pipeline of a PreprovisioningImage.
+func (r *PreprovisioningImageReconciler) customizers(ctx context.Context, img *metal3.PreprovisioningImage) []imageCustomizer {
+	if wantsConfigDrive(img.Annotations) {
+		// a config drive holds none of the live image's customizations
+		return []imageCustomizer{&configDriveCustomizer{r}}
+	}
+	pipeline := []imageCustomizer{}
+	if r.NetworkMode != NetworkModeDHCP {
+		pipeline = append(pipeline, &networkDataCustomizer{r})
+	} else if img.Spec.NetworkDataName != "" {
+		ctrl.LoggerFrom(ctx).V(1).Info("ignoring network data in DHCP network mode")
+	}
+	if img.Annotations[streamAnnotation] != "" || owningHostName(img) != "" {
+		// the host may pin its images to a stream
+		pipeline = append(pipeline, &streamCustomizer{r})
+	}
+	if len(r.KernelArgs) > 0 || len(r.ArchKernelArgs) > 0 || img.Annotations[kernelArgsAnnotation] != "" {
+		pipeline = append(pipeline, &kernelArgsCustomizer{r})
+	}
+	if !r.BootConfig.IsZero() || hasBootMenuAnnotations(img.Annotations) {
+		pipeline = append(pipeline, &bootMenuCustomizer{r})
+	}
+	if r.CustomizationMode == CustomizationModeKeyfiles {
+		// the remaining steps add ignition content
+		return pipeline
+	}
+	pipeline = append(pipeline, &extraFilesCustomizer{r})
+	if len(r.extraFiles()) > 0 || img.Annotations[extraFilesAnnotation] != "" {
+		pipeline = append(pipeline, &userFilesCustomizer{r})
+	}
+	return append(pipeline, &ignitionMergeCustomizer{r})
+}
+
+// customizeImage runs the customization pipeline of a PreprovisioningImage
+// whose image is built for arch.
+func (r *PreprovisioningImageReconciler) customizeImage(ctx context.Context, img *metal3.PreprovisioningImage, arch string) (*imageCustomization, []byte, *conditionError) {
+	secrets := secretutils.NewSecretManager(ctrl.LoggerFrom(ctx), r.Client, r.APIReader)
+	c := &imageCustomization{
+		img:           img,
+		arch:          arch,
+		baseImage:     img.Labels[baseImageLabel],
+		secretManager: &secrets,
+	}
+	if r.DryRun {
+		c.secretManager = dryRunSecrets{&secrets}
+	}
+	for _, step := range r.customizers(ctx, img) {
+		stepCtx, span := tracing.Start(ctx, "Customize", "step", step.Name())
+		condErr := step.Customize(stepCtx, c)
+		if condErr != nil {
+			tracing.End(span, condErr.cause)
+			return nil, nil, condErr
+		}
+		tracing.End(span, nil)
+	}
+
+	_, span := tracing.Start(ctx, "BuildIgnition")
+	content, err := c.ignitionContent()
+	tracing.End(span, err)
+	if err != nil {
+		return nil, nil, newConditionError(reasonConfigurationError, err.Error(), err)
+	}
+	return c, content, nil
+}
+
+// configurationError reports a failure to read the configuration of a step.
+func configurationError(err error) *conditionError {
+	if k8serrors.IsNotFound(err) {
+		return newConditionError(reasonConfigurationError, "referenced ConfigMap or Secret not found", err)
+	}
+	if isTransientAPIError(err) {
+		return newConditionError(reasonTransientAPIError, err.Error(), err)
+	}
+	return newConditionError(reasonConfigurationError, err.Error(), err)
+}
+
+// networkDataCustomizer converts the host's network data to ignition.
+type networkDataCustomizer struct {
+	r *PreprovisioningImageReconciler
+}
+
+func (s *networkDataCustomizer) Name() string { return "NetworkData" }
+
+func (s *networkDataCustomizer) Customize(ctx context.Context, c *imageCustomization) *conditionError {
+	if s.r.NetworkMode == NetworkModeStatic && c.img.Spec.NetworkDataName == "" {
+		err := errors.New("static network mode requires a NetworkData secret")
+		return newConditionError(reasonMissingNetworkData, err.Error(), err)
+	}
+
+	_, span := tracing.Start(ctx, "FetchNetworkDataSecret")
+	secret, err := getNetworkDataSecret(c.secretManager, c.img)
+	tracing.End(span, err)
+	if err != nil {
+		return networkDataSecretError(err)
+	}
+
+	_, span = tracing.Start(ctx, "ConvertNetworkData")
+	convert := gatherNetworkData
+	if s.r.CustomizationMode == CustomizationModeKeyfiles {
+		convert = func(_ logr.Logger, secret *corev1.Secret) ([]byte, string, error) {
+			return gatherKeyfiles(secret, s.r.InitrdCompression)
+		}
+	}
+	content, key, err := convert(s.r.converterLog(c.img), secret)
+	tracing.SetAttributes(span, "networkDataKey", key)
+	tracing.End(span, err)
+	if err != nil {
+		return newConditionError(reasonConfigurationError, err.Error(), err)
+	}
+	c.hostIgnition, c.networkDataSecret, c.networkDataKey = content, secret, key
+	return nil
+}
+
+// kernelArgsCustomizer adds the cluster-wide kernel arguments, those of the
+// image's architecture and those of the image's annotation.
+type kernelArgsCustomizer struct {
+	r *PreprovisioningImageReconciler
+}
+
+func (s *kernelArgsCustomizer) Name() string { return "KernelArgs" }
+
+func (s *kernelArgsCustomizer) Customize(ctx context.Context, c *imageCustomization) *conditionError {
+	c.kernelArgs = append(c.kernelArgs, s.r.KernelArgs...)
+	c.kernelArgs = append(c.kernelArgs, s.r.ArchKernelArgs[c.arch]...)
+	c.kernelArgs = append(c.kernelArgs, strings.Fields(c.img.Annotations[kernelArgsAnnotation])...)
+	return nil
+}
+
+// extraFilesCustomizer adds the files configuring the live image's
+// environment: the proxy settings, trusted CA bundle and pull secret.
+type extraFilesCustomizer struct {
+	r *PreprovisioningImageReconciler
+}
+
+func (s *extraFilesCustomizer) Name() string { return "ExtraFiles" }
+
+func (s *extraFilesCustomizer) Customize(ctx context.Context, c *imageCustomization) *conditionError {
+	pullSecret, err := s.r.pullSecret(c.secretManager)
+	if err != nil {
+		return configurationError(err)
+	}
+
+	proxy := s.r.Proxy
+	var trustedCA []byte
+	if s.r.UseClusterProxy {
+		clusterProxy, bundle, err := s.r.clusterProxy(ctx)
+		if err != nil {
+			return configurationError(err)
+		}
+		if !clusterProxy.IsEmpty() {
+			proxy = clusterProxy
+		}
+		trustedCA = bundle
+	}
+
+	if proxy.IsEmpty() && pullSecret == nil && trustedCA == nil {
+		return nil
+	}
+	c.ignitionBuilder().
+		AddProxy(proxy).
+		AddTrustedCA(trustedCA).
+		AddPullSecret(pullSecret)
+	return nil
+}
+
+// ignitionMergeCustomizer merges the cluster-wide ignition snippet, the SSH
+// keys and the image's own ignition snippet into the image, in that order,
+// so that later ones replace files and units of earlier ones.
+type ignitionMergeCustomizer struct {
+	r *PreprovisioningImageReconciler
+}
+
+func (s *ignitionMergeCustomizer) Name() string { return "IgnitionMerge" }
+
+func (s *ignitionMergeCustomizer) Customize(ctx context.Context, c *imageCustomization) *conditionError {
+	additional, err := s.r.additionalIgnition(ctx)
+	if err != nil {
+		return configurationError(err)
+	}
+	sshKeys, err := s.r.sshKeysIgnition(c.secretManager, c.img)
+	if err != nil {
+		return configurationError(err)
+	}
+	user, err := userIgnition(c.secretManager, c.img)
+	if err != nil {
+		return configurationError(err)
+	}
+	for _, snippet := range []*ignition.Config{additional, sshKeys, user} {
+		if snippet != nil {
+			c.ignitionBuilder().Merge(snippet)
+		}
+	}
+	return nil
+}
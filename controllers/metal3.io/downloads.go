@@ -0,0 +1,159 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	"github.com/asalkeld/image-customization-controller/pkg/imagehandler"
+	metal3 "github.com/metal3-io/baremetal-operator/apis/metal3.io/v1alpha1"
+)
+
+const (
+	eventImageDownloaded          = "ImageDownloaded"
+	eventImagePartiallyDownloaded = "ImagePartiallyDownloaded"
+)
+
+// conditionImageServing is true once a host has downloaded the current image
+// in full, confirming that its BMC can reach the URL.
+const conditionImageServing = "ImageServing"
+
+const (
+	reasonImageDownloaded    conditionReason = "ImageDownloaded"
+	reasonImageNotDownloaded conditionReason = "ImageNotDownloaded"
+)
+
+const (
+	lastDownloadTimeAnnotation   = annotationPrefix + "last-download-time"
+	lastDownloadClientAnnotation = annotationPrefix + "last-download-client"
+)
+
+// downloadWatcher follows downloads of images. Complete downloads trigger a
+// reconcile of the PreprovisioningImage so that its ImageServing condition
+// is updated. If a recorder is set, every download is also recorded as an
+// event, so that it can be traced which host fetched a given ignition
+// payload, and if annotate is set the time and client of the last complete
+// download are recorded in annotations.
+type downloadWatcher struct {
+	client   client.Client
+	server   imagehandler.ImageFileServer
+	imageFor func(context.Context, string) (*metal3.PreprovisioningImage, error)
+	recorder record.EventRecorder
+	annotate bool
+	events   chan<- event.GenericEvent
+	log      logr.Logger
+}
+
+func (w *downloadWatcher) Start(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case download := <-w.server.Downloads():
+			w.handle(ctx, download)
+		}
+	}
+}
+
+func (w *downloadWatcher) handle(ctx context.Context, download imagehandler.Download) {
+	if w.recorder == nil && !download.Complete {
+		return
+	}
+	img, err := w.imageFor(ctx, download.Name)
+	if err != nil {
+		w.log.Error(err, "unable to find the PreprovisioningImage of a download", "image", download.Name)
+		return
+	}
+	if img == nil {
+		return
+	}
+	if w.recorder != nil {
+		if download.Complete {
+			w.recorder.Eventf(img, corev1.EventTypeNormal, eventImageDownloaded,
+				"Image downloaded by %s", download.RemoteAddr)
+		} else {
+			w.recorder.Eventf(img, corev1.EventTypeNormal, eventImagePartiallyDownloaded,
+				"%d bytes of image downloaded by %s", download.Bytes, download.RemoteAddr)
+		}
+	}
+	if download.Complete && w.annotate {
+		if err := w.annotateDownload(ctx, img, download); err != nil {
+			w.log.Error(err, "unable to annotate PreprovisioningImage with download",
+				"namespace", img.Namespace, "name", img.Name)
+		}
+	}
+	if download.Complete {
+		select {
+		case w.events <- event.GenericEvent{Object: img}:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// annotateDownload records the time and client of a complete download on
+// the PreprovisioningImage.
+func (w *downloadWatcher) annotateDownload(ctx context.Context, img *metal3.PreprovisioningImage, download imagehandler.Download) error {
+	patch := client.MergeFrom(img.DeepCopy())
+	annotations := img.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[lastDownloadTimeAnnotation] = download.Time.UTC().Format(time.RFC3339)
+	annotations[lastDownloadClientAnnotation] = download.RemoteAddr
+	img.SetAnnotations(annotations)
+	return w.client.Patch(ctx, img, patch)
+}
+
+// setImageServing records whether the current image has been downloaded.
+// Downloads are not remembered across restarts, so a URL that was already
+// confirmed stays confirmed until it changes.
+func setImageServing(generation int64, status *metal3.PreprovisioningImageStatus, download *imagehandler.Download, urlChanged bool) bool {
+	cond := metav1.Condition{
+		Type:               conditionImageServing,
+		Status:             metav1.ConditionFalse,
+		LastTransitionTime: metav1.Now(),
+		ObservedGeneration: generation,
+		Reason:             string(reasonImageNotDownloaded),
+		Message:            "Waiting for the image to be downloaded",
+	}
+	switch {
+	case download != nil:
+		cond.Status = metav1.ConditionTrue
+		cond.Reason = string(reasonImageDownloaded)
+		cond.Message = fmt.Sprintf("Image downloaded by %s at %s", download.RemoteAddr, download.Time.UTC().Format(time.RFC3339))
+	case !urlChanged && meta.IsStatusConditionTrue(status.Conditions, conditionImageServing):
+		return false
+	}
+
+	newStatus := status.DeepCopy()
+	meta.SetStatusCondition(&newStatus.Conditions, cond)
+
+	changed := !apiequality.Semantic.DeepEqual(status, newStatus)
+	*status = *newStatus
+	return changed
+}
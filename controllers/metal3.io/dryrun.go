@@ -0,0 +1,59 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	metal3 "github.com/metal3-io/baremetal-operator/apis/metal3.io/v1alpha1"
+)
+
+const (
+	eventDryRunSucceeded = "DryRunSucceeded"
+	eventDryRunFailed    = "DryRunFailed"
+)
+
+// dryRun builds the content of the image of a PreprovisioningImage, as a
+// reconcile would before registering it, and reports what would be
+// published, or why it would be in error. Transient API errors are returned
+// for the reconcile to be retried.
+func (r *PreprovisioningImageReconciler) dryRun(ctx context.Context, img *metal3.PreprovisioningImage) error {
+	log := ctrl.LoggerFrom(ctx)
+	spec, err := r.ImageSpecFor(ctx, img)
+	if isTransientAPIError(err) {
+		return err
+	}
+	if err != nil {
+		log.Info("dry run: image would be in error", "error", err.Error())
+		r.recorder.Eventf(img, corev1.EventTypeWarning, eventDryRunFailed, "Image would be in error: %s", err)
+		return nil
+	}
+	log.Info("dry run: image would be published", "image", spec.Name, "arch", spec.Base.Arch,
+		"baseImage", spec.Base.Name, "contentBytes", len(spec.Ignition), "kernelArgs", spec.KernelArgs,
+		"configDrive", spec.ConfigDrive != nil)
+	message := fmt.Sprintf("Image %s would be published with %d bytes of content", spec.Name, len(spec.Ignition))
+	if len(spec.KernelArgs) > 0 {
+		message += " and kernel arguments " + strings.Join(spec.KernelArgs, " ")
+	}
+	r.recorder.Event(img, corev1.EventTypeNormal, eventDryRunSucceeded, message)
+	return nil
+}
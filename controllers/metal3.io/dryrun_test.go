@@ -0,0 +1,65 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// assertEvent checks that the next event recorded starts with prefix.
+func assertEvent(t *testing.T, recorder *record.FakeRecorder, prefix string) {
+	t.Helper()
+	select {
+	case event := <-recorder.Events:
+		if !strings.HasPrefix(event, prefix) {
+			t.Errorf("unexpected event %q, expected %s", event, prefix)
+		}
+	default:
+		t.Errorf("no event recorded, expected %s", prefix)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	img, _ := newTestNetworkData("host-1")
+	r, server := newTestReconciler(t, newTestImage("host-0"), img)
+	r.DryRun = true
+	recorder := record.NewFakeRecorder(10)
+	r.recorder = recorder
+
+	_, img = reconcileImage(t, r, "host-0")
+	assertEvent(t, recorder, "Normal "+eventDryRunSucceeded)
+	if len(img.Status.Conditions) != 0 || img.Status.ImageUrl != "" {
+		t.Errorf("unexpected status %+v after a dry run", img.Status)
+	}
+
+	// the network data Secret is missing
+	_, img = reconcileImage(t, r, "host-1")
+	assertEvent(t, recorder, "Warning "+eventDryRunFailed)
+	if len(img.Status.Conditions) != 0 {
+		t.Errorf("unexpected status %+v after a dry run", img.Status)
+	}
+	server.AssertImages(t)
+}
+
+func TestDryRunLeavesSecretsUnclaimed(t *testing.T) {
+	img, secret := newTestNetworkData("host-0")
+	r, server := newTestReconciler(t, img, secret)
+	r.DryRun = true
+	recorder := record.NewFakeRecorder(10)
+	r.recorder = recorder
+
+	reconcileImage(t, r, "host-0")
+	assertEvent(t, recorder, "Normal "+eventDryRunSucceeded)
+	got := &corev1.Secret{}
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(secret), got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.OwnerReferences) != 0 {
+		t.Errorf("unexpected owner references %v after a dry run", got.OwnerReferences)
+	}
+	server.AssertImages(t)
+}
@@ -0,0 +1,184 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// extraFilesAnnotation holds a JSON list of ExtraFiles written to the live
+// filesystem of a PreprovisioningImage's image, read from ConfigMaps and
+// Secrets in its namespace. They replace cluster-wide files with the same
+// path.
+const extraFilesAnnotation = annotationPrefix + "extra-files"
+
+// defaultExtraFileMode is the mode of extra files that don't set one.
+const defaultExtraFileMode = 0644
+
+// ExtraFile is a file written to the live filesystem of images, e.g. a
+// trust anchor in /etc/pki or a udev rule, with the content of a ConfigMap
+// or Secret key.
+type ExtraFile struct {
+	// Path is the absolute path of the file.
+	Path string `json:"path"`
+	// Mode is the octal permission bits of the file, 0644 if unset.
+	Mode string `json:"mode,omitempty"`
+	// ConfigMap or Secret names the object holding the content, in
+	// Namespace. Files of an image's annotation are always read from its
+	// namespace.
+	ConfigMap string `json:"configMap,omitempty"`
+	Secret    string `json:"secret,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	// Key is the key of the content in the ConfigMap or Secret.
+	Key string `json:"key"`
+}
+
+// Validate checks that the file is well-formed.
+func (f ExtraFile) Validate() error {
+	if !path.IsAbs(f.Path) || path.Clean(f.Path) != f.Path {
+		return fmt.Errorf("extra file path %q must be absolute and clean", f.Path)
+	}
+	if _, err := f.mode(); err != nil {
+		return fmt.Errorf("extra file %s: invalid mode %q", f.Path, f.Mode)
+	}
+	if (f.ConfigMap == "") == (f.Secret == "") {
+		return fmt.Errorf("extra file %s must name either a ConfigMap or a Secret", f.Path)
+	}
+	if f.Key == "" {
+		return fmt.Errorf("extra file %s has no key", f.Path)
+	}
+	return nil
+}
+
+func (f ExtraFile) mode() (int, error) {
+	if f.Mode == "" {
+		return defaultExtraFileMode, nil
+	}
+	mode, err := strconv.ParseUint(f.Mode, 8, 32)
+	if err != nil || mode > 07777 {
+		return 0, errors.New("invalid mode")
+	}
+	return int(mode), nil
+}
+
+// imageExtraFiles returns the extra files of an image: the cluster-wide ones
+// not replaced by a file with the same path in its annotation, and those of
+// the annotation.
+func (r *PreprovisioningImageReconciler) imageExtraFiles(c *imageCustomization) (cluster, image []ExtraFile, err error) {
+	cluster = r.extraFiles()
+	value, ok := c.img.Annotations[extraFilesAnnotation]
+	if !ok {
+		return cluster, nil, nil
+	}
+	if err := json.Unmarshal([]byte(value), &image); err != nil {
+		return nil, nil, fmt.Errorf("invalid %s annotation: %w", extraFilesAnnotation, err)
+	}
+	replaced := map[string]bool{}
+	for _, file := range image {
+		if err := file.Validate(); err != nil {
+			return nil, nil, fmt.Errorf("invalid %s annotation: %w", extraFilesAnnotation, err)
+		}
+		if file.Namespace != "" && file.Namespace != c.img.Namespace {
+			return nil, nil, fmt.Errorf("invalid %s annotation: extra file %s must be in namespace %s",
+				extraFilesAnnotation, file.Path, c.img.Namespace)
+		}
+		replaced[file.Path] = true
+	}
+
+	kept := []ExtraFile{}
+	for _, file := range cluster {
+		if !replaced[file.Path] {
+			kept = append(kept, file)
+		}
+	}
+	return kept, image, nil
+}
+
+// extraFileContent reads the content of an extra file. Files of the image's
+// annotation are read from its namespace, and their Secrets are owned by it.
+func (r *PreprovisioningImageReconciler) extraFileContent(ctx context.Context, c *imageCustomization, file ExtraFile, fromImage bool) ([]byte, error) {
+	key := types.NamespacedName{Namespace: file.Namespace, Name: file.ConfigMap}
+	if fromImage {
+		key.Namespace = c.img.Namespace
+	}
+
+	if file.Secret != "" {
+		key.Name = file.Secret
+		var secret *corev1.Secret
+		var err error
+		if fromImage {
+			secret, err = c.secretManager.AcquireSecret(key, c.img, false)
+		} else {
+			// cluster-wide files are shared by every image
+			secret, err = c.secretManager.ObtainSecret(key)
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, ok := secret.Data[file.Key]
+		if !ok {
+			return nil, fmt.Errorf("Secret %s has no %q key", key, file.Key)
+		}
+		return data, nil
+	}
+
+	cm := corev1.ConfigMap{}
+	if err := r.Get(ctx, key, &cm); err != nil {
+		return nil, err
+	}
+	if data, ok := cm.Data[file.Key]; ok {
+		return []byte(data), nil
+	}
+	if data, ok := cm.BinaryData[file.Key]; ok {
+		return data, nil
+	}
+	return nil, fmt.Errorf("ConfigMap %s has no %q key", key, file.Key)
+}
+
+// userFilesCustomizer writes the cluster-wide and per-image extra files to
+// the live filesystem.
+type userFilesCustomizer struct {
+	r *PreprovisioningImageReconciler
+}
+
+func (s *userFilesCustomizer) Name() string { return "UserFiles" }
+
+func (s *userFilesCustomizer) Customize(ctx context.Context, c *imageCustomization) *conditionError {
+	cluster, image, err := s.r.imageExtraFiles(c)
+	if err != nil {
+		return configurationError(err)
+	}
+	for i, files := range [][]ExtraFile{cluster, image} {
+		for _, file := range files {
+			content, err := s.r.extraFileContent(ctx, c, file, i == 1)
+			if err != nil {
+				return configurationError(err)
+			}
+			mode, _ := file.mode()
+			c.ignitionBuilder().AddFile(file.Path, mode, content)
+		}
+	}
+	return nil
+}
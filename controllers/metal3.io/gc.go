@@ -0,0 +1,91 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/asalkeld/image-customization-controller/pkg/imagehandler"
+	metal3 "github.com/metal3-io/baremetal-operator/apis/metal3.io/v1alpha1"
+)
+
+// imageCollector periodically unregisters images that no PreprovisioningImage
+// refers to any more, such as those of deleted PreprovisioningImages or
+// previous names of renamed ones, so that the image server's registry does
+// not grow for as long as the controller runs.
+type imageCollector struct {
+	client    client.Client
+	server    imagehandler.ImageFileServer
+	imageName func(*metal3.PreprovisioningImage) string
+	interval  time.Duration
+	log       logr.Logger
+}
+
+func (c *imageCollector) Start(ctx context.Context) error {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		c.collect(ctx)
+	}
+}
+
+func (c *imageCollector) collect(ctx context.Context) {
+	// Registered images are listed first, so that any image registered
+	// since belongs to a PreprovisioningImage in the list below.
+	registered, err := c.server.ListImages(ctx)
+	if err != nil {
+		c.log.Error(err, "unable to list registered images")
+		return
+	}
+
+	images := metal3.PreprovisioningImageList{}
+	if err := c.client.List(ctx, &images); err != nil {
+		c.log.Error(err, "unable to list PreprovisioningImages")
+		return
+	}
+	inUse := make(map[string]bool, len(images.Items))
+	for i := range images.Items {
+		inUse[c.imageName(&images.Items[i])] = true
+	}
+
+	removed := 0
+	for _, image := range registered {
+		// leave images registered by a reconcile still in progress
+		if inUse[image.Name] || time.Since(image.Created) < c.interval {
+			continue
+		}
+		err := c.server.RemoveImage(ctx, image.Name)
+		if err != nil && !errors.Is(err, imagehandler.ErrImageNotFound) {
+			c.log.Error(err, "unable to remove orphaned image", "image", image.Name)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		c.log.Info("removed orphaned images", "count", removed)
+	}
+}
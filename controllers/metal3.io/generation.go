@@ -0,0 +1,171 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	metal3 "github.com/metal3-io/baremetal-operator/apis/metal3.io/v1alpha1"
+)
+
+// generationWaiter reconciles a PreprovisioningImage as soon as generation of
+// its image finishes, so that it becomes Ready once the image can be
+// downloaded rather than when it is next polled.
+type generationWaiter struct {
+	events chan<- event.GenericEvent
+
+	mu      sync.Mutex
+	waiting map[types.NamespacedName]bool
+}
+
+func newGenerationWaiter(events chan<- event.GenericEvent) *generationWaiter {
+	return &generationWaiter{events: events, waiting: map[types.NamespacedName]bool{}}
+}
+
+// await queues a reconcile of the PreprovisioningImage once done is closed,
+// unless one is queued already.
+func (w *generationWaiter) await(img *metal3.PreprovisioningImage, done <-chan struct{}) {
+	key := types.NamespacedName{Namespace: img.Namespace, Name: img.Name}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.waiting[key] {
+		return
+	}
+	w.waiting[key] = true
+
+	go func() {
+		<-done
+		w.mu.Lock()
+		delete(w.waiting, key)
+		w.mu.Unlock()
+		w.events <- event.GenericEvent{Object: &metal3.PreprovisioningImage{
+			ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name},
+		}}
+	}()
+}
+
+// generationFailures counts the consecutive failures to generate the image
+// of each PreprovisioningImage generation, so that retries back off and
+// eventually stop. The counts are only kept in memory, so a restarted
+// controller tries each image afresh.
+type generationFailures struct {
+	mu     sync.Mutex
+	counts map[types.NamespacedName]generationFailureCount
+}
+
+type generationFailureCount struct {
+	generation int64
+	count      int
+	// reason and message are those of the error condition reported for
+	// the last failure.
+	reason  conditionReason
+	message string
+	// retryAt is when the image may be generated again, unless exhausted
+	// is set and it is not to be tried again at all.
+	retryAt   time.Time
+	exhausted bool
+}
+
+// add records a failure to generate the image of a PreprovisioningImage, and
+// returns the consecutive failures for its current generation, with when it
+// may be tried again.
+func (g *generationFailures) add(img *metal3.PreprovisioningImage, err error, delays RetryDelays) generationFailureCount {
+	key := types.NamespacedName{Namespace: img.Namespace, Name: img.Name}
+	attempts := delays.GenerationAttempts
+	if attempts <= 0 {
+		attempts = DefaultRetryDelays.GenerationAttempts
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.counts == nil {
+		g.counts = map[types.NamespacedName]generationFailureCount{}
+	}
+	failures := g.counts[key]
+	if failures.generation != img.Generation {
+		failures = generationFailureCount{generation: img.Generation}
+	}
+	failures.count++
+	if failures.count >= attempts {
+		failures.reason = reasonGenerationAttemptsExhausted
+		failures.message = fmt.Sprintf("%s (gave up after %d attempts)", err.Error(), failures.count)
+		failures.retryAt, failures.exhausted = time.Time{}, true
+	} else {
+		failures.reason, failures.message = reasonGenerationFailed, err.Error()
+		failures.retryAt = time.Now().Add(generationRetryDelay(failures.count, delays))
+	}
+	g.counts[key] = failures
+	return failures
+}
+
+// backingOff returns the last failure to generate the image of the current
+// generation of a PreprovisioningImage, if it is not to be generated again
+// yet. Reconciles triggered in the meantime, e.g. by the update of its
+// status reporting the failure, must not register it again.
+func (g *generationFailures) backingOff(img *metal3.PreprovisioningImage) (generationFailureCount, bool) {
+	key := types.NamespacedName{Namespace: img.Namespace, Name: img.Name}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	failures, ok := g.counts[key]
+	if !ok || failures.generation != img.Generation {
+		return generationFailureCount{}, false
+	}
+	return failures, failures.exhausted || time.Now().Before(failures.retryAt)
+}
+
+// reset forgets the failures of a PreprovisioningImage, once its image is
+// generated or it is deleted.
+func (g *generationFailures) reset(key types.NamespacedName) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.counts, key)
+}
+
+// generationRetryDelay returns the delay before generating an image again
+// after it failed failures times in a row: MinError, doubling with each
+// failure up to MaxError.
+func generationRetryDelay(failures int, delays RetryDelays) time.Duration {
+	delay := delays.MinError
+	for i := 1; i < failures && delay < delays.MaxError; i++ {
+		delay *= 2
+	}
+	if delay > delays.MaxError {
+		return delays.MaxError
+	}
+	return delay
+}
+
+// generationRetryError is returned by reconcile when generating the image
+// failed and is retried after delay.
+type generationRetryError struct {
+	delay   time.Duration
+	attempt int
+	cause   error
+}
+
+func (e *generationRetryError) Error() string {
+	return e.cause.Error()
+}
+
+func (e *generationRetryError) Unwrap() error {
+	return e.cause
+}
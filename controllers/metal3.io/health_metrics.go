@@ -0,0 +1,104 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/asalkeld/image-customization-controller/pkg/sharding"
+	metal3 "github.com/metal3-io/baremetal-operator/apis/metal3.io/v1alpha1"
+)
+
+var (
+	staleErrorImagesDesc = prometheus.NewDesc(
+		"image_customization_stale_error_images",
+		"PreprovisioningImages whose ImageError condition has been true for longer than the staleness threshold.",
+		nil, nil)
+	failedSecretUpdateImagesDesc = prometheus.NewDesc(
+		"image_customization_failed_secret_update_images",
+		"PreprovisioningImages in error whose network data Secret changed since their image was last built.",
+		nil, nil)
+)
+
+// imageHealthCollector counts PreprovisioningImages that need attention
+// from the controller's cache each time metrics are scraped, so that alerts
+// can fire for hosts stuck without an image. Only the images of the shard are
+// counted, so that the totals of all replicas add up.
+type imageHealthCollector struct {
+	client         client.Client
+	shard          sharding.Shard
+	staleThreshold time.Duration
+	log            logr.Logger
+}
+
+func (c *imageHealthCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- staleErrorImagesDesc
+	ch <- failedSecretUpdateImagesDesc
+}
+
+func (c *imageHealthCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx := context.Background()
+	images := metal3.PreprovisioningImageList{}
+	if err := c.client.List(ctx, &images); err != nil {
+		c.log.Error(err, "unable to list PreprovisioningImages")
+		return
+	}
+
+	stale, failedSecretUpdates := 0, 0
+	for i := range images.Items {
+		img := &images.Items[i]
+		if !c.shard.Owns(client.ObjectKeyFromObject(img).String()) {
+			continue
+		}
+		errorCond := meta.FindStatusCondition(img.Status.Conditions, string(metal3.ConditionImageError))
+		if errorCond == nil || errorCond.Status != metav1.ConditionTrue {
+			continue
+		}
+		if time.Since(errorCond.LastTransitionTime.Time) > c.staleThreshold {
+			stale++
+		}
+		if c.secretChanged(ctx, img) {
+			failedSecretUpdates++
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(staleErrorImagesDesc, prometheus.GaugeValue, float64(stale))
+	ch <- prometheus.MustNewConstMetric(failedSecretUpdateImagesDesc, prometheus.GaugeValue, float64(failedSecretUpdates))
+}
+
+// secretChanged returns true if the network data Secret of an image is not
+// the version its current image was built from.
+func (c *imageHealthCollector) secretChanged(ctx context.Context, img *metal3.PreprovisioningImage) bool {
+	if img.Spec.NetworkDataName == "" || img.Status.NetworkData.Version == "" {
+		return false
+	}
+	secret := corev1.Secret{}
+	key := client.ObjectKey{Namespace: img.Namespace, Name: img.Spec.NetworkDataName}
+	if err := c.client.Get(ctx, key, &secret); err != nil {
+		return false
+	}
+	return secret.Name != img.Status.NetworkData.Name ||
+		secret.ResourceVersion != img.Status.NetworkData.Version
+}
@@ -0,0 +1,163 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/asalkeld/image-customization-controller/pkg/ignition"
+	metal3 "github.com/metal3-io/baremetal-operator/apis/metal3.io/v1alpha1"
+)
+
+const (
+	// additionalIgnitionKey is the ConfigMap key holding the cluster-wide
+	// ignition snippet.
+	additionalIgnitionKey = "ignition"
+
+	// sshKeysKey is the Secret key holding authorized SSH public keys, one
+	// per line.
+	sshKeysKey = "authorized_keys"
+
+	// sshKeySecretAnnotation names a Secret in the PreprovisioningImage's
+	// namespace containing SSH keys for the core user.
+	sshKeySecretAnnotation = annotationPrefix + "ssh-key-secret"
+
+	// coreUser is the user on the live image that gets the SSH keys.
+	coreUser = "core"
+
+	// userIgnitionSecretAnnotation names a Secret in the
+	// PreprovisioningImage's namespace containing an ignition snippet for
+	// its image only, in the userIgnitionKey key.
+	userIgnitionSecretAnnotation = annotationPrefix + "ignition-secret"
+	userIgnitionKey              = "ignition"
+)
+
+func (r *PreprovisioningImageReconciler) additionalIgnition(ctx context.Context) (*ignition.Config, error) {
+	if r.AdditionalIgnitionConfigMap.Name == "" {
+		return nil, nil
+	}
+
+	cm := corev1.ConfigMap{}
+	if err := r.Get(ctx, r.AdditionalIgnitionConfigMap, &cm); err != nil {
+		return nil, err
+	}
+	data, ok := cm.Data[additionalIgnitionKey]
+	if !ok {
+		return nil, fmt.Errorf("ConfigMap %s has no %q key", r.AdditionalIgnitionConfigMap, additionalIgnitionKey)
+	}
+	config, err := ignition.Parse([]byte(data))
+	if err != nil {
+		return nil, redactError(err, "ConfigMap %s key %q is not a valid ignition config", r.AdditionalIgnitionConfigMap, additionalIgnitionKey)
+	}
+	return config, nil
+}
+
+// sshKeys collects SSH keys from the cluster-wide Secret and from the Secret
+// named in the image's annotation. Only the latter is owned by the image;
+// the cluster-wide one is shared by every image.
+func (r *PreprovisioningImageReconciler) sshKeys(secretManager secretSource, img *metal3.PreprovisioningImage) ([]string, error) {
+	keys := []string{}
+
+	if r.SSHKeySecret.Name != "" {
+		secret, err := secretManager.ObtainSecret(r.SSHKeySecret)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, parseSSHKeys(secret.Data[sshKeysKey])...)
+	}
+
+	if name := img.Annotations[sshKeySecretAnnotation]; name != "" {
+		key := types.NamespacedName{Namespace: img.Namespace, Name: name}
+		secret, err := secretManager.AcquireSecret(key, img, false)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, parseSSHKeys(secret.Data[sshKeysKey])...)
+	}
+	return keys, nil
+}
+
+// sshKeysIgnition authorizes the SSH keys of the image for the core user.
+func (r *PreprovisioningImageReconciler) sshKeysIgnition(secretManager secretSource, img *metal3.PreprovisioningImage) (*ignition.Config, error) {
+	keys, err := r.sshKeys(secretManager, img)
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+	return ignition.SSHKeys(coreUser, keys), nil
+}
+
+// userIgnition returns the ignition snippet of the Secret named in the
+// image's annotation, if any.
+func userIgnition(secretManager secretSource, img *metal3.PreprovisioningImage) (*ignition.Config, error) {
+	name := img.Annotations[userIgnitionSecretAnnotation]
+	if name == "" {
+		return nil, nil
+	}
+	key := types.NamespacedName{Namespace: img.Namespace, Name: name}
+	secret, err := secretManager.AcquireSecret(key, img, false)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := secret.Data[userIgnitionKey]
+	if !ok {
+		return nil, fmt.Errorf("Secret %s has no %q key", key, userIgnitionKey)
+	}
+	config, err := ignition.Parse(data)
+	if err != nil {
+		return nil, redactError(err, "Secret %s key %q is not a valid ignition config", key, userIgnitionKey)
+	}
+	return config, nil
+}
+
+// pullSecret returns the cluster pull secret, if one is configured. It is
+// shared by every image, so none owns it.
+func (r *PreprovisioningImageReconciler) pullSecret(secretManager secretSource) ([]byte, error) {
+	if r.PullSecret.Name == "" {
+		return nil, nil
+	}
+	secret, err := secretManager.ObtainSecret(r.PullSecret)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := secret.Data[corev1.DockerConfigJsonKey]
+	if !ok {
+		return nil, fmt.Errorf("Secret %s has no %q key", r.PullSecret, corev1.DockerConfigJsonKey)
+	}
+	if err := ignition.ValidatePullSecret(data); err != nil {
+		return nil, redactError(err, "Secret %s key %q is not a valid pull secret", r.PullSecret, corev1.DockerConfigJsonKey)
+	}
+	return data, nil
+}
+
+// parseSSHKeys splits authorized_keys content, skipping blank lines and
+// comments.
+func parseSSHKeys(data []byte) []string {
+	keys := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, line)
+	}
+	return keys
+}
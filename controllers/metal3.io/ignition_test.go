@@ -0,0 +1,38 @@
+package controllers
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestReconcileUserIgnition(t *testing.T) {
+	img, secret := newTestUserIgnition("host-0", map[string][]byte{
+		userIgnitionKey: []byte(`{"ignition":{"version":"3.2.0"},"storage":{"files":[{"path":"/etc/motd","contents":{"source":"data:;base64,aGVsbG8="}}]}}`),
+	})
+	r, server := newTestReconciler(t, img, secret)
+
+	_, img = reconcileImage(t, r, "host-0")
+	assertReady(t, img)
+	spec := server.AssertImage(t, testImageName("host-0"))
+	if motd, _ := ignitionFile(t, spec.Ignition, "/etc/motd"); motd != "hello" {
+		t.Errorf("unexpected file from the ignition Secret %q", motd)
+	}
+	assertOwned(t, r, types.NamespacedName{Namespace: testNamespace, Name: secret.Name}, img)
+}
+
+func TestReconcileInvalidUserIgnition(t *testing.T) {
+	for name, data := range map[string]map[string][]byte{
+		"invalid":     {userIgnitionKey: []byte("not ignition")},
+		"missing-key": {"other": []byte(`{"ignition":{"version":"3.2.0"}}`)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			img, secret := newTestUserIgnition("host-0", data)
+			r, server := newTestReconciler(t, img, secret)
+
+			_, img = reconcileImage(t, r, "host-0")
+			assertError(t, img, reasonConfigurationError)
+			server.AssertNoImage(t, testImageName("host-0"))
+		})
+	}
+}
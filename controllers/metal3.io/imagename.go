@@ -0,0 +1,195 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	metal3 "github.com/metal3-io/baremetal-operator/apis/metal3.io/v1alpha1"
+)
+
+// ImageNameData is what an image name template is executed with.
+type ImageNameData struct {
+	Namespace string
+	Name      string
+	// Revision is the generation of the PreprovisioningImage, so that a
+	// change to its spec gives the image a new name.
+	Revision int64
+	// Extension is the configured image extension, e.g. ".iso".
+	Extension string
+}
+
+// ParseImageNameTemplate parses a text/template for the names images are
+// registered, and so served, under, e.g.
+// "{{.Namespace}}_{{.Name}}-{{.Revision}}.iso". The template must yield a
+// non-empty name without slashes that differs between PreprovisioningImages,
+// including those of the same name in different namespaces.
+func ParseImageNameTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("image-name").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	first, err := executeImageNameTemplate(tmpl, ImageNameData{
+		Namespace: "namespace", Name: "first", Revision: 1, Extension: ".iso"})
+	if err != nil {
+		return nil, err
+	}
+	second, err := executeImageNameTemplate(tmpl, ImageNameData{
+		Namespace: "namespace", Name: "second", Revision: 1, Extension: ".iso"})
+	if err != nil {
+		return nil, err
+	}
+	if first == second {
+		return nil, errors.New("image name template must include the name of the PreprovisioningImage")
+	}
+	other, err := executeImageNameTemplate(tmpl, ImageNameData{
+		Namespace: "other", Name: "first", Revision: 1, Extension: ".iso"})
+	if err != nil {
+		return nil, err
+	}
+	if first == other {
+		return nil, errors.New("image name template must include the namespace of the PreprovisioningImage")
+	}
+	return tmpl, nil
+}
+
+func executeImageNameTemplate(tmpl *template.Template, data ImageNameData) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	name := buf.String()
+	if name == "" || strings.ContainsAny(name, "/\\") {
+		return "", fmt.Errorf("image name %q is not a valid file name", name)
+	}
+	return name, nil
+}
+
+// imageNameFor returns the name a PreprovisioningImage's image is registered
+// under with the image server: the ImageNameTemplate if there is one,
+// otherwise the PreprovisioningImage's namespace and name with the
+// ImageExtension.
+func (r *PreprovisioningImageReconciler) imageNameFor(img *metal3.PreprovisioningImage) string {
+	if r.ImageNameTemplate == nil {
+		return r.defaultImageName(img)
+	}
+	name, err := executeImageNameTemplate(r.ImageNameTemplate, ImageNameData{
+		Namespace: img.Namespace,
+		Name:      img.Name,
+		Revision:  img.Generation,
+		Extension: r.ImageExtension,
+	})
+	if err != nil {
+		// the template was checked by ParseImageNameTemplate, so this
+		// only happens for names it cannot turn into a file name
+		r.Log.Error(err, "falling back to the default image name", "name", img.Name)
+		return r.defaultImageName(img)
+	}
+	return name
+}
+
+// defaultImageName joins the namespace and name of a PreprovisioningImage
+// with an underscore, which neither can contain, so that no two images
+// share a name.
+func (r *PreprovisioningImageReconciler) defaultImageName(img *metal3.PreprovisioningImage) string {
+	return img.Namespace + "_" + img.Name + r.ImageExtension
+}
+
+// imageIndex maps the names images are registered under to their
+// PreprovisioningImages, so that a download or rebuild of an image finds its
+// PreprovisioningImage with a single Get rather than a listing. It is filled
+// in as PreprovisioningImages are reconciled.
+type imageIndex struct {
+	mu     sync.RWMutex
+	byName map[string]types.NamespacedName
+	byKey  map[types.NamespacedName]string
+}
+
+// set records the name the image of a PreprovisioningImage is registered
+// under, replacing any it had before.
+func (x *imageIndex) set(key types.NamespacedName, name string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.byName == nil {
+		x.byName = map[string]types.NamespacedName{}
+		x.byKey = map[types.NamespacedName]string{}
+	}
+	if previous, ok := x.byKey[key]; ok && x.byName[previous] == key {
+		delete(x.byName, previous)
+	}
+	x.byName[name] = key
+	x.byKey[key] = name
+}
+
+// remove forgets a deleted PreprovisioningImage.
+func (x *imageIndex) remove(key types.NamespacedName) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if name, ok := x.byKey[key]; ok && x.byName[name] == key {
+		delete(x.byName, name)
+	}
+	delete(x.byKey, key)
+}
+
+func (x *imageIndex) lookup(name string) (types.NamespacedName, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	key, ok := x.byName[name]
+	return key, ok
+}
+
+// imageForName returns the PreprovisioningImage whose image is registered
+// under a name, or nil if there is none. Those not reconciled since the
+// controller started, e.g. whose images were restored from the cache, are
+// found by listing them all, which indexes them too.
+func (r *PreprovisioningImageReconciler) imageForName(ctx context.Context, name string) (*metal3.PreprovisioningImage, error) {
+	if key, ok := r.imageIndex.lookup(name); ok {
+		img := &metal3.PreprovisioningImage{}
+		err := r.Get(ctx, key, img)
+		if err == nil && r.imageNameFor(img) == name {
+			return img, nil
+		}
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return nil, err
+		}
+	}
+
+	images := metal3.PreprovisioningImageList{}
+	if err := r.List(ctx, &images); err != nil {
+		return nil, err
+	}
+	var found *metal3.PreprovisioningImage
+	for i := range images.Items {
+		img := &images.Items[i]
+		imgName := r.imageNameFor(img)
+		r.imageIndex.set(client.ObjectKeyFromObject(img), imgName)
+		if imgName == name {
+			found = img
+		}
+	}
+	return found, nil
+}
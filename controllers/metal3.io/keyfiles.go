@@ -0,0 +1,119 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/asalkeld/image-customization-controller/pkg/ignition"
+	"github.com/asalkeld/image-customization-controller/pkg/initrd"
+)
+
+// CustomizationMode selects the form of the content embedded in images.
+type CustomizationMode string
+
+const (
+	// CustomizationModeIgnition embeds an ignition config, for CoreOS live
+	// images.
+	CustomizationModeIgnition CustomizationMode = "ignition"
+	// CustomizationModeKeyfiles embeds an initramfs archive of the host's
+	// NetworkManager keyfiles instead, as in Ironic's DHCP-less flow, for
+	// ramdisks that don't run ignition. Only network data is embedded.
+	CustomizationModeKeyfiles CustomizationMode = "nm-keyfiles"
+)
+
+// ParseCustomizationMode validates a customization mode name.
+func ParseCustomizationMode(value string) (CustomizationMode, error) {
+	switch mode := CustomizationMode(value); mode {
+	case CustomizationModeIgnition, CustomizationModeKeyfiles:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown customization mode %q", value)
+}
+
+const (
+	// keyfilesDir is where NetworkManager reads connection profiles from.
+	keyfilesDir = "/etc/NetworkManager/system-connections"
+	// keyfileSuffix marks the network data Secret keys holding
+	// NetworkManager keyfiles, one connection profile per key.
+	keyfileSuffix = ".nmconnection"
+	// keyfilesKey is reported as the key network data was read from when
+	// it came from keyfiles.
+	keyfilesKey = "*" + keyfileSuffix
+)
+
+// secretKeyfiles returns the NetworkManager keyfiles in a Secret, sorted by
+// key.
+func secretKeyfiles(secret *corev1.Secret) ([]string, error) {
+	keys := []string{}
+	for key, data := range secret.Data {
+		if !strings.HasSuffix(key, keyfileSuffix) {
+			continue
+		}
+		if len(data) == 0 {
+			return nil, fmt.Errorf("keyfile %q is empty", key)
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// keyfilesToIgnition installs the NetworkManager keyfiles of a Secret with
+// ignition.
+func keyfilesToIgnition(secret *corev1.Secret, keys []string) ([]byte, error) {
+	builder := ignition.NewBuilder()
+	for _, key := range keys {
+		builder.AddFile(path.Join(keyfilesDir, key), 0600, secret.Data[key])
+	}
+	return builder.Build()
+}
+
+// gatherKeyfiles returns an initramfs archive of the NetworkManager keyfiles
+// in the network data Secret, for CustomizationModeKeyfiles. The archive is
+// loaded as an initrd segment after that of the live image, so it is
+// compressed as the boot flow requires.
+func gatherKeyfiles(secret *corev1.Secret, compression initrd.Compression) ([]byte, string, error) {
+	if secret == nil {
+		return nil, "", nil
+	}
+	keys, err := secretKeyfiles(secret)
+	if err != nil {
+		return nil, keyfilesKey, redactError(err, "network data in Secret %s has the incorrect format", secret.Name)
+	}
+	if len(keys) == 0 {
+		for _, format := range networkDataFormats {
+			if _, ok := secret.Data[format.key]; ok {
+				return nil, format.key, fmt.Errorf("network data in key %q of Secret %s cannot be embedded as NetworkManager keyfiles",
+					format.key, secret.Name)
+			}
+		}
+		return nil, "", errors.New("no NetworkManager keyfiles found in Secret " + secret.Name)
+	}
+	archive := initrd.NewArchive()
+	for _, key := range keys {
+		archive.AddFile(path.Join(keyfilesDir, key), 0600, secret.Data[key])
+	}
+	content, err := archive.Encode(compression)
+	return content, keyfilesKey, err
+}
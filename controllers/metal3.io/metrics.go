@@ -0,0 +1,71 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/api/meta"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	metal3 "github.com/metal3-io/baremetal-operator/apis/metal3.io/v1alpha1"
+)
+
+const reasonLabel = "reason"
+
+var (
+	reconcileDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "image_customization_reconcile_duration_seconds",
+		Help:    "Time taken to reconcile a PreprovisioningImage, by the reason of its ImageReady condition.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{reasonLabel})
+	reconcileRequeues = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "image_customization_reconcile_requeues_total",
+		Help: "Reconciles of a PreprovisioningImage that were requeued, by the reason of its ImageReady condition.",
+	}, []string{reasonLabel})
+	reconcileErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "image_customization_reconcile_errors_total",
+		Help: "Reconciles of a PreprovisioningImage that returned an error, by the reason of its ImageReady condition.",
+	}, []string{reasonLabel})
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		reconcileDuration,
+		reconcileRequeues,
+		reconcileErrors,
+	)
+}
+
+// recordReconcile updates the reconcile metrics with the outcome of a
+// reconcile that started at start.
+func recordReconcile(start time.Time, status metal3.PreprovisioningImageStatus, result ctrl.Result, err error) {
+	reason := "Unknown"
+	if cond := meta.FindStatusCondition(status.Conditions, string(metal3.ConditionImageReady)); cond != nil {
+		reason = cond.Reason
+	}
+
+	reconcileDuration.WithLabelValues(reason).Observe(time.Since(start).Seconds())
+	if result.Requeue || result.RequeueAfter > 0 {
+		reconcileRequeues.WithLabelValues(reason).Inc()
+	}
+	if err != nil {
+		reconcileErrors.WithLabelValues(reason).Inc()
+	}
+}
@@ -0,0 +1,130 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/asalkeld/image-customization-controller/pkg/ignition"
+)
+
+// NetworkMode selects how the live image configures the provisioning
+// network.
+type NetworkMode string
+
+const (
+	// NetworkModeAuto embeds network data when a PreprovisioningImage
+	// references any, and otherwise leaves the network to DHCP.
+	NetworkModeAuto NetworkMode = "auto"
+	// NetworkModeDHCP never embeds network data, so that every host gets
+	// the same configuration from DHCP.
+	NetworkModeDHCP NetworkMode = "dhcp"
+	// NetworkModeStatic requires every PreprovisioningImage to reference
+	// network data.
+	NetworkModeStatic NetworkMode = "static"
+)
+
+// ParseNetworkMode validates a network mode name.
+func ParseNetworkMode(value string) (NetworkMode, error) {
+	switch mode := NetworkMode(value); mode {
+	case NetworkModeAuto, NetworkModeDHCP, NetworkModeStatic:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown network mode %q", value)
+}
+
+const (
+	nmstatePath          = "/etc/nmstate/preprovisioning.yml"
+	openstackNetDataPath = "/etc/metal3/network_data.json"
+)
+
+// networkDataFormat describes a well-known Secret key and how to turn its
+// contents into the ignition config embedded in the image.
+type networkDataFormat struct {
+	key     string
+	convert func(data []byte) ([]byte, error)
+}
+
+// networkDataFormats lists the Secret keys we look for, in priority order.
+var networkDataFormats = []networkDataFormat{
+	{key: "nmstate", convert: nmstateToIgnition},
+	{key: "network_data.json", convert: openstackToIgnition},
+	{key: "networkData", convert: openstackToIgnition},
+	{key: "ignition", convert: validateIgnition},
+	// legacy key, embedded as-is
+	{key: "network", convert: func(data []byte) ([]byte, error) { return data, nil }},
+}
+
+// gatherNetworkData returns the ignition content built from the first
+// well-known key found in the secret, along with the name of that key.
+func gatherNetworkData(log logr.Logger, secret *corev1.Secret) ([]byte, string, error) {
+	if secret == nil {
+		log.V(1).Info("no network data secret")
+		return nil, "", nil
+	}
+	for _, format := range networkDataFormats {
+		data, ok := secret.Data[format.key]
+		if !ok {
+			continue
+		}
+		content, err := format.convert(data)
+		if err != nil {
+			return nil, format.key, redactError(err, "network data in key %q of Secret %s has the incorrect format", format.key, secret.Name)
+		}
+		log.V(1).Info("converted network data", "secret", secret.Name, "key", format.key, "bytes", len(content))
+		return content, format.key, nil
+	}
+	keys, err := secretKeyfiles(secret)
+	if err != nil {
+		return nil, keyfilesKey, redactError(err, "network data in Secret %s has the incorrect format", secret.Name)
+	}
+	if len(keys) > 0 {
+		content, err := keyfilesToIgnition(secret, keys)
+		if err != nil {
+			return nil, keyfilesKey, err
+		}
+		log.V(1).Info("converted network data", "secret", secret.Name, "key", keyfilesKey, "bytes", len(content))
+		return content, keyfilesKey, nil
+	}
+	return nil, "", fmt.Errorf("no network data found in Secret %s", secret.Name)
+}
+
+func nmstateToIgnition(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("nmstate data is empty")
+	}
+	return ignition.NewBuilder().AddFile(nmstatePath, 0600, data).Build()
+}
+
+func openstackToIgnition(data []byte) ([]byte, error) {
+	if !json.Valid(data) {
+		return nil, errors.New("network data is not valid JSON")
+	}
+	return ignition.NewBuilder().AddFile(openstackNetDataPath, 0600, data).Build()
+}
+
+func validateIgnition(data []byte) ([]byte, error) {
+	if _, err := ignition.Parse(data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,125 @@
+package controllers
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+const testNMState = "interfaces:\n- name: eth0\n  type: ethernet\n  state: up\n"
+
+func TestGatherNetworkData(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data map[string][]byte
+		key  string
+		path string
+	}{
+		{
+			name: "nmstate first",
+			data: map[string][]byte{"nmstate": []byte(testNMState), "network_data.json": []byte(`{"links":[]}`)},
+			key:  "nmstate",
+			path: nmstatePath,
+		},
+		{
+			name: "openstack",
+			data: map[string][]byte{"network_data.json": []byte(`{"links":[]}`)},
+			key:  "network_data.json",
+			path: openstackNetDataPath,
+		},
+		{
+			name: "openstack camel case",
+			data: map[string][]byte{"networkData": []byte(`{"links":[]}`)},
+			key:  "networkData",
+			path: openstackNetDataPath,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "network"}, Data: tc.data}
+			content, key, err := gatherNetworkData(zap.New(zap.UseDevMode(true)), secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key != tc.key {
+				t.Errorf("network data read from key %q, expected %q", key, tc.key)
+			}
+			if data, _ := ignitionFile(t, content, tc.path); data != string(tc.data[tc.key]) {
+				t.Errorf("unexpected network data %q at %s", data, tc.path)
+			}
+		})
+	}
+}
+
+func TestGatherNetworkDataErrors(t *testing.T) {
+	for name, data := range map[string]map[string][]byte{
+		"empty nmstate":     {"nmstate": {}},
+		"invalid openstack": {"network_data.json": []byte("not JSON")},
+		"invalid ignition":  {"ignition": []byte("not ignition")},
+		"no known key":      {"other": []byte(testNMState)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "network"}, Data: data}
+			if _, _, err := gatherNetworkData(zap.New(zap.UseDevMode(true)), secret); err == nil {
+				t.Error("expected the network data to be refused")
+			}
+		})
+	}
+}
+
+func TestReconcileNetworkData(t *testing.T) {
+	img, secret := newTestNetworkData("host-0")
+	r, server := newTestReconciler(t, img, secret)
+	r.NetworkMode = NetworkModeAuto
+
+	_, img = reconcileImage(t, r, "host-0")
+	assertReady(t, img)
+	spec := server.AssertImage(t, testImageName("host-0"))
+	if nmstate, _ := ignitionFile(t, spec.Ignition, nmstatePath); nmstate != testNMState {
+		t.Errorf("unexpected network data %q", nmstate)
+	}
+	if img.Status.NetworkData.Name != secret.Name || img.Status.NetworkData.Version == "" {
+		t.Errorf("unexpected network data status %+v", img.Status.NetworkData)
+	}
+}
+
+func TestReconcileNetworkDataDHCP(t *testing.T) {
+	img, secret := newTestNetworkData("host-0")
+	r, server := newTestReconciler(t, img, secret)
+	r.NetworkMode = NetworkModeDHCP
+
+	_, img = reconcileImage(t, r, "host-0")
+	assertReady(t, img)
+	if spec := server.AssertImage(t, testImageName("host-0")); len(spec.Ignition) != 0 {
+		t.Errorf("unexpected ignition %s in DHCP network mode", spec.Ignition)
+	}
+	if img.Status.NetworkData.Name != "" {
+		t.Errorf("unexpected network data status %+v in DHCP network mode", img.Status.NetworkData)
+	}
+}
+
+func TestReconcileNetworkDataStatic(t *testing.T) {
+	img, secret := newTestNetworkData("host-0")
+	r, server := newTestReconciler(t, img, secret, newTestImage("host-1"))
+	r.NetworkMode = NetworkModeStatic
+
+	_, img = reconcileImage(t, r, "host-0")
+	assertReady(t, img)
+	server.AssertImage(t, testImageName("host-0"))
+
+	_, img = reconcileImage(t, r, "host-1")
+	assertError(t, img, reasonMissingNetworkData)
+	server.AssertNoImage(t, testImageName("host-1"))
+}
+
+func TestReconcileMissingNetworkData(t *testing.T) {
+	img, _ := newTestNetworkData("host-0")
+	r, _ := newTestReconciler(t, img)
+
+	result, img := reconcileImage(t, r, "host-0")
+	assertError(t, img, reasonMissingNetworkData)
+	if result.RequeueAfter <= 0 {
+		t.Errorf("expected a retry to check for the Secret, got %+v", result)
+	}
+}
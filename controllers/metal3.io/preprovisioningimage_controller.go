@@ -18,9 +18,14 @@ package controllers
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"sync"
+	"text/template"
 	"time"
 
+	jsonpatch "github.com/evanphx/json-patch"
 	"github.com/go-logr/logr"
 	corev1 "k8s.io/api/core/v1"
 	apiequality "k8s.io/apimachinery/pkg/api/equality"
@@ -28,28 +33,167 @@ import (
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/asalkeld/image-customization-controller/pkg/ignition"
 	"github.com/asalkeld/image-customization-controller/pkg/imagehandler"
+	"github.com/asalkeld/image-customization-controller/pkg/initrd"
+	"github.com/asalkeld/image-customization-controller/pkg/sharding"
+	"github.com/asalkeld/image-customization-controller/pkg/tracing"
 	metal3 "github.com/metal3-io/baremetal-operator/apis/metal3.io/v1alpha1"
-	"github.com/metal3-io/baremetal-operator/pkg/secretutils"
-)
-
-const (
-	minRetryDelay = time.Second * 10
-	maxRetryDelay = time.Minute * 10
 )
 
 // PreprovisioningImageReconciler reconciles a PreprovisioningImage object
 type PreprovisioningImageReconciler struct {
 	client.Client
 	Log             logr.Logger
+	ConverterLog    logr.Logger
 	Scheme          *runtime.Scheme
 	APIReader       client.Reader
 	ImageFileServer imagehandler.ImageFileServer
+
+	// AdditionalIgnitionConfigMap optionally references a ConfigMap whose
+	// ignition snippet is merged into every image.
+	AdditionalIgnitionConfigMap types.NamespacedName
+
+	// SSHKeySecret optionally references a Secret whose authorized SSH keys
+	// are added to the core user of every image.
+	SSHKeySecret types.NamespacedName
+
+	// PullSecret optionally references the cluster pull secret, which is
+	// installed on every image so that it can pull from authenticated
+	// registries.
+	PullSecret types.NamespacedName
+
+	// NetworkMode selects whether network data is embedded in images.
+	NetworkMode NetworkMode
+
+	// CustomizationMode selects whether images embed an ignition config or
+	// NetworkManager keyfiles. Defaults to ignition.
+	CustomizationMode CustomizationMode
+
+	// InitrdCompression is the compression of the initramfs archives
+	// embedded in images, which some PXE toolchains and firmwares
+	// require. Defaults to none.
+	InitrdCompression initrd.Compression
+
+	// KernelArgs are added to the kernel arguments of every image.
+	KernelArgs []string
+
+	// ArchKernelArgs are added to the kernel arguments of the images of
+	// each CPU architecture, after KernelArgs. They are not added to images
+	// whose architecture is unknown.
+	ArchKernelArgs map[string][]string
+
+	// BootConfig rewrites the volume label and boot menu of every image,
+	// unless overridden by a PreprovisioningImage's annotations.
+	BootConfig imagehandler.BootConfig
+
+	// Proxy is the proxy configuration set in the environment of the live
+	// image.
+	Proxy ignition.ProxyConfig
+
+	// UseClusterProxy adds the trusted CA bundle of the OpenShift
+	// cluster-wide Proxy to every image, and takes the proxy configuration
+	// from it instead when it sets a proxy.
+	UseClusterProxy bool
+
+	// BaseImagePollInterval is how often to check whether the base ISO has
+	// been replaced. Zero disables the check.
+	BaseImagePollInterval time.Duration
+
+	// ImageGCInterval is how often images that no PreprovisioningImage
+	// refers to are unregistered. Zero disables garbage collection.
+	ImageGCInterval time.Duration
+
+	// BaseImageChanges, if set, notifies the controller that a base ISO
+	// has been replaced, so that it checks without waiting for the next
+	// poll.
+	BaseImageChanges <-chan struct{}
+
+	// PrewarmImages queues generation of the images of already Ready
+	// PreprovisioningImages at startup.
+	PrewarmImages bool
+
+	// SweepStatus checks at startup that the URLs advertised by Ready
+	// PreprovisioningImages can still be served, correcting the status of
+	// those that can't.
+	SweepStatus bool
+
+	// ProvisionedImageRetention, if set, is how long the image of a
+	// PreprovisioningImage is kept once its BareMetalHost is provisioned.
+	// It is then unregistered, until the host is deprovisioned.
+	ProvisionedImageRetention time.Duration
+
+	// RemoveDeprovisionedImages unregisters the image of a
+	// PreprovisioningImage as soon as its BareMetalHost is deprovisioned
+	// or deleted, until the host needs it again.
+	RemoveDeprovisionedImages bool
+
+	// DownloadEvents records an event on the PreprovisioningImage for each
+	// download of its image.
+	DownloadEvents bool
+
+	// DownloadAnnotations records the time and client address of the last
+	// complete download of the image in annotations on the
+	// PreprovisioningImage.
+	DownloadAnnotations bool
+
+	// ErrorStaleThreshold is how long an image can be in error before it
+	// is counted as stale in the metrics.
+	ErrorStaleThreshold time.Duration
+
+	// ImageExtension is appended to the name of images, e.g. ".iso", which
+	// some Redfish implementations require URLs to end with.
+	ImageExtension string
+
+	// ImageNameTemplate, if set, names images instead of ImageExtension.
+	// See ParseImageNameTemplate.
+	ImageNameTemplate *template.Template
+
+	// Shard limits the controller to the PreprovisioningImages owned by
+	// this replica, when images are divided between several.
+	Shard sharding.Shard
+
+	// DryRun builds the content of every image without registering it or
+	// updating the PreprovisioningImage, logging the outcome and recording
+	// it as an event instead. Nothing that registers images or writes
+	// status runs alongside, though the Secrets read are still labelled to
+	// be watched, as in a normal reconcile.
+	DryRun bool
+	// recorder records the outcome of dry runs.
+	recorder record.EventRecorder
+
+	reconfigureMu sync.Mutex
+	settings      Settings
+	reconfigured  chan event.GenericEvent
+	// cancelRequeue stops reconciling the images again for the previous
+	// settings.
+	cancelRequeue context.CancelFunc
+
+	// generations reconciles images when their generation finishes.
+	generations *generationWaiter
+	// generationFailures backs off retries of failed image generation.
+	generationFailures generationFailures
+	// imageIndex finds the PreprovisioningImage of a registered image.
+	imageIndex imageIndex
 }
 
+// annotationPrefix is the prefix of the PreprovisioningImage annotations
+// understood by this controller.
+const annotationPrefix = "image-customization.metal3.io/"
+
 type conditionReason string
 
 const (
@@ -58,105 +202,347 @@ const (
 	reasonMissingNetworkData conditionReason = "MissingNetworkData"
 	reasonUnexpectedError    conditionReason = "UnexpectedError"
 	reasonImageServingError  conditionReason = "ImageServingError"
+	reasonImageGenerating    conditionReason = "ImageGenerating"
+	reasonUnknownBaseImage   conditionReason = "UnknownBaseImage"
+
+	reasonBaseImageUnavailable conditionReason = "BaseImageUnavailable"
+	reasonIgnitionTooLarge     conditionReason = "IgnitionTooLarge"
+	reasonGenerationFailed     conditionReason = "ImageGenerationFailed"
+
+	reasonGenerationAttemptsExhausted conditionReason = "ImageGenerationAttemptsExhausted"
+
+	// reasonTransientAPIError is the reason of an image whose
+	// configuration could not be fetched from the API server for now, as
+	// opposed to one that is wrong. It is retried with backoff.
+	reasonTransientAPIError conditionReason = "TransientAPIError"
 )
 
+// urlExpiryMargin delays the reconcile replacing an expiring image URL until
+// just after it has expired, so that the image server issues a new one.
+const urlExpiryMargin = time.Second
+
+// errImagePending is returned by reconcile while the image is still being
+// generated in the background.
+var errImagePending = errors.New("image generation in progress")
+
+// The controller creates no Kubernetes objects of its own apart from Events,
+// which are tied to the PreprovisioningImage through their involvedObject.
+// Secrets it reads are given a non-controller owner reference by the secret
+// manager, since they belong to the user. Any auxiliary object it creates in
+// future must be given a controller owner reference to its
+// PreprovisioningImage with controllerutil.SetControllerReference, so that
+// garbage collection removes it along with the image, and be watched with
+// Owns() in SetupWithManager.
+
 // +kubebuilder:rbac:groups=metal3.io,resources=preprovisioningimages,verbs=get;list;watch;update;patch
 // +kubebuilder:rbac:groups=metal3.io,resources=preprovisioningimages/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=metal3.io,resources=baremetalhosts,verbs=get;list;watch
 // +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;update
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups=config.openshift.io,resources=proxies,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=services,verbs=get
 
 func (r *PreprovisioningImageReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	log := ctrl.LoggerFrom(ctx)
+	ctx, span := tracing.Start(ctx, "Reconcile", "namespace", req.Namespace, "name", req.Name)
 
 	result := ctrl.Result{}
+	if !r.Shard.Owns(req.NamespacedName.String()) {
+		log.V(1).Info("PreprovisioningImage is owned by another shard")
+		tracing.End(span, nil)
+		return result, nil
+	}
 
 	img := metal3.PreprovisioningImage{}
 	err := r.Get(ctx, req.NamespacedName, &img)
 	if err != nil {
 		if k8serrors.IsNotFound(err) {
 			log.Info("PreprovisioningImage not found")
+			r.generationFailures.reset(req.NamespacedName)
+			r.imageIndex.remove(req.NamespacedName)
 			err = nil
 		}
+		tracing.End(span, err)
 		return result, err
 	}
-
-	changed, err := r.reconcile(ctx, &img)
+	r.imageIndex.set(req.NamespacedName, r.imageNameFor(&img))
+	if r.DryRun {
+		err = r.dryRun(ctx, &img)
+		tracing.End(span, err)
+		return result, err
+	}
+	original := img.DeepCopy()
+
+	start := time.Now()
+	delays := r.retryDelays()
+	retirement, retireAfter, err := r.retirement(ctx, &img)
+	changed := false
+	switch {
+	case err != nil:
+	case retirement != nil:
+		log.Info("retiring image", "reason", retirement.reason)
+		changed, err = r.retire(ctx, &img, retirement)
+	default:
+		changed, err = r.reconcile(ctx, &img)
+	}
 	if k8serrors.IsNotFound(err) {
-		delay := getErrorRetryDelay(img.Status)
+		delay := getErrorRetryDelay(img.Status, delays)
 		log.Info("requeuing to check for secret", "after", delay)
 		result.RequeueAfter = delay
 	}
+	var retry *generationRetryError
+	if errors.As(err, &retry) {
+		log.Info("requeuing to retry image generation", "after", retry.delay, "attempt", retry.attempt)
+		result.RequeueAfter = retry.delay
+		err = nil
+	}
+	if isTransientAPIError(err) {
+		delay := transientAPIErrorDelay(err, img.Status, delays)
+		log.Info("requeuing after a transient API error", "after", delay, "error", err.Error())
+		result.RequeueAfter = delay
+		err = nil
+	}
+	if errors.Is(err, errImagePending) {
+		log.Info("requeuing to check for image generation", "after", delays.Pending)
+		result.RequeueAfter = delays.Pending
+		err = nil
+	}
+	if err == nil && result.RequeueAfter == 0 {
+		// publish a fresh URL once the current one expires
+		if expiry := r.ImageFileServer.ImageURLExpiry(r.imageNameFor(&img)); !expiry.IsZero() {
+			result.RequeueAfter = urlExpiryMargin
+			if until := time.Until(expiry); until > 0 {
+				result.RequeueAfter += until
+			}
+		}
+	}
+	if err == nil && retireAfter > 0 && (result.RequeueAfter == 0 || retireAfter < result.RequeueAfter) {
+		result.RequeueAfter = retireAfter
+	}
 	if changed {
 		log.Info("updating status")
-		err = r.Status().Update(ctx, &img)
+		err = patchStatus(ctx, r.Client, &img, original)
 	}
 
+	recordReconcile(start, img.Status, result, err)
+	tracing.End(span, err)
 	return result, err
 }
 
+// patchStatus writes the status of a PreprovisioningImage as a merge patch
+// of what changed since original. The patch carries the resourceVersion of
+// original, since a merge patch replaces lists such as the conditions as a
+// whole, and would otherwise overwrite changes made meanwhile. On a conflict
+// the latest version is read and the changes are applied to it again. Other
+// transient failures are retried.
+func patchStatus(ctx context.Context, c client.Client, img, original *metal3.PreprovisioningImage) error {
+	return retryTransientAPIErrors(func() error {
+		return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			patch := client.MergeFromWithOptions(original, client.MergeFromWithOptimisticLock{})
+			err := c.Status().Patch(ctx, img, patch)
+			if !k8serrors.IsConflict(err) {
+				return err
+			}
+			latest := &metal3.PreprovisioningImage{}
+			if err := c.Get(ctx, client.ObjectKeyFromObject(img), latest); err != nil {
+				return err
+			}
+			if err := rebaseStatus(latest, original, img); err != nil {
+				return err
+			}
+			original = latest
+			return err
+		})
+	})
+}
+
+// rebaseStatus applies the changes made to the status of img since original
+// to latest, and sets img to the result. Conditions are merged by type, so
+// that those changed by others meanwhile are kept.
+func rebaseStatus(latest, original, img *metal3.PreprovisioningImage) error {
+	changes, err := client.MergeFrom(original).Data(img)
+	if err != nil {
+		return err
+	}
+	patch := map[string]interface{}{}
+	if err := json.Unmarshal(changes, &patch); err != nil {
+		return err
+	}
+	if status, ok := patch["status"].(map[string]interface{}); ok {
+		delete(status, "conditions")
+	}
+	if changes, err = json.Marshal(patch); err != nil {
+		return err
+	}
+	data, err := json.Marshal(latest)
+	if err != nil {
+		return err
+	}
+	if data, err = jsonpatch.MergePatch(data, changes); err != nil {
+		return err
+	}
+	rebased := metal3.PreprovisioningImage{}
+	if err := json.Unmarshal(data, &rebased); err != nil {
+		return err
+	}
+
+	for _, cond := range img.Status.Conditions {
+		if old := meta.FindStatusCondition(original.Status.Conditions, cond.Type); old == nil || !apiequality.Semantic.DeepEqual(*old, cond) {
+			meta.SetStatusCondition(&rebased.Status.Conditions, cond)
+		}
+	}
+	for _, cond := range original.Status.Conditions {
+		if meta.FindStatusCondition(img.Status.Conditions, cond.Type) == nil {
+			meta.RemoveStatusCondition(&rebased.Status.Conditions, cond.Type)
+		}
+	}
+	*img = rebased
+	return nil
+}
+
 func (r *PreprovisioningImageReconciler) reconcile(ctx context.Context, img *metal3.PreprovisioningImage) (bool, error) {
 	log := ctrl.LoggerFrom(ctx)
 	generation := img.GetGeneration()
 
-	secretManager := secretutils.NewSecretManager(log, r.Client, r.APIReader)
-	secret, err := getNetworkDataSecret(secretManager, img)
-	if k8serrors.IsNotFound(err) {
-		return setError(ctx, generation, &img.Status, reasonMissingNetworkData, "NetworkData secret not found"), err
-	}
+	arch, err := r.imageArchitecture(ctx, img)
 	if err != nil {
 		return setError(ctx, generation, &img.Status, reasonUnexpectedError, err.Error()), err
 	}
 
-	netData, err := gatherNetworkData(secret)
-	if err != nil {
-		return setError(ctx, generation, &img.Status, reasonConfigurationError, err.Error()), err
+	customization, ignitionContent, condErr := r.customizeImage(ctx, img, arch)
+	if condErr != nil {
+		return setError(ctx, generation, &img.Status, condErr.reason, condErr.message), condErr.cause
 	}
 
-	format := metal3.ImageFormatISO
-	imageName := img.Name + ".qcow"
+	imageName := r.imageNameFor(img)
+	spec := customization.imageSpec(imageName, ignitionContent)
+
+	if failure, ok := r.generationFailures.backingOff(img); ok {
+		changed := setError(ctx, generation, &img.Status, failure.reason, failure.message)
+		if failure.exhausted {
+			return changed, nil
+		}
+		return changed, &generationRetryError{delay: time.Until(failure.retryAt), attempt: failure.count,
+			cause: errors.New(failure.message)}
+	}
 
-	url, err := r.ImageFileServer.ServeImage(imageName, netData)
+	_, span := tracing.Start(ctx, "ServeImage", "image", imageName, "arch", arch, "baseImage", spec.Base.Name)
+	info, err := r.ImageFileServer.ServeImage(ctx, spec)
+	tracing.End(span, err)
+	if errors.Is(err, imagehandler.ErrUnknownBaseImage) {
+		// retrying won't help until the base image label or the host changes
+		return setError(ctx, generation, &img.Status, reasonUnknownBaseImage, err.Error()), nil
+	}
+	if errors.Is(err, imagehandler.ErrBaseISOUnavailable) {
+		return setError(ctx, generation, &img.Status, reasonBaseImageUnavailable, err.Error()), err
+	}
 	if err != nil {
 		return setError(ctx, generation, &img.Status, reasonImageServingError, err.Error()), err
 	}
 
+	if info.Error != nil {
+		return r.generationFailed(ctx, img, imageName, info.Error)
+	}
+	if !info.Ready {
+		if info.Done != nil && r.generations != nil {
+			r.generations.await(img, info.Done)
+		}
+		return setPending(generation, &img.Status, "Image generation in progress"), errImagePending
+	}
+	r.generationFailures.reset(client.ObjectKeyFromObject(img))
+
 	secretStatus := metal3.SecretStatus{}
-	if secret != nil {
+	if secret := customization.networkDataSecret; secret != nil {
 		secretStatus.Name = secret.Name
 		secretStatus.Version = secret.GetResourceVersion()
 	}
+	if previous := img.Status.NetworkData; previous.Name != "" && previous != secretStatus {
+		// the URL changes with the content, so the old one no longer works
+		log.Info("network data changed, publishing a new image URL", "secret", secretStatus.Name)
+	}
+
+	message := "Image available"
+	if key := customization.networkDataKey; key != "" {
+		message = fmt.Sprintf("Image available with network data from key %q", key)
+	}
+
+	baseImageVersion, err := r.ImageFileServer.BaseImageVersion(ctx)
+	if err != nil {
+		return setError(ctx, generation, &img.Status, reasonImageServingError, err.Error()), err
+	}
+
+	url, format := info.URL, metal3.ImageFormat(info.Format)
+	if info.Format == imagehandler.ImageFormatConfigDrive {
+		// a config drive is an ISO 9660 image, the only format of the API
+		// it can be reported as
+		format = metal3.ImageFormatISO
+	}
+	// the URL may carry a download token or presigned credentials, so only
+	// the image name is logged
+	log.Info("image available", "image", imageName, "format", format, "size", info.Size, "networkDataKey", customization.networkDataKey)
+	urlChanged := img.Status.ImageUrl != url
+	changed := setImage(generation, &img.Status, url, format, info.Checksum, metal3.ChecksumType(info.ChecksumType),
+		secretStatus, arch, message)
+	changed = setBaseImageVersion(generation, &img.Status, baseImageVersion) || changed
+
+	var lastDownload *imagehandler.Download
+	if download, ok := r.ImageFileServer.LastDownload(imageName); ok {
+		lastDownload = &download
+	}
+	return setImageServing(generation, &img.Status, lastDownload, urlChanged) || changed, nil
+}
+
+// generationFailed reports an image whose generation failed. An image whose
+// ignition content does not fit is not retried, since only a change to its
+// network data, which triggers a reconcile, can fix it. Any other failed
+// image is removed, so that it is generated afresh when the reconcile is
+// retried after a growing delay, until the configured number of attempts
+// have failed. Until then reconciles triggered by other events leave it in
+// error. After that only a new generation of the PreprovisioningImage, or a
+// restart of the controller, tries again.
+func (r *PreprovisioningImageReconciler) generationFailed(ctx context.Context, img *metal3.PreprovisioningImage, imageName string, err error) (bool, error) {
+	generation := img.GetGeneration()
+	if errors.Is(err, imagehandler.ErrIgnitionTooLarge) {
+		return setError(ctx, generation, &img.Status, reasonIgnitionTooLarge, err.Error()), nil
+	}
+	if removeErr := r.ImageFileServer.RemoveImage(ctx, imageName); removeErr != nil && !errors.Is(removeErr, imagehandler.ErrImageNotFound) {
+		ctrl.LoggerFrom(ctx).Error(removeErr, "unable to remove failed image")
+	}
 
-	log.Info("image available", "url", url, "format", format)
-	return setImage(generation, &img.Status, url, format, secretStatus, img.Spec.Architecture, "Image available"), nil
+	failure := r.generationFailures.add(img, err, r.retryDelays())
+	changed := setError(ctx, generation, &img.Status, failure.reason, failure.message)
+	if failure.exhausted {
+		return changed, nil
+	}
+	return changed, &generationRetryError{delay: time.Until(failure.retryAt), attempt: failure.count, cause: err}
 }
 
-func getErrorRetryDelay(status metal3.PreprovisioningImageStatus) time.Duration {
+// converterLog returns the logger for network data conversion of an image.
+func (r *PreprovisioningImageReconciler) converterLog(img *metal3.PreprovisioningImage) logr.Logger {
+	log := r.ConverterLog
+	if log == nil {
+		log = r.Log.WithName("converter")
+	}
+	return log.WithValues("namespace", img.Namespace, "name", img.Name)
+}
+
+func getErrorRetryDelay(status metal3.PreprovisioningImageStatus, delays RetryDelays) time.Duration {
 	errorCond := meta.FindStatusCondition(status.Conditions, string(metal3.ConditionImageError))
 	if errorCond == nil || errorCond.Status != metav1.ConditionTrue {
 		return 0
 	}
 
 	// exponential delay
-	delay := time.Since(errorCond.LastTransitionTime.Time) + minRetryDelay
+	delay := time.Since(errorCond.LastTransitionTime.Time) + delays.MinError
 
-	if delay > maxRetryDelay {
-		return maxRetryDelay
+	if delay > delays.MaxError {
+		return delays.MaxError
 	}
 	return delay
 }
 
-func gatherNetworkData(secret *corev1.Secret) ([]byte, error) {
-	if secret == nil {
-		return nil, nil
-	}
-	// TODO not yet sure what to do here, this is just something for testing.
-	netData, ok := secret.Data["network"]
-	if !ok {
-		return nil, errors.New("network data in the secret has the incorrect format")
-	}
-	return netData, nil
-}
-
-func getNetworkDataSecret(secretManager secretutils.SecretManager, img *metal3.PreprovisioningImage) (*corev1.Secret, error) {
+func getNetworkDataSecret(secretManager secretSource, img *metal3.PreprovisioningImage) (*corev1.Secret, error) {
 	networkDataSecret := img.Spec.NetworkDataName
 	if networkDataSecret == "" {
 		return nil, nil
@@ -166,21 +552,26 @@ func getNetworkDataSecret(secretManager secretutils.SecretManager, img *metal3.P
 		Name:      networkDataSecret,
 		Namespace: img.ObjectMeta.Namespace,
 	}
-	return secretManager.AcquireSecret(secretKey, img, false)
+	var secret *corev1.Secret
+	err := retryTransientAPIErrors(func() (err error) {
+		secret, err = secretManager.AcquireSecret(secretKey, img, false)
+		return err
+	})
+	return secret, err
 }
 
 func setImage(generation int64, status *metal3.PreprovisioningImageStatus, url string,
-	format metal3.ImageFormat, networkData metal3.SecretStatus, arch string,
-	message string) bool {
+	format metal3.ImageFormat, checksum string, checksumType metal3.ChecksumType,
+	networkData metal3.SecretStatus, arch string, message string) bool {
 	newStatus := status.DeepCopy()
 	newStatus.ImageUrl = url
 	newStatus.Format = format
-	newStatus.Checksum = ""
-	newStatus.ChecksumType = ""
+	newStatus.Checksum = checksum
+	newStatus.ChecksumType = checksumType
 	newStatus.Architecture = arch
 	newStatus.NetworkData = networkData
 
-	meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+	meta.SetStatusCondition(&newStatus.Conditions, metav1.Condition{
 		Type:               string(metal3.ConditionImageReady),
 		Status:             metav1.ConditionTrue,
 		LastTransitionTime: metav1.Now(),
@@ -188,7 +579,7 @@ func setImage(generation int64, status *metal3.PreprovisioningImageStatus, url s
 		Reason:             string(reasonSuccess),
 		Message:            message,
 	})
-	meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+	meta.SetStatusCondition(&newStatus.Conditions, metav1.Condition{
 		Type:               string(metal3.ConditionImageError),
 		Status:             metav1.ConditionFalse,
 		LastTransitionTime: metav1.Now(),
@@ -197,7 +588,7 @@ func setImage(generation int64, status *metal3.PreprovisioningImageStatus, url s
 		Message:            "",
 	})
 
-	changed := !apiequality.Semantic.DeepEqual(status, &newStatus)
+	changed := !apiequality.Semantic.DeepEqual(status, newStatus)
 	*status = *newStatus
 	return changed
 }
@@ -212,7 +603,7 @@ func setError(ctx context.Context, generation int64, status *metal3.Preprovision
 
 	log.Info("error condition", "reason", reason, "message", message)
 
-	meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+	meta.SetStatusCondition(&newStatus.Conditions, metav1.Condition{
 		Type:               string(metal3.ConditionImageReady),
 		Status:             metav1.ConditionFalse,
 		LastTransitionTime: metav1.Now(),
@@ -220,23 +611,184 @@ func setError(ctx context.Context, generation int64, status *metal3.Preprovision
 		Reason:             string(reason),
 		Message:            "",
 	})
-	meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+	meta.SetStatusCondition(&newStatus.Conditions, metav1.Condition{
 		Type:               string(metal3.ConditionImageError),
-		Status:             metav1.ConditionFalse,
+		Status:             metav1.ConditionTrue,
 		LastTransitionTime: metav1.Now(),
 		ObservedGeneration: generation,
 		Reason:             string(reason),
 		Message:            message,
 	})
 
-	changed := !apiequality.Semantic.DeepEqual(status, &newStatus)
+	changed := !apiequality.Semantic.DeepEqual(status, newStatus)
 	*status = *newStatus
 	return changed
 }
 
+func setPending(generation int64, status *metal3.PreprovisioningImageStatus, message string) bool {
+	newStatus := status.DeepCopy()
+	newStatus.ImageUrl = ""
+	newStatus.Checksum = ""
+	newStatus.ChecksumType = ""
+
+	meta.SetStatusCondition(&newStatus.Conditions, metav1.Condition{
+		Type:               string(metal3.ConditionImageReady),
+		Status:             metav1.ConditionFalse,
+		LastTransitionTime: metav1.Now(),
+		ObservedGeneration: generation,
+		Reason:             string(reasonImageGenerating),
+		Message:            message,
+	})
+	meta.SetStatusCondition(&newStatus.Conditions, metav1.Condition{
+		Type:               string(metal3.ConditionImageError),
+		Status:             metav1.ConditionFalse,
+		LastTransitionTime: metav1.Now(),
+		ObservedGeneration: generation,
+		Reason:             string(reasonImageGenerating),
+		Message:            "",
+	})
+
+	changed := !apiequality.Semantic.DeepEqual(status, newStatus)
+	*status = *newStatus
+	return changed
+}
+
+// imagesForConfigMap maps a change to the additional ignition ConfigMap or
+// the trusted CA bundle to requests for every PreprovisioningImage, since
+// they all embed it.
+func (r *PreprovisioningImageReconciler) imagesForConfigMap(obj client.Object) []reconcile.Request {
+	key := client.ObjectKeyFromObject(obj)
+	if key != r.AdditionalIgnitionConfigMap && !r.isTrustedCAConfigMap(key) {
+		return nil
+	}
+	return r.allImages()
+}
+
+// imagesForClusterSecret maps a change to the cluster-wide SSH key or pull
+// secret to requests for every PreprovisioningImage, since they all embed
+// it.
+func (r *PreprovisioningImageReconciler) imagesForClusterSecret(obj client.Object) []reconcile.Request {
+	key := client.ObjectKeyFromObject(obj)
+	if key != r.PullSecret && key != r.SSHKeySecret {
+		return nil
+	}
+	return r.allImages()
+}
+
+// allImages returns requests for every PreprovisioningImage of the shard.
+func (r *PreprovisioningImageReconciler) allImages() []reconcile.Request {
+	images := metal3.PreprovisioningImageList{}
+	if err := r.List(context.Background(), &images); err != nil {
+		r.Log.Error(err, "unable to list PreprovisioningImages")
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(images.Items))
+	for i := range images.Items {
+		key := client.ObjectKeyFromObject(&images.Items[i])
+		if r.Shard.Owns(key.String()) {
+			requests = append(requests, reconcile.Request{NamespacedName: key})
+		}
+	}
+	return requests
+}
+
 func (r *PreprovisioningImageReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
+	b := ctrl.NewControllerManagedBy(mgr).
 		For(&metal3.PreprovisioningImage{}).
 		Owns(&corev1.Secret{}).
-		Complete(r)
+		WithLogger(r.Log)
+	if r.AdditionalIgnitionConfigMap.Name != "" || r.UseClusterProxy {
+		b = b.Watches(&source.Kind{Type: &corev1.ConfigMap{}},
+			handler.EnqueueRequestsFromMapFunc(r.imagesForConfigMap))
+	}
+	if r.UseClusterProxy {
+		b = b.Watches(&source.Kind{Type: newClusterProxy()},
+			handler.EnqueueRequestsFromMapFunc(r.imagesForClusterProxy))
+	}
+	if r.ProvisionedImageRetention > 0 || r.RemoveDeprovisionedImages {
+		b = b.Watches(&source.Kind{Type: &metal3.BareMetalHost{}},
+			handler.EnqueueRequestsFromMapFunc(r.imagesForHost))
+	} else {
+		// only a change of the stream a host is pinned to, or of its
+		// architecture, affects its images
+		b = b.Watches(&source.Kind{Type: &metal3.BareMetalHost{}},
+			handler.EnqueueRequestsFromMapFunc(r.imagesForHost),
+			builder.WithPredicates(predicate.Or(hostStreamChanged, hostArchChanged)))
+	}
+	reconfigured := make(chan event.GenericEvent)
+	r.reconfigureMu.Lock()
+	r.reconfigured = reconfigured
+	r.reconfigureMu.Unlock()
+	b = b.Watches(&source.Channel{Source: reconfigured}, &handler.EnqueueRequestForObject{})
+	generated := make(chan event.GenericEvent)
+	r.generations = newGenerationWaiter(generated)
+	b = b.Watches(&source.Channel{Source: generated}, &handler.EnqueueRequestForObject{})
+	if r.PullSecret.Name != "" || r.SSHKeySecret.Name != "" {
+		b = b.Watches(&source.Kind{Type: &corev1.Secret{}},
+			handler.EnqueueRequestsFromMapFunc(r.imagesForClusterSecret))
+	}
+	if r.DryRun {
+		r.recorder = mgr.GetEventRecorderFor("image-customization-controller")
+	}
+	if r.PrewarmImages && !r.DryRun {
+		if err := mgr.Add(&imagePrewarmer{reconciler: r}); err != nil {
+			return err
+		}
+	}
+	if r.SweepStatus && !r.DryRun {
+		if err := mgr.Add(&statusSweeper{reconciler: r}); err != nil {
+			return err
+		}
+	}
+	if err := metrics.Registry.Register(&imageHealthCollector{
+		client:         mgr.GetClient(),
+		shard:          r.Shard,
+		staleThreshold: r.ErrorStaleThreshold,
+		log:            r.Log.WithName("metrics"),
+	}); err != nil {
+		return err
+	}
+	downloads := make(chan event.GenericEvent)
+	watcher := &downloadWatcher{
+		client:   mgr.GetClient(),
+		server:   r.ImageFileServer,
+		imageFor: r.imageForName,
+		annotate: r.DownloadAnnotations,
+		events:   downloads,
+		log:      r.Log.WithName("DownloadWatcher"),
+	}
+	if r.DownloadEvents {
+		watcher.recorder = mgr.GetEventRecorderFor("image-customization-controller")
+	}
+	if err := mgr.Add(watcher); err != nil {
+		return err
+	}
+	b = b.Watches(&source.Channel{Source: downloads}, &handler.EnqueueRequestForObject{})
+	if r.ImageGCInterval > 0 && !r.DryRun {
+		if err := mgr.Add(&imageCollector{
+			client:    mgr.GetClient(),
+			server:    r.ImageFileServer,
+			imageName: r.imageNameFor,
+			interval:  r.ImageGCInterval,
+			log:       r.Log.WithName("ImageCollector"),
+		}); err != nil {
+			return err
+		}
+	}
+	if r.BaseImagePollInterval > 0 || r.BaseImageChanges != nil {
+		events := make(chan event.GenericEvent)
+		if err := mgr.Add(&baseImageWatcher{
+			client:   mgr.GetClient(),
+			server:   r.ImageFileServer,
+			shard:    r.Shard,
+			interval: r.BaseImagePollInterval,
+			changes:  r.BaseImageChanges,
+			events:   events,
+			log:      r.Log.WithName("BaseImageWatcher"),
+		}); err != nil {
+			return err
+		}
+		b = b.Watches(&source.Channel{Source: events}, &handler.EnqueueRequestForObject{})
+	}
+	return b.Complete(r)
 }
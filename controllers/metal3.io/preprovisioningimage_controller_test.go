@@ -0,0 +1,546 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	"github.com/asalkeld/image-customization-controller/pkg/ignition"
+	"github.com/asalkeld/image-customization-controller/pkg/imagehandler"
+	"github.com/asalkeld/image-customization-controller/pkg/imagehandler/fake"
+	metal3 "github.com/metal3-io/baremetal-operator/apis/metal3.io/v1alpha1"
+	"github.com/metal3-io/baremetal-operator/pkg/secretutils"
+)
+
+const testNamespace = "test-namespace"
+
+// newTestReconciler returns a reconciler reading the objects from a fake
+// cluster and registering images with a fake image server.
+func newTestReconciler(t *testing.T, objects ...client.Object) (*PreprovisioningImageReconciler, *fake.Server) {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := metal3.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fakeclient.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build()
+	server := fake.New()
+	return &PreprovisioningImageReconciler{
+		Client:          c,
+		APIReader:       c,
+		Scheme:          scheme,
+		Log:             zap.New(zap.UseDevMode(true)),
+		ImageFileServer: server,
+		ImageExtension:  ".iso",
+	}, server
+}
+
+// testImageName is the name the image of a PreprovisioningImage in the
+// test namespace is registered under.
+func testImageName(name string) string {
+	return testNamespace + "_" + name + ".iso"
+}
+
+func newTestImage(name string) *metal3.PreprovisioningImage {
+	return &metal3.PreprovisioningImage{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: name, UID: types.UID(name + "-uid")},
+	}
+}
+
+// newTestNetworkData returns a PreprovisioningImage referencing a network
+// data Secret, and the Secret.
+func newTestNetworkData(name string) (*metal3.PreprovisioningImage, *corev1.Secret) {
+	img := newTestImage(name)
+	img.Spec.NetworkDataName = name + "-network"
+	key := types.NamespacedName{Namespace: testNamespace, Name: img.Spec.NetworkDataName}
+	return img, newTestSecret(key, map[string][]byte{"nmstate": []byte(testNMState)})
+}
+
+// newTestUserIgnition returns an image annotated with an ignition Secret
+// holding data, and the Secret.
+func newTestUserIgnition(name string, data map[string][]byte) (*metal3.PreprovisioningImage, *corev1.Secret) {
+	img := newTestImage(name)
+	img.Annotations = map[string]string{userIgnitionSecretAnnotation: name + "-ignition"}
+	key := types.NamespacedName{Namespace: testNamespace, Name: name + "-ignition"}
+	return img, newTestSecret(key, data)
+}
+
+// newTestSecret returns a Secret holding data.
+func newTestSecret(key types.NamespacedName, data map[string][]byte) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name},
+		Data:       data,
+	}
+}
+
+func newTestHost(name string) *metal3.BareMetalHost {
+	return &metal3.BareMetalHost{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: name, UID: types.UID(name + "-uid")},
+	}
+}
+
+// newTestHostImage returns the PreprovisioningImage of a BareMetalHost.
+func newTestHostImage(host *metal3.BareMetalHost) *metal3.PreprovisioningImage {
+	img := newTestImage(host.Name)
+	img.OwnerReferences = []metav1.OwnerReference{{
+		APIVersion: metal3.GroupVersion.String(),
+		Kind:       "BareMetalHost",
+		Name:       host.Name,
+		UID:        host.UID,
+	}}
+	return img
+}
+
+// newTestClusterProxy returns the cluster Proxy, referencing a trusted CA
+// bundle if caName is set.
+func newTestClusterProxy(caName string) *unstructured.Unstructured {
+	proxy := newClusterProxy()
+	proxy.SetName(clusterProxyName)
+	proxy.Object["status"] = map[string]interface{}{
+		"httpProxy":  "http://proxy.example.com:3128",
+		"httpsProxy": "http://proxy.example.com:3128",
+		"noProxy":    ".cluster.local,10.0.0.0/16",
+	}
+	if caName != "" {
+		proxy.Object["spec"] = map[string]interface{}{
+			"trustedCA": map[string]interface{}{"name": caName},
+		}
+	}
+	return proxy
+}
+
+// reconcileImage reconciles a PreprovisioningImage, failing the test on an
+// error, and returns it as updated.
+func reconcileImage(t *testing.T, r *PreprovisioningImageReconciler, name string) (ctrl.Result, *metal3.PreprovisioningImage) {
+	t.Helper()
+	key := types.NamespacedName{Namespace: testNamespace, Name: name}
+	result, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: key})
+	if err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	img := &metal3.PreprovisioningImage{}
+	if err := r.Get(context.Background(), key, img); err != nil {
+		t.Fatal(err)
+	}
+	return result, img
+}
+
+func assertReady(t *testing.T, img *metal3.PreprovisioningImage) {
+	t.Helper()
+	cond := meta.FindStatusCondition(img.Status.Conditions, string(metal3.ConditionImageReady))
+	if cond == nil || cond.Status != metav1.ConditionTrue {
+		t.Fatalf("image is not ready: %+v", img.Status.Conditions)
+	}
+}
+
+func assertError(t *testing.T, img *metal3.PreprovisioningImage, reason conditionReason) {
+	t.Helper()
+	cond := meta.FindStatusCondition(img.Status.Conditions, string(metal3.ConditionImageError))
+	if cond == nil || cond.Status != metav1.ConditionTrue || cond.Reason != string(reason) {
+		t.Fatalf("image is not in error with reason %s: %+v", reason, img.Status.Conditions)
+	}
+}
+
+// assertWatched checks that a Secret was labelled to be watched, without
+// being given an owner.
+func assertWatched(t *testing.T, r *PreprovisioningImageReconciler, key types.NamespacedName) {
+	t.Helper()
+	secret := &corev1.Secret{}
+	if err := r.Get(context.Background(), key, secret); err != nil {
+		t.Fatal(err)
+	}
+	if secret.Labels[secretutils.LabelEnvironmentName] != secretutils.LabelEnvironmentValue {
+		t.Errorf("Secret %s is not labelled to be watched", key)
+	}
+	if len(secret.OwnerReferences) != 0 {
+		t.Errorf("cluster-wide Secret %s was given owners %v", key, secret.OwnerReferences)
+	}
+}
+
+// assertOwned checks that a Secret of a PreprovisioningImage is owned by
+// it.
+func assertOwned(t *testing.T, r *PreprovisioningImageReconciler, key types.NamespacedName, img *metal3.PreprovisioningImage) {
+	t.Helper()
+	secret := &corev1.Secret{}
+	if err := r.Get(context.Background(), key, secret); err != nil {
+		t.Fatal(err)
+	}
+	if len(secret.OwnerReferences) != 1 || secret.OwnerReferences[0].UID != img.UID {
+		t.Errorf("Secret %s of the image is not owned by it: %v", key, secret.OwnerReferences)
+	}
+}
+
+// ignitionFile returns the contents of a file of an image's ignition config,
+// and whether it has the file at all.
+func ignitionFile(t *testing.T, content []byte, path string) (string, bool) {
+	t.Helper()
+	config, err := ignition.Parse(content)
+	if err != nil {
+		t.Fatalf("invalid ignition %s: %v", content, err)
+	}
+	for _, file := range config.Storage.Files {
+		if file.Path != path {
+			continue
+		}
+		if file.Contents.Source == nil {
+			return "", true
+		}
+		data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(*file.Contents.Source, "data:;base64,"))
+		if err != nil {
+			t.Fatalf("unexpected source of %s: %v", path, err)
+		}
+		return string(data), true
+	}
+	return "", false
+}
+
+func TestReconcileSSHKeySecret(t *testing.T) {
+	secretKey := types.NamespacedName{Namespace: "openshift-machine-api", Name: "ssh-keys"}
+	r, server := newTestReconciler(t, newTestImage("host-0"), newTestSecret(secretKey, map[string][]byte{
+		sshKeysKey: []byte("# admin\nssh-ed25519 AAAAC3Nza admin@example.com\n"),
+	}))
+	r.SSHKeySecret = secretKey
+
+	_, img := reconcileImage(t, r, "host-0")
+	assertReady(t, img)
+	spec := server.AssertImage(t, testImageName("host-0"))
+	if !strings.Contains(string(spec.Ignition), "ssh-ed25519 AAAAC3Nza admin@example.com") {
+		t.Errorf("SSH key not in ignition %s", spec.Ignition)
+	}
+	assertWatched(t, r, secretKey)
+}
+
+func TestReconcilePullSecret(t *testing.T) {
+	secretKey := types.NamespacedName{Namespace: "openshift-config", Name: "pull-secret"}
+	pullSecret := newTestSecret(secretKey, map[string][]byte{
+		corev1.DockerConfigJsonKey: []byte(`{"auths":{"registry.example.com":{"auth":"dXNlcjpwYXNz"}}}`),
+	})
+	pullSecret.Type = corev1.SecretTypeDockerConfigJson
+	r, server := newTestReconciler(t, newTestImage("host-0"), pullSecret)
+	r.PullSecret = secretKey
+
+	_, img := reconcileImage(t, r, "host-0")
+	assertReady(t, img)
+	spec := server.AssertImage(t, testImageName("host-0"))
+	if !strings.Contains(string(spec.Ignition), "/root/.docker/config.json") {
+		t.Errorf("pull secret not in ignition %s", spec.Ignition)
+	}
+	assertWatched(t, r, secretKey)
+}
+
+func TestReconcileDoesNotLogURL(t *testing.T) {
+	img, secret := newTestNetworkData("host-0")
+	r, _ := newTestReconciler(t, img, secret)
+
+	var out bytes.Buffer
+	ctx := ctrl.LoggerInto(context.Background(), zap.New(zap.WriteTo(&out)))
+	key := types.NamespacedName{Namespace: testNamespace, Name: "host-0"}
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Get(context.Background(), key, img); err != nil {
+		t.Fatal(err)
+	}
+	assertReady(t, img)
+	if !strings.Contains(out.String(), "image available") {
+		t.Fatalf("image available was not logged: %s", out.String())
+	}
+	if strings.Contains(out.String(), img.Status.ImageUrl) {
+		t.Errorf("image URL %s was logged: %s", img.Status.ImageUrl, out.String())
+	}
+}
+
+// countingClient counts the listings of a client.
+type countingClient struct {
+	client.Client
+	lists int
+}
+
+func (c *countingClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	c.lists++
+	return c.Client.List(ctx, list, opts...)
+}
+
+func TestDownloadFindsImageByName(t *testing.T) {
+	r, _ := newTestReconciler(t, newTestImage("host-0"), newTestImage("host-1"))
+	counting := &countingClient{Client: r.Client}
+	r.Client = counting
+	reconcileImage(t, r, "host-0")
+
+	recorder := record.NewFakeRecorder(3)
+	events := make(chan event.GenericEvent, 1)
+	watcher := &downloadWatcher{
+		client:   r.Client,
+		imageFor: r.imageForName,
+		recorder: recorder,
+		annotate: true,
+		events:   events,
+		log:      r.Log,
+	}
+	download := imagehandler.Download{Name: testImageName("host-0"), RemoteAddr: "192.0.2.1", Time: time.Now(), Complete: true}
+	lists := counting.lists
+	watcher.handle(context.Background(), download)
+	if counting.lists != lists {
+		t.Errorf("expected the image to be found without a listing")
+	}
+	if e := <-events; e.Object.GetName() != "host-0" {
+		t.Errorf("unexpected reconcile of %s", e.Object.GetName())
+	}
+	if e := <-recorder.Events; !strings.Contains(e, "Image downloaded by 192.0.2.1") {
+		t.Errorf("unexpected event %q", e)
+	}
+	img := &metal3.PreprovisioningImage{}
+	if err := r.Get(context.Background(), types.NamespacedName{Namespace: testNamespace, Name: "host-0"}, img); err != nil {
+		t.Fatal(err)
+	}
+	if img.Annotations[lastDownloadClientAnnotation] != "192.0.2.1" {
+		t.Errorf("download not annotated: %v", img.Annotations)
+	}
+
+	// one not reconciled yet is found by a listing, once
+	download.Name = testImageName("host-1")
+	for i := 0; i < 2; i++ {
+		watcher.handle(context.Background(), download)
+		if e := <-events; e.Object.GetName() != "host-1" {
+			t.Errorf("unexpected reconcile of %s", e.Object.GetName())
+		}
+		<-recorder.Events
+	}
+	if counting.lists != lists+1 {
+		t.Errorf("expected a single listing, got %d", counting.lists-lists)
+	}
+}
+
+func TestReconcileUnknownBaseImage(t *testing.T) {
+	img := newTestImage("host-0")
+	img.Labels = map[string]string{baseImageLabel: "typo"}
+	r, server := newTestReconciler(t, img)
+	server.FailRegistrations(fmt.Errorf("%w %q", imagehandler.ErrUnknownBaseImage, "typo"))
+
+	result, img := reconcileImage(t, r, "host-0")
+	assertError(t, img, reasonUnknownBaseImage)
+	if result.Requeue || result.RequeueAfter != 0 {
+		t.Errorf("expected no retry of an unknown base image, got %+v", result)
+	}
+}
+
+func TestReconcileDetectedArch(t *testing.T) {
+	host := newTestHost("host-0")
+	r, server := newTestReconciler(t, host, newTestHostImage(host))
+
+	_, img := reconcileImage(t, r, "host-0")
+	assertReady(t, img)
+	if spec := server.AssertImage(t, testImageName("host-0")); spec.Base.Arch != "" {
+		t.Fatalf("unexpected architecture %q before inspection", spec.Base.Arch)
+	}
+
+	inspected := host.DeepCopy()
+	inspected.Status.HardwareDetails = &metal3.HardwareDetails{CPU: metal3.CPU{Arch: "aarch64"}}
+	if !hostArchChanged.Update(event.UpdateEvent{ObjectOld: host, ObjectNew: inspected}) {
+		t.Fatal("expected the detected architecture to reconcile the image")
+	}
+	if requests := r.imagesForHost(inspected); len(requests) != 1 || requests[0].Name != "host-0" {
+		t.Fatalf("unexpected requests %v for the host", requests)
+	}
+	if err := r.Update(context.Background(), inspected); err != nil {
+		t.Fatal(err)
+	}
+	_, img = reconcileImage(t, r, "host-0")
+	assertReady(t, img)
+	if spec := server.AssertImage(t, testImageName("host-0")); spec.Base.Arch != "aarch64" {
+		t.Errorf("expected the image to be built for the detected architecture, got %q", spec.Base.Arch)
+	}
+	if img.Status.Architecture != "aarch64" {
+		t.Errorf("unexpected architecture %q in status", img.Status.Architecture)
+	}
+
+	relabelled := inspected.DeepCopy()
+	relabelled.Labels = map[string]string{archLabel: "amd64"}
+	if hostArchChanged.Update(event.UpdateEvent{ObjectOld: inspected, ObjectNew: relabelled}) {
+		t.Error("expected the label to be overridden by the detected architecture")
+	}
+}
+
+func TestReconfigureStopsWithContext(t *testing.T) {
+	r, _ := newTestReconciler(t, newTestImage("host-0"), newTestImage("host-1"))
+	events := make(chan event.GenericEvent)
+	r.reconfigured = events
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.Reconfigure(ctx, Settings{})
+	select {
+	case <-events:
+	case <-time.After(time.Second):
+		t.Fatal("expected the images to be reconciled again")
+	}
+	// e.g. the manager is stopping and the controller no longer consumes
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case ev := <-events:
+		t.Errorf("unexpected event for %s after the context was done", ev.Object.GetName())
+	default:
+	}
+}
+
+func TestRequeueAll(t *testing.T) {
+	r, _ := newTestReconciler(t, newTestImage("host-0"), newTestImage("host-1"))
+	events := make(chan event.GenericEvent)
+	r.reconfigured = events
+
+	r.RequeueAll(context.Background())
+	requeued := map[string]bool{}
+	for len(requeued) < 2 {
+		select {
+		case ev := <-events:
+			requeued[ev.Object.GetName()] = true
+		case <-time.After(time.Second):
+			t.Fatalf("expected every image to be reconciled again, got %v", requeued)
+		}
+	}
+}
+
+func TestImageNameTemplate(t *testing.T) {
+	for _, text := range []string{"{{.Name}}.iso", "{{.Namespace}}.iso", "image.iso", "{{.Name}}/{{.Namespace}}"} {
+		if _, err := ParseImageNameTemplate(text); err == nil {
+			t.Errorf("expected %q to be rejected", text)
+		}
+	}
+	tmpl, err := ParseImageNameTemplate("{{.Namespace}}_{{.Name}}-{{.Revision}}{{.Extension}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ := newTestReconciler(t)
+	img := newTestImage("host-0")
+	other := img.DeepCopy()
+	other.Namespace = "other-namespace"
+	if r.imageNameFor(img) == r.imageNameFor(other) {
+		t.Errorf("images of the same name in different namespaces share the name %s", r.imageNameFor(img))
+	}
+	r.ImageNameTemplate = tmpl
+	img.Generation = 2
+	if name := r.imageNameFor(img); name != testNamespace+"_host-0-2.iso" {
+		t.Errorf("unexpected image name %s", name)
+	}
+}
+
+func TestIgnitionFor(t *testing.T) {
+	r, server := newTestReconciler(t, newTestImage("host-0"))
+	counting := &countingClient{Client: r.Client}
+	r.Client = counting
+	reconcileImage(t, r, "host-0")
+
+	lists := counting.lists
+	content, err := r.IgnitionFor(context.Background(), testImageName("host-0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec := server.AssertImage(t, testImageName("host-0")); string(content) != string(spec.Ignition) {
+		t.Errorf("rebuilt ignition %s differs from the registered %s", content, spec.Ignition)
+	}
+	if counting.lists != lists {
+		t.Errorf("expected the image to be found without a listing")
+	}
+	if _, err := r.IgnitionFor(context.Background(), "other.iso"); !errors.Is(err, imagehandler.ErrImageNotFound) {
+		t.Errorf("expected an unknown image to be reported, got %v", err)
+	}
+}
+
+func TestReconcileExtraFileSecrets(t *testing.T) {
+	clusterKey := types.NamespacedName{Namespace: "openshift-config", Name: "trust"}
+	imageKey := types.NamespacedName{Namespace: testNamespace, Name: "udev"}
+	img := newTestImage("host-0")
+	img.Annotations = map[string]string{
+		extraFilesAnnotation: `[{"path":"/etc/udev/rules.d/70-nic.rules","secret":"udev","key":"rules"}]`,
+	}
+	r, server := newTestReconciler(t, img,
+		newTestSecret(clusterKey, map[string][]byte{"ca.crt": []byte("cluster CA")}),
+		newTestSecret(imageKey, map[string][]byte{"rules": []byte("udev rules")}))
+	r.settings.ExtraFiles = []ExtraFile{
+		{Path: "/etc/pki/ca-trust/source/anchors/cluster.crt", Secret: clusterKey.Name, Namespace: clusterKey.Namespace, Key: "ca.crt"},
+	}
+
+	_, img = reconcileImage(t, r, "host-0")
+	assertReady(t, img)
+	spec := server.AssertImage(t, testImageName("host-0"))
+	for _, path := range []string{"/etc/pki/ca-trust/source/anchors/cluster.crt", "/etc/udev/rules.d/70-nic.rules"} {
+		if !strings.Contains(string(spec.Ignition), path) {
+			t.Errorf("%s not in ignition %s", path, spec.Ignition)
+		}
+	}
+	assertWatched(t, r, clusterKey)
+	assertOwned(t, r, imageKey, img)
+}
+
+func TestReconcileGenerationBackoff(t *testing.T) {
+	r, server := newTestReconciler(t, newTestImage("host-0"))
+	r.settings.RetryDelays = RetryDelays{
+		MinError:           100 * time.Millisecond,
+		MaxError:           time.Second,
+		Pending:            time.Second,
+		GenerationAttempts: 2,
+	}
+	server.HoldGeneration(true)
+	failGeneration := func() {
+		t.Helper()
+		if result, _ := reconcileImage(t, r, "host-0"); result.RequeueAfter != time.Second {
+			t.Fatalf("expected the image to be pending, got %+v", result)
+		}
+		if !server.FinishGeneration(testImageName("host-0"), errors.New("no space left on device")) {
+			t.Fatal("image not generating")
+		}
+	}
+
+	failGeneration()
+	result, img := reconcileImage(t, r, "host-0")
+	assertError(t, img, reasonGenerationFailed)
+	if result.RequeueAfter <= 0 || result.RequeueAfter > 100*time.Millisecond {
+		t.Errorf("expected a retry after the minimum delay, got %+v", result)
+	}
+	server.AssertNoImage(t, testImageName("host-0"))
+
+	// the update of the status reconciles it again before the delay
+	result, img = reconcileImage(t, r, "host-0")
+	assertError(t, img, reasonGenerationFailed)
+	if result.RequeueAfter <= 0 {
+		t.Errorf("expected the retry to still be delayed, got %+v", result)
+	}
+	server.AssertNoImage(t, testImageName("host-0"))
+
+	time.Sleep(100 * time.Millisecond)
+	failGeneration()
+	result, img = reconcileImage(t, r, "host-0")
+	assertError(t, img, reasonGenerationAttemptsExhausted)
+	if result.RequeueAfter != 0 {
+		t.Errorf("expected no retry once the attempts are exhausted, got %+v", result)
+	}
+
+	result, img = reconcileImage(t, r, "host-0")
+	assertError(t, img, reasonGenerationAttemptsExhausted)
+	if result.RequeueAfter != 0 {
+		t.Errorf("expected no retry once the attempts are exhausted, got %+v", result)
+	}
+	server.AssertNoImage(t, testImageName("host-0"))
+}
@@ -0,0 +1,68 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	metal3 "github.com/metal3-io/baremetal-operator/apis/metal3.io/v1alpha1"
+)
+
+// imagePrewarmer registers the images of all PreprovisioningImages that were
+// already Ready when the controller started, so that their generation is
+// queued straight away and previously published URLs become downloadable
+// again as soon as possible.
+type imagePrewarmer struct {
+	reconciler *PreprovisioningImageReconciler
+}
+
+func (p *imagePrewarmer) Start(ctx context.Context) error {
+	log := p.reconciler.Log.WithName("prewarm")
+
+	images := metal3.PreprovisioningImageList{}
+	if err := p.reconciler.List(ctx, &images); err != nil {
+		log.Error(err, "unable to list PreprovisioningImages")
+		return nil
+	}
+
+	count := 0
+	for i := range images.Items {
+		img := images.Items[i].DeepCopy()
+		if !p.reconciler.Shard.Owns(client.ObjectKeyFromObject(img).String()) {
+			continue
+		}
+		if !meta.IsStatusConditionTrue(img.Status.Conditions, string(metal3.ConditionImageReady)) {
+			continue
+		}
+		imgLog := log.WithValues("preprovisioningimage", img.Namespace+"/"+img.Name)
+		// The status is discarded; the controller updates it when it
+		// reconciles the image itself.
+		_, err := p.reconciler.reconcile(ctrl.LoggerInto(ctx, imgLog), img)
+		if err != nil && !errors.Is(err, errImagePending) {
+			imgLog.Error(err, "unable to pre-generate image")
+			continue
+		}
+		count++
+	}
+	log.Info("queued existing images for generation", "count", count)
+	return nil
+}
@@ -0,0 +1,136 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	metal3 "github.com/metal3-io/baremetal-operator/apis/metal3.io/v1alpha1"
+)
+
+// RetryDelays are the delays before reconciling an image again.
+type RetryDelays struct {
+	// MinError and MaxError bound the growing delay before retrying an
+	// image in error.
+	MinError time.Duration
+	MaxError time.Duration
+	// Pending is the delay before checking on an image being generated.
+	Pending time.Duration
+	// GenerationAttempts is how many times generating an image is tried,
+	// with a doubling delay from MinError, before its failure is final.
+	GenerationAttempts int
+}
+
+// DefaultRetryDelays are used until the reconciler is reconfigured.
+var DefaultRetryDelays = RetryDelays{
+	MinError: 10 * time.Second,
+	MaxError: 10 * time.Minute,
+	Pending:  5 * time.Second,
+
+	GenerationAttempts: 6,
+}
+
+// Settings are the options of the reconciler that can be changed while it is
+// running.
+type Settings struct {
+	RetryDelays RetryDelays
+	// Streams are the image streams PreprovisioningImages can select with
+	// the stream annotation, by name.
+	Streams map[string]ImageStream
+	// ExtraFiles are written to the live filesystem of every image.
+	ExtraFiles []ExtraFile
+}
+
+// retryDelays returns the current retry delays.
+func (r *PreprovisioningImageReconciler) retryDelays() RetryDelays {
+	r.reconfigureMu.Lock()
+	defer r.reconfigureMu.Unlock()
+	if r.settings.RetryDelays == (RetryDelays{}) {
+		return DefaultRetryDelays
+	}
+	return r.settings.RetryDelays
+}
+
+// imageStream returns the current configuration of a stream.
+func (r *PreprovisioningImageReconciler) imageStream(name string) (ImageStream, bool) {
+	r.reconfigureMu.Lock()
+	defer r.reconfigureMu.Unlock()
+	stream, ok := r.settings.Streams[name]
+	return stream, ok
+}
+
+// extraFiles returns the current cluster-wide extra files.
+func (r *PreprovisioningImageReconciler) extraFiles() []ExtraFile {
+	r.reconfigureMu.Lock()
+	defer r.reconfigureMu.Unlock()
+	return r.settings.ExtraFiles
+}
+
+// Reconfigure applies new settings and reconciles every
+// PreprovisioningImage, so that changes to the image server's settings are
+// reflected in their status. Reconciling the images for any previous
+// settings is abandoned, as is reconciling them at all once ctx is done.
+func (r *PreprovisioningImageReconciler) Reconfigure(ctx context.Context, settings Settings) {
+	r.reconfigureMu.Lock()
+	defer r.reconfigureMu.Unlock()
+	r.settings = settings
+	r.requeueAllLocked(ctx)
+}
+
+// RequeueAll reconciles every PreprovisioningImage again, e.g. once the
+// image server's URL has changed, so that they are registered again for
+// their new URLs. Reconciling them for an earlier call or reconfiguration
+// is abandoned, as is reconciling them at all once ctx is done. It does
+// not block.
+func (r *PreprovisioningImageReconciler) RequeueAll(ctx context.Context) {
+	r.reconfigureMu.Lock()
+	defer r.reconfigureMu.Unlock()
+	r.requeueAllLocked(ctx)
+}
+
+func (r *PreprovisioningImageReconciler) requeueAllLocked(ctx context.Context) {
+	if r.cancelRequeue != nil {
+		r.cancelRequeue()
+		r.cancelRequeue = nil
+	}
+	events := r.reconfigured
+	if events == nil {
+		return
+	}
+
+	// the controller may not have started yet, so don't block the caller
+	ctx, cancel := context.WithCancel(ctx)
+	r.cancelRequeue = cancel
+	go func() {
+		defer cancel()
+		images := metal3.PreprovisioningImageList{}
+		if err := r.List(ctx, &images); err != nil {
+			r.Log.Error(err, "unable to list PreprovisioningImages")
+			return
+		}
+		for i := range images.Items {
+			select {
+			case events <- event.GenericEvent{Object: &images.Items[i]}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
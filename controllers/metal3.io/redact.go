@@ -0,0 +1,40 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+)
+
+// redactedError is an error about the content of a Secret or ConfigMap. Its
+// message only names the object and key, since the content may hold
+// credentials and the message ends up in logs and status conditions. The
+// underlying error is kept for errors.Is/As but is not part of the message.
+type redactedError struct {
+	message string
+	cause   error
+}
+
+func (e *redactedError) Error() string { return e.message }
+func (e *redactedError) Unwrap() error { return e.cause }
+
+func redactError(cause error, format string, args ...interface{}) error {
+	return &redactedError{
+		message: fmt.Sprintf(format, args...),
+		cause:   cause,
+	}
+}
@@ -0,0 +1,88 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/asalkeld/image-customization-controller/pkg/imagehandler"
+	metal3 "github.com/metal3-io/baremetal-operator/apis/metal3.io/v1alpha1"
+)
+
+// conditionError is a failure to build an image, with the reason and
+// message reported in the PreprovisioningImage's error condition.
+type conditionError struct {
+	reason  conditionReason
+	message string
+	cause   error
+}
+
+func newConditionError(reason conditionReason, message string, cause error) *conditionError {
+	return &conditionError{reason: reason, message: message, cause: cause}
+}
+
+func (e *conditionError) Error() string {
+	return fmt.Sprintf("%s: %s", e.reason, e.message)
+}
+
+func (e *conditionError) Unwrap() error {
+	return e.cause
+}
+
+// IgnitionFor rebuilds the ignition content of the image registered under a
+// name, for an image server that has evicted it from memory. It returns
+// imagehandler.ErrImageNotFound if no PreprovisioningImage has an image of
+// that name.
+func (r *PreprovisioningImageReconciler) IgnitionFor(ctx context.Context, name string) ([]byte, error) {
+	img, err := r.imageForName(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if img == nil {
+		return nil, imagehandler.ErrImageNotFound
+	}
+	ctx = ctrl.LoggerInto(ctx, r.Log.WithValues("preprovisioningimage", img.Namespace+"/"+img.Name))
+	arch, err := r.imageArchitecture(ctx, img)
+	if err != nil {
+		return nil, fmt.Errorf("rebuilding image %s: %w", name, err)
+	}
+	_, content, condErr := r.customizeImage(ctx, img, arch)
+	if condErr != nil {
+		return nil, fmt.Errorf("rebuilding image %s: %w", name, condErr.cause)
+	}
+	return content, nil
+}
+
+// ImageSpecFor returns the image the reconciler would register for a
+// PreprovisioningImage, without registering it, reading the Secrets and
+// ConfigMaps it references through the reconciler's clients. An error from
+// the customization pipeline is reported with the reason the image's error
+// condition would be given.
+func (r *PreprovisioningImageReconciler) ImageSpecFor(ctx context.Context, img *metal3.PreprovisioningImage) (imagehandler.ImageSpec, error) {
+	arch, err := r.imageArchitecture(ctx, img)
+	if err != nil {
+		return imagehandler.ImageSpec{}, err
+	}
+	customization, content, condErr := r.customizeImage(ctx, img, arch)
+	if condErr != nil {
+		return imagehandler.ImageSpec{}, condErr
+	}
+	return customization.imageSpec(r.imageNameFor(img), content), nil
+}
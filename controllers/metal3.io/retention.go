@@ -0,0 +1,154 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/asalkeld/image-customization-controller/pkg/imagehandler"
+	metal3 "github.com/metal3-io/baremetal-operator/apis/metal3.io/v1alpha1"
+)
+
+const (
+	// reasonHostProvisioned is the reason an image is not Ready once it
+	// has been retired because its host is provisioned.
+	reasonHostProvisioned conditionReason = "HostProvisioned"
+	// reasonHostDeprovisioned is the reason an image is not Ready once it
+	// has been retired because its host was deprovisioned or deleted.
+	reasonHostDeprovisioned conditionReason = "HostDeprovisioned"
+)
+
+// imageRetirement is why the image of a PreprovisioningImage is no longer
+// needed.
+type imageRetirement struct {
+	reason  conditionReason
+	message string
+}
+
+// retirement returns why the image of a PreprovisioningImage is due to be
+// retired, if it is, or else how long until it will be. Hosts whose
+// provisioning time is unknown, e.g. externally provisioned ones, are
+// treated as having been provisioned long ago.
+func (r *PreprovisioningImageReconciler) retirement(ctx context.Context, img *metal3.PreprovisioningImage) (*imageRetirement, time.Duration, error) {
+	if r.ProvisionedImageRetention <= 0 && !r.RemoveDeprovisionedImages {
+		return nil, 0, nil
+	}
+	name := owningHostName(img)
+	if name == "" {
+		return nil, 0, nil
+	}
+	host := &metal3.BareMetalHost{}
+	err := r.Get(ctx, client.ObjectKey{Namespace: img.Namespace, Name: name}, host)
+	if k8serrors.IsNotFound(err) {
+		if r.RemoveDeprovisionedImages {
+			return &imageRetirement{reasonHostDeprovisioned, "Image removed since the host was deleted"}, 0, nil
+		}
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch host.Status.Provisioning.State {
+	case metal3.StateProvisioned, metal3.StateExternallyProvisioned:
+		if r.ProvisionedImageRetention <= 0 {
+			return nil, 0, nil
+		}
+		provisioned := host.Status.OperationHistory.Provision.End
+		remaining := time.Until(provisioned.Add(r.ProvisionedImageRetention))
+		if !provisioned.IsZero() && remaining > 0 {
+			return nil, remaining, nil
+		}
+		return &imageRetirement{reasonHostProvisioned, "Image removed since the host is provisioned"}, 0, nil
+	case metal3.StateAvailable, metal3.StateReady:
+		if !r.RemoveDeprovisionedImages || host.Status.OperationHistory.Deprovision.End.IsZero() {
+			return nil, 0, nil
+		}
+		return &imageRetirement{reasonHostDeprovisioned, "Image removed since the host was deprovisioned"}, 0, nil
+	}
+	if !host.DeletionTimestamp.IsZero() && r.RemoveDeprovisionedImages {
+		return &imageRetirement{reasonHostDeprovisioned, "Image removed since the host is being deleted"}, 0, nil
+	}
+	return nil, 0, nil
+}
+
+// retire unregisters the image of a PreprovisioningImage whose host no
+// longer needs it, deleting its generated copies and withdrawing its URL. It
+// is registered again by the next reconcile once the host needs it again.
+func (r *PreprovisioningImageReconciler) retire(ctx context.Context, img *metal3.PreprovisioningImage, retirement *imageRetirement) (bool, error) {
+	err := r.ImageFileServer.RemoveImage(ctx, r.imageNameFor(img))
+	if err != nil && !errors.Is(err, imagehandler.ErrImageNotFound) {
+		return false, err
+	}
+	return setRetired(img.GetGeneration(), &img.Status, retirement.reason, retirement.message), nil
+}
+
+func setRetired(generation int64, status *metal3.PreprovisioningImageStatus, reason conditionReason, message string) bool {
+	newStatus := status.DeepCopy()
+	newStatus.ImageUrl = ""
+	newStatus.Checksum = ""
+	newStatus.ChecksumType = ""
+
+	meta.SetStatusCondition(&newStatus.Conditions, metav1.Condition{
+		Type:               string(metal3.ConditionImageReady),
+		Status:             metav1.ConditionFalse,
+		LastTransitionTime: metav1.Now(),
+		ObservedGeneration: generation,
+		Reason:             string(reason),
+		Message:            message,
+	})
+	meta.SetStatusCondition(&newStatus.Conditions, metav1.Condition{
+		Type:               string(metal3.ConditionImageError),
+		Status:             metav1.ConditionFalse,
+		LastTransitionTime: metav1.Now(),
+		ObservedGeneration: generation,
+		Reason:             string(reason),
+		Message:            "",
+	})
+
+	changed := !apiequality.Semantic.DeepEqual(status, newStatus)
+	*status = *newStatus
+	return changed
+}
+
+// imagesForHost maps a change to a BareMetalHost to requests for the
+// PreprovisioningImages it owns.
+func (r *PreprovisioningImageReconciler) imagesForHost(obj client.Object) []reconcile.Request {
+	images := metal3.PreprovisioningImageList{}
+	if err := r.List(context.Background(), &images, client.InNamespace(obj.GetNamespace())); err != nil {
+		r.Log.Error(err, "unable to list PreprovisioningImages")
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for i := range images.Items {
+		img := &images.Items[i]
+		key := client.ObjectKeyFromObject(img)
+		if r.Shard.Owns(key.String()) && owningHostName(img) == obj.GetName() {
+			requests = append(requests, reconcile.Request{NamespacedName: key})
+		}
+	}
+	return requests
+}
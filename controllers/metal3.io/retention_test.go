@@ -0,0 +1,115 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	metal3 "github.com/metal3-io/baremetal-operator/apis/metal3.io/v1alpha1"
+)
+
+// assertRetired checks that the image of a PreprovisioningImage was
+// withdrawn for reason.
+func assertRetired(t *testing.T, img *metal3.PreprovisioningImage, reason conditionReason) {
+	t.Helper()
+	cond := meta.FindStatusCondition(img.Status.Conditions, string(metal3.ConditionImageReady))
+	if cond == nil || cond.Status != metav1.ConditionFalse || cond.Reason != string(reason) {
+		t.Fatalf("image is not retired with reason %s: %+v", reason, img.Status.Conditions)
+	}
+	if img.Status.ImageUrl != "" {
+		t.Errorf("retired image still has the URL %q", img.Status.ImageUrl)
+	}
+}
+
+// updateHost changes the state of a BareMetalHost.
+func updateHost(t *testing.T, r *PreprovisioningImageReconciler, host *metal3.BareMetalHost, update func(*metal3.BareMetalHost)) {
+	t.Helper()
+	if err := r.Get(context.Background(), client.ObjectKeyFromObject(host), host); err != nil {
+		t.Fatal(err)
+	}
+	update(host)
+	if err := r.Update(context.Background(), host); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReconcileDeprovisionedHost(t *testing.T) {
+	host := newTestHost("host-0")
+	host.Status.Provisioning.State = metal3.StateInspecting
+	r, server := newTestReconciler(t, host, newTestHostImage(host), newTestImage("other"))
+	r.RemoveDeprovisionedImages = true
+
+	_, img := reconcileImage(t, r, "host-0")
+	assertReady(t, img)
+	server.AssertImage(t, testImageName("host-0"))
+
+	if requests := r.imagesForHost(host); len(requests) != 1 || requests[0].Name != "host-0" {
+		t.Errorf("unexpected requests %v for a change to the host", requests)
+	}
+
+	updateHost(t, r, host, func(host *metal3.BareMetalHost) {
+		host.Status.Provisioning.State = metal3.StateAvailable
+		host.Status.OperationHistory.Deprovision.End = metav1.Now()
+	})
+	_, img = reconcileImage(t, r, "host-0")
+	assertRetired(t, img, reasonHostDeprovisioned)
+	server.AssertNoImage(t, testImageName("host-0"))
+
+	// provisioning it again needs the image again
+	updateHost(t, r, host, func(host *metal3.BareMetalHost) {
+		host.Status.Provisioning.State = metal3.StateProvisioning
+	})
+	_, img = reconcileImage(t, r, "host-0")
+	assertReady(t, img)
+	server.AssertImage(t, testImageName("host-0"))
+}
+
+func TestReconcileDeletedHost(t *testing.T) {
+	host := newTestHost("host-0")
+	r, server := newTestReconciler(t, host, newTestHostImage(host))
+	r.RemoveDeprovisionedImages = true
+
+	_, img := reconcileImage(t, r, "host-0")
+	assertReady(t, img)
+
+	if err := r.Delete(context.Background(), host); err != nil {
+		t.Fatal(err)
+	}
+	_, img = reconcileImage(t, r, "host-0")
+	assertRetired(t, img, reasonHostDeprovisioned)
+	server.AssertNoImage(t, testImageName("host-0"))
+
+	// an image without a host is left alone
+	r.RemoveDeprovisionedImages = false
+	_, img = reconcileImage(t, r, "host-0")
+	assertReady(t, img)
+}
+
+func TestReconcileProvisionedImageRetention(t *testing.T) {
+	host := newTestHost("host-0")
+	host.Status.Provisioning.State = metal3.StateProvisioned
+	host.Status.OperationHistory.Provision.End = metav1.Now()
+	r, server := newTestReconciler(t, host, newTestHostImage(host))
+	r.ProvisionedImageRetention = time.Hour
+
+	result, img := reconcileImage(t, r, "host-0")
+	assertReady(t, img)
+	server.AssertImage(t, testImageName("host-0"))
+	if result.RequeueAfter <= 0 || result.RequeueAfter > time.Hour {
+		t.Errorf("expected a reconcile once the retention period is over, got %+v", result)
+	}
+	if requests := r.imagesForHost(host); len(requests) != 1 || requests[0].Name != "host-0" {
+		t.Errorf("unexpected requests %v for a change to the host", requests)
+	}
+
+	updateHost(t, r, host, func(host *metal3.BareMetalHost) {
+		host.Status.OperationHistory.Provision.End = metav1.NewTime(time.Now().Add(-2 * time.Hour))
+	})
+	_, img = reconcileImage(t, r, "host-0")
+	assertRetired(t, img, reasonHostProvisioned)
+	server.AssertNoImage(t, testImageName("host-0"))
+}
@@ -0,0 +1,105 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	metal3 "github.com/metal3-io/baremetal-operator/apis/metal3.io/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// streamAnnotation selects the image stream a PreprovisioningImage's image
+// is built from. It takes precedence over the base image label. It can also
+// be set on a BareMetalHost, to pin the images of a host to a stream, e.g. an
+// older release for hardware only certified against it; that of the
+// PreprovisioningImage takes precedence.
+const streamAnnotation = annotationPrefix + "stream"
+
+// reasonUnknownImageStream is reported for a PreprovisioningImage selecting
+// a stream that is not configured.
+const reasonUnknownImageStream conditionReason = "UnknownImageStream"
+
+// rootfsURLKernelArg tells the live image where to fetch its root
+// filesystem from.
+const rootfsURLKernelArg = "coreos.live.rootfs_url="
+
+// ImageStream is a release of the live image that PreprovisioningImages can
+// select, e.g. to provision hosts with either the old or the new release
+// while a cluster is upgraded. Its base ISO is the image server's named base
+// image of the same name.
+type ImageStream struct {
+	// RootfsURL, if set, is where the live image fetches its root
+	// filesystem from.
+	RootfsURL string
+	// KernelArgs are added to the kernel arguments of the stream's images.
+	KernelArgs []string
+}
+
+// streamCustomizer builds the image from the base ISO of the selected
+// stream, with its kernel arguments.
+type streamCustomizer struct {
+	r *PreprovisioningImageReconciler
+}
+
+func (s *streamCustomizer) Name() string { return "Stream" }
+
+func (s *streamCustomizer) Customize(ctx context.Context, c *imageCustomization) *conditionError {
+	name, err := s.r.imageStreamName(ctx, c.img)
+	if err != nil {
+		return configurationError(err)
+	}
+	if name == "" {
+		return nil
+	}
+	stream, ok := s.r.imageStream(name)
+	if !ok {
+		err := fmt.Errorf("unknown image stream %q", name)
+		return newConditionError(reasonUnknownImageStream, err.Error(), err)
+	}
+	c.baseImage = name
+	if stream.RootfsURL != "" {
+		c.kernelArgs = append(c.kernelArgs, rootfsURLKernelArg+stream.RootfsURL)
+	}
+	c.kernelArgs = append(c.kernelArgs, stream.KernelArgs...)
+	return nil
+}
+
+// imageStreamName returns the name of the stream selected for a
+// PreprovisioningImage, by its own annotation or that of its BareMetalHost,
+// or "" if none is.
+func (r *PreprovisioningImageReconciler) imageStreamName(ctx context.Context, img *metal3.PreprovisioningImage) (string, error) {
+	if name := img.Annotations[streamAnnotation]; name != "" {
+		return name, nil
+	}
+	host, err := r.owningHost(ctx, img)
+	if host == nil || err != nil {
+		return "", err
+	}
+	return host.Annotations[streamAnnotation], nil
+}
+
+// hostStreamChanged passes updates of BareMetalHosts that change the stream
+// their images are pinned to.
+var hostStreamChanged = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		return e.ObjectOld.GetAnnotations()[streamAnnotation] != e.ObjectNew.GetAnnotations()[streamAnnotation]
+	},
+	GenericFunc: func(event.GenericEvent) bool { return false },
+}
@@ -0,0 +1,107 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	metal3 "github.com/metal3-io/baremetal-operator/apis/metal3.io/v1alpha1"
+)
+
+// statusSweeper checks, when the controller starts, that the URLs advertised
+// by Ready PreprovisioningImages can still be served, since the base ISO or
+// NetworkData secret may have changed while the controller was down. The
+// status of those that can't is corrected straight away, so that hosts don't
+// boot from them while they wait for their turn to be reconciled.
+type statusSweeper struct {
+	reconciler *PreprovisioningImageReconciler
+}
+
+func (s *statusSweeper) Start(ctx context.Context) error {
+	log := s.reconciler.Log.WithName("sweep")
+
+	images := metal3.PreprovisioningImageList{}
+	if err := s.reconciler.List(ctx, &images); err != nil {
+		log.Error(err, "unable to list PreprovisioningImages")
+		return nil
+	}
+	version, versionErr := s.reconciler.ImageFileServer.BaseImageVersion(ctx)
+
+	checked, corrected := 0, 0
+	for i := range images.Items {
+		img := images.Items[i].DeepCopy()
+		original := img.DeepCopy()
+		if !s.reconciler.Shard.Owns(client.ObjectKeyFromObject(img).String()) {
+			continue
+		}
+		if img.Status.ImageUrl == "" || !meta.IsStatusConditionTrue(img.Status.Conditions, string(metal3.ConditionImageReady)) {
+			continue
+		}
+		checked++
+		imgLog := log.WithValues("preprovisioningimage", img.Namespace+"/"+img.Name)
+		changed, err := s.check(ctrl.LoggerInto(ctx, imgLog), img, version, versionErr)
+		if err != nil {
+			imgLog.Error(err, "unable to check image")
+			continue
+		}
+		if !changed {
+			continue
+		}
+		if err := patchStatus(ctx, s.reconciler.Client, img, original); err != nil {
+			imgLog.Error(err, "unable to correct status")
+			continue
+		}
+		corrected++
+	}
+	log.Info("checked advertised image URLs", "checked", checked, "corrected", corrected)
+	return nil
+}
+
+// check updates the status of a Ready image whose URL can no longer be
+// served, returning true if it changed.
+func (s *statusSweeper) check(ctx context.Context, img *metal3.PreprovisioningImage, version string, versionErr error) (bool, error) {
+	generation := img.GetGeneration()
+	if versionErr != nil {
+		return setError(ctx, generation, &img.Status, reasonImageServingError, versionErr.Error()), nil
+	}
+	if cond := meta.FindStatusCondition(img.Status.Conditions, conditionBaseImage); cond != nil && cond.Message != baseImageMessage(version) {
+		return setPending(generation, &img.Status, "Base image changed"), nil
+	}
+
+	if s.reconciler.NetworkMode == NetworkModeDHCP || img.Spec.NetworkDataName == "" {
+		return false, nil
+	}
+	secret := &corev1.Secret{}
+	key := client.ObjectKey{Namespace: img.Namespace, Name: img.Spec.NetworkDataName}
+	err := s.reconciler.APIReader.Get(ctx, key, secret)
+	if k8serrors.IsNotFound(err) {
+		return setError(ctx, generation, &img.Status, reasonMissingNetworkData, "NetworkData secret not found"), nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if secret.Name != img.Status.NetworkData.Name || secret.ResourceVersion != img.Status.NetworkData.Version {
+		return setPending(generation, &img.Status, "Network data changed"), nil
+	}
+	return false, nil
+}
@@ -3,15 +3,28 @@ module github.com/asalkeld/image-customization-controller
 go 1.16
 
 require (
+	github.com/coreos/ignition/v2 v2.12.0
+	github.com/evanphx/json-patch v4.11.0+incompatible
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/go-logr/logr v0.4.0
 	github.com/golangci/golangci-lint v1.32.0
+	github.com/google/uuid v1.1.2
 	github.com/metal3-io/baremetal-operator v0.0.0-00010101000000-000000000000
 	github.com/metal3-io/baremetal-operator/apis v0.0.0
 	github.com/openshift/assisted-image-service v0.0.0-20210825003515-8675374a2fc2
+	github.com/prometheus/client_golang v1.11.0
+	github.com/ulikunitz/xz v0.5.6
+	go.opentelemetry.io/otel v1.0.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.0.0
+	go.opentelemetry.io/otel/sdk v1.0.0
+	go.opentelemetry.io/otel/trace v1.0.0
+	go.uber.org/zap v1.18.1
+	golang.org/x/crypto v0.0.0-20210220033148-5ea612d1eb83
 	k8s.io/api v0.22.1
 	k8s.io/apimachinery v0.22.1
 	k8s.io/client-go v0.22.1
 	sigs.k8s.io/controller-runtime v0.9.6
+	sigs.k8s.io/yaml v1.2.0
 )
 
 replace (
@@ -17,22 +17,38 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
 
+	"go.uber.org/zap/zapcore"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	k8sruntime "k8s.io/apimachinery/pkg/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 
 	metal3iocontroller "github.com/asalkeld/image-customization-controller/controllers/metal3.io"
+	"github.com/asalkeld/image-customization-controller/pkg/config"
 	"github.com/asalkeld/image-customization-controller/pkg/imagehandler"
+	"github.com/asalkeld/image-customization-controller/pkg/logging"
+	"github.com/asalkeld/image-customization-controller/pkg/objectstore"
+	"github.com/asalkeld/image-customization-controller/pkg/tracing"
 	metal3iov1alpha1 "github.com/metal3-io/baremetal-operator/apis/metal3.io/v1alpha1"
 	"github.com/metal3-io/baremetal-operator/pkg/version"
 	// +kubebuilder:scaffold:imports
@@ -58,84 +74,673 @@ func printVersion() {
 	setupLog.Info(fmt.Sprintf("Component: %s", version.String))
 }
 
-func setupChecks(mgr ctrl.Manager) {
+func setupChecks(mgr ctrl.Manager, imageServer imagehandler.ImageFileServer) {
 	if err := mgr.AddReadyzCheck("ping", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to create ready check")
 		os.Exit(1)
 	}
 
+	if err := mgr.AddReadyzCheck("images", readyChecker(imageServer)); err != nil {
+		setupLog.Error(err, "unable to create ready check")
+		os.Exit(1)
+	}
+
 	if err := mgr.AddHealthzCheck("ping", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to create health check")
 		os.Exit(1)
 	}
 }
 
+// clientAuthTLSConfig returns a TLS config that requires client certificates
+// signed by the CA bundle, if one is given.
+func clientAuthTLSConfig(clientCAFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if clientCAFile == "" {
+		return config, nil
+	}
+	caPEM, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
+}
+
+// readTokenFile reads a bearer token from a file, such as a mounted Secret.
+func readTokenFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("no token found in %s", path)
+	}
+	return token, nil
+}
+
+// listenNetwork returns the network to listen on at an address. An IP
+// literal binds just its own family, so that separate IPv4 and IPv6
+// listeners can share a port; a host name or empty host binds both.
+func listenNetwork(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "tcp"
+	}
+	ip := imagehandler.HostIP(host)
+	switch {
+	case ip == nil:
+		return "tcp"
+	case ip.To4() != nil:
+		return "tcp4"
+	default:
+		return "tcp6"
+	}
+}
+
+// newRemoteImageServer configures delegation of image serving to an
+// external image server.
+func newRemoteImageServer(cfg config.Config) (imagehandler.ImageFileServer, error) {
+	opts := imagehandler.RemoteOptions{URL: cfg.ImageServiceURL}
+	if cfg.ImageServiceTokenFile != "" {
+		token, err := readTokenFile(cfg.ImageServiceTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		opts.Token = token
+	}
+	if cfg.ImageServiceCA != "" || cfg.ImageServiceClientCert != "" {
+		opts.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if cfg.ImageServiceCA != "" {
+		caPEM, err := os.ReadFile(cfg.ImageServiceCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.ImageServiceCA)
+		}
+		opts.TLSConfig.RootCAs = pool
+	}
+	if cfg.ImageServiceClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ImageServiceClientCert, cfg.ImageServiceClientKey)
+		if err != nil {
+			return nil, err
+		}
+		opts.TLSConfig.Certificates = []tls.Certificate{cert}
+	}
+	return imagehandler.NewRemoteImageServer(ctrl.Log.WithName("RemoteImageServer"), opts)
+}
+
+// newAssistedImageServer configures delegation of image serving to an
+// assisted-image-service, which fetches the ignition of each image from the
+// returned server's IgnitionHandler.
+func newAssistedImageServer(cfg config.Config, ignitionSource imagehandler.IgnitionSource) (imagehandler.AssistedImageServer, error) {
+	apiKey, err := readTokenFile(cfg.AssistedImageServiceAPIKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	opts := imagehandler.AssistedOptions{
+		URL:            cfg.AssistedImageServiceURL,
+		Version:        cfg.AssistedImageServiceVersion,
+		ImageType:      cfg.AssistedImageServiceImageType,
+		APIKey:         apiKey,
+		IgnitionSource: ignitionSource,
+	}
+	if cfg.AssistedImageServiceCA != "" {
+		caPEM, err := os.ReadFile(cfg.AssistedImageServiceCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.AssistedImageServiceCA)
+		}
+		opts.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: pool}
+	}
+	return imagehandler.NewAssistedImageServer(ctrl.Log.WithName("AssistedImageServer"), opts)
+}
+
+// newStorage configures the backend generated images are published to, if
+// any. Validate has checked that at most one is configured.
+func newStorage(cfg config.Config) (imagehandler.Storage, error) {
+	s3Config, ociConfig := cfg.S3, cfg.OCI
+	switch {
+	case s3Config.Bucket != "":
+		s3Config.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		s3Config.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		return objectstore.NewS3(s3Config)
+	case ociConfig.Repository != "":
+		ociConfig.Username = os.Getenv("REGISTRY_USERNAME")
+		ociConfig.Password = os.Getenv("REGISTRY_PASSWORD")
+		return objectstore.NewOCI(ociConfig)
+	case cfg.ExportDir != "":
+		return objectstore.NewDirectory(cfg.ExportDir, cfg.ExportURL)
+	}
+	return nil, nil
+}
+
+// imageServerSettings returns the image server settings from the runtime
+// configuration.
+func imageServerSettings(tunables config.Tunables) imagehandler.Settings {
+	return imagehandler.Settings{
+		BaseURL:                  tunables.ImagesBaseURL,
+		ExternalURL:              tunables.ImagesExternalURL,
+		ArchIsoFiles:             tunables.ArchISOs,
+		NamedIsoFiles:            tunables.NamedISOs(),
+		MaxConcurrentGenerations: tunables.MaxConcurrentGenerations,
+		MemoryBudget:             tunables.MemoryBudgetBytes(),
+	}
+}
+
+// reconfigureImageServer applies the runtime configuration to the image
+// server, if it is served from this process.
+func reconfigureImageServer(imageServer imagehandler.ImageFileServer, tunables config.Tunables) {
+	if server, ok := imageServer.(imagehandler.Reconfigurable); ok {
+		server.Reconfigure(imageServerSettings(tunables))
+	}
+}
+
+// serveImages serves images on the images endpoint, which serves nothing
+// but images, so that it can be exposed to the provisioning network on its
+// own.
+func serveImages(cfg config.Config, handler http.Handler) {
+	imagesServer := &http.Server{Handler: handler}
+	if cfg.ImagesTLSCert != "" {
+		var err error
+		imagesServer.TLSConfig, err = clientAuthTLSConfig(cfg.ImagesClientCA)
+		if err != nil {
+			setupLog.Error(err, "unable to load images-client-ca")
+			os.Exit(1)
+		}
+	}
+	for _, addr := range cfg.ImagesBindAddrs {
+		listener, err := net.Listen(listenNetwork(addr), addr)
+		if err != nil {
+			setupLog.Error(err, "unable to listen for images", "address", addr)
+			os.Exit(1)
+		}
+		go func() {
+			if cfg.ImagesTLSCert != "" {
+				log.Fatal(imagesServer.ServeTLS(listener, cfg.ImagesTLSCert, cfg.ImagesTLSKey))
+			}
+			log.Fatal(imagesServer.Serve(listener))
+		}()
+	}
+}
+
+// runImageServer runs just the image server, whose images are registered
+// through the registration API rather than by the controller. It serves
+// health checks itself and returns once ctx is done.
+func runImageServer(ctx context.Context, healthAddr string, imageServer imagehandler.ImageFileServer, baseImageWatcher imagehandler.BaseImageWatcher,
+	configFile string, configPollInterval time.Duration, defaults, tunables config.Tunables) {
+	if healthAddr != "0" {
+		healthServer := &http.Server{Addr: healthAddr, Handler: healthHandler(imageServer)}
+		go func() {
+			log.Fatal(healthServer.ListenAndServe())
+		}()
+	}
+
+	if baseImageWatcher != nil {
+		go func() {
+			// clients find out from the registration API
+			if err := baseImageWatcher.WatchBaseImages(ctx, func(string) {}); err != nil {
+				setupLog.Error(err, "unable to watch base images")
+			}
+		}()
+	}
+	if configFile != "" {
+		watcher := &config.Watcher{
+			Path:     configFile,
+			Interval: configPollInterval,
+			Defaults: defaults,
+			Current:  tunables,
+			Apply: func(_ context.Context, tunables config.Tunables) {
+				reconfigureImageServer(imageServer, tunables)
+			},
+			Log: ctrl.Log.WithName("config"),
+		}
+		go func() {
+			_ = watcher.Start(ctx)
+		}()
+	}
+
+	setupLog.Info("starting image server")
+	<-ctx.Done()
+}
+
+// cleanupCache applies the cache shutdown policy to the image server's cache
+// directory.
+func cleanupCache(imageServer imagehandler.ImageFileServer, policy imagehandler.CachePolicy) {
+	purger, ok := imageServer.(imagehandler.CachePurger)
+	if !ok || policy != imagehandler.CachePurge {
+		return
+	}
+	if err := purger.PurgeCache(); err != nil {
+		setupLog.Error(err, "unable to purge the image cache")
+	}
+}
+
+// downloadSource is a remote base ISO downloaded to a known path.
+type downloadSource interface {
+	imagehandler.BaseImageSource
+	Path(dir string) string
+}
+
+// fetchDeployISO downloads the base ISO from deploy-iso-url or
+// deploy-iso-stream, found at url, in the background and returns the path it
+// is downloaded to. The image server is not ready until the verified ISO is
+// in place.
+func fetchDeployISO(source downloadSource, url, dir string) string {
+	log := ctrl.Log.WithName("BaseImageSource")
+	go func() {
+		log.Info("downloading base ISO", "url", url)
+		path, err := imagehandler.FetchBaseImage(context.Background(), log, source, dir)
+		if err == nil {
+			log.Info("base ISO downloaded", "path", path)
+		}
+	}()
+	return source.Path(dir)
+}
+
+// healthHandler serves the /healthz and /readyz endpoints in the absence of
+// a manager.
+func healthHandler(imageServer imagehandler.ImageFileServer) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", http.StripPrefix("/healthz", &healthz.Handler{Checks: map[string]healthz.Checker{
+		"ping": healthz.Ping,
+	}}))
+	mux.Handle("/readyz", http.StripPrefix("/readyz", &healthz.Handler{Checks: map[string]healthz.Checker{
+		"ping":   healthz.Ping,
+		"images": readyChecker(imageServer),
+	}}))
+	return mux
+}
+
+// readyChecker adapts an image server's readiness to a health check.
+func readyChecker(imageServer imagehandler.ImageFileServer) healthz.Checker {
+	return func(req *http.Request) error {
+		return imageServer.CheckReady(req.Context())
+	}
+}
+
+// reconcilerSettings returns the reconciler's retry delays, image streams and
+// extra files from the runtime configuration.
+func reconcilerSettings(tunables config.Tunables) metal3iocontroller.Settings {
+	streams := map[string]metal3iocontroller.ImageStream{}
+	for name, stream := range tunables.Streams {
+		streams[name] = metal3iocontroller.ImageStream{
+			RootfsURL:  stream.RootfsURL,
+			KernelArgs: stream.KernelArgs,
+		}
+	}
+	extraFiles := []metal3iocontroller.ExtraFile{}
+	for _, file := range tunables.ExtraFiles {
+		extraFiles = append(extraFiles, metal3iocontroller.ExtraFile{
+			Path:      file.Path,
+			Mode:      file.Mode,
+			ConfigMap: file.ConfigMap,
+			Secret:    file.Secret,
+			Namespace: file.Namespace,
+			Key:       file.Key,
+		})
+	}
+	return metal3iocontroller.Settings{
+		RetryDelays: metal3iocontroller.RetryDelays{
+			MinError: tunables.ErrorRetryMinDelay.Duration,
+			MaxError: tunables.ErrorRetryMaxDelay.Duration,
+			Pending:  tunables.PendingRetryDelay.Duration,
+
+			GenerationAttempts: tunables.GenerationAttempts,
+		},
+		Streams:    streams,
+		ExtraFiles: extraFiles,
+	}
+}
+
 func main() {
-	var watchNamespace string
-	var devLogging bool
-	var imagesBindAddr string
-	var imagesPublishAddr string
-
-	// From CAPI point of view, BMO should be able to watch all namespaces
-	// in case of a deployment that is not multi-tenant. If the deployment
-	// is for multi-tenancy, then the BMO should watch only the provided
-	// namespace.
-	flag.StringVar(&watchNamespace, "namespace", os.Getenv("WATCH_NAMESPACE"),
-		"Namespace that the controller watches to reconcile host resources.")
-	flag.StringVar(&imagesBindAddr, "images-bind-addr", ":8084",
-		"The address the images endpoint binds to.")
-	flag.StringVar(&imagesPublishAddr, "images-publish-addr", "127.0.0.1:8084",
-		"The address clients would access the images endpoint from.")
+	cfg := config.Config{}
+	cfg.BindFlags(flag.CommandLine)
 	flag.Parse()
 
-	ctrl.SetLogger(zap.New(zap.UseDevMode(devLogging)))
+	// The root logger is enabled up to the highest verbosity requested, and
+	// each component then filters its own messages.
+	maxVerbosity := 0
+	for _, v := range []int{cfg.ControllerVerbosity, cfg.ImagesVerbosity, cfg.ConverterVerbosity, cfg.CacheVerbosity} {
+		if v > maxVerbosity {
+			maxVerbosity = v
+		}
+	}
+	ctrl.SetLogger(zap.New(zap.UseDevMode(cfg.DevLogging), zap.Level(zapcore.Level(-maxVerbosity))))
 
 	printVersion()
 
-	iso := os.Getenv("DEPLOY_ISO")
-	if iso == "" {
-		setupLog.Info("No DEPLOY_ISO specified")
+	if cfg.TraceSpans {
+		shutdownTracing, err := tracing.Setup(context.Background(), "image-customization-controller")
+		if err != nil {
+			setupLog.Error(err, "unable to set up tracing")
+			os.Exit(1)
+		}
+		defer func() {
+			if err := shutdownTracing(context.Background()); err != nil {
+				setupLog.Error(err, "unable to flush spans")
+			}
+		}()
+	}
+
+	err := cfg.Validate()
+	if err != nil {
+		setupLog.Error(err, "invalid options")
 		os.Exit(1)
 	}
+	setupLog.Info("effective configuration", cfg.Summary()...)
 
-	imageServer := imagehandler.NewImageFileServer(ctrl.Log.WithName("ImageFileServer"), iso, imagesPublishAddr)
-	// why use a FileServer?
-	// 1. it streams files efficiently
-	// 2. if we cache these images, then that will be an easy change.
-	http.Handle("/", http.FileServer(imageServer.FileSystem()))
-	go func() {
-		log.Fatal(http.ListenAndServe(imagesBindAddr, nil))
-	}()
+	if cfg.ImagesPublishFrom != "" {
+		var reader client.Reader
+		if cfg.ImagesPublishFrom == config.PublishFromService {
+			reader, err = client.New(ctrl.GetConfigOrDie(), client.Options{Scheme: scheme})
+			if err != nil {
+				setupLog.Error(err, "unable to create client")
+				os.Exit(1)
+			}
+		}
+		if err := cfg.DetectPublishAddr(context.Background(), reader); err != nil {
+			setupLog.Error(err, "invalid images-publish-from")
+			os.Exit(1)
+		}
+		setupLog.Info("detected images URL", "url", cfg.ImagesPublishAddr)
+	}
+
+	defaults := config.Tunables{
+		ImagesBaseURL:            cfg.ImagesPublishAddr,
+		ImagesExternalURL:        cfg.ImagesExternalURL,
+		ArchISOs:                 cfg.ArchISOs,
+		BaseISOs:                 cfg.BaseISOs,
+		MaxConcurrentGenerations: cfg.MaxConcurrentGenerations,
+		MemoryBudget:             &cfg.MemoryBudget,
+		ErrorRetryMinDelay:       &metav1.Duration{Duration: metal3iocontroller.DefaultRetryDelays.MinError},
+		ErrorRetryMaxDelay:       &metav1.Duration{Duration: metal3iocontroller.DefaultRetryDelays.MaxError},
+		PendingRetryDelay:        &metav1.Duration{Duration: metal3iocontroller.DefaultRetryDelays.Pending},
+		GenerationAttempts:       metal3iocontroller.DefaultRetryDelays.GenerationAttempts,
+	}
+	tunables := defaults
+	if cfg.ConfigFile != "" {
+		tunables, err = config.LoadTunables(cfg.ConfigFile, defaults)
+		if err != nil {
+			setupLog.Error(err, "invalid config-file")
+			os.Exit(1)
+		}
+	}
+
+	// validated with the other options
+	pathPrefix, _ := imagehandler.ParsePathPrefix(cfg.ImagesPathPrefix)
+
+	var cacheEncryptionKey []byte
+	if cfg.CacheEncryptionKeyFile != "" {
+		keyData, err := os.ReadFile(cfg.CacheEncryptionKeyFile)
+		if err == nil {
+			cacheEncryptionKey, err = imagehandler.ParseEncryptionKey(keyData, cfg.CacheEncryptionKeyEncoding)
+		}
+		if err != nil {
+			setupLog.Error(err, "invalid cache-encryption-key-file")
+			os.Exit(1)
+		}
+	}
+
+	storage, err := newStorage(cfg)
+	if err != nil {
+		setupLog.Error(err, "invalid image storage configuration")
+		os.Exit(1)
+	}
+
+	ctx := ctrl.SetupSignalHandler()
+
+	// The reconciler rebuilds the content of evicted images, and registers
+	// the images again once their URL changes, but is only created once the
+	// image server is running, so it is published to the server's
+	// goroutines once it is.
+	var reconcilerReady atomic.Value
+	ignitionSource := func(ctx context.Context, name string) ([]byte, error) {
+		imgReconciler, ok := reconcilerReady.Load().(*metal3iocontroller.PreprovisioningImageReconciler)
+		if !ok {
+			return nil, errors.New("controller not started")
+		}
+		return imgReconciler.IgnitionFor(ctx, name)
+	}
+	urlChanged := func() {
+		if imgReconciler, ok := reconcilerReady.Load().(*metal3iocontroller.PreprovisioningImageReconciler); ok {
+			imgReconciler.RequeueAll(ctx)
+		}
+	}
+
+	var imageServer imagehandler.ImageFileServer
+	if cfg.Mode == config.ModeController {
+		if storage != nil {
+			setupLog.Error(errors.New("image storage is configured on the external image server"),
+				"invalid image storage configuration")
+			os.Exit(1)
+		}
+		if cfg.AssistedImageServiceURL != "" {
+			assistedServer, err := newAssistedImageServer(cfg, ignitionSource)
+			if err != nil {
+				setupLog.Error(err, "unable to configure assisted-image-service-url")
+				os.Exit(1)
+			}
+			imageServer = assistedServer
+			ignitionServer := &http.Server{Addr: cfg.AssistedIgnitionAddr, Handler: assistedServer.IgnitionHandler()}
+			go func() {
+				log.Fatal(ignitionServer.ListenAndServe())
+			}()
+		} else {
+			imageServer, err = newRemoteImageServer(cfg)
+			if err != nil {
+				setupLog.Error(err, "unable to configure image-service-url")
+				os.Exit(1)
+			}
+		}
+	} else {
+		isoFile := cfg.DeployISO
+		if cfg.DeployISOURL != "" {
+			source := &imagehandler.URLSource{URL: cfg.DeployISOURL, SHA256: cfg.DeployISOSHA256}
+			isoFile = fetchDeployISO(source, cfg.DeployISOURL, cfg.DeployISODir)
+		}
+		if cfg.DeployISOStream != "" {
+			source := &imagehandler.StreamSource{Stream: cfg.DeployISOStream, Arch: cfg.DeployISOStreamArch}
+			isoFile = fetchDeployISO(source, source.MetadataURL(), cfg.DeployISODir)
+		}
+		// a dry run leaves the cache alone
+		cacheDir := cfg.CacheDir
+		if cfg.DryRun {
+			cacheDir = ""
+		}
+		imagesLog := ctrl.Log.WithName("ImageFileServer")
+		imageHandler := imagehandler.NewImageFileServer(logging.WithVerbosity(imagesLog, cfg.ImagesVerbosity), imagehandler.Options{
+			IsoFile:                  isoFile,
+			ArchIsoFiles:             tunables.ArchISOs,
+			NamedIsoFiles:            tunables.NamedISOs(),
+			BaseURL:                  tunables.ImagesBaseURL,
+			CacheDir:                 cacheDir,
+			MaxConcurrentGenerations: tunables.MaxConcurrentGenerations,
+			GenerationTimeout:        cfg.GenerationTimeout,
+			GenericEmbed:             cfg.GenericEmbed,
+			MemoryBudget:             tunables.MemoryBudgetBytes(),
+			OneTimeTokens:            cfg.OneTimeTokens,
+			TokenGracePeriod:         cfg.TokenGracePeriod,
+			URLTTL:                   cfg.ImageURLTTL,
+			RandomFileNames:          cfg.RandomFileNames,
+			ChecksumType:             cfg.ChecksumType,
+			CacheEncryptionKey:       cacheEncryptionKey,
+			Storage:                  storage,
+			PathPrefix:               pathPrefix,
+			ExternalURL:              tunables.ImagesExternalURL,
+			TrustedProxies:           cfg.TrustedProxies,
+			UseForwardedURL:          cfg.UseForwardedURL,
+			URLChanged:               urlChanged,
+			MaxImagesInMemory:        cfg.MaxImagesInMemory,
+			IgnitionSource:           ignitionSource,
+			CacheStartupPolicy:       cfg.CacheStartupPolicy,
+			CacheLog:                 logging.WithVerbosity(imagesLog.WithName("cache"), cfg.CacheVerbosity),
+			Context:                  ctx,
+		})
+		imageServer = imageHandler
+		if !cfg.DryRun {
+			serveImages(cfg, imageHandler)
+		}
+	}
+
+	if cfg.DebugAddr != "" {
+		token, err := readTokenFile(cfg.DebugTokenFile)
+		if err != nil {
+			setupLog.Error(err, "unable to read debug-token-file")
+			os.Exit(1)
+		}
+		debugServer := &http.Server{
+			Addr:    cfg.DebugAddr,
+			Handler: imagehandler.NewDebugHandler(imageServer, token),
+		}
+		go func() {
+			log.Fatal(debugServer.ListenAndServe())
+		}()
+	}
+
+	if cfg.APIAddr != "" && !cfg.DryRun {
+		token := ""
+		if cfg.APITokenFile != "" {
+			token, err = readTokenFile(cfg.APITokenFile)
+			if err != nil {
+				setupLog.Error(err, "unable to read api-token-file")
+				os.Exit(1)
+			}
+		}
+		apiServer := &http.Server{
+			Addr:    cfg.APIAddr,
+			Handler: imagehandler.NewAPIHandler(imageServer, token),
+		}
+		if cfg.APITLSCert != "" {
+			apiServer.TLSConfig, err = clientAuthTLSConfig(cfg.APIClientCA)
+			if err != nil {
+				setupLog.Error(err, "unable to load api-client-ca")
+				os.Exit(1)
+			}
+		}
+		go func() {
+			if cfg.APITLSCert != "" {
+				log.Fatal(apiServer.ListenAndServeTLS(cfg.APITLSCert, cfg.APITLSKey))
+			}
+			log.Fatal(apiServer.ListenAndServe())
+		}()
+	}
+
+	var baseImageWatcher imagehandler.BaseImageWatcher
+	if watcher, ok := imageServer.(imagehandler.BaseImageWatcher); ok && cfg.WatchBaseImages && !cfg.DryRun {
+		baseImageWatcher = watcher
+	}
+
+	if cfg.Mode == config.ModeImageServer {
+		runImageServer(ctx, cfg.HealthAddr, imageServer, baseImageWatcher, cfg.ConfigFile, cfg.ConfigPollInterval, defaults, tunables)
+		cleanupCache(imageServer, cfg.CacheShutdownPolicy)
+		return
+	}
 
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
-		Scheme:    scheme,
-		Port:      0, // Add flag with default of 9443 when adding webhooks
-		Namespace: watchNamespace,
+		Scheme:                 scheme,
+		Port:                   0, // Add flag with default of 9443 when adding webhooks
+		Namespace:              cfg.Namespace,
+		MetricsBindAddress:     cfg.MetricsAddr,
+		HealthProbeBindAddress: cfg.HealthAddr,
 	})
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
 
-	imgReconciler := metal3iocontroller.PreprovisioningImageReconciler{
+	imgReconciler := &metal3iocontroller.PreprovisioningImageReconciler{
 		Client:          mgr.GetClient(),
-		Log:             ctrl.Log.WithName("controllers").WithName("PreprovisioningImage"),
+		Log:             logging.WithVerbosity(ctrl.Log.WithName("controllers").WithName("PreprovisioningImage"), cfg.ControllerVerbosity),
+		ConverterLog:    logging.WithVerbosity(ctrl.Log.WithName("controllers").WithName("converter"), cfg.ConverterVerbosity),
 		APIReader:       mgr.GetAPIReader(),
 		Scheme:          mgr.GetScheme(),
 		ImageFileServer: imageServer,
+
+		AdditionalIgnitionConfigMap: cfg.AdditionalIgnitionConfigMap,
+		SSHKeySecret:                cfg.SSHKeySecret,
+		PullSecret:                  cfg.PullSecret,
+		KernelArgs:                  cfg.KernelArgs,
+		ArchKernelArgs:              cfg.ArchKernelArgs,
+		BootConfig:                  cfg.BootConfig,
+		UseClusterProxy:             cfg.UseClusterProxy,
+		NetworkMode:                 cfg.NetworkMode,
+		CustomizationMode:           cfg.CustomizationMode,
+		InitrdCompression:           cfg.InitrdCompression,
+		Proxy:                       cfg.Proxy,
+		BaseImagePollInterval:       cfg.BaseImagePollInterval,
+		ImageGCInterval:             cfg.ImageGCInterval,
+		ProvisionedImageRetention:   cfg.ProvisionedImageRetention,
+		RemoveDeprovisionedImages:   cfg.RemoveDeprovisionedImages,
+		PrewarmImages:               cfg.PrewarmImages,
+		SweepStatus:                 cfg.SweepStatus,
+		DryRun:                      cfg.DryRun,
+		DownloadEvents:              cfg.DownloadEvents,
+		DownloadAnnotations:         cfg.DownloadAnnotations,
+		ErrorStaleThreshold:         cfg.ErrorStaleThreshold,
+		ImageExtension:              cfg.ImageExtension,
+		ImageNameTemplate:           cfg.ImageNameTemplate,
+		Shard:                       cfg.Shard,
 	}
-	if err = (&imgReconciler).SetupWithManager(mgr); err != nil {
+	if baseImageWatcher != nil {
+		changes := make(chan struct{}, 1)
+		imgReconciler.BaseImageChanges = changes
+		if err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+			return baseImageWatcher.WatchBaseImages(ctx, func(string) {
+				select {
+				case changes <- struct{}{}:
+				default:
+				}
+			})
+		})); err != nil {
+			setupLog.Error(err, "unable to watch base images")
+			os.Exit(1)
+		}
+	}
+	// nothing is reconciled again before the controller is set up
+	imgReconciler.Reconfigure(context.Background(), reconcilerSettings(tunables))
+	if err = imgReconciler.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "PreprovisioningImage")
 		os.Exit(1)
 	}
+	reconcilerReady.Store(imgReconciler)
+
+	if cfg.ConfigFile != "" {
+		if err := mgr.Add(&config.Watcher{
+			Path:     cfg.ConfigFile,
+			Interval: cfg.ConfigPollInterval,
+			Defaults: defaults,
+			Current:  tunables,
+			Apply: func(ctx context.Context, tunables config.Tunables) {
+				reconfigureImageServer(imageServer, tunables)
+				imgReconciler.Reconfigure(ctx, reconcilerSettings(tunables))
+			},
+			Log: ctrl.Log.WithName("config"),
+		}); err != nil {
+			setupLog.Error(err, "unable to watch config-file")
+			os.Exit(1)
+		}
+	}
 
 	// +kubebuilder:scaffold:builder
 
-	setupChecks(mgr)
+	setupChecks(mgr, imageServer)
 
-	setupLog.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+	setupLog.Info("starting manager", "shard", cfg.Shard.String())
+	if err := mgr.Start(ctx); err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
+	cleanupCache(imageServer, cfg.CacheShutdownPolicy)
 }
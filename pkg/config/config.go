@@ -0,0 +1,962 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/types"
+
+	metal3iocontroller "github.com/asalkeld/image-customization-controller/controllers/metal3.io"
+	"github.com/asalkeld/image-customization-controller/pkg/ignition"
+	"github.com/asalkeld/image-customization-controller/pkg/imagehandler"
+	"github.com/asalkeld/image-customization-controller/pkg/initrd"
+	"github.com/asalkeld/image-customization-controller/pkg/objectstore"
+	"github.com/asalkeld/image-customization-controller/pkg/sharding"
+)
+
+// Config holds the startup options of the image server: base ISOs, URLs,
+// listeners, cache, TLS, download tokens, storage and log verbosities, and
+// those of the PreprovisioningImage controller. Each option is set with a
+// flag, defaulting to an environment variable named after it.
+type Config struct {
+	// Mode selects the parts of the service this process runs.
+	Mode string
+
+	DeployISO string
+	// DeployISOURL is downloaded at startup into DeployISODir, and
+	// verified against DeployISOSHA256, instead of DeployISO.
+	DeployISOURL    string
+	DeployISOSHA256 string
+	DeployISODir    string
+	// DeployISOStream is the URL of CoreOS stream metadata, or the name of
+	// a Fedora CoreOS stream, that the base ISO of DeployISOStreamArch is
+	// resolved from and downloaded into DeployISODir at startup, instead
+	// of DeployISO.
+	DeployISOStream     string
+	DeployISOStreamArch string
+	// ArchISOs and BaseISOs are parsed from comma-separated key=path
+	// pairs by Validate.
+	ArchISOs map[string]string
+	BaseISOs map[string]string
+	// GenericEmbed is parsed by Validate.
+	GenericEmbed imagehandler.EmbedStrategy
+
+	// ImagesBindAddrs is parsed from a comma-separated ImagesBindAddr by
+	// Validate, which also picks the ImagesPublishAddr of the IPFamily.
+	ImagesBindAddr    string
+	ImagesBindAddrs   []string
+	ImagesPublishAddr string
+	ImagesPublishFrom string
+	ImagesService     string
+	IPFamily          string
+	ImagesExternalURL string
+	ImagesPathPrefix  string
+	ImageExtension    string
+	MetricsAddr       string
+	HealthAddr        string
+	DebugAddr         string
+	DebugTokenFile    string
+
+	ImagesTLSCert  string
+	ImagesTLSKey   string
+	ImagesClientCA string
+	// TrustedProxies is parsed from comma-separated addresses and CIDR
+	// ranges by Validate.
+	TrustedProxies  []*net.IPNet
+	UseForwardedURL bool
+
+	OneTimeTokens    bool
+	TokenGracePeriod time.Duration
+	ImageURLTTL      time.Duration
+
+	// S3, OCI and ExportDir select the mutually exclusive backends
+	// generated images are published to. Their credentials are read from
+	// the environment when the backend is created.
+	S3        objectstore.S3Config
+	OCI       objectstore.OCIConfig
+	ExportDir string
+	ExportURL string
+
+	ControllerVerbosity int
+	ImagesVerbosity     int
+	ConverterVerbosity  int
+	CacheVerbosity      int
+
+	CacheDir                 string
+	CacheEncryptionKeyFile   string
+	MaxConcurrentGenerations int
+	// MemoryBudget is parsed by Validate.
+	MemoryBudget resource.Quantity
+	// CacheEncryptionKeyEncoding is parsed by Validate.
+	CacheEncryptionKeyEncoding imagehandler.KeyEncoding
+	// CacheStartupPolicy and CacheShutdownPolicy are parsed by Validate.
+	CacheStartupPolicy  imagehandler.CachePolicy
+	CacheShutdownPolicy imagehandler.CachePolicy
+
+	ImageServiceURL        string
+	ImageServiceTokenFile  string
+	ImageServiceCA         string
+	ImageServiceClientCert string
+	ImageServiceClientKey  string
+
+	// AssistedImageServiceURL delegates to an assisted-image-service, which
+	// fetches the ignition config of each image from AssistedIgnitionAddr.
+	AssistedImageServiceURL        string
+	AssistedImageServiceVersion    string
+	AssistedImageServiceImageType  string
+	AssistedImageServiceAPIKeyFile string
+	AssistedImageServiceCA         string
+	AssistedIgnitionAddr           string
+
+	APIAddr      string
+	APITokenFile string
+	APITLSCert   string
+	APITLSKey    string
+	APIClientCA  string
+
+	// Namespace is the namespace the controller watches, all of them if
+	// empty.
+	Namespace  string
+	DevLogging bool
+	TraceSpans bool
+	// ConfigFile holds the Tunables, and is reloaded every
+	// ConfigPollInterval.
+	ConfigFile         string
+	ConfigPollInterval time.Duration
+
+	// AdditionalIgnitionConfigMap, SSHKeySecret and PullSecret are parsed
+	// from namespace/name references by Validate.
+	AdditionalIgnitionConfigMap types.NamespacedName
+	SSHKeySecret                types.NamespacedName
+	PullSecret                  types.NamespacedName
+	// KernelArgs is split into fields by Validate, which also parses
+	// ArchKernelArgs and the boot menu entries of BootConfig.
+	KernelArgs     []string
+	ArchKernelArgs map[string][]string
+	BootConfig     imagehandler.BootConfig
+	// NetworkMode, CustomizationMode, InitrdCompression, ImageNameTemplate,
+	// ChecksumType and Shard are parsed by Validate.
+	NetworkMode       metal3iocontroller.NetworkMode
+	CustomizationMode metal3iocontroller.CustomizationMode
+	InitrdCompression initrd.Compression
+	ImageNameTemplate *template.Template
+	ChecksumType      imagehandler.ChecksumType
+	Shard             sharding.Shard
+	UseClusterProxy   bool
+	Proxy             ignition.ProxyConfig
+
+	BaseImagePollInterval     time.Duration
+	ImageGCInterval           time.Duration
+	ProvisionedImageRetention time.Duration
+	RemoveDeprovisionedImages bool
+	WatchBaseImages           bool
+	PrewarmImages             bool
+	SweepStatus               bool
+	DryRun                    bool
+	MaxImagesInMemory         int
+	GenerationTimeout         time.Duration
+	RandomFileNames           bool
+	DownloadEvents            bool
+	DownloadAnnotations       bool
+	ErrorStaleThreshold       time.Duration
+
+	archISOs       string
+	baseISOs       string
+	genericEmbed   string
+	memoryBudget   string
+	cacheKeyEnc    string
+	cacheStartup   string
+	cacheShutdown  string
+	trustedProxies string
+
+	additionalIgnition string
+	sshKeySecret       string
+	pullSecret         string
+	kernelArgs         string
+	archKernelArgs     string
+	bootMenuDefault    int
+	bootMenuTimeout    int
+	networkMode        string
+	customizationMode  string
+	initrdCompression  string
+	imageNameTemplate  string
+	checksumType       string
+	shardIndex         string
+	shardCount         int
+	// names lists the options in the order they were bound, for Summary.
+	names   []string
+	flags   *flag.FlagSet
+	envErrs []string
+}
+
+const (
+	// IPv4 and IPv6 are the IP families a base URL can be chosen from.
+	IPv4 = "ipv4"
+	IPv6 = "ipv6"
+)
+
+const (
+	// ModeAll runs the controller together with the image server.
+	ModeAll = "all"
+	// ModeController runs only the controller, which registers images with
+	// the external image server at ImageServiceURL, or the
+	// assisted-image-service at AssistedImageServiceURL, and publishes the
+	// URLs it returns.
+	ModeController = "controller"
+	// ModeImageServer runs only the image server and its registration
+	// API, without connecting to a Kubernetes cluster.
+	ModeImageServer = "image-server"
+)
+
+// envName returns the environment variable an option defaults to.
+func envName(name string) string {
+	return strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+func (c *Config) stringVar(fs *flag.FlagSet, p *string, name, env, value, usage string) {
+	if v, ok := os.LookupEnv(env); ok {
+		value = v
+	}
+	fs.StringVar(p, name, value, fmt.Sprintf("%s (env %s)", usage, env))
+	c.names = append(c.names, name)
+}
+
+func (c *Config) intVar(fs *flag.FlagSet, p *int, name string, value int, usage string) {
+	fs.IntVar(p, name, value, fmt.Sprintf("%s (env %s)", usage, envName(name)))
+	c.setFromEnv(fs, name)
+}
+
+func (c *Config) boolVar(fs *flag.FlagSet, p *bool, name string, value bool, usage string) {
+	fs.BoolVar(p, name, value, fmt.Sprintf("%s (env %s)", usage, envName(name)))
+	c.setFromEnv(fs, name)
+}
+
+func (c *Config) durationVar(fs *flag.FlagSet, p *time.Duration, name string, value time.Duration, usage string) {
+	fs.DurationVar(p, name, value, fmt.Sprintf("%s (env %s)", usage, envName(name)))
+	c.setFromEnv(fs, name)
+}
+
+// setFromEnv sets a bound option from its environment variable, if set,
+// recording an invalid value for Validate to report.
+func (c *Config) setFromEnv(fs *flag.FlagSet, name string) {
+	if v, ok := os.LookupEnv(envName(name)); ok {
+		if err := fs.Set(name, v); err != nil {
+			c.envErrs = append(c.envErrs, fmt.Sprintf("%s: invalid value %q in %s", name, v, envName(name)))
+		}
+	}
+	c.names = append(c.names, name)
+}
+
+// BindFlags registers the options with a flag set.
+func (c *Config) BindFlags(fs *flag.FlagSet) {
+	c.flags = fs
+	c.stringVar(fs, &c.Mode, "mode", envName("mode"), ModeAll,
+		"What to run: \"all\" for the controller and the image server, \"controller\" for just the controller, "+
+			"delegating to the image server at image-service-url, or \"image-server\" for just the image server "+
+			"and its registration API.")
+	c.stringVar(fs, &c.DeployISO, "deploy-iso", "DEPLOY_ISO", "",
+		"The base RHCOS live ISO. Required unless image-service-url or deploy-iso-url is set. "+
+			"If it does not exist yet, the image server starts degraded, and serves images once it appears.")
+	c.stringVar(fs, &c.DeployISOURL, "deploy-iso-url", envName("deploy-iso-url"), "",
+		"An http or https URL the base RHCOS live ISO is downloaded from at startup, instead of deploy-iso. "+
+			"Images are served once it has been downloaded and verified against deploy-iso-sha256.")
+	c.stringVar(fs, &c.DeployISOSHA256, "deploy-iso-sha256", envName("deploy-iso-sha256"), "",
+		"The SHA256 digest of the ISO at deploy-iso-url.")
+	c.stringVar(fs, &c.DeployISODir, "deploy-iso-dir", envName("deploy-iso-dir"), os.TempDir(),
+		"The directory the ISO at deploy-iso-url or of deploy-iso-stream is downloaded to. A persistent volume avoids downloading it again after a restart.")
+	c.stringVar(fs, &c.DeployISOStream, "deploy-iso-stream", envName("deploy-iso-stream"), "",
+		"The URL of CoreOS stream metadata, or the name of a Fedora CoreOS stream such as stable, that the base live ISO "+
+			"is resolved from and downloaded at startup, instead of deploy-iso. Its digest is verified against the metadata.")
+	c.stringVar(fs, &c.DeployISOStreamArch, "deploy-iso-stream-arch", envName("deploy-iso-stream-arch"), "x86_64",
+		"The architecture whose live ISO is selected from deploy-iso-stream.")
+	c.stringVar(fs, &c.archISOs, "arch-isos", "DEPLOY_ARCH_ISOS", "",
+		"Comma-separated arch=path pairs of base ISOs for other CPU architectures than that of deploy-iso, e.g. aarch64=/shared/rhcos-aarch64.iso.")
+	c.stringVar(fs, &c.baseISOs, "base-isos", "DEPLOY_BASE_ISOS", "",
+		"Comma-separated name=path pairs of alternative base ISOs, which PreprovisioningImages select with the "+
+			"image-customization.metal3.io/base-image label, e.g. rhcos-4.9=/shared/rhcos-4.9.iso.")
+	c.stringVar(fs, &c.genericEmbed, "generic-embed", envName("generic-embed"), "",
+		"How images embed their content in base ISOs that are not RHCOS live ISOs, e.g. other distributions' live media: "+
+			"\"raw:<file>\" writes it over a placeholder file in the ISO, and \"initrd:<file>:<path>\" writes an initramfs "+
+			"archive holding it at path over a placeholder the boot menu loads as an additional initrd.")
+	c.stringVar(fs, &c.ImagesBindAddr, "images-bind-addr", envName("images-bind-addr"), ":8084",
+		"The address the images endpoint binds to. Several comma-separated addresses, e.g. 0.0.0.0:8084,[::]:8084, "+
+			"give separate IPv4 and IPv6 listeners.")
+	c.stringVar(fs, &c.ImagesPublishAddr, "images-publish-addr", envName("images-publish-addr"), "http://127.0.0.1:8084",
+		"The URL clients would access the images endpoint from. IPv6 addresses are written in brackets, e.g. "+
+			"http://[fd00::1]:8084. On dual-stack networks, comma-separate one URL for each family and pick one with ip-family.")
+	c.stringVar(fs, &c.ImagesPublishFrom, "images-publish-from", envName("images-publish-from"), "",
+		"Derive images-publish-addr at startup: \"node\" from the node IPs in NODE_IP and the port in HOST_PORT, "+
+			"or \"service\" from the address of images-service.")
+	c.stringVar(fs, &c.ImagesService, "images-service", envName("images-service"), "",
+		"The [namespace/]name of the Service exposing the images endpoint, for images-publish-from=service. "+
+			"The namespace defaults to POD_NAMESPACE.")
+	c.stringVar(fs, &c.IPFamily, "ip-family", envName("ip-family"), "",
+		"The IP family, ipv4 or ipv6, of the images-publish-addr URL to advertise. Defaults to the first URL.")
+	c.stringVar(fs, &c.ImagesExternalURL, "images-external-url", envName("images-external-url"), "",
+		"The URL clients reach the images endpoint at through a route, ingress or load balancer. Overrides images-publish-addr.")
+	c.stringVar(fs, &c.ImagesPathPrefix, "images-path-prefix", envName("images-path-prefix"), "",
+		"A directory the images are served under, e.g. /images.")
+	c.stringVar(fs, &c.ImageExtension, "image-extension", envName("image-extension"), ".iso",
+		"The extension of image file names. Some Redfish implementations require URLs to end in .iso.")
+	c.stringVar(fs, &c.MetricsAddr, "metrics-addr", envName("metrics-addr"), ":8080",
+		"The address the metrics endpoint binds to. Keep it separate from the images endpoint.")
+	c.stringVar(fs, &c.HealthAddr, "health-addr", envName("health-addr"), ":9440",
+		"The address the /healthz and /readyz endpoints bind to.")
+	c.stringVar(fs, &c.DebugAddr, "debug-addr", envName("debug-addr"), "",
+		"The address a JSON listing of registered images is served on, for troubleshooting. Disabled if unset.")
+	c.stringVar(fs, &c.DebugTokenFile, "debug-token-file", envName("debug-token-file"), "",
+		"A file holding the bearer token required by the debug endpoint.")
+	c.stringVar(fs, &c.ImagesTLSCert, "images-tls-cert", envName("images-tls-cert"), "",
+		"A TLS certificate for the images endpoint. The endpoint uses plain HTTP if unset.")
+	c.stringVar(fs, &c.ImagesTLSKey, "images-tls-key", envName("images-tls-key"), "",
+		"The private key of the images endpoint TLS certificate.")
+	c.stringVar(fs, &c.ImagesClientCA, "images-client-ca", envName("images-client-ca"), "",
+		"A CA bundle used to verify client certificates. If set, clients must present a certificate to download images.")
+	c.stringVar(fs, &c.trustedProxies, "trusted-proxies", envName("trusted-proxies"), "",
+		"Comma-separated addresses or CIDR ranges of reverse proxies whose X-Forwarded-For headers identify clients.")
+	c.boolVar(fs, &c.UseForwardedURL, "use-forwarded-url", false,
+		"Give images URLs under the X-Forwarded-Proto and X-Forwarded-Host of requests from trusted-proxies, unless images-external-url is set.")
+	c.boolVar(fs, &c.OneTimeTokens, "one-time-tokens", false,
+		"Add a download token to image URLs that is invalidated after the first complete download of the image, or of its network boot initrd.")
+	c.durationVar(fs, &c.TokenGracePeriod, "token-grace-period", 10*time.Minute,
+		"How long a used download token keeps working, to allow resuming downloads.")
+	c.durationVar(fs, &c.ImageURLTTL, "image-url-ttl", 0,
+		"How long an image URL works before it is replaced by a fresh one, with a new download token. 0 disables rotation.")
+	c.stringVar(fs, &c.CacheDir, "cache-dir", envName("cache-dir"), "",
+		"A directory to generate images into ahead of download. Images are streamed on demand if unset.")
+	c.stringVar(fs, &c.CacheEncryptionKeyFile, "cache-encryption-key-file", envName("cache-encryption-key-file"), "",
+		"A file (e.g. a mounted Secret) holding an AES key used to encrypt images in the cache directory.")
+	c.stringVar(fs, &c.cacheKeyEnc, "cache-encryption-key-encoding", envName("cache-encryption-key-encoding"), string(imagehandler.KeyEncodingHex),
+		"How the key in cache-encryption-key-file is written: \"hex\", \"base64\" or \"raw\" bytes.")
+	c.stringVar(fs, &c.cacheStartup, "cache-startup-policy", envName("cache-startup-policy"), string(imagehandler.CacheKeep),
+		"What to do with the images in cache-dir at startup: \"keep\" them, \"purge\" them, or \"validate\" them, "+
+			"keeping only those built from the current base ISO whose size and checksum still match.")
+	c.stringVar(fs, &c.cacheShutdown, "cache-shutdown-policy", envName("cache-shutdown-policy"), string(imagehandler.CacheKeep),
+		"What to do with the images in cache-dir at shutdown: \"keep\" or \"purge\" them.")
+	c.intVar(fs, &c.MaxConcurrentGenerations, "max-concurrent-generations", 4,
+		"The maximum number of images generated at the same time.")
+	c.stringVar(fs, &c.memoryBudget, "memory-budget", envName("memory-budget"), "0",
+		"The total memory used for image copy buffers, by generation and downloads, e.g. 64Mi. 0 means no limit.")
+	c.stringVar(fs, &c.S3.Endpoint, "s3-endpoint", envName("s3-endpoint"), "https://s3.amazonaws.com",
+		"The URL of the S3-compatible service generated images are uploaded to.")
+	c.stringVar(fs, &c.S3.Bucket, "s3-bucket", envName("s3-bucket"), "",
+		"An S3 bucket to upload generated images to. Image URLs then point at presigned object URLs. "+
+			"Credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.")
+	c.stringVar(fs, &c.S3.Region, "s3-region", envName("s3-region"), "us-east-1",
+		"The region of the S3 bucket.")
+	c.stringVar(fs, &c.S3.Prefix, "s3-prefix", envName("s3-prefix"), "",
+		"A prefix for the keys of uploaded images.")
+	c.boolVar(fs, &c.S3.PathStyle, "s3-path-style", false,
+		"Address the S3 bucket in the URL path rather than the host name, as many S3-compatible services require.")
+	c.durationVar(fs, &c.S3.URLExpiry, "s3-url-expiry", 24*time.Hour,
+		"How long presigned image URLs remain valid. They are renewed by reconciles after half that time, "+
+			"so it should be well over the controller's resync period.")
+	c.stringVar(fs, &c.OCI.Repository, "oci-repository", envName("oci-repository"), "",
+		"A registry repository, e.g. registry.example.com/metal3/images, to push generated images to as OCI artifacts. "+
+			"Credentials are read from REGISTRY_USERNAME and REGISTRY_PASSWORD.")
+	c.stringVar(fs, &c.OCI.URLStyle, "oci-url-style", envName("oci-url-style"), objectstore.OCIURLBlob,
+		"The URLs published for images pushed to the registry: \"blob\" for the registry's blob URL, "+
+			"which requires anonymous pulls, or \"oci\" for an oci:// reference.")
+	c.boolVar(fs, &c.OCI.Insecure, "oci-insecure", false,
+		"Reach the registry over plain HTTP.")
+	c.stringVar(fs, &c.ExportDir, "export-dir", envName("export-dir"), "",
+		"A directory shared with the Ironic conductor to write generated images into.")
+	c.stringVar(fs, &c.ExportURL, "export-url", envName("export-url"), "",
+		"The URL the conductor reads export-dir at. Defaults to a file:// URL of export-dir.")
+	c.stringVar(fs, &c.ImageServiceURL, "image-service-url", envName("image-service-url"), "",
+		"The registration API URL of an image server running in image-server mode to delegate to, instead of serving images from this process. "+
+			"Implies controller mode.")
+	c.stringVar(fs, &c.ImageServiceTokenFile, "image-service-token-file", envName("image-service-token-file"), "",
+		"A file holding the bearer token for the external image server.")
+	c.stringVar(fs, &c.ImageServiceCA, "image-service-ca", envName("image-service-ca"), "",
+		"A CA bundle used to verify the certificate of the external image server.")
+	c.stringVar(fs, &c.ImageServiceClientCert, "image-service-client-cert", envName("image-service-client-cert"), "",
+		"A client certificate presented to the external image server, if it requires one.")
+	c.stringVar(fs, &c.ImageServiceClientKey, "image-service-client-key", envName("image-service-client-key"), "",
+		"The private key of the image-service-client-cert.")
+	c.stringVar(fs, &c.AssistedImageServiceURL, "assisted-image-service-url", envName("assisted-image-service-url"), "",
+		"The URL of an assisted-image-service to publish image URLs of, instead of serving images from this process. "+
+			"The service fetches the ignition of each image from assisted-ignition-addr, which must be its ASSISTED_SERVICE_HOST. "+
+			"Implies controller mode.")
+	c.stringVar(fs, &c.AssistedImageServiceVersion, "assisted-image-service-version", envName("assisted-image-service-version"), "",
+		"The RHCOS version, a key of the assisted-image-service's RHCOS_VERSIONS, that images are built from. "+
+			"The image-customization.metal3.io/base-image label selects another.")
+	c.stringVar(fs, &c.AssistedImageServiceImageType, "assisted-image-service-image-type", envName("assisted-image-service-image-type"),
+		imagehandler.AssistedImageFull,
+		"The type of images the assisted-image-service builds: \"full\" or \"minimal\".")
+	c.stringVar(fs, &c.AssistedImageServiceAPIKeyFile, "assisted-image-service-api-key-file", envName("assisted-image-service-api-key-file"), "",
+		"A file holding the API key added to image URLs, which the assisted-image-service must present when it fetches "+
+			"the ignition, as its REQUEST_AUTH_TYPE configures.")
+	c.stringVar(fs, &c.AssistedImageServiceCA, "assisted-image-service-ca", envName("assisted-image-service-ca"), "",
+		"A CA bundle used to verify the certificate of the assisted-image-service.")
+	c.stringVar(fs, &c.AssistedIgnitionAddr, "assisted-ignition-addr", envName("assisted-ignition-addr"), ":8090",
+		"The address the ignition of images is served to the assisted-image-service on.")
+	c.intVar(fs, &c.ControllerVerbosity, "controller-verbosity", 0,
+		"The log verbosity of the PreprovisioningImage controller.")
+	c.intVar(fs, &c.ImagesVerbosity, "images-verbosity", 0,
+		"The log verbosity of the images endpoint.")
+	c.intVar(fs, &c.ConverterVerbosity, "converter-verbosity", 0,
+		"The log verbosity of network data conversion.")
+	c.intVar(fs, &c.CacheVerbosity, "cache-verbosity", 0,
+		"The log verbosity of the image cache.")
+	c.stringVar(fs, &c.APIAddr, "api-addr", envName("api-addr"), "",
+		"The address the image registration API binds to, for remote controllers and other clients. Disabled if unset.")
+	c.stringVar(fs, &c.APITokenFile, "api-token-file", envName("api-token-file"), "",
+		"A file holding the bearer token required by the registration API. Required by api-addr unless api-client-ca is set.")
+	c.stringVar(fs, &c.APITLSCert, "api-tls-cert", envName("api-tls-cert"), "",
+		"A TLS certificate for the registration API. The API uses plain HTTP if unset.")
+	c.stringVar(fs, &c.APITLSKey, "api-tls-key", envName("api-tls-key"), "",
+		"The private key of the registration API TLS certificate.")
+	c.stringVar(fs, &c.APIClientCA, "api-client-ca", envName("api-client-ca"), "",
+		"A CA bundle used to verify client certificates. If set, clients of the registration API must present a certificate.")
+
+	// From CAPI point of view, BMO should be able to watch all namespaces
+	// in case of a deployment that is not multi-tenant. If the deployment
+	// is for multi-tenancy, then the BMO should watch only the provided
+	// namespace.
+	c.stringVar(fs, &c.Namespace, "namespace", "WATCH_NAMESPACE", "",
+		"Namespace that the controller watches to reconcile host resources.")
+	c.boolVar(fs, &c.DevLogging, "dev", false,
+		"Log in the human-readable development format.")
+	c.intVar(fs, &c.MaxImagesInMemory, "max-images-in-memory", 0,
+		"The number of generated images whose ignition content is kept in memory. The content of the least recently "+
+			"used ones is rebuilt from the PreprovisioningImage when they are next downloaded. 0 means no limit.")
+	c.durationVar(fs, &c.GenerationTimeout, "generation-timeout", 30*time.Minute,
+		"How long generating an image may take before it fails and is retried. 0 means no limit.")
+	c.boolVar(fs, &c.RandomFileNames, "random-file-names", false,
+		"Serve images under random UUIDs instead of names derived from the PreprovisioningImage.")
+	c.stringVar(fs, &c.checksumType, "checksum-type", envName("checksum-type"), "",
+		"The algorithm used to checksum generated images: sha256 or sha512. No checksum is published if unset.")
+	c.durationVar(fs, &c.BaseImagePollInterval, "base-image-poll-interval", time.Minute,
+		"How often to check whether the base ISO has been replaced. 0 disables the check.")
+	c.durationVar(fs, &c.ImageGCInterval, "image-gc-interval", 10*time.Minute,
+		"How often to unregister images that no PreprovisioningImage refers to. In controller mode this includes "+
+			"images registered with the external image server by other clients. 0 disables garbage collection.")
+	c.durationVar(fs, &c.ProvisionedImageRetention, "provisioned-image-retention", 0,
+		"How long to keep serving the image of a host once it is provisioned. The image is then removed until the "+
+			"host is deprovisioned. 0 keeps images of provisioned hosts.")
+	c.boolVar(fs, &c.RemoveDeprovisionedImages, "remove-deprovisioned-images", false,
+		"Remove the image of a host as soon as the host is deprovisioned or deleted, instead of waiting for garbage "+
+			"collection. It is generated again when the host next needs it.")
+	c.boolVar(fs, &c.WatchBaseImages, "watch-base-images", true,
+		"Watch the base ISO files for replacement, unregistering the images built from a replaced one until it "+
+			"has been validated and they are registered again.")
+	c.durationVar(fs, &c.ErrorStaleThreshold, "error-stale-threshold", 30*time.Minute,
+		"How long a PreprovisioningImage can be in error before it is counted as stale in the metrics.")
+	c.boolVar(fs, &c.PrewarmImages, "prewarm-images", true,
+		"Queue generation of the images of already Ready PreprovisioningImages at startup.")
+	c.boolVar(fs, &c.SweepStatus, "sweep-status", true,
+		"Check at startup that the URLs of Ready PreprovisioningImages can still be served, e.g. that their base ISO "+
+			"and NetworkData secret haven't changed, and withdraw those that can't until they are reconciled.")
+	c.boolVar(fs, &c.DryRun, "dry-run", false,
+		"Build the content of every image, validating the network data and other configuration it references, "+
+			"without registering images or updating PreprovisioningImages. The outcome is logged and recorded as an "+
+			"event on the PreprovisioningImage instead, e.g. to check the network data of a fleet before a maintenance window. "+
+			"Secrets are read without being claimed, the image cache is left alone and nothing is served.")
+	c.boolVar(fs, &c.DownloadEvents, "download-events", false,
+		"Record an event on the PreprovisioningImage each time its image is downloaded.")
+	c.boolVar(fs, &c.TraceSpans, "trace-spans", false,
+		"Export an OpenTelemetry span for each step of reconciling and generating an image, over OTLP/HTTP to the "+
+			"collector configured by the standard OTEL_EXPORTER_OTLP_* environment variables.")
+	c.boolVar(fs, &c.DownloadAnnotations, "download-annotations", false,
+		"Annotate the PreprovisioningImage with the time and client address of the last complete download of its image.")
+	c.stringVar(fs, &c.additionalIgnition, "additional-ignition-configmap", envName("additional-ignition-configmap"), "",
+		"The namespace/name of a ConfigMap whose \"ignition\" key is merged into every image.")
+	c.stringVar(fs, &c.pullSecret, "pull-secret", envName("pull-secret"), "",
+		"A namespace/name reference to the cluster pull secret, which is installed on every image.")
+	c.stringVar(fs, &c.sshKeySecret, "ssh-key-secret", envName("ssh-key-secret"), "",
+		"The namespace/name of a Secret whose \"authorized_keys\" are added to the core user of every image.")
+	c.stringVar(fs, &c.kernelArgs, "kernel-args", envName("kernel-args"), "",
+		"Space-separated kernel arguments added to every image, before those of the image-customization.metal3.io/kernel-args annotation.")
+	c.stringVar(fs, &c.archKernelArgs, "arch-kernel-args", envName("arch-kernel-args"), "",
+		"Semicolon-separated arch=args pairs of kernel arguments added to the images of a CPU architecture after kernel-args, "+
+			"e.g. \"aarch64=console=ttyAMA0;x86_64=console=ttyS0\".")
+	c.stringVar(fs, &c.BootConfig.VolumeLabel, "volume-label", envName("volume-label"), "",
+		"The volume label of images, replacing that of the base ISO. Overridden by the image-customization.metal3.io/volume-label annotation.")
+	c.stringVar(fs, &c.BootConfig.MenuTitle, "boot-menu-title", envName("boot-menu-title"), "",
+		"The title of the first boot menu entry of images. Overridden by the image-customization.metal3.io/boot-menu-title annotation.")
+	c.intVar(fs, &c.bootMenuDefault, "boot-menu-default", -1,
+		"The boot menu entry images boot by default, counting from 0, or -1 to keep that of the base ISO. "+
+			"Overridden by the image-customization.metal3.io/boot-menu-default annotation.")
+	c.intVar(fs, &c.bootMenuTimeout, "boot-menu-timeout", -1,
+		"The seconds the boot menu of images waits before booting the default entry, or -1 to keep that of the base ISO. "+
+			"Overridden by the image-customization.metal3.io/boot-menu-timeout annotation.")
+	c.stringVar(fs, &c.ConfigFile, "config-file", envName("config-file"), "",
+		"A YAML file, typically a mounted ConfigMap, overriding the image base URLs, base ISOs, generation limits, "+
+			"retry delays, image streams and extra files. It is reloaded while running.")
+	c.durationVar(fs, &c.ConfigPollInterval, "config-poll-interval", 10*time.Second,
+		"How often to check config-file for changes.")
+	c.stringVar(fs, &c.networkMode, "network-mode", envName("network-mode"), string(metal3iocontroller.NetworkModeAuto),
+		"How hosts configure the provisioning network: \"dhcp\" ignores network data, \"static\" requires every "+
+			"PreprovisioningImage to have network data, and \"auto\" embeds network data when there is some.")
+	c.stringVar(fs, &c.customizationMode, "customization-mode", envName("customization-mode"), string(metal3iocontroller.CustomizationModeIgnition),
+		"The content embedded in images: \"ignition\" embeds an ignition config for CoreOS live ISOs, and "+
+			"\"nm-keyfiles\" embeds only the NetworkManager keyfiles of the network data, as an initramfs archive.")
+	c.stringVar(fs, &c.initrdCompression, "initrd-compression", envName("initrd-compression"), string(initrd.CompressionNone),
+		"The compression of the initramfs archives embedded in images: \"none\", \"gzip\" or \"xz\".")
+	c.stringVar(fs, &c.imageNameTemplate, "image-name-template", envName("image-name-template"), "",
+		"A Go template for the file names images are served under, e.g. {{.Namespace}}_{{.Name}}-{{.Revision}}.iso, "+
+			"with the fields Namespace, Name, Revision (the PreprovisioningImage generation) and Extension. "+
+			"It must include both the namespace and the name. Defaults to the namespace and name joined by an "+
+			"underscore, followed by image-extension.")
+	c.intVar(fs, &c.shardCount, "shards", 1,
+		"The number of replicas PreprovisioningImages are divided between by consistent hashing. Each replica "+
+			"generates and serves only its own images, so images-publish-addr must route to the replica itself, "+
+			"e.g. http://$(POD_NAME).image-customization:8084 with a headless Service.")
+	c.stringVar(fs, &c.shardIndex, "shard", "POD_NAME", "",
+		"The index of this replica among the shards, or the name of its StatefulSet pod.")
+	c.boolVar(fs, &c.UseClusterProxy, "use-cluster-proxy", false,
+		"Take the proxy settings and trusted CA bundle of images from the OpenShift cluster-wide Proxy when it sets a proxy.")
+	c.stringVar(fs, &c.Proxy.HTTPProxy, "http-proxy", "HTTP_PROXY", "",
+		"The HTTP proxy to configure in the live image environment.")
+	c.stringVar(fs, &c.Proxy.HTTPSProxy, "https-proxy", "HTTPS_PROXY", "",
+		"The HTTPS proxy to configure in the live image environment.")
+	c.stringVar(fs, &c.Proxy.NoProxy, "no-proxy", "NO_PROXY", "",
+		"The hosts excluded from proxying in the live image environment.")
+}
+
+// Validate checks the options once flags have been parsed, and parses those
+// with structured values.
+func (c *Config) Validate() error {
+	errs := append([]string{}, c.envErrs...)
+	check := func(name string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+
+	switch c.Mode {
+	case ModeAll:
+		if c.ImageServiceURL != "" || c.AssistedImageServiceURL != "" {
+			c.Mode = ModeController
+		}
+	case ModeController:
+		if c.ImageServiceURL == "" && c.AssistedImageServiceURL == "" {
+			check("image-service-url", fmt.Errorf("image-service-url or assisted-image-service-url is required in %s mode", c.Mode))
+		}
+	case ModeImageServer:
+		if c.APIAddr == "" {
+			check("api-addr", fmt.Errorf("required in %s mode", c.Mode))
+		}
+		if c.ImageServiceURL != "" {
+			check("image-service-url", fmt.Errorf("not supported in %s mode", c.Mode))
+		}
+		if c.AssistedImageServiceURL != "" {
+			check("assisted-image-service-url", fmt.Errorf("not supported in %s mode", c.Mode))
+		}
+	default:
+		check("mode", fmt.Errorf("unknown mode %q", c.Mode))
+	}
+
+	if c.ImageServiceURL != "" {
+		check("image-service-url", validateURL(c.ImageServiceURL))
+		check("image-service-token-file", validateFile(c.ImageServiceTokenFile))
+		check("image-service-ca", validateFile(c.ImageServiceCA))
+		if (c.ImageServiceClientCert == "") != (c.ImageServiceClientKey == "") {
+			check("image-service-client-cert", errors.New("image-service-client-cert and image-service-client-key must be set together"))
+		}
+		check("image-service-client-cert", validateFile(c.ImageServiceClientCert))
+		check("image-service-client-key", validateFile(c.ImageServiceClientKey))
+		if c.AssistedImageServiceURL != "" {
+			check("assisted-image-service-url", errors.New("image-service-url and assisted-image-service-url are mutually exclusive"))
+		}
+	} else if c.AssistedImageServiceURL != "" {
+		check("assisted-image-service-url", validateURL(c.AssistedImageServiceURL))
+		if c.AssistedImageServiceVersion == "" {
+			check("assisted-image-service-version", errors.New("required by assisted-image-service-url"))
+		}
+		switch c.AssistedImageServiceImageType {
+		case imagehandler.AssistedImageFull, imagehandler.AssistedImageMinimal:
+		default:
+			check("assisted-image-service-image-type", fmt.Errorf("unknown image type %q", c.AssistedImageServiceImageType))
+		}
+		// the ignition served to the service holds the images' secrets
+		if c.AssistedImageServiceAPIKeyFile == "" {
+			check("assisted-image-service-api-key-file", errors.New("required by assisted-image-service-url"))
+		}
+		check("assisted-image-service-api-key-file", validateFile(c.AssistedImageServiceAPIKeyFile))
+		check("assisted-image-service-ca", validateFile(c.AssistedImageServiceCA))
+		check("assisted-ignition-addr", validateListener(c.AssistedIgnitionAddr, false))
+	} else if c.DeployISO == "" && c.DeployISOURL == "" && c.DeployISOStream == "" {
+		check("deploy-iso", errors.New("a base ISO is required"))
+	}
+	check("deploy-iso", validateBaseISO(c.DeployISO))
+	if c.DeployISOURL != "" {
+		if c.DeployISO != "" {
+			check("deploy-iso-url", errors.New("deploy-iso and deploy-iso-url are mutually exclusive"))
+		}
+		check("deploy-iso-url", validateURL(c.DeployISOURL))
+		check("deploy-iso-sha256", validateSHA256(c.DeployISOSHA256))
+		check("deploy-iso-dir", validateWritableDir(c.DeployISODir))
+	}
+	if c.DeployISOStream != "" {
+		if c.DeployISO != "" || c.DeployISOURL != "" {
+			check("deploy-iso-stream", errors.New("deploy-iso, deploy-iso-url and deploy-iso-stream are mutually exclusive"))
+		}
+		if strings.Contains(c.DeployISOStream, "://") {
+			check("deploy-iso-stream", validateURL(c.DeployISOStream))
+		} else if strings.ContainsAny(c.DeployISOStream, "/?#") {
+			check("deploy-iso-stream", fmt.Errorf("invalid stream name %q", c.DeployISOStream))
+		}
+		if c.DeployISOStreamArch == "" {
+			check("deploy-iso-stream-arch", errors.New("required by deploy-iso-stream"))
+		}
+		check("deploy-iso-dir", validateWritableDir(c.DeployISODir))
+	}
+
+	var err error
+	c.ArchISOs, err = parseISOFiles(c.archISOs, "arch")
+	check("arch-isos", err)
+	c.BaseISOs, err = parseISOFiles(c.baseISOs, "name")
+	check("base-isos", err)
+	c.GenericEmbed, err = imagehandler.ParseEmbedStrategy(c.genericEmbed)
+	check("generic-embed", err)
+
+	switch c.ImagesPublishFrom {
+	case "", PublishFromNode:
+	case PublishFromService:
+		if c.ImagesService == "" {
+			check("images-service", errors.New("required by images-publish-from=service"))
+		}
+	default:
+		check("images-publish-from", fmt.Errorf("unknown source %q", c.ImagesPublishFrom))
+	}
+	if c.IPFamily != "" && c.IPFamily != IPv4 && c.IPFamily != IPv6 {
+		check("ip-family", fmt.Errorf("unknown IP family %q", c.IPFamily))
+	} else {
+		c.ImagesPublishAddr, err = selectBaseURL(c.ImagesPublishAddr, c.IPFamily)
+		check("images-publish-addr", err)
+	}
+	if c.ImagesExternalURL != "" {
+		_, err = imagehandler.ParseBaseURL(c.ImagesExternalURL)
+		check("images-external-url", err)
+	}
+	_, err = imagehandler.ParsePathPrefix(c.ImagesPathPrefix)
+	check("images-path-prefix", err)
+	if strings.Contains(c.ImageExtension, "/") {
+		check("image-extension", errors.New("must not contain a slash"))
+	}
+
+	c.ImagesBindAddrs = nil
+	for _, addr := range strings.Split(c.ImagesBindAddr, ",") {
+		addr = strings.TrimSpace(addr)
+		check("images-bind-addr", validateListener(addr, false))
+		c.ImagesBindAddrs = append(c.ImagesBindAddrs, addr)
+	}
+	check("metrics-addr", validateListener(c.MetricsAddr, true))
+	check("health-addr", validateListener(c.HealthAddr, true))
+	if c.DebugAddr != "" {
+		check("debug-addr", validateListener(c.DebugAddr, false))
+		if c.DebugTokenFile == "" {
+			check("debug-token-file", errors.New("required by debug-addr"))
+		}
+	}
+	check("debug-token-file", validateFile(c.DebugTokenFile))
+	if c.APIAddr != "" {
+		if c.ImageServiceURL != "" || c.AssistedImageServiceURL != "" {
+			check("api-addr", errors.New("cannot serve the registration API of an external image server"))
+		}
+		check("api-addr", validateListener(c.APIAddr, false))
+		// registered images are served to hosts as they are
+		if c.APITokenFile == "" && c.APIClientCA == "" {
+			check("api-token-file", errors.New("api-token-file or api-client-ca is required by api-addr"))
+		}
+	}
+	check("api-token-file", validateFile(c.APITokenFile))
+	if (c.APITLSCert == "") != (c.APITLSKey == "") {
+		check("api-tls-cert", errors.New("api-tls-cert and api-tls-key must be set together"))
+	}
+	if c.APIClientCA != "" && c.APITLSCert == "" {
+		check("api-client-ca", errors.New("requires api-tls-cert"))
+	}
+	check("api-tls-cert", validateFile(c.APITLSCert))
+	check("api-tls-key", validateFile(c.APITLSKey))
+	check("api-client-ca", validateFile(c.APIClientCA))
+
+	if (c.ImagesTLSCert == "") != (c.ImagesTLSKey == "") {
+		check("images-tls-cert", errors.New("images-tls-cert and images-tls-key must be set together"))
+	}
+	if c.ImagesClientCA != "" && c.ImagesTLSCert == "" {
+		check("images-client-ca", errors.New("requires images-tls-cert"))
+	}
+	check("images-tls-cert", validateFile(c.ImagesTLSCert))
+	check("images-tls-key", validateFile(c.ImagesTLSKey))
+	check("images-client-ca", validateFile(c.ImagesClientCA))
+
+	c.TrustedProxies, err = imagehandler.ParseTrustedProxies(c.trustedProxies)
+	check("trusted-proxies", err)
+	if c.UseForwardedURL && len(c.TrustedProxies) == 0 {
+		check("use-forwarded-url", errors.New("requires trusted-proxies"))
+	}
+	if c.TokenGracePeriod < 0 {
+		check("token-grace-period", errors.New("must not be negative"))
+	}
+	if c.ImageURLTTL < 0 {
+		check("image-url-ttl", errors.New("must not be negative"))
+	}
+
+	storageBackends := 0
+	for _, value := range []string{c.S3.Bucket, c.OCI.Repository, c.ExportDir} {
+		if value != "" {
+			storageBackends++
+		}
+	}
+	if storageBackends > 1 {
+		check("s3-bucket", errors.New("s3-bucket, oci-repository and export-dir are mutually exclusive"))
+	}
+	if c.S3.Bucket != "" {
+		check("s3-endpoint", validateURL(c.S3.Endpoint))
+		if c.S3.URLExpiry <= 0 {
+			check("s3-url-expiry", errors.New("must be positive"))
+		}
+	}
+	if c.OCI.Repository != "" {
+		switch c.OCI.URLStyle {
+		case objectstore.OCIURLBlob, objectstore.OCIURLReference:
+		default:
+			check("oci-url-style", fmt.Errorf("unknown URL style %q", c.OCI.URLStyle))
+		}
+	}
+	if c.ExportDir != "" {
+		check("export-dir", validateWritableDir(c.ExportDir))
+	} else if c.ExportURL != "" {
+		check("export-url", errors.New("requires export-dir"))
+	}
+
+	for _, verbosity := range []struct {
+		name  string
+		value int
+	}{
+		{"controller-verbosity", c.ControllerVerbosity},
+		{"images-verbosity", c.ImagesVerbosity},
+		{"converter-verbosity", c.ConverterVerbosity},
+		{"cache-verbosity", c.CacheVerbosity},
+	} {
+		if verbosity.value < 0 {
+			check(verbosity.name, errors.New("must not be negative"))
+		}
+	}
+
+	if c.CacheDir != "" {
+		check("cache-dir", validateWritableDir(c.CacheDir))
+	}
+	check("cache-encryption-key-file", validateFile(c.CacheEncryptionKeyFile))
+	c.CacheEncryptionKeyEncoding, err = imagehandler.ParseKeyEncoding(c.cacheKeyEnc)
+	check("cache-encryption-key-encoding", err)
+	c.CacheStartupPolicy, err = imagehandler.ParseCachePolicy(c.cacheStartup)
+	check("cache-startup-policy", err)
+	c.CacheShutdownPolicy, err = imagehandler.ParseCachePolicy(c.cacheShutdown)
+	check("cache-shutdown-policy", err)
+	if c.CacheShutdownPolicy == imagehandler.CacheValidate {
+		check("cache-shutdown-policy", errors.New("cached images can only be validated at startup"))
+	}
+	if c.DryRun && c.Mode == ModeImageServer {
+		check("dry-run", fmt.Errorf("not supported in %s mode, only the controller builds images in a dry run", c.Mode))
+	}
+	if c.MaxImagesInMemory < 0 {
+		check("max-images-in-memory", errors.New("must not be negative"))
+	} else if c.MaxImagesInMemory > 0 && c.Mode == ModeImageServer {
+		check("max-images-in-memory", fmt.Errorf("not supported in %s mode, evicted images can only be rebuilt by the controller", c.Mode))
+	}
+	if c.MaxConcurrentGenerations < 1 {
+		check("max-concurrent-generations", errors.New("must be at least 1"))
+	}
+	c.MemoryBudget, err = resource.ParseQuantity(c.memoryBudget)
+	check("memory-budget", err)
+	if err == nil && c.MemoryBudget.Sign() < 0 {
+		check("memory-budget", errors.New("must not be negative"))
+	}
+
+	c.AdditionalIgnitionConfigMap, err = parseNamespacedName(c.additionalIgnition)
+	check("additional-ignition-configmap", err)
+	c.SSHKeySecret, err = parseNamespacedName(c.sshKeySecret)
+	check("ssh-key-secret", err)
+	c.PullSecret, err = parseNamespacedName(c.pullSecret)
+	check("pull-secret", err)
+	c.KernelArgs = strings.Fields(c.kernelArgs)
+	c.ArchKernelArgs, err = metal3iocontroller.ParseArchKernelArgs(c.archKernelArgs)
+	check("arch-kernel-args", err)
+	c.BootConfig.MenuDefault, c.BootConfig.MenuTimeout = nil, nil
+	if c.bootMenuDefault >= 0 {
+		menuDefault := c.bootMenuDefault
+		c.BootConfig.MenuDefault = &menuDefault
+	}
+	if c.bootMenuTimeout >= 0 {
+		menuTimeout := c.bootMenuTimeout
+		c.BootConfig.MenuTimeout = &menuTimeout
+	}
+	check("boot configuration", c.BootConfig.Validate())
+	c.NetworkMode, err = metal3iocontroller.ParseNetworkMode(c.networkMode)
+	check("network-mode", err)
+	c.CustomizationMode, err = metal3iocontroller.ParseCustomizationMode(c.customizationMode)
+	check("customization-mode", err)
+	c.InitrdCompression, err = initrd.ParseCompression(c.initrdCompression)
+	check("initrd-compression", err)
+	c.ImageNameTemplate = nil
+	if c.imageNameTemplate != "" {
+		c.ImageNameTemplate, err = metal3iocontroller.ParseImageNameTemplate(c.imageNameTemplate)
+		check("image-name-template", err)
+	}
+	c.ChecksumType, err = imagehandler.ParseChecksumType(c.checksumType)
+	check("checksum-type", err)
+	c.Shard, err = sharding.Parse(c.shardIndex, c.shardCount)
+	check("shard", err)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Summary returns the effective options as key/value pairs for logging.
+// Proxy URLs are logged without their credentials.
+func (c *Config) Summary() []interface{} {
+	summary := []interface{}{}
+	for _, name := range c.names {
+		value := c.flags.Lookup(name).Value.String()
+		if name == "http-proxy" || name == "https-proxy" {
+			value = redactURL(value)
+		}
+		summary = append(summary, name, value)
+	}
+	return summary
+}
+
+// redactURL replaces the password of a URL with "xxxxx".
+func redactURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+	return u.Redacted()
+}
+
+// parseNamespacedName parses a "namespace/name" option value. An empty value
+// yields an empty NamespacedName.
+func parseNamespacedName(value string) (types.NamespacedName, error) {
+	if value == "" {
+		return types.NamespacedName{}, nil
+	}
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return types.NamespacedName{}, fmt.Errorf("%q is not of the form namespace/name", value)
+	}
+	return types.NamespacedName{Namespace: parts[0], Name: parts[1]}, nil
+}
+
+// parseISOFiles parses a comma-separated list of key=path pairs, checking
+// that the files exist.
+func parseISOFiles(value string, key string) (map[string]string, error) {
+	isoFiles := map[string]string{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%q is not of the form %s=path", entry, key)
+		}
+		if err := validateBaseISO(parts[1]); err != nil {
+			return nil, err
+		}
+		isoFiles[parts[0]] = parts[1]
+	}
+	return isoFiles, nil
+}
+
+func validateURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q is not an absolute http or https URL", value)
+	}
+	return nil
+}
+
+// selectBaseURL picks the URL of an IP family from a comma-separated list.
+// URLs with a DNS name match either family. Without a family the first URL
+// is used.
+func selectBaseURL(value, family string) (string, error) {
+	for _, entry := range strings.Split(value, ",") {
+		u, err := imagehandler.ParseBaseURL(strings.TrimSpace(entry))
+		if err != nil {
+			return "", err
+		}
+		ip := imagehandler.HostIP(u.Hostname())
+		if family == "" || ip == nil || (ip.To4() != nil) == (family == IPv4) {
+			return u.String(), nil
+		}
+	}
+	return "", fmt.Errorf("no %s URL in %q", family, value)
+}
+
+// validateListener checks a listen address. Some listeners can be disabled
+// with "0".
+func validateListener(value string, canDisable bool) error {
+	if canDisable && value == "0" {
+		return nil
+	}
+	_, _, err := net.SplitHostPort(value)
+	return err
+}
+
+// validateFile checks that a file, if set, exists and is not a directory.
+func validateSHA256(digest string) error {
+	if _, err := hex.DecodeString(digest); err != nil || len(digest) != sha256.Size*2 {
+		return fmt.Errorf("%q is not a hex SHA256 digest", digest)
+	}
+	return nil
+}
+
+func validateFile(path string) error {
+	if path == "" {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	return nil
+}
+
+// validateBaseISO checks that a base ISO, if set, is not a directory. It
+// need not exist yet: the image server starts degraded without it, and
+// recovers once it appears.
+func validateBaseISO(path string) error {
+	if err := validateFile(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func validateWritableDir(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	probe, err := os.CreateTemp(path, "config-check.tmp-*")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
@@ -0,0 +1,193 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// PublishFromNode advertises the images endpoint at the IP addresses of
+	// the node, taken from the NODE_IP environment variable, and the port
+	// in HOST_PORT, as for a pod using host networking or a host port.
+	PublishFromNode = "node"
+	// PublishFromService advertises the images endpoint at the Service
+	// named by ImagesService: its node port on the node's IP addresses for
+	// a NodePort Service, its load balancer for a LoadBalancer Service, and
+	// otherwise its cluster IPs.
+	PublishFromService = "service"
+)
+
+// DetectPublishAddr replaces ImagesPublishAddr with a URL derived from the
+// environment, if ImagesPublishFrom asks for one. The reader is only used
+// to look up the Service.
+func (c *Config) DetectPublishAddr(ctx context.Context, reader client.Reader) error {
+	var hosts []string
+	var port int32
+	var err error
+	switch c.ImagesPublishFrom {
+	case "":
+		return nil
+	case PublishFromNode:
+		hosts, port, err = c.nodeEndpoints()
+	case PublishFromService:
+		hosts, port, err = c.serviceEndpoints(ctx, reader)
+	default:
+		err = fmt.Errorf("unknown source %q", c.ImagesPublishFrom)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to detect the images URL: %w", err)
+	}
+
+	scheme := "http"
+	if c.ImagesTLSCert != "" {
+		scheme = "https"
+	}
+	urls := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		u := url.URL{Scheme: scheme, Host: net.JoinHostPort(host, strconv.Itoa(int(port)))}
+		urls = append(urls, u.String())
+	}
+	publishAddr, err := selectBaseURL(strings.Join(urls, ","), c.IPFamily)
+	if err != nil {
+		return fmt.Errorf("unable to detect the images URL: %w", err)
+	}
+	c.ImagesPublishAddr = publishAddr
+	return nil
+}
+
+// nodeIPs returns the node's IP addresses from the downward API, which
+// gives a comma-separated list for status.hostIPs.
+func nodeIPs() ([]string, error) {
+	ips := []string{}
+	for _, ip := range strings.Split(os.Getenv("NODE_IP"), ",") {
+		if ip = strings.TrimSpace(ip); ip != "" {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, errors.New("NODE_IP is not set")
+	}
+	return ips, nil
+}
+
+// bindPort returns the port of the first images listener.
+func (c *Config) bindPort() (int32, error) {
+	addr := c.ImagesBindAddr
+	if len(c.ImagesBindAddrs) > 0 {
+		addr = c.ImagesBindAddrs[0]
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(port, 10, 32)
+	return int32(n), err
+}
+
+func (c *Config) nodeEndpoints() ([]string, int32, error) {
+	ips, err := nodeIPs()
+	if err != nil {
+		return nil, 0, err
+	}
+	if hostPort := os.Getenv("HOST_PORT"); hostPort != "" {
+		port, err := strconv.ParseInt(hostPort, 10, 32)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid HOST_PORT %q", hostPort)
+		}
+		return ips, int32(port), nil
+	}
+	port, err := c.bindPort()
+	return ips, port, err
+}
+
+func (c *Config) serviceEndpoints(ctx context.Context, reader client.Reader) ([]string, int32, error) {
+	name, err := c.imagesService()
+	if err != nil {
+		return nil, 0, err
+	}
+	service := &corev1.Service{}
+	if err := reader.Get(ctx, name, service); err != nil {
+		return nil, 0, err
+	}
+	servicePort, err := c.imagesServicePort(service)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch service.Spec.Type {
+	case corev1.ServiceTypeNodePort:
+		ips, err := nodeIPs()
+		return ips, servicePort.NodePort, err
+	case corev1.ServiceTypeLoadBalancer:
+		hosts := []string{}
+		for _, ingress := range service.Status.LoadBalancer.Ingress {
+			if ingress.IP != "" {
+				hosts = append(hosts, ingress.IP)
+			} else if ingress.Hostname != "" {
+				hosts = append(hosts, ingress.Hostname)
+			}
+		}
+		if len(hosts) == 0 {
+			return nil, 0, fmt.Errorf("service %s has no load balancer address yet", name)
+		}
+		return hosts, servicePort.Port, nil
+	}
+	hosts := []string{}
+	for _, ip := range append([]string{service.Spec.ClusterIP}, service.Spec.ClusterIPs...) {
+		if ip != "" && ip != corev1.ClusterIPNone && !contains(hosts, ip) {
+			hosts = append(hosts, ip)
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, 0, fmt.Errorf("service %s has no cluster IP", name)
+	}
+	return hosts, servicePort.Port, nil
+}
+
+// imagesService returns the name of the Service, whose namespace defaults
+// to that of the pod.
+func (c *Config) imagesService() (types.NamespacedName, error) {
+	parts := strings.SplitN(c.ImagesService, "/", 2)
+	if len(parts) == 1 {
+		parts = []string{os.Getenv("POD_NAMESPACE"), parts[0]}
+	}
+	if parts[0] == "" || parts[1] == "" {
+		return types.NamespacedName{}, fmt.Errorf("%q is not of the form namespace/name, and POD_NAMESPACE is not set", c.ImagesService)
+	}
+	return types.NamespacedName{Namespace: parts[0], Name: parts[1]}, nil
+}
+
+// imagesServicePort finds the port of a Service that leads to the images
+// endpoint: the one named "images", the one targeting the images listener,
+// or the only one.
+func (c *Config) imagesServicePort(service *corev1.Service) (corev1.ServicePort, error) {
+	bindPort, _ := c.bindPort()
+	for _, port := range service.Spec.Ports {
+		if port.Name == "images" || (bindPort != 0 && port.TargetPort.IntValue() == int(bindPort)) {
+			return port, nil
+		}
+	}
+	if len(service.Spec.Ports) == 1 {
+		return service.Spec.Ports[0], nil
+	}
+	return corev1.ServicePort{}, fmt.Errorf("no port of Service %s/%s leads to the images endpoint", service.Namespace, service.Name)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
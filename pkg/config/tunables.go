@@ -0,0 +1,284 @@
+// Package config loads the settings of the controller that can be changed
+// while it is running.
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/go-logr/logr"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/asalkeld/image-customization-controller/pkg/imagehandler"
+)
+
+// Tunables are the settings that can be changed at runtime through a YAML
+// file, typically a mounted ConfigMap. Settings missing from the file keep
+// the values given on the command line.
+type Tunables struct {
+	ImagesBaseURL            string             `json:"imagesBaseURL,omitempty"`
+	ImagesExternalURL        string             `json:"imagesExternalURL,omitempty"`
+	ArchISOs                 map[string]string  `json:"archISOs,omitempty"`
+	BaseISOs                 map[string]string  `json:"baseISOs,omitempty"`
+	MaxConcurrentGenerations int                `json:"maxConcurrentGenerations,omitempty"`
+	MemoryBudget             *resource.Quantity `json:"memoryBudget,omitempty"`
+	ErrorRetryMinDelay       *metav1.Duration   `json:"errorRetryMinDelay,omitempty"`
+	ErrorRetryMaxDelay       *metav1.Duration   `json:"errorRetryMaxDelay,omitempty"`
+	PendingRetryDelay        *metav1.Duration   `json:"pendingRetryDelay,omitempty"`
+	// GenerationAttempts is how many times generating an image is tried
+	// before its failure is final.
+	GenerationAttempts int `json:"generationAttempts,omitempty"`
+	// Streams are the image streams PreprovisioningImages select with the
+	// image-customization.metal3.io/stream annotation, by name.
+	Streams map[string]Stream `json:"streams,omitempty"`
+	// ExtraFiles are written to the live filesystem of every image.
+	ExtraFiles []ExtraFile `json:"extraFiles,omitempty"`
+}
+
+// Stream is a release of the live image, so that hosts can be provisioned
+// with either the old or the new release while a cluster is upgraded.
+type Stream struct {
+	// ISO is the path of the stream's base ISO. If unset, the stream uses
+	// the image server's base ISO of the same name, e.g. on an external
+	// image server.
+	ISO string `json:"iso,omitempty"`
+	// RootfsURL is where the live image fetches its root filesystem from,
+	// if not from the ISO.
+	RootfsURL string `json:"rootfsURL,omitempty"`
+	// KernelArgs are added to the kernel arguments of the stream's images.
+	KernelArgs []string `json:"kernelArgs,omitempty"`
+}
+
+// ExtraFile is a file written to the live filesystem of images, with the
+// content of a key of a ConfigMap or Secret.
+type ExtraFile struct {
+	// Path is the absolute path of the file.
+	Path string `json:"path"`
+	// Mode is the octal permission bits of the file as a string, e.g.
+	// "0600". Files are world-readable by default.
+	Mode      string `json:"mode,omitempty"`
+	ConfigMap string `json:"configMap,omitempty"`
+	Secret    string `json:"secret,omitempty"`
+	Namespace string `json:"namespace"`
+	Key       string `json:"key"`
+}
+
+// validate checks that the file is well-formed.
+func (f ExtraFile) validate() error {
+	if !path.IsAbs(f.Path) || path.Clean(f.Path) != f.Path {
+		return fmt.Errorf("path %q must be absolute and clean", f.Path)
+	}
+	if f.Mode != "" {
+		if mode, err := strconv.ParseUint(f.Mode, 8, 32); err != nil || mode > 07777 {
+			return fmt.Errorf("invalid mode %q", f.Mode)
+		}
+	}
+	if (f.ConfigMap == "") == (f.Secret == "") {
+		return errors.New("either a ConfigMap or a Secret is required")
+	}
+	if f.Namespace == "" || f.Key == "" {
+		return errors.New("a namespace and a key are required")
+	}
+	return nil
+}
+
+// NamedISOs returns the named base ISOs, including those of the streams.
+func (t Tunables) NamedISOs() map[string]string {
+	isoFiles := map[string]string{}
+	for name, isoPath := range t.BaseISOs {
+		isoFiles[name] = isoPath
+	}
+	for name, stream := range t.Streams {
+		if stream.ISO != "" {
+			isoFiles[name] = stream.ISO
+		}
+	}
+	return isoFiles
+}
+
+// overlay returns the settings with those set in other replacing them.
+func (t Tunables) overlay(other Tunables) Tunables {
+	if other.ImagesBaseURL != "" {
+		t.ImagesBaseURL = other.ImagesBaseURL
+	}
+	if other.ImagesExternalURL != "" {
+		t.ImagesExternalURL = other.ImagesExternalURL
+	}
+	if other.ArchISOs != nil {
+		t.ArchISOs = other.ArchISOs
+	}
+	if other.BaseISOs != nil {
+		t.BaseISOs = other.BaseISOs
+	}
+	if other.MaxConcurrentGenerations != 0 {
+		t.MaxConcurrentGenerations = other.MaxConcurrentGenerations
+	}
+	if other.MemoryBudget != nil {
+		t.MemoryBudget = other.MemoryBudget
+	}
+	if other.ErrorRetryMinDelay != nil {
+		t.ErrorRetryMinDelay = other.ErrorRetryMinDelay
+	}
+	if other.ErrorRetryMaxDelay != nil {
+		t.ErrorRetryMaxDelay = other.ErrorRetryMaxDelay
+	}
+	if other.PendingRetryDelay != nil {
+		t.PendingRetryDelay = other.PendingRetryDelay
+	}
+	if other.GenerationAttempts != 0 {
+		t.GenerationAttempts = other.GenerationAttempts
+	}
+	if other.Streams != nil {
+		t.Streams = other.Streams
+	}
+	if other.ExtraFiles != nil {
+		t.ExtraFiles = other.ExtraFiles
+	}
+	return t
+}
+
+// Validate checks that the settings are usable.
+func (t Tunables) Validate() error {
+	for name, value := range map[string]string{"imagesBaseURL": t.ImagesBaseURL, "imagesExternalURL": t.ImagesExternalURL} {
+		if value == "" {
+			continue
+		}
+		if _, err := imagehandler.ParseBaseURL(value); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	for _, isoFiles := range []map[string]string{t.ArchISOs, t.BaseISOs} {
+		for key, isoPath := range isoFiles {
+			if _, err := os.Stat(isoPath); err != nil {
+				return fmt.Errorf("base ISO for %q: %w", key, err)
+			}
+		}
+	}
+	for name, stream := range t.Streams {
+		if stream.ISO != "" {
+			if _, ok := t.BaseISOs[name]; ok {
+				return fmt.Errorf("stream %q: a base ISO has the same name", name)
+			}
+			if _, err := os.Stat(stream.ISO); err != nil {
+				return fmt.Errorf("stream %q: %w", name, err)
+			}
+		}
+		if stream.RootfsURL != "" {
+			if err := validateURL(stream.RootfsURL); err != nil {
+				return fmt.Errorf("stream %q: rootfsURL: %w", name, err)
+			}
+		}
+	}
+	paths := map[string]bool{}
+	for i, file := range t.ExtraFiles {
+		if err := file.validate(); err != nil {
+			return fmt.Errorf("extraFiles[%d]: %w", i, err)
+		}
+		if paths[file.Path] {
+			return fmt.Errorf("extraFiles[%d]: path %s is used more than once", i, file.Path)
+		}
+		paths[file.Path] = true
+	}
+	if t.MaxConcurrentGenerations < 0 {
+		return errors.New("maxConcurrentGenerations must not be negative")
+	}
+	if t.GenerationAttempts < 0 {
+		return errors.New("generationAttempts must not be negative")
+	}
+	if t.MemoryBudget != nil && t.MemoryBudget.Sign() < 0 {
+		return errors.New("memoryBudget must not be negative")
+	}
+	for name, delay := range map[string]*metav1.Duration{
+		"errorRetryMinDelay": t.ErrorRetryMinDelay,
+		"errorRetryMaxDelay": t.ErrorRetryMaxDelay,
+		"pendingRetryDelay":  t.PendingRetryDelay,
+	} {
+		if delay != nil && delay.Duration <= 0 {
+			return fmt.Errorf("%s must be positive", name)
+		}
+	}
+	if t.ErrorRetryMinDelay != nil && t.ErrorRetryMaxDelay != nil &&
+		t.ErrorRetryMinDelay.Duration > t.ErrorRetryMaxDelay.Duration {
+		return errors.New("errorRetryMinDelay must not exceed errorRetryMaxDelay")
+	}
+	return nil
+}
+
+// MemoryBudgetBytes returns the memory budget, zero meaning no limit.
+func (t Tunables) MemoryBudgetBytes() int64 {
+	if t.MemoryBudget == nil {
+		return 0
+	}
+	return t.MemoryBudget.Value()
+}
+
+// LoadTunables reads the settings file at path on top of the defaults, which
+// are assumed to have been validated already. A missing file yields the
+// defaults, so that the ConfigMap is optional.
+func LoadTunables(path string, defaults Tunables) (Tunables, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return defaults, nil
+	}
+	if err != nil {
+		return Tunables{}, err
+	}
+	file := Tunables{}
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return Tunables{}, fmt.Errorf("invalid configuration file %s: %w", path, err)
+	}
+	if err := file.Validate(); err != nil {
+		return Tunables{}, fmt.Errorf("invalid configuration file %s: %w", path, err)
+	}
+	tunables := defaults.overlay(file)
+	if tunables.ErrorRetryMinDelay != nil && tunables.ErrorRetryMaxDelay != nil &&
+		tunables.ErrorRetryMinDelay.Duration > tunables.ErrorRetryMaxDelay.Duration {
+		return Tunables{}, fmt.Errorf("invalid configuration file %s: errorRetryMinDelay must not exceed errorRetryMaxDelay", path)
+	}
+	return tunables, nil
+}
+
+// Watcher polls the settings file and applies changes to it. Invalid
+// changes are logged and ignored, keeping the previous settings.
+type Watcher struct {
+	Path     string
+	Interval time.Duration
+	Defaults Tunables
+	// Current is the settings in effect when the watcher starts.
+	Current Tunables
+	// Apply is called with the context of the watcher.
+	Apply func(context.Context, Tunables)
+	Log   logr.Logger
+}
+
+func (w *Watcher) Start(ctx context.Context) error {
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		tunables, err := LoadTunables(w.Path, w.Defaults)
+		if err != nil {
+			w.Log.Error(err, "ignoring configuration change")
+			continue
+		}
+		if apiequality.Semantic.DeepEqual(tunables, w.Current) {
+			continue
+		}
+		w.Log.Info("configuration changed", "path", w.Path)
+		w.Current = tunables
+		w.Apply(ctx, tunables)
+	}
+}
@@ -0,0 +1,92 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestLoadTunables(t *testing.T) {
+	dir := t.TempDir()
+	iso := filepath.Join(dir, "aarch64.iso")
+	if err := os.WriteFile(iso, []byte("iso"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defaults := Tunables{
+		ImagesBaseURL:            "http://localhost:8084",
+		MaxConcurrentGenerations: 4,
+		ErrorRetryMinDelay:       &metav1.Duration{Duration: 10 * time.Second},
+		ErrorRetryMaxDelay:       &metav1.Duration{Duration: 10 * time.Minute},
+	}
+	path := filepath.Join(dir, "config.yaml")
+
+	tunables, err := LoadTunables(path, defaults)
+	if err != nil || tunables.ImagesBaseURL != defaults.ImagesBaseURL {
+		t.Fatalf("expected the defaults without a file, got %+v (%v)", tunables, err)
+	}
+
+	if err := os.WriteFile(path, []byte("imagesBaseURL: http://images.example.com\n"+
+		"archISOs:\n  aarch64: "+iso+"\nerrorRetryMinDelay: 30s\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tunables, err = LoadTunables(path, defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tunables.ImagesBaseURL != "http://images.example.com" || tunables.ArchISOs["aarch64"] != iso ||
+		tunables.ErrorRetryMinDelay.Duration != 30*time.Second || tunables.MaxConcurrentGenerations != 4 {
+		t.Errorf("unexpected settings %+v", tunables)
+	}
+
+	if err := os.WriteFile(path, []byte("baseISOs:\n  rhcos-4.8: "+iso+"\nstreams:\n  rhcos-4.9:\n    iso: "+iso+"\n"+
+		"    rootfsURL: http://rootfs.example.com/rhcos.img\n    kernelArgs: [console=ttyS0]\n  rhcos-4.10: {}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tunables, err = LoadTunables(path, defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream := tunables.Streams["rhcos-4.9"]; stream.RootfsURL != "http://rootfs.example.com/rhcos.img" || len(stream.KernelArgs) != 1 {
+		t.Errorf("unexpected stream %+v", stream)
+	}
+	if isoFiles := tunables.NamedISOs(); len(isoFiles) != 2 || isoFiles["rhcos-4.9"] != iso {
+		t.Errorf("unexpected named base ISOs %v", isoFiles)
+	}
+
+	if err := os.WriteFile(path, []byte("extraFiles:\n- path: /etc/pki/ca-trust/source/anchors/lab.pem\n"+
+		"  configMap: lab-ca\n  namespace: openshift-machine-api\n  key: ca.pem\n"+
+		"- path: /etc/udev/rules.d/70-nic.rules\n  mode: \"0600\"\n  secret: nic-rules\n  namespace: openshift-machine-api\n  key: rules\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tunables, err = LoadTunables(path, defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tunables.ExtraFiles) != 2 || tunables.ExtraFiles[1].Secret != "nic-rules" || tunables.ExtraFiles[1].Mode != "0600" {
+		t.Errorf("unexpected extra files %+v", tunables.ExtraFiles)
+	}
+
+	for _, invalid := range []string{
+		"unknownSetting: 1\n",
+		"archISOs:\n  aarch64: " + filepath.Join(dir, "missing.iso") + "\n",
+		"errorRetryMinDelay: 1h\n",
+		"generationAttempts: -1\n",
+		"imagesBaseURL: not a url\n",
+		"streams:\n  rhcos-4.9:\n    iso: " + filepath.Join(dir, "missing.iso") + "\n",
+		"streams:\n  rhcos-4.9:\n    rootfsURL: ftp://rootfs.example.com/rhcos.img\n",
+		"baseISOs:\n  rhcos-4.9: " + iso + "\nstreams:\n  rhcos-4.9:\n    iso: " + iso + "\n",
+		"extraFiles:\n- path: etc/motd\n  configMap: motd\n  namespace: default\n  key: motd\n",
+		"extraFiles:\n- path: /etc/motd\n  configMap: motd\n  secret: motd\n  namespace: default\n  key: motd\n",
+		"extraFiles:\n- path: /etc/motd\n  mode: \"0999\"\n  configMap: motd\n  namespace: default\n  key: motd\n",
+	} {
+		if err := os.WriteFile(path, []byte(invalid), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadTunables(path, defaults); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package ignition
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/coreos/ignition/v2/config/v3_2"
+	"github.com/coreos/ignition/v2/config/v3_2/types"
+)
+
+// Version is the Ignition spec version of the configs generated here.
+const Version = "3.2.0"
+
+// Config is an Ignition v3.2 config. It uses the upstream Ignition types, so
+// that parsing and merging configs keeps every field they set.
+type Config = types.Config
+
+// Builder accumulates the pieces of a host's embedded ignition config.
+type Builder struct {
+	config Config
+}
+
+func NewBuilder() *Builder {
+	return &Builder{
+		config: Config{
+			Ignition: types.Ignition{Version: Version},
+		},
+	}
+}
+
+// AddFile adds a file with the given contents, replacing any previous file
+// at the same path.
+func (b *Builder) AddFile(path string, mode int, contents []byte) *Builder {
+	overwrite, source := true, dataURL(contents)
+	return b.Merge(&Config{
+		Storage: types.Storage{
+			Files: []types.File{{
+				Node: types.Node{Path: path, Overwrite: &overwrite},
+				FileEmbedded1: types.FileEmbedded1{
+					Mode:     &mode,
+					Contents: types.Resource{Source: &source},
+				},
+			}},
+		},
+	})
+}
+
+// Merge merges another config on top of the accumulated one, following the
+// Ignition merge rules: files, directories and units from the other config
+// replace those with the same path or name, and lists such as the SSH keys
+// of a user or the CAs to trust are combined.
+func (b *Builder) Merge(other *Config) *Builder {
+	if other == nil {
+		return b
+	}
+	b.config = v3_2.Merge(b.config, *other)
+	return b
+}
+
+// Build renders the accumulated config as JSON.
+func (b *Builder) Build() ([]byte, error) {
+	return json.Marshal(b.config)
+}
+
+// SSHKeys returns a config authorizing SSH keys for a user.
+func SSHKeys(user string, keys []string) *Config {
+	authorized := make([]types.SSHAuthorizedKey, len(keys))
+	for i, key := range keys {
+		authorized[i] = types.SSHAuthorizedKey(key)
+	}
+	return &Config{
+		Passwd: types.Passwd{
+			Users: []types.PasswdUser{
+				{Name: user, SSHAuthorizedKeys: authorized},
+			},
+		},
+	}
+}
+
+// Parse decodes and validates an ignition config. Configs of spec versions
+// 3.0 to 3.2 are translated to 3.2; later versions are refused, as fields
+// they add could not be kept.
+func Parse(data []byte) (*Config, error) {
+	config, report, err := v3_2.ParseCompatibleVersion(data)
+	if err != nil {
+		if len(report.Entries) > 0 {
+			return nil, fmt.Errorf("invalid ignition config: %w: %s", err, report.String())
+		}
+		return nil, fmt.Errorf("invalid ignition config: %w", err)
+	}
+	return &config, nil
+}
+
+func dataURL(contents []byte) string {
+	return "data:;base64," + base64.StdEncoding.EncodeToString(contents)
+}
@@ -0,0 +1,66 @@
+package ignition
+
+import (
+	"testing"
+)
+
+func TestMergeRoundTrip(t *testing.T) {
+	user, err := Parse([]byte(`{
+		"ignition": {
+			"version": "3.2.0",
+			"security": {"tls": {"certificateAuthorities": [{"source": "data:,user%20CA"}]}}
+		},
+		"storage": {
+			"directories": [{"path": "/etc/extra", "mode": 493}],
+			"files": [{"path": "/etc/motd", "contents": {"source": "data:,hello"}}]
+		},
+		"systemd": {"units": [{"name": "extra.service", "enabled": true, "contents": "[Unit]"}]}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := NewBuilder().
+		AddFile("/etc/motd", 0644, []byte("replaced")).
+		Merge(SSHKeys("core", []string{"ssh-ed25519 AAAA"})).
+		Merge(user).
+		Merge(SSHKeys("core", []string{"ssh-ed25519 AAAA", "ssh-ed25519 BBBB"})).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := Parse(content)
+	if err != nil {
+		t.Fatalf("built config %s does not parse: %v", content, err)
+	}
+
+	if cas := config.Ignition.Security.TLS.CertificateAuthorities; len(cas) != 1 || *cas[0].Source != "data:,user%20CA" {
+		t.Errorf("CAs not kept: %s", content)
+	}
+	if dirs := config.Storage.Directories; len(dirs) != 1 || dirs[0].Path != "/etc/extra" || *dirs[0].Mode != 0755 {
+		t.Errorf("directories not kept: %s", content)
+	}
+	if files := config.Storage.Files; len(files) != 1 || *files[0].Contents.Source != "data:,hello" {
+		t.Errorf("expected the user's file to replace the built one: %s", content)
+	}
+	if units := config.Systemd.Units; len(units) != 1 || units[0].Enabled == nil || !*units[0].Enabled {
+		t.Errorf("units not kept: %s", content)
+	}
+	if users := config.Passwd.Users; len(users) != 1 || len(users[0].SSHAuthorizedKeys) != 2 {
+		t.Errorf("expected the SSH keys of the core user to be combined: %s", content)
+	}
+}
+
+func TestParseUnsupported(t *testing.T) {
+	for _, data := range []string{
+		`{"ignition": {"version": "2.2.0"}}`,
+		// kernel arguments are only supported from spec 3.3
+		`{"ignition": {"version": "3.3.0"}, "kernelArguments": {"shouldExist": ["quiet"]}}`,
+		`{"ignition": {"version": "3.2.0"}, "storage": {"files": [{"path": "relative"}]}}`,
+		`not json`,
+	} {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("expected %s to be refused", data)
+		}
+	}
+}
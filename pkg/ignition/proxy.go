@@ -0,0 +1,59 @@
+package ignition
+
+import (
+	"fmt"
+	"strings"
+)
+
+// proxyEnvPath is a systemd manager drop-in that sets the default environment
+// of every unit on the live image.
+const proxyEnvPath = "/etc/systemd/system.conf.d/10-default-env.conf"
+
+// trustedCAPath is an anchor added to the system trust store when the live
+// image boots.
+const trustedCAPath = "/etc/pki/ca-trust/source/anchors/openshift-config-user-ca-bundle.crt"
+
+// ProxyConfig holds the proxy settings to apply on the live image.
+type ProxyConfig struct {
+	HTTPProxy  string
+	HTTPSProxy string
+	NoProxy    string
+}
+
+// IsEmpty returns true when no proxy is configured.
+func (p ProxyConfig) IsEmpty() bool {
+	return p.HTTPProxy == "" && p.HTTPSProxy == "" && p.NoProxy == ""
+}
+
+// AddProxy sets the proxy environment for all systemd units, in both upper
+// and lower case since tools disagree about which one they read.
+func (b *Builder) AddProxy(proxy ProxyConfig) *Builder {
+	if proxy.IsEmpty() {
+		return b
+	}
+
+	vars := []string{}
+	for _, env := range []struct{ name, value string }{
+		{"HTTP_PROXY", proxy.HTTPProxy},
+		{"HTTPS_PROXY", proxy.HTTPSProxy},
+		{"NO_PROXY", proxy.NoProxy},
+	} {
+		if env.value == "" {
+			continue
+		}
+		vars = append(vars,
+			fmt.Sprintf("%q", env.name+"="+env.value),
+			fmt.Sprintf("%q", strings.ToLower(env.name)+"="+env.value))
+	}
+	contents := "[Manager]\nDefaultEnvironment=" + strings.Join(vars, " ") + "\n"
+	return b.AddFile(proxyEnvPath, 0644, []byte(contents))
+}
+
+// AddTrustedCA adds a PEM bundle of CA certificates, such as those needed to
+// reach a TLS-intercepting proxy, to the trust store of the live image.
+func (b *Builder) AddTrustedCA(bundle []byte) *Builder {
+	if len(bundle) == 0 {
+		return b
+	}
+	return b.AddFile(trustedCAPath, 0644, bundle)
+}
@@ -0,0 +1,34 @@
+package ignition
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// pullSecretPath is where podman and crictl on the live image find registry
+// credentials for root.
+const pullSecretPath = "/root/.docker/config.json"
+
+// ValidatePullSecret checks that a pull secret is a Docker config JSON
+// document with credentials for at least one registry.
+func ValidatePullSecret(pullSecret []byte) error {
+	config := struct {
+		Auths map[string]json.RawMessage `json:"auths"`
+	}{}
+	if err := json.Unmarshal(pullSecret, &config); err != nil {
+		return err
+	}
+	if len(config.Auths) == 0 {
+		return errors.New("pull secret has no registry credentials")
+	}
+	return nil
+}
+
+// AddPullSecret installs registry credentials on the live image, so that it
+// can pull release payload images from authenticated registries.
+func (b *Builder) AddPullSecret(pullSecret []byte) *Builder {
+	if len(pullSecret) == 0 {
+		return b
+	}
+	return b.AddFile(pullSecretPath, 0600, pullSecret)
+}
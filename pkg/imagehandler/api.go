@@ -0,0 +1,93 @@
+package imagehandler
+
+import (
+	"errors"
+	"time"
+)
+
+// The registration API lets an image server run separately from the
+// controller that registers images with it. All paths are relative to the
+// server's API URL and requests may carry a bearer token. NewAPIHandler
+// serves it and NewRemoteImageServer is its client.
+//
+//	GET /api/v1/health         HealthResponse
+//	GET /api/v1/images         []RegisteredImage
+//	PUT /api/v1/images/{name}  RegistrationRequest -> ImageStatus
+//	GET /api/v1/images/{name}  ImageStatus
+//	DELETE /api/v1/images/{name}
+//
+// A registration selecting an unknown base image is rejected with 422
+// Unprocessable Entity, and one whose base image cannot be read with 503
+// Service Unavailable.
+const (
+	apiHealthPath = "/api/v1/health"
+	apiImagesPath = "/api/v1/images"
+)
+
+// RegistrationRequest registers, or re-registers, an image.
+type RegistrationRequest struct {
+	Architecture string `json:"architecture,omitempty"`
+	// BaseImage selects a named base image instead of that of the
+	// architecture.
+	BaseImage string `json:"baseImage,omitempty"`
+	// Ignition is the ignition config to embed, base64 encoded in JSON.
+	Ignition []byte `json:"ignition"`
+	// KernelArgs are appended to the default kernel arguments of the base
+	// image.
+	KernelArgs []string `json:"kernelArgs,omitempty"`
+	// Boot rewrites the volume label and boot menu of the base image.
+	Boot *BootConfig `json:"boot,omitempty"`
+	// ConfigDrive makes the image a config drive holding these files,
+	// base64 encoded in JSON.
+	ConfigDrive map[string][]byte `json:"configDrive,omitempty"`
+	// Replace requires the image to be registered already, and generates
+	// it again even if its content is unchanged.
+	Replace bool `json:"replace,omitempty"`
+}
+
+// ImageStatus reports the state of a registered image.
+type ImageStatus struct {
+	Name         string       `json:"name"`
+	URL          string       `json:"url"`
+	IPXEURL      string       `json:"ipxeURL,omitempty"`
+	InsURL       string       `json:"insURL,omitempty"`
+	Format       ImageFormat  `json:"format,omitempty"`
+	Size         int64        `json:"size,omitempty"`
+	Ready        bool         `json:"ready"`
+	Error        string       `json:"error,omitempty"`
+	Checksum     string       `json:"checksum,omitempty"`
+	ChecksumType ChecksumType `json:"checksumType,omitempty"`
+	// URLExpiry is when the URL stops working unless the image is
+	// registered again.
+	URLExpiry *time.Time `json:"urlExpiry,omitempty"`
+}
+
+// imageInfo describes the image a status reports on.
+func (s ImageStatus) imageInfo() ImageInfo {
+	info := ImageInfo{
+		URL:          s.URL,
+		IPXEURL:      s.IPXEURL,
+		InsURL:       s.InsURL,
+		Format:       s.Format,
+		Size:         s.Size,
+		Ready:        s.Ready,
+		Checksum:     s.Checksum,
+		ChecksumType: s.ChecksumType,
+	}
+	if info.Format == "" {
+		info.Format = ImageFormatISO
+	}
+	if s.Error != "" {
+		info.Error = errors.New(s.Error)
+	}
+	if s.URLExpiry != nil {
+		info.URLExpiry = *s.URLExpiry
+	}
+	return info
+}
+
+// HealthResponse reports whether the server can serve images.
+type HealthResponse struct {
+	BaseImageVersion string `json:"baseImageVersion"`
+	Error            string `json:"error,omitempty"`
+}
@@ -0,0 +1,184 @@
+package imagehandler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxRegistrationSize bounds the body of a registration request. Ignition
+// configs embedded in images are limited to far less by the embed area.
+const maxRegistrationSize = 16 << 20
+
+// NewAPIHandler returns a handler implementing the registration API for
+// server, so that a controller, or any other client, can register images
+// with it remotely. If token is set, requests must carry it as a bearer
+// token. It is meant to be served on its own listener, away from the images
+// endpoint.
+func NewAPIHandler(server ImageFileServer, token string) http.Handler {
+	api := &apiHandler{server: server}
+	mux := http.NewServeMux()
+	mux.HandleFunc(apiHealthPath, api.health)
+	mux.HandleFunc(apiImagesPath, api.list)
+	mux.HandleFunc(apiImagesPath+"/", api.image)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" && !hasBearerToken(r, token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// hasBearerToken reports whether a request carries token as its bearer
+// token.
+func hasBearerToken(r *http.Request, token string) bool {
+	auth := r.Header.Get("Authorization")
+	return strings.HasPrefix(auth, "Bearer ") &&
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1
+}
+
+type apiHandler struct {
+	server ImageFileServer
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+func (a *apiHandler) health(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	health := HealthResponse{}
+	version, err := a.server.BaseImageVersion(r.Context())
+	if err == nil {
+		err = a.server.CheckReady(r.Context())
+	}
+	health.BaseImageVersion = version
+	if err != nil {
+		health.Error = err.Error()
+	}
+	writeJSON(w, health)
+}
+
+func (a *apiHandler) list(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	images, err := a.server.ListImages(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, images)
+}
+
+// newImageStatus reports the state of a registered image in the API.
+func newImageStatus(name string, info ImageInfo) ImageStatus {
+	status := ImageStatus{
+		Name:         name,
+		URL:          info.URL,
+		IPXEURL:      info.IPXEURL,
+		InsURL:       info.InsURL,
+		Format:       info.Format,
+		Size:         info.Size,
+		Ready:        info.Ready,
+		Checksum:     info.Checksum,
+		ChecksumType: info.ChecksumType,
+	}
+	if info.Error != nil {
+		status.Error = info.Error.Error()
+	}
+	if !info.URLExpiry.IsZero() {
+		status.URLExpiry = &info.URLExpiry
+	}
+	return status
+}
+
+func (a *apiHandler) image(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, apiImagesPath+"/")
+	if name == "" || strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	status := ImageStatus{Name: name}
+	switch r.Method {
+	case http.MethodPut:
+		req := RegistrationRequest{}
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxRegistrationSize)).Decode(&req); err != nil {
+			http.Error(w, "invalid registration: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		spec := ImageSpec{
+			Name:        name,
+			Base:        BaseImage{Arch: req.Architecture, Name: req.BaseImage},
+			Ignition:    req.Ignition,
+			KernelArgs:  req.KernelArgs,
+			ConfigDrive: req.ConfigDrive,
+		}
+		if req.Boot != nil {
+			if err := req.Boot.Validate(); err != nil {
+				http.Error(w, "invalid registration: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			spec.Boot = *req.Boot
+		}
+		register := a.server.ServeImage
+		if req.Replace {
+			register = a.server.ReplaceImage
+		}
+		info, err := register(r.Context(), spec)
+		if errors.Is(err, ErrImageNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		if errors.Is(err, ErrUnknownBaseImage) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if errors.Is(err, ErrBaseISOUnavailable) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, newImageStatus(name, info))
+		return
+	case http.MethodGet:
+	case http.MethodDelete:
+		if err := a.server.RemoveImage(r.Context(), name); errors.Is(err, ErrImageNotFound) {
+			http.NotFound(w, r)
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		} else {
+			writeJSON(w, status)
+		}
+		return
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	info, err := a.server.GetImage(r.Context(), name)
+	if errors.Is(err, ErrImageNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, newImageStatus(name, info))
+}
@@ -0,0 +1,87 @@
+package imagehandler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPIHandler(t *testing.T) {
+	imageServer := newTestImageServer(t, Options{
+		IsoFile:      "default.iso",
+		BaseURL:      "http://localhost:8080",
+		ChecksumType: ChecksumSHA256,
+	},
+		&imageFile{
+			name:            "host-xyz-45.iso",
+			ignitionContent: []byte("asietonarst"),
+			generated:       true,
+			checksum:        "abc",
+		},
+	)
+	ts := httptest.NewServer(NewAPIHandler(imageServer, "s3cret"))
+	defer ts.Close()
+
+	request := func(method, path, token, body string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := request(http.MethodGet, apiImagesPath+"/host-xyz-45.iso", "", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected a request without the token to be rejected, got %s", resp.Status)
+	}
+	resp = request(http.MethodGet, apiImagesPath+"/host-xyz-45.iso", "wrong", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected a request with the wrong token to be rejected, got %s", resp.Status)
+	}
+
+	resp = request(http.MethodGet, apiImagesPath+"/host-xyz-45.iso", "s3cret", "")
+	status := ImageStatus{}
+	err := json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Ready || status.Checksum != "abc" || status.ChecksumType != ChecksumSHA256 {
+		t.Errorf("unexpected image status %+v", status)
+	}
+
+	resp = request(http.MethodGet, apiImagesPath+"/other.iso", "s3cret", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected an unknown image to be reported, got %s", resp.Status)
+	}
+
+	resp = request(http.MethodPut, apiImagesPath+"/other.iso", "s3cret", `{"baseImage": "missing", "ignition": "e30="}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("expected an unknown base image to be rejected, got %s", resp.Status)
+	}
+
+	resp = request(http.MethodGet, apiImagesPath, "s3cret", "")
+	images := []RegisteredImage{}
+	err = json.NewDecoder(resp.Body).Decode(&images)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[0].Name != "host-xyz-45.iso" {
+		t.Errorf("unexpected images listed: %+v", images)
+	}
+}
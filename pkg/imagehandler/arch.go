@@ -0,0 +1,48 @@
+package imagehandler
+
+import (
+	"fmt"
+
+	"github.com/openshift/assisted-image-service/pkg/isoeditor"
+)
+
+// efiBootLoaders are the removable media EFI boot loaders of each
+// architecture, which a live ISO for UEFI systems has in /EFI/BOOT of its
+// EFI system partition layout. The aarch64 layout chains grubaa64.efi, with
+// any devicetree loaded by the grub configuration, which is customized like
+// that of the other architectures.
+var efiBootLoaders = map[string][]string{
+	"x86_64":  {"/EFI/BOOT/BOOTX64.EFI", "/EFI/BOOT/bootx64.efi"},
+	"aarch64": {"/EFI/BOOT/BOOTAA64.EFI", "/EFI/BOOT/bootaa64.efi"},
+}
+
+// isoArchitecture returns the architecture a base ISO boots on, found from
+// its EFI boot loader, or "" if it has none we know.
+func isoArchitecture(isoPath string) string {
+	for arch, paths := range efiBootLoaders {
+		for _, path := range paths {
+			if _, _, err := isoeditor.GetISOFileInfo(path, isoPath); err == nil {
+				return arch
+			}
+		}
+	}
+	return ""
+}
+
+// checkArchitecture refuses to build an image for a host of one
+// architecture from a base ISO for another, e.g. when there is no base ISO
+// for the host's architecture and the default one is for x86_64.
+func checkArchitecture(base BaseImage, isoPath string) error {
+	if base.Arch == "" {
+		return nil
+	}
+	info, err := getISOInfo(isoPath)
+	if err != nil {
+		// generating the image reports why the ISO can't be read
+		return nil
+	}
+	if info.arch != "" && info.arch != base.Arch {
+		return fmt.Errorf("%w for architecture %s: base ISO %s is for %s", ErrUnknownBaseImage, base.Arch, isoPath, info.arch)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package imagehandler
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// buildAarch64LiveISO creates a minimal ISO laid out like the aarch64 RHCOS
+// live ISO, which boots grubaa64.efi and has no isolinux configuration.
+func buildAarch64LiveISO(t *testing.T) string {
+	t.Helper()
+	kargs := "coreos.liveiso=rhcos ignition.firstboot"
+	area := kargs + strings.Repeat("#", 64-len(kargs))
+	grub := "set timeout=5\nmenuentry 'RHEL CoreOS (Live)' --class fedora {\n" +
+		"\tlinux /images/pxeboot/vmlinuz " + area + "\n\tdevicetree /images/dtb/board.dtb\n}\n"
+	files := map[string]string{
+		"images/ignition.img":       strings.Repeat("\x00", 64),
+		"EFI/BOOT/BOOTAA64.EFI":     "shim",
+		"EFI/BOOT/grubaa64.efi":     "grub",
+		"EFI/redhat/grub.cfg":       grub,
+		"images/dtb/board.dtb":      "dtb",
+		"images/pxeboot/vmlinuz":    "kernel",
+		"images/pxeboot/initrd.img": "initrd",
+	}
+	return createISO(t, files, map[string]interface{}{
+		"default": kargs,
+		"files":   []map[string]interface{}{{"path": "EFI/redhat/grub.cfg", "offset": strings.Index(grub, area)}},
+		"size":    64,
+	})
+}
+
+func TestAarch64ISO(t *testing.T) {
+	isoPath := buildAarch64LiveISO(t)
+	if arch := isoArchitecture(isoPath); arch != "aarch64" {
+		t.Errorf("expected an aarch64 ISO, got %q", arch)
+	}
+	if arch := isoArchitecture(buildLiveISO(t)); arch != "x86_64" {
+		t.Errorf("expected an x86_64 ISO, got %q", arch)
+	}
+
+	five := 5
+	im := &imageFile{
+		isoFile:         isoPath,
+		ignitionContent: []byte(`{}`),
+		kernelArgs:      []string{"console=ttyAMA0"},
+		boot:            BootConfig{MenuTitle: "Discovery", MenuTimeout: &five},
+	}
+	reader, err := newImageReader(im)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.Close()
+	info, _ := getISOInfo(isoPath)
+	if len(info.bootFiles) != 1 {
+		t.Errorf("expected only the grub configuration, got %v", info.bootFiles)
+	}
+	rewritten := rewriteBootFile(info.bootFiles[0].path, readISOFile(t, isoPath, info.bootFiles[0].path), im.boot, "")
+	if !strings.Contains(rewritten, "\tdevicetree /images/dtb/board.dtb\n") {
+		t.Errorf("expected the devicetree to be kept:\n%s", rewritten)
+	}
+
+	imageServer := newTestImageServer(t, Options{
+		IsoFile: isoPath,
+		BaseURL: "http://localhost:8080",
+	})
+	ctx := context.Background()
+	if _, err := imageServer.ServeImage(ctx, ImageSpec{Name: "host-arm.iso", Base: BaseImage{Arch: "aarch64"}}); err != nil {
+		t.Error(err)
+	}
+	_, err = imageServer.ServeImage(ctx, ImageSpec{Name: "host-x86.iso", Base: BaseImage{Arch: "x86_64"}})
+	if !errors.Is(err, ErrUnknownBaseImage) {
+		t.Errorf("expected an image for another architecture to be refused, got %v", err)
+	}
+	imageServer.namedIsoFiles = map[string]string{"arm": isoPath}
+	_, err = imageServer.ServeImage(ctx, ImageSpec{Name: "host-named.iso", Base: BaseImage{Arch: "x86_64", Name: "arm"}})
+	if !errors.Is(err, ErrUnknownBaseImage) {
+		t.Errorf("expected a named base ISO for another architecture to be refused, got %v", err)
+	}
+	if _, err := imageServer.ServeImage(ctx, ImageSpec{Name: "host-named.iso", Base: BaseImage{Arch: "aarch64", Name: "arm"}}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,341 @@
+package imagehandler
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// The assisted-image-service streams live ISOs from
+//
+//	GET /images/{image_id}?version={version}&type={full|minimal}[&api_key={key}]
+//
+// fetching the ignition config of each download from the assisted-service
+// it is configured with (ASSISTED_SERVICE_SCHEME and ASSISTED_SERVICE_HOST)
+// at
+//
+//	GET /api/assisted-install/v2/infra-envs/{image_id}/downloads/files?file_name=discovery.ign
+//
+// passing on the api_key as a bearer token or query parameter, depending on
+// its REQUEST_AUTH_TYPE. The assistedImageServer plays the assisted-service
+// side of this exchange.
+const (
+	assistedImagesPath    = "/images/"
+	assistedHealthPath    = "/health"
+	assistedIgnitionPath  = "/api/assisted-install/v2/infra-envs/"
+	assistedIgnitionFile  = "discovery.ign"
+	assistedIgnitionRoute = "/downloads/files"
+)
+
+const (
+	// AssistedImageFull and AssistedImageMinimal are the image types of
+	// the assisted-image-service: a full live ISO, or a minimal one that
+	// fetches its rootfs at boot.
+	AssistedImageFull    = "full"
+	AssistedImageMinimal = "minimal"
+)
+
+// AssistedOptions configures an ImageFileServer that delegates to an
+// assisted-image-service.
+type AssistedOptions struct {
+	// URL is the base URL of the assisted-image-service.
+	URL string
+	// Version is the RHCOS version, a key of the service's RHCOS_VERSIONS,
+	// that images are built from unless their BaseImage names another.
+	Version string
+	// Arch is the CPU architecture of the service's base ISOs. Images for
+	// other architectures are refused.
+	Arch string
+	// ImageType is AssistedImageFull or AssistedImageMinimal.
+	ImageType string
+	// APIKey, if set, is added to image URLs and must be presented by the
+	// service when it fetches the ignition configs.
+	APIKey string
+	// TLSConfig is used for HTTPS connections to the service.
+	TLSConfig *tls.Config
+	// IgnitionSource rebuilds the ignition config of images that are
+	// fetched before they are registered again, e.g. after a restart.
+	IgnitionSource IgnitionSource
+}
+
+// AssistedImageServer is an ImageFileServer that publishes the image URLs of
+// an assisted-image-service, and serves the service the ignition config of
+// each image as it is downloaded.
+type AssistedImageServer interface {
+	ImageFileServer
+	// IgnitionHandler serves the ignition configs of the registered
+	// images to the service, which must be configured to reach it as its
+	// assisted-service.
+	IgnitionHandler() http.Handler
+}
+
+type assistedImage struct {
+	version  string
+	ignition []byte
+	url      string
+	created  time.Time
+}
+
+// assistedImageServer keeps the ignition config of each registered image in
+// memory until the service asks for it.
+type assistedImageServer struct {
+	log            logr.Logger
+	base           *url.URL
+	opts           AssistedOptions
+	client         *http.Client
+	ignitionSource IgnitionSource
+
+	mu     sync.Mutex
+	images map[string]assistedImage
+}
+
+var _ AssistedImageServer = &assistedImageServer{}
+
+// NewAssistedImageServer returns an ImageFileServer that delegates to the
+// assisted-image-service at opts.URL.
+func NewAssistedImageServer(logger logr.Logger, opts AssistedOptions) (AssistedImageServer, error) {
+	base, err := ParseBaseURL(opts.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid assisted-image-service URL: %w", err)
+	}
+	if opts.Version == "" {
+		return nil, errors.New("an RHCOS version is required")
+	}
+	if opts.Arch == "" {
+		opts.Arch = "x86_64"
+	}
+	switch opts.ImageType {
+	case "":
+		opts.ImageType = AssistedImageFull
+	case AssistedImageFull, AssistedImageMinimal:
+	default:
+		return nil, fmt.Errorf("unknown image type %q", opts.ImageType)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = opts.TLSConfig
+	return &assistedImageServer{
+		log:            logger,
+		base:           base,
+		opts:           opts,
+		client:         &http.Client{Transport: transport, Timeout: remoteRequestTimeout},
+		ignitionSource: opts.IgnitionSource,
+		images:         map[string]assistedImage{},
+	}, nil
+}
+
+// imageURL returns the URL the service streams an image from.
+func (s *assistedImageServer) imageURL(name, version string) string {
+	u := *s.base
+	u.Path = path.Join("/", s.base.Path, assistedImagesPath, name)
+	u.RawPath = path.Join("/", s.base.Path, assistedImagesPath, url.PathEscape(name))
+	query := url.Values{"version": {version}, "type": {s.opts.ImageType}}
+	if s.opts.APIKey != "" {
+		query.Set("api_key", s.opts.APIKey)
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// register checks that the service can build an image, which it can only
+// embed an ignition config in.
+func (s *assistedImageServer) register(spec ImageSpec) (assistedImage, error) {
+	if spec.ConfigDrive != nil {
+		return assistedImage{}, errors.New("the assisted-image-service cannot serve config drives")
+	}
+	if len(spec.KernelArgs) > 0 || !spec.Boot.IsZero() {
+		return assistedImage{}, errors.New("the assisted-image-service cannot set kernel arguments or boot menus")
+	}
+	if spec.Base.Name == "" && spec.Base.Arch != "" && spec.Base.Arch != s.opts.Arch {
+		return assistedImage{}, fmt.Errorf("%w: the assisted-image-service has no %s base image", ErrUnknownBaseImage, spec.Base.Arch)
+	}
+	version := s.opts.Version
+	if spec.Base.Name != "" {
+		version = spec.Base.Name
+	}
+	return assistedImage{
+		version:  version,
+		ignition: spec.Ignition,
+		url:      s.imageURL(spec.Name, version),
+		created:  time.Now(),
+	}, nil
+}
+
+func (im assistedImage) info() ImageInfo {
+	// the service streams each image as it is downloaded
+	return ImageInfo{URL: im.url, Format: ImageFormatISO, Ready: true}
+}
+
+func (s *assistedImageServer) ServeImage(ctx context.Context, spec ImageSpec) (ImageInfo, error) {
+	im, err := s.register(spec)
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.images[spec.Name] = im
+	return im.info(), nil
+}
+
+func (s *assistedImageServer) ReplaceImage(ctx context.Context, spec ImageSpec) (ImageInfo, error) {
+	im, err := s.register(spec)
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.images[spec.Name]; !ok {
+		return ImageInfo{}, ErrImageNotFound
+	}
+	s.images[spec.Name] = im
+	return im.info(), nil
+}
+
+func (s *assistedImageServer) GetImage(ctx context.Context, name string) (ImageInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	im, ok := s.images[name]
+	if !ok {
+		return ImageInfo{}, ErrImageNotFound
+	}
+	return im.info(), nil
+}
+
+func (s *assistedImageServer) RemoveImage(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.images[name]; !ok {
+		return ErrImageNotFound
+	}
+	delete(s.images, name)
+	return nil
+}
+
+// ImageReady reports registered images as ready, as the service streams
+// each image as it is downloaded.
+func (s *assistedImageServer) ImageReady(ctx context.Context, name string) (bool, error) {
+	if _, err := s.GetImage(ctx, name); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ImageChecksum returns no checksum, as the service doesn't publish one.
+func (s *assistedImageServer) ImageChecksum(name string) (string, ChecksumType) {
+	return "", ChecksumNone
+}
+
+// BaseImageVersion is the configured RHCOS version, as the service reports
+// nothing about its base images.
+func (s *assistedImageServer) BaseImageVersion(ctx context.Context) (string, error) {
+	return s.opts.Version, nil
+}
+
+// Downloads never delivers anything, as downloads happen on the service.
+func (s *assistedImageServer) Downloads() <-chan Download { return nil }
+
+func (s *assistedImageServer) ImageURLExpiry(name string) time.Time { return time.Time{} }
+
+func (s *assistedImageServer) LastDownload(name string) (Download, bool) { return Download{}, false }
+
+func (s *assistedImageServer) ListImages(ctx context.Context) ([]RegisteredImage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	images := make([]RegisteredImage, 0, len(s.images))
+	for name, im := range s.images {
+		images = append(images, RegisteredImage{
+			Name:      name,
+			Digest:    contentDigest(im.ignition),
+			Revision:  im.version,
+			Created:   im.created,
+			Generated: true,
+		})
+	}
+	return images, nil
+}
+
+func (s *assistedImageServer) CheckReady(ctx context.Context) error {
+	u := *s.base
+	u.Path = path.Join("/", s.base.Path, assistedHealthPath)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("assisted-image-service is not ready: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("assisted-image-service is not ready: health check returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *assistedImageServer) IgnitionHandler() http.Handler {
+	return http.HandlerFunc(s.serveIgnition)
+}
+
+// serveIgnition serves the ignition config of an image to the service.
+func (s *assistedImageServer) serveIgnition(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.opts.APIKey != "" && !hasAPIKey(r, s.opts.APIKey) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, assistedIgnitionPath)
+	if name == r.URL.Path || !strings.HasSuffix(name, assistedIgnitionRoute) ||
+		r.URL.Query().Get("file_name") != assistedIgnitionFile {
+		http.NotFound(w, r)
+		return
+	}
+	name = strings.TrimSuffix(name, assistedIgnitionRoute)
+
+	s.mu.Lock()
+	im, ok := s.images[name]
+	s.mu.Unlock()
+	ignition := im.ignition
+	if !ok {
+		if s.ignitionSource == nil {
+			http.NotFound(w, r)
+			return
+		}
+		var err error
+		ignition, err = s.ignitionSource(r.Context(), name)
+		if err != nil {
+			if errors.Is(err, ErrImageNotFound) {
+				http.NotFound(w, r)
+				return
+			}
+			s.log.Error(err, "unable to rebuild ignition", "image", name)
+			http.Error(w, "unable to build ignition", http.StatusInternalServerError)
+			return
+		}
+	}
+	s.log.Info("serving ignition", "image", name)
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(ignition)
+}
+
+// hasAPIKey reports whether the service presented the API key, as a bearer
+// token or an api_key query parameter.
+func hasAPIKey(r *http.Request, key string) bool {
+	if hasBearerToken(r, key) {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("api_key")), []byte(key)) == 1
+}
@@ -0,0 +1,164 @@
+package imagehandler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+// newFakeAssistedImageService returns a server that, like the
+// assisted-image-service, answers each image download with the ignition it
+// fetches from ignitionURL, passing on the api_key as a bearer token.
+func newFakeAssistedImageService(t *testing.T, ignitionURL *string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Path, "/images/")
+		query := r.URL.Query()
+		if id == r.URL.Path || query.Get("version") != "4.9" || query.Get("type") != "full" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		u := fmt.Sprintf("%s/api/assisted-install/v2/infra-envs/%s/downloads/files?file_name=discovery.ign", *ignitionURL, id)
+		req, _ := http.NewRequest(http.MethodGet, u, nil)
+		req.Header.Set("Authorization", "Bearer "+query.Get("api_key"))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			http.Error(w, "ignition unavailable", http.StatusInternalServerError)
+			return
+		}
+		defer resp.Body.Close()
+		_, _ = io.Copy(w, resp.Body)
+	}))
+}
+
+func TestAssistedImageServer(t *testing.T) {
+	ignitionURL := ""
+	service := newFakeAssistedImageService(t, &ignitionURL)
+	defer service.Close()
+
+	server, err := NewAssistedImageServer(zap.New(zap.UseDevMode(true)), AssistedOptions{
+		URL:     service.URL,
+		Version: "4.9",
+		APIKey:  "s3cret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ignitionServer := httptest.NewServer(server.IgnitionHandler())
+	defer ignitionServer.Close()
+	ignitionURL = ignitionServer.URL
+
+	info, err := server.ServeImage(context.Background(), ImageSpec{
+		Name:     "host-xyz-45.iso",
+		Base:     BaseImage{Arch: "x86_64"},
+		Ignition: []byte("asietonarst"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageURL := info.URL
+	if !strings.HasPrefix(imageURL, service.URL+"/images/host-xyz-45.iso?") {
+		t.Errorf("unexpected image URL %s", imageURL)
+	}
+	if ready, err := server.ImageReady(context.Background(), "host-xyz-45.iso"); !ready || err != nil {
+		t.Errorf("expected the image to be ready, got %v, %v", ready, err)
+	}
+	download := func(name string) (int, string) {
+		t.Helper()
+		u, _ := url.Parse(imageURL)
+		u.Path = "/images/" + name
+		resp, err := http.Get(u.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	if status, body := download("host-xyz-45.iso"); status != http.StatusOK || body != "asietonarst" {
+		t.Errorf("unexpected download (%d) %q", status, body)
+	}
+	if status, _ := download("other.iso"); status == http.StatusOK {
+		t.Error("expected an unknown image to be refused")
+	}
+
+	resp, err := http.Get(ignitionServer.URL + "/api/assisted-install/v2/infra-envs/host-xyz-45.iso/downloads/files?file_name=discovery.ign")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the ignition to require the API key, got %s", resp.Status)
+	}
+
+	if err := server.CheckReady(context.Background()); err != nil {
+		t.Error(err)
+	}
+	if _, err := server.ServeImage(context.Background(), ImageSpec{Name: "arm.iso", Base: BaseImage{Arch: "aarch64"}}); !errors.Is(err, ErrUnknownBaseImage) {
+		t.Error("expected another architecture to be refused")
+	}
+	if _, err := server.ImageReady(context.Background(), "arm.iso"); !errors.Is(err, ErrImageNotFound) {
+		t.Errorf("expected the refused image not to be registered, got %v", err)
+	}
+	if _, err := server.ServeImage(context.Background(), ImageSpec{Name: "config.iso", ConfigDrive: map[string][]byte{"openstack/latest/user_data": nil}}); err == nil {
+		t.Error("expected a config drive to be refused")
+	}
+	if _, err := server.ServeImage(context.Background(), ImageSpec{Name: "args.iso", KernelArgs: []string{"quiet"}}); err == nil {
+		t.Error("expected kernel arguments to be refused")
+	}
+
+	if err := server.RemoveImage(context.Background(), "host-xyz-45.iso"); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := download("host-xyz-45.iso"); status == http.StatusOK {
+		t.Error("expected a removed image to be refused")
+	}
+}
+
+func TestAssistedIgnitionSource(t *testing.T) {
+	server, err := NewAssistedImageServer(zap.New(zap.UseDevMode(true)), AssistedOptions{
+		URL:     "http://images.example.com",
+		Version: "4.9",
+		APIKey:  "s3cret",
+		IgnitionSource: func(_ context.Context, name string) ([]byte, error) {
+			if name != "host-xyz-45.iso" {
+				return nil, ErrImageNotFound
+			}
+			return []byte("rebuilt"), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ignitionServer := httptest.NewServer(server.IgnitionHandler())
+	defer ignitionServer.Close()
+
+	fetch := func(name string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, ignitionServer.URL+assistedIgnitionPath+name+assistedIgnitionRoute+"?file_name="+assistedIgnitionFile, nil)
+		req.Header.Set("Authorization", "Bearer s3cret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	if status, body := fetch("host-xyz-45.iso"); status != http.StatusOK || body != "rebuilt" {
+		t.Errorf("expected the ignition of an unregistered image to be rebuilt, got (%d) %q", status, body)
+	}
+	if status, _ := fetch("other.iso"); status != http.StatusNotFound {
+		t.Errorf("expected an unknown image not to be found, got %d", status)
+	}
+}
@@ -0,0 +1,122 @@
+package imagehandler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// volumeDescriptorOffset and volumeDescriptorSize locate the ISO 9660
+// primary volume descriptor, which holds the volume label and creation time
+// of the ISO and so differs between any two builds.
+const (
+	volumeDescriptorOffset = 16 * 2048
+	volumeDescriptorSize   = 2048
+)
+
+// statBaseImage returns the size of a base ISO and a version identifier
+// that changes whenever the file is replaced or modified. Besides the size
+// and modification time, the version covers the ISO's primary volume
+// descriptor, so that it changes even if a different build is copied over
+// the file with its timestamp preserved.
+func statBaseImage(isoPath string) (int64, string, error) {
+	file, err := os.Open(isoPath)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return 0, "", err
+	}
+	descriptor := make([]byte, volumeDescriptorSize)
+	n, err := file.ReadAt(descriptor, volumeDescriptorOffset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, "", err
+	}
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%d-%d-", fi.Size(), fi.ModTime().UnixNano())
+	hash.Write(descriptor[:n])
+	return fi.Size(), hex.EncodeToString(hash.Sum(nil))[:8], nil
+}
+
+// ErrUnknownBaseImage is returned when an image selects a base ISO by a name
+// that is not configured, or there is none for its architecture.
+var ErrUnknownBaseImage = errors.New("unknown base image")
+
+// BaseImage selects the base ISO of an image.
+type BaseImage struct {
+	// Arch is the CPU architecture of the image.
+	Arch string
+	// Name, if set, selects one of the named base ISOs, which must be for
+	// the architecture.
+	Name string
+}
+
+// baseImageFor returns the base ISO selected by name, or else the one for
+// the architecture, falling back to the default one. Either way, a base ISO
+// for another architecture is refused.
+func (f *imageFileSystem) baseImageFor(base BaseImage) (string, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.baseImageForLocked(base)
+}
+
+// baseImageForLocked is baseImageFor for callers holding the lock.
+func (f *imageFileSystem) baseImageForLocked(base BaseImage) (string, error) {
+	if base.Name != "" {
+		isoPath, ok := f.namedIsoFiles[base.Name]
+		if !ok {
+			return "", fmt.Errorf("%w %q", ErrUnknownBaseImage, base.Name)
+		}
+		return isoPath, checkArchitecture(base, isoPath)
+	}
+	if isoPath, ok := f.archIsoFiles[base.Arch]; ok {
+		return isoPath, nil
+	}
+	return f.isoFile, checkArchitecture(base, f.isoFile)
+}
+
+// baseImages returns the paths of all the configured base ISOs, starting
+// with the default one, then those for each architecture and the named ones.
+func (f *imageFileSystem) baseImages() []string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	paths := []string{f.isoFile}
+	for _, isoFiles := range []map[string]string{f.archIsoFiles, f.namedIsoFiles} {
+		keys := make([]string, 0, len(isoFiles))
+		for key := range isoFiles {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			paths = append(paths, isoFiles[key])
+		}
+	}
+	return paths
+}
+
+// BaseImageVersion combines the versions of all the base ISOs, so that it
+// changes when any of them does.
+func (f *imageFileSystem) BaseImageVersion(ctx context.Context) (string, error) {
+	versions := []string{}
+	for _, isoPath := range f.baseImages() {
+		_, version, err := statBaseImage(isoPath)
+		if err != nil {
+			return "", err
+		}
+		versions = append(versions, version)
+	}
+	if len(versions) == 1 {
+		return versions[0], nil
+	}
+	sum := sha256.Sum256([]byte(strings.Join(versions, "-")))
+	return hex.EncodeToString(sum[:])[:8], nil
+}
@@ -0,0 +1,232 @@
+package imagehandler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	// baseImageFetchMinDelay and baseImageFetchMaxDelay bound the delay
+	// before a failed download of a base ISO is retried.
+	baseImageFetchMinDelay = time.Second
+	baseImageFetchMaxDelay = time.Minute
+)
+
+// BaseImageSource provides a base ISO, so that it need not be part of the
+// container image.
+type BaseImageSource interface {
+	// Fetch makes the base ISO available as a local file, downloading it
+	// into dir if it is remote, and returns the path of the file.
+	Fetch(ctx context.Context, dir string) (string, error)
+}
+
+// FileSource is a base ISO that is a local file already.
+type FileSource string
+
+func (s FileSource) Fetch(ctx context.Context, dir string) (string, error) {
+	if _, err := os.Stat(string(s)); err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
+
+// URLSource downloads a base ISO over HTTP or HTTPS. An interrupted
+// download is resumed where it stopped if the server supports ranges.
+type URLSource struct {
+	URL string
+	// SHA256 is the hex digest the ISO must have.
+	SHA256 string
+	// Client is used for the download, or http.DefaultClient if nil.
+	Client *http.Client
+}
+
+// Path returns the path the ISO is downloaded to in dir.
+func (s *URLSource) Path(dir string) string {
+	return downloadPath(dir, s.SHA256)
+}
+
+func (s *URLSource) Fetch(ctx context.Context, dir string) (string, error) {
+	if s.SHA256 == "" {
+		return "", fmt.Errorf("no digest given for base ISO %s", s.URL)
+	}
+	return fetchVerified(ctx, dir, s.SHA256, s.open)
+}
+
+// open requests the ISO from offset onwards, returning the offset the
+// content starts at, which is zero if the server ignored the range.
+func (s *URLSource) open(ctx context.Context, offset int64) (io.ReadCloser, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return resp.Body, 0, nil
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		return resp.Body, offset, nil
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// the partial download is no shorter than the ISO
+		resp.Body.Close()
+		return s.open(ctx, 0)
+	}
+	resp.Body.Close()
+	return nil, 0, fmt.Errorf("downloading %s returned %s", s.URL, resp.Status)
+}
+
+// ArtifactPuller pulls artifacts from an OCI registry repository.
+type ArtifactPuller interface {
+	// Resolve returns the digest of the image layer of the artifact a tag
+	// or digest refers to.
+	Resolve(ctx context.Context, reference string) (string, error)
+	// OpenBlob downloads the blob with a digest.
+	OpenBlob(ctx context.Context, digest string) (io.ReadCloser, error)
+}
+
+// OCISource pulls a base ISO stored as an artifact in an OCI registry. The
+// registry's digest of the ISO is always verified.
+type OCISource struct {
+	Puller ArtifactPuller
+	// Reference is the tag or digest of the artifact.
+	Reference string
+	// SHA256, if set, is the hex digest the ISO must have, pinning the
+	// content a tag refers to.
+	SHA256 string
+}
+
+func (s *OCISource) Fetch(ctx context.Context, dir string) (string, error) {
+	digest, err := s.Puller.Resolve(ctx, s.Reference)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(digest, "sha256:") {
+		return "", fmt.Errorf("unsupported digest %s of base ISO %s", digest, s.Reference)
+	}
+	expected := strings.TrimPrefix(digest, "sha256:")
+	if s.SHA256 != "" && !strings.EqualFold(s.SHA256, expected) {
+		return "", fmt.Errorf("base ISO %s has digest %s instead of %s", s.Reference, expected, s.SHA256)
+	}
+	return fetchVerified(ctx, dir, expected, func(ctx context.Context, offset int64) (io.ReadCloser, int64, error) {
+		blob, err := s.Puller.OpenBlob(ctx, digest)
+		return blob, 0, err
+	})
+}
+
+// FetchBaseImage fetches a base ISO, retrying with a growing delay until it
+// succeeds or ctx is done, and returns the path of the file.
+func FetchBaseImage(ctx context.Context, log logr.Logger, source BaseImageSource, dir string) (string, error) {
+	delay := baseImageFetchMinDelay
+	for {
+		path, err := source.Fetch(ctx, dir)
+		if err == nil {
+			return path, nil
+		}
+		log.Error(err, "unable to fetch base ISO", "retryAfter", delay)
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > baseImageFetchMaxDelay {
+			delay = baseImageFetchMaxDelay
+		}
+	}
+}
+
+// downloadPath is the path a file is downloaded to in dir, named after its
+// SHA256 digest.
+func downloadPath(dir, digest string) string {
+	return filepath.Join(dir, strings.ToLower(digest)+".iso")
+}
+
+// fetchVerified downloads a file into dir, named after its expected SHA256
+// digest, unless a copy with that digest is there already. Content is
+// downloaded to a partial file first, which a later attempt resumes from if
+// open honours the offset.
+func fetchVerified(ctx context.Context, dir, expected string, open func(ctx context.Context, offset int64) (io.ReadCloser, int64, error)) (string, error) {
+	expected = strings.ToLower(expected)
+	if _, err := hex.DecodeString(expected); err != nil || len(expected) != sha256.Size*2 {
+		return "", fmt.Errorf("invalid SHA256 digest %q", expected)
+	}
+	target := downloadPath(dir, expected)
+	if digest, err := fileDigest(target); err == nil && digest == expected {
+		return target, nil
+	}
+
+	partialPath := target + ".partial"
+	partial, err := os.OpenFile(partialPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer partial.Close()
+	info, err := partial.Stat()
+	if err != nil {
+		return "", err
+	}
+	content, offset, err := open(ctx, info.Size())
+	if err != nil {
+		return "", err
+	}
+	defer content.Close()
+
+	// the digest covers the part downloaded before
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(partial, 0, offset)); err != nil {
+		return "", err
+	}
+	if err := partial.Truncate(offset); err != nil {
+		return "", err
+	}
+	if _, err := partial.Seek(offset, io.SeekStart); err != nil {
+		return "", err
+	}
+	_, err = io.Copy(io.MultiWriter(partial, hash), content)
+	if closeErr := partial.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	if digest := hex.EncodeToString(hash.Sum(nil)); digest != expected {
+		os.Remove(partialPath)
+		return "", fmt.Errorf("downloaded base ISO has digest %s instead of %s", digest, expected)
+	}
+	if err := os.Rename(partialPath, target); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// fileDigest returns the hex SHA256 digest of a file.
+func fileDigest(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
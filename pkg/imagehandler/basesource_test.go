@@ -0,0 +1,157 @@
+package imagehandler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakePuller struct {
+	digest string
+	blobs  map[string]string
+	pulls  int
+}
+
+func (p *fakePuller) Resolve(ctx context.Context, reference string) (string, error) {
+	return p.digest, nil
+}
+
+func (p *fakePuller) OpenBlob(ctx context.Context, digest string) (io.ReadCloser, error) {
+	p.pulls++
+	return io.NopCloser(strings.NewReader(p.blobs[digest])), nil
+}
+
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestURLSource(t *testing.T) {
+	downloads := 0
+	ranges := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads++
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "rhcos.iso", time.Time{}, strings.NewReader("aiosetnarsetin"))
+	}))
+	defer ts.Close()
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	source := &URLSource{URL: ts.URL + "/rhcos.iso", SHA256: sha256Hex("aiosetnarsetin")}
+	// an interrupted download is resumed
+	if err := os.WriteFile(source.Path(dir)+".partial", []byte("aiose"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	path, err := source.Fetch(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != source.Path(dir) || len(ranges) != 1 || ranges[0] != "bytes=5-" {
+		t.Errorf("expected the download to resume, got %s with ranges %v", path, ranges)
+	}
+	if content, _ := os.ReadFile(path); string(content) != "aiosetnarsetin" {
+		t.Errorf("unexpected content %q", content)
+	}
+	if again, err := source.Fetch(ctx, dir); err != nil || again != path || downloads != 1 {
+		t.Errorf("expected the downloaded ISO to be reused, got %s, %v after %d downloads", again, err, downloads)
+	}
+
+	corrupt := &URLSource{URL: ts.URL + "/rhcos.iso", SHA256: sha256Hex("other")}
+	if _, err := corrupt.Fetch(ctx, dir); err == nil {
+		t.Error("expected a download with the wrong digest to fail")
+	}
+	if _, err := (&URLSource{URL: ts.URL + "/rhcos.iso"}).Fetch(ctx, dir); err == nil {
+		t.Error("expected a download without a digest to be refused")
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*.partial")); len(matches) != 0 {
+		t.Errorf("partial downloads left behind: %v", matches)
+	}
+}
+
+func TestOCISource(t *testing.T) {
+	digest := "sha256:" + sha256Hex("aiosetnarsetin")
+	puller := &fakePuller{digest: digest, blobs: map[string]string{digest: "aiosetnarsetin"}}
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	source := &OCISource{Puller: puller, Reference: "4.9"}
+	path, err := source.Fetch(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(path); string(content) != "aiosetnarsetin" {
+		t.Errorf("unexpected content %q", content)
+	}
+
+	pinned := &OCISource{Puller: puller, Reference: "4.9", SHA256: sha256Hex("other")}
+	if _, err := pinned.Fetch(ctx, dir); err == nil || puller.pulls != 1 {
+		t.Errorf("expected a tag with other content to be refused before pulling, got %v", err)
+	}
+
+	puller.blobs[digest] = "tampered"
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := source.Fetch(ctx, dir); err == nil {
+		t.Error("expected a blob not matching its digest to be rejected")
+	}
+}
+
+func TestStreamSource(t *testing.T) {
+	release := "release-1"
+	mux := http.NewServeMux()
+	var serverURL string
+	mux.HandleFunc("/streams/stable.json", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"stream": "stable", "architectures": {"x86_64": {"artifacts": {"metal": {"formats": {
+			"iso": {"disk": {"location": "%s/%s.iso", "sha256": "%s"}}}}}}}}`, serverURL, release, sha256Hex(release))
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "live.iso", time.Time{}, strings.NewReader(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".iso")))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	serverURL = ts.URL
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	source := &StreamSource{Stream: ts.URL + "/streams/stable.json", Arch: "x86_64"}
+	path, err := source.Fetch(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != filepath.Join(dir, "stable-x86_64.iso") || path != source.Path(dir) {
+		t.Errorf("unexpected path %s", path)
+	}
+	if content, err := os.ReadFile(path); err != nil || string(content) != release {
+		t.Errorf("unexpected content %q: %v", content, err)
+	}
+
+	// a new release of the stream replaces the ISO
+	release = "release-2"
+	if _, err := source.Fetch(ctx, dir); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := os.ReadFile(path); err != nil || string(content) != release {
+		t.Errorf("unexpected content %q after a new release: %v", content, err)
+	}
+	if _, err := os.Stat(downloadPath(dir, sha256Hex("release-1"))); !os.IsNotExist(err) {
+		t.Errorf("expected the previous release to be removed, got %v", err)
+	}
+
+	if _, err := (&StreamSource{Stream: source.Stream, Arch: "s390x"}).Fetch(ctx, dir); err == nil {
+		t.Error("expected an architecture missing from the stream to be refused")
+	}
+	if url := (&StreamSource{Stream: "stable"}).MetadataURL(); url != "https://builds.coreos.fedoraproject.org/streams/stable.json" {
+		t.Errorf("unexpected metadata URL %s for a stream name", url)
+	}
+}
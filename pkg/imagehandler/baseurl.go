@@ -0,0 +1,52 @@
+package imagehandler
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// ParseBaseURL parses the URL of an http or https endpoint. IPv6 literal
+// hosts are accepted with or without brackets, and with a zone ID in either
+// its raw ("%eth0") or URL-encoded ("%25eth0") form. Without brackets the
+// whole host is taken as the address, so a port requires brackets.
+func ParseBaseURL(value string) (*url.URL, error) {
+	if parts := strings.SplitN(value, "://", 2); len(parts) == 2 {
+		host, rest := parts[1], ""
+		if i := strings.IndexAny(host, "/?#"); i >= 0 {
+			host, rest = host[:i], host[i:]
+		}
+		if strings.Count(host, ":") > 1 && !strings.HasPrefix(host, "[") && !strings.Contains(host, "@") {
+			host = "[" + host + "]"
+		}
+		if i := strings.Index(host, "%"); i >= 0 && !strings.HasPrefix(host[i:], "%25") {
+			host = host[:i] + "%25" + host[i+1:]
+		}
+		value = parts[0] + "://" + host + rest
+	}
+
+	u, err := url.Parse(value)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%q is not an absolute http or https URL", value)
+	}
+	if u.User != nil {
+		return nil, fmt.Errorf("%q must not contain credentials", value)
+	}
+	if strings.HasPrefix(u.Host, "[") && HostIP(u.Hostname()) == nil {
+		return nil, fmt.Errorf("%q is not a valid IPv6 address", u.Hostname())
+	}
+	return u, nil
+}
+
+// HostIP returns the IP address a host name is a literal of, ignoring any
+// IPv6 zone ID, or nil if it is a DNS name.
+func HostIP(host string) net.IP {
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		host = host[:i]
+	}
+	return net.ParseIP(host)
+}
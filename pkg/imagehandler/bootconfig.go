@@ -0,0 +1,413 @@
+package imagehandler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/openshift/assisted-image-service/pkg/isoeditor"
+	"github.com/openshift/assisted-image-service/pkg/overlay"
+)
+
+// bootConfigPaths are the boot configuration files of the live ISOs we
+// know, which are rewritten to customize the boot menu.
+var bootConfigPaths = []string{
+	"/EFI/redhat/grub.cfg",
+	"/EFI/centos/grub.cfg",
+	"/EFI/fedora/grub.cfg",
+	"/EFI/BOOT/grub.cfg",
+	"/isolinux/isolinux.cfg",
+}
+
+const (
+	isoSectorSize = 2048
+	// volumeIDOffset and volumeIDLength locate the volume ID in an ISO 9660
+	// volume descriptor.
+	volumeIDOffset = 40
+	volumeIDLength = 32
+	// maxVolumeLabelLength is the length of a volume ID in the primary
+	// volume descriptor. Joliet volume IDs hold half as many characters.
+	maxVolumeLabelLength = volumeIDLength
+	// kargsPlaceholder stands in for the kernel arguments areas of a boot
+	// configuration file while it is rewritten.
+	kargsPlaceholder = "\x00kargs\x00"
+)
+
+// BootConfig rewrites the volume label and boot menu of the base ISO, which
+// some BMC virtual media implementations and installer workflows depend on.
+// The zero value leaves the ISO's own.
+type BootConfig struct {
+	// VolumeLabel replaces the volume ID of the ISO, along with references
+	// to it in the boot configuration files, such as the coreos.liveiso
+	// kernel argument. The EFI boot image is not modified.
+	VolumeLabel string `json:"volumeLabel,omitempty"`
+	// MenuTitle renames the first boot menu entry, which boots the live
+	// system.
+	MenuTitle string `json:"menuTitle,omitempty"`
+	// MenuDefault selects the default boot menu entry, counting from zero.
+	MenuDefault *int `json:"menuDefault,omitempty"`
+	// MenuTimeout is the number of seconds before the default entry is
+	// booted.
+	MenuTimeout *int `json:"menuTimeout,omitempty"`
+}
+
+// IsZero reports whether the base ISO is left as it is.
+func (b BootConfig) IsZero() bool {
+	return b.VolumeLabel == "" && b.MenuTitle == "" && b.MenuDefault == nil && b.MenuTimeout == nil
+}
+
+// rewritesMenu reports whether the boot configuration files are rewritten.
+func (b BootConfig) rewritesMenu() bool {
+	return b.MenuTitle != "" || b.MenuDefault != nil || b.MenuTimeout != nil
+}
+
+// Validate checks that the configuration can be written to an ISO.
+func (b BootConfig) Validate() error {
+	if len(b.VolumeLabel) > maxVolumeLabelLength {
+		return fmt.Errorf("volume label %q is longer than %d characters", b.VolumeLabel, maxVolumeLabelLength)
+	}
+	for _, c := range b.VolumeLabel {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("._-", c)) {
+			return fmt.Errorf("volume label %q may only contain letters, digits, '.', '_' and '-'", b.VolumeLabel)
+		}
+	}
+	if strings.ContainsAny(b.MenuTitle, "'\"\\\n\r\x00") {
+		return fmt.Errorf("boot menu title %q may not contain quotes, backslashes or line breaks", b.MenuTitle)
+	}
+	if b.MenuDefault != nil && *b.MenuDefault < 0 {
+		return fmt.Errorf("invalid boot menu default entry %d", *b.MenuDefault)
+	}
+	if b.MenuTimeout != nil && *b.MenuTimeout < 0 {
+		return fmt.Errorf("invalid boot menu timeout %d", *b.MenuTimeout)
+	}
+	return nil
+}
+
+// isoFileArea is the location of a file in an ISO.
+type isoFileArea struct {
+	path   string
+	start  int64
+	length int64
+}
+
+// volumeIDField is the location of a volume ID in an ISO, which is UCS-2
+// encoded in Joliet volume descriptors.
+type volumeIDField struct {
+	offset int64
+	joliet bool
+}
+
+// readVolumeIDs finds the volume IDs of an ISO, returning the label of the
+// primary volume descriptor.
+func readVolumeIDs(isoPath string) (string, []volumeIDField, error) {
+	isoFile, err := os.Open(isoPath)
+	if err != nil {
+		return "", nil, err
+	}
+	defer isoFile.Close()
+
+	label := ""
+	fields := []volumeIDField{}
+	descriptor := make([]byte, isoSectorSize)
+	for sector := int64(16); ; sector++ {
+		offset := sector * isoSectorSize
+		if _, err := isoFile.ReadAt(descriptor, offset); err != nil {
+			return "", nil, fmt.Errorf("reading volume descriptors: %w", err)
+		}
+		if string(descriptor[1:6]) != "CD001" {
+			return "", nil, fmt.Errorf("invalid volume descriptor at sector %d", sector)
+		}
+		switch descriptor[0] {
+		case 1:
+			label = strings.TrimRight(string(descriptor[volumeIDOffset:volumeIDOffset+volumeIDLength]), " \x00")
+			fields = append(fields, volumeIDField{offset: offset + volumeIDOffset})
+		case 2:
+			// Joliet supplementary descriptors are marked by their escape
+			// sequence
+			if escape := string(descriptor[88:91]); escape == "%/@" || escape == "%/C" || escape == "%/E" {
+				fields = append(fields, volumeIDField{offset: offset + volumeIDOffset, joliet: true})
+			}
+		case 255:
+			return label, fields, nil
+		}
+	}
+}
+
+// encode returns the content of the field for a volume label.
+func (v volumeIDField) encode(label string) []byte {
+	if !v.joliet {
+		return []byte(label + strings.Repeat(" ", volumeIDLength-len(label)))
+	}
+	chars := []rune(label)
+	if len(chars) > volumeIDLength/2 {
+		chars = chars[:volumeIDLength/2]
+	}
+	for len(chars) < volumeIDLength/2 {
+		chars = append(chars, ' ')
+	}
+	data := make([]byte, volumeIDLength)
+	for i, c := range utf16.Encode(chars) {
+		binary.BigEndian.PutUint16(data[i*2:], c)
+	}
+	return data
+}
+
+// findBootFiles returns the boot configuration files the ISO has.
+func findBootFiles(isoPath string) []isoFileArea {
+	files := []isoFileArea{}
+	for _, path := range bootConfigPaths {
+		start, length, err := isoeditor.GetISOFileInfo(path, isoPath)
+		if err != nil || length == 0 {
+			continue
+		}
+		files = append(files, isoFileArea{path: path, start: start, length: length})
+	}
+	return files
+}
+
+// bootConfigOverlays returns the areas of the base ISO that are replaced to
+// apply a boot configuration. kargsArea is the content of the kernel
+// arguments areas, or nil if they are unchanged; those in rewritten boot
+// configuration files are returned as part of the file, with kargsInfoPath
+// updated for their new offsets. The remaining kernel arguments areas are
+// returned in kargsOffsets, for the caller to overlay.
+func bootConfigOverlays(isoPath string, info isoInfo, boot BootConfig, kargsArea []byte) (overlays []overlay.Overlay, kargsOffsets []int64, err error) {
+	kargsOffsets = info.kargsOffsets
+	if boot.VolumeLabel != "" && boot.VolumeLabel != info.volumeLabel {
+		if info.volumeErr != nil {
+			return nil, nil, fmt.Errorf("cannot set the volume label of base image %s: %w", isoPath, info.volumeErr)
+		}
+		for _, field := range info.volumeFields {
+			content := field.encode(boot.VolumeLabel)
+			overlays = append(overlays, overlay.Overlay{
+				Reader: bytes.NewReader(content),
+				Offset: field.offset,
+				Length: int64(len(content)),
+			})
+		}
+	} else if !boot.rewritesMenu() {
+		return nil, kargsOffsets, nil
+	}
+	if len(info.bootFiles) == 0 {
+		return nil, nil, fmt.Errorf("base image %s has no known boot configuration files", isoPath)
+	}
+
+	isoFile, err := os.Open(isoPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer isoFile.Close()
+
+	moved := map[int]int64{}
+	for _, file := range info.bootFiles {
+		original := make([]byte, file.length)
+		if _, err := isoFile.ReadAt(original, file.start); err != nil {
+			return nil, nil, err
+		}
+		// the kernel arguments areas are kept out of the rewriting, and
+		// their new offsets recorded
+		areas := []int{}
+		var text strings.Builder
+		last := int64(0)
+		for i, offset := range info.kargsOffsets {
+			if offset < file.start || offset+info.kargsLength > file.start+file.length {
+				continue
+			}
+			areas = append(areas, i)
+			text.Write(original[last : offset-file.start])
+			text.WriteString(kargsPlaceholder)
+			last = offset - file.start + info.kargsLength
+		}
+		text.Write(original[last:])
+
+		rewritten := rewriteBootFile(file.path, text.String(), boot, info.volumeLabel)
+		content := []byte{}
+		for i, part := range strings.Split(rewritten, kargsPlaceholder) {
+			if i > 0 {
+				index := areas[i-1]
+				moved[index] = int64(len(content))
+				area := kargsArea
+				if area == nil {
+					area = original[info.kargsOffsets[index]-file.start : info.kargsOffsets[index]-file.start+info.kargsLength]
+				}
+				content = append(content, area...)
+			}
+			content = append(content, part...)
+		}
+		if int64(len(content)) > file.length {
+			return nil, nil, fmt.Errorf("rewritten boot configuration %s (%d bytes) exceeds its size in the base image (%d bytes)",
+				file.path, len(content), file.length)
+		}
+		content = append(content, bytes.Repeat([]byte{'\n'}, int(file.length)-len(content))...)
+		overlays = append(overlays, overlay.Overlay{
+			Reader: bytes.NewReader(content),
+			Offset: file.start,
+			Length: file.length,
+		})
+	}
+	if len(moved) == 0 {
+		return overlays, kargsOffsets, nil
+	}
+
+	kargsOffsets = []int64{}
+	for i, offset := range info.kargsOffsets {
+		if _, ok := moved[i]; !ok {
+			kargsOffsets = append(kargsOffsets, offset)
+		}
+	}
+	embedInfo, err := movedKargsInfo(isoFile, info, moved)
+	if err != nil {
+		return nil, nil, err
+	}
+	return append(overlays, embedInfo), kargsOffsets, nil
+}
+
+// movedKargsInfo rewrites kargsInfoPath for kernel arguments areas that
+// have moved within their files, so that tools editing the kernel arguments
+// of the image find them. moved maps the index of each area in the file to
+// its new offset in its file.
+func movedKargsInfo(isoFile *os.File, info isoInfo, moved map[int]int64) (overlay.Overlay, error) {
+	data := make([]byte, info.kargsInfo.length)
+	if _, err := isoFile.ReadAt(data, info.kargsInfo.start); err != nil {
+		return overlay.Overlay{}, err
+	}
+	embed := map[string]interface{}{}
+	if err := json.Unmarshal(data, &embed); err != nil {
+		return overlay.Overlay{}, fmt.Errorf("invalid %s: %w", kargsInfoPath, err)
+	}
+	files, _ := embed["files"].([]interface{})
+	for i, newOffset := range moved {
+		file, ok := files[i].(map[string]interface{})
+		if !ok {
+			return overlay.Overlay{}, fmt.Errorf("invalid %s: unexpected file entry", kargsInfoPath)
+		}
+		file["offset"] = newOffset
+	}
+	content, err := json.Marshal(embed)
+	if err != nil {
+		return overlay.Overlay{}, err
+	}
+	if int64(len(content)) > info.kargsInfo.length {
+		return overlay.Overlay{}, fmt.Errorf("updated %s exceeds its size in the base image", kargsInfoPath)
+	}
+	content = append(content, bytes.Repeat([]byte{' '}, int(info.kargsInfo.length)-len(content))...)
+	return overlay.Overlay{
+		Reader: bytes.NewReader(content),
+		Offset: info.kargsInfo.start,
+		Length: info.kargsInfo.length,
+	}, nil
+}
+
+// rewriteBootFile applies a boot configuration to the content of a grub or
+// isolinux configuration file. Comment lines are dropped to make room when
+// the content grows.
+func rewriteBootFile(path, content string, boot BootConfig, oldLabel string) string {
+	state := &menuState{boot: boot, isolinux: strings.HasSuffix(path, "isolinux.cfg"), entry: -1}
+	rewrite := rewriteGrubLine
+	if state.isolinux {
+		rewrite = rewriteIsolinuxLine
+	}
+	var out strings.Builder
+	for _, line := range strings.SplitAfter(content, "\n") {
+		out.WriteString(rewrite(state, line))
+	}
+	rewritten := state.prologue() + out.String()
+	if boot.VolumeLabel != "" && oldLabel != "" {
+		rewritten = strings.ReplaceAll(rewritten, oldLabel, boot.VolumeLabel)
+	}
+	if len(rewritten) > len(content) {
+		lines := strings.SplitAfter(rewritten, "\n")
+		rewritten = ""
+		for _, line := range lines {
+			if !strings.HasPrefix(strings.TrimSpace(line), "#") {
+				rewritten += line
+			}
+		}
+	}
+	return rewritten
+}
+
+// menuState tracks a boot configuration file as it is rewritten.
+type menuState struct {
+	boot       BootConfig
+	isolinux   bool
+	entry      int
+	sawDefault bool
+	sawTimeout bool
+}
+
+// prologue returns the settings the file lacked, to be added at its start.
+func (s *menuState) prologue() string {
+	prologue := ""
+	if s.boot.MenuTimeout != nil && !s.sawTimeout {
+		if s.isolinux {
+			prologue += fmt.Sprintf("timeout %d\n", *s.boot.MenuTimeout*10)
+		} else {
+			prologue += fmt.Sprintf("set timeout=%d\n", *s.boot.MenuTimeout)
+		}
+	}
+	// isolinux marks the default entry itself
+	if s.boot.MenuDefault != nil && !s.sawDefault && !s.isolinux {
+		prologue += fmt.Sprintf("set default=\"%d\"\n", *s.boot.MenuDefault)
+	}
+	return prologue
+}
+
+// lineIndent returns the leading whitespace of a line.
+func lineIndent(line string) string {
+	return line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+}
+
+func rewriteGrubLine(s *menuState, line string) string {
+	trimmed := strings.TrimSpace(line)
+	indent := lineIndent(line)
+	switch {
+	case s.boot.MenuDefault != nil && strings.HasPrefix(trimmed, "set default="):
+		s.sawDefault = true
+		return fmt.Sprintf("%sset default=\"%d\"\n", indent, *s.boot.MenuDefault)
+	case s.boot.MenuTimeout != nil && strings.HasPrefix(trimmed, "set timeout="):
+		s.sawTimeout = true
+		return fmt.Sprintf("%sset timeout=%d\n", indent, *s.boot.MenuTimeout)
+	case strings.HasPrefix(trimmed, "menuentry "):
+		s.entry++
+		if s.boot.MenuTitle == "" || s.entry > 0 {
+			return line
+		}
+		rest := strings.TrimSpace(strings.TrimPrefix(trimmed, "menuentry"))
+		if rest == "" || (rest[0] != '\'' && rest[0] != '"') {
+			return line
+		}
+		end := strings.IndexByte(rest[1:], rest[0])
+		if end < 0 {
+			return line
+		}
+		return fmt.Sprintf("%smenuentry '%s'%s\n", indent, s.boot.MenuTitle, rest[end+2:])
+	}
+	return line
+}
+
+func rewriteIsolinuxLine(s *menuState, line string) string {
+	fields := strings.Fields(strings.ToLower(line))
+	indent := lineIndent(line)
+	switch {
+	case len(fields) == 0:
+	case s.boot.MenuTimeout != nil && fields[0] == "timeout":
+		s.sawTimeout = true
+		// isolinux counts in tenths of a second
+		return fmt.Sprintf("%stimeout %d\n", indent, *s.boot.MenuTimeout*10)
+	case fields[0] == "label":
+		s.entry++
+		if s.boot.MenuDefault != nil && s.entry == *s.boot.MenuDefault {
+			return line + indent + "  menu default\n"
+		}
+	case len(fields) >= 2 && fields[0] == "menu" && fields[1] == "default" && s.boot.MenuDefault != nil:
+		return ""
+	case len(fields) >= 2 && fields[0] == "menu" && fields[1] == "label" && s.boot.MenuTitle != "" && s.entry == 0:
+		return fmt.Sprintf("%smenu label %s\n", indent, s.boot.MenuTitle)
+	}
+	return line
+}
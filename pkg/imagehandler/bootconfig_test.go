@@ -0,0 +1,102 @@
+package imagehandler
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/openshift/assisted-image-service/pkg/isoeditor"
+)
+
+// readISOFile returns the content of a file in an ISO.
+func readISOFile(t *testing.T, isoPath, path string) string {
+	t.Helper()
+	start, length, err := isoeditor.GetISOFileInfo(path, isoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	isoFile, err := os.Open(isoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer isoFile.Close()
+	data := make([]byte, length)
+	if _, err := isoFile.ReadAt(data, start); err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestBootConfig(t *testing.T) {
+	isoPath := buildLiveISO(t)
+	one, three := 1, 3
+	reader, err := newImageReader(&imageFile{
+		isoFile:         isoPath,
+		ignitionContent: []byte(`{}`),
+		kernelArgs:      []string{"console=ttyS0"},
+		boot: BootConfig{
+			VolumeLabel: "CUSTOM-LIVE",
+			MenuTitle:   "Discovery",
+			MenuDefault: &one,
+			MenuTimeout: &three,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	outPath := filepath.Join(t.TempDir(), "custom.iso")
+	out, err := os.Create(outPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(out, reader); err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+
+	if label, _, err := readVolumeIDs(outPath); err != nil || label != "CUSTOM-LIVE" {
+		t.Errorf("unexpected volume label %q: %v", label, err)
+	}
+	grub := readISOFile(t, outPath, "/EFI/redhat/grub.cfg")
+	for _, expected := range []string{"set default=\"1\"\n", "set timeout=3\n", "menuentry 'Discovery' --class fedora {\n"} {
+		if !strings.Contains(grub, expected) {
+			t.Errorf("expected %q in grub.cfg:\n%s", expected, grub)
+		}
+	}
+	isolinux := readISOFile(t, outPath, "/isolinux/isolinux.cfg")
+	for _, expected := range []string{"timeout 30\n", "menu label Discovery\n", "label check\n  menu default\n"} {
+		if !strings.Contains(isolinux, expected) {
+			t.Errorf("expected %q in isolinux.cfg:\n%s", expected, isolinux)
+		}
+	}
+	if strings.Count(isolinux, "menu default") != 1 {
+		t.Errorf("expected a single default entry in isolinux.cfg:\n%s", isolinux)
+	}
+
+	// the kernel arguments areas moved with the rewritten files
+	info := isoInfo{}
+	if err := readKargsInfo(outPath, &info); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(outPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, offset := range info.kargsOffsets {
+		area := string(content[offset : offset+info.kargsLength])
+		if expected := "coreos.liveiso=CUSTOM-LIVE ignition.firstboot console=ttyS0"; strings.TrimRight(area, "#") != expected {
+			t.Errorf("unexpected kernel arguments %q", area)
+		}
+	}
+
+	long := BootConfig{MenuTitle: strings.Repeat("x", 200)}
+	if _, err := newImageReader(&imageFile{isoFile: isoPath, boot: long}); err == nil {
+		t.Error("expected a boot menu larger than the base image's to be refused")
+	}
+	if err := (BootConfig{VolumeLabel: "bad label"}).Validate(); err == nil {
+		t.Error("expected an invalid volume label to be refused")
+	}
+}
@@ -0,0 +1,107 @@
+package imagehandler
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// copyBufferSize is the size of the buffers used when copying image data.
+const copyBufferSize = 1024 * 1024
+
+// downloadBufferSize is the size of the buffer io.Copy allocates for each
+// download that cannot be sent with sendfile.
+const downloadBufferSize = 32 * 1024
+
+var copyBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, copyBufferSize)
+		return &buf
+	},
+}
+
+// bufferBudget caps the total memory held in copy buffers across all
+// concurrent copies, both those made by the image server itself and the
+// downloads that pass through Go buffers rather than being sent with
+// sendfile.
+type bufferBudget struct {
+	mu     sync.Mutex
+	budget int64
+	used   int64
+	// changed is closed, and replaced, whenever room may have been made.
+	changed chan struct{}
+}
+
+// newBufferBudget returns a budget allowing at most budget bytes of copy
+// buffers. A budget of zero or less means no limit.
+func newBufferBudget(budget int64) *bufferBudget {
+	b := &bufferBudget{changed: make(chan struct{})}
+	b.SetBudget(budget)
+	return b
+}
+
+// SetBudget changes the budget. Buffers already in use count against the
+// new budget, so that no further copies start until there is room under it.
+func (b *bufferBudget) SetBudget(budget int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.budget = budget
+	b.notifyLocked()
+}
+
+func (b *bufferBudget) notifyLocked() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// reserve waits for room in the budget for a buffer of up to size bytes,
+// and returns the size reserved, which is smaller if the whole budget is.
+// The reservation must be given back with release. It stops with the
+// context's error once ctx is done.
+func (b *bufferBudget) reserve(ctx context.Context, size int64) (int64, error) {
+	for {
+		b.mu.Lock()
+		if b.budget > 0 && size > b.budget {
+			size = b.budget
+		}
+		// a single copy is always let in, should the budget have been
+		// lowered below the size of its buffer
+		if b.budget <= 0 || b.used == 0 || b.used+size <= b.budget {
+			b.used += size
+			b.mu.Unlock()
+			return size, nil
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+func (b *bufferBudget) release(size int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= size
+	b.notifyLocked()
+}
+
+// Copy copies src to dst using a pooled buffer, waiting for room in the
+// budget first. It stops with the context's error once ctx is done.
+func (b *bufferBudget) Copy(ctx context.Context, dst io.Writer, src io.Reader) (int64, error) {
+	size, err := b.reserve(ctx, copyBufferSize)
+	if err != nil {
+		return 0, err
+	}
+	defer b.release(size)
+
+	if size < copyBufferSize {
+		return io.CopyBuffer(dst, &contextReader{ctx: ctx, r: src}, make([]byte, size))
+	}
+	buf := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(buf)
+	return io.CopyBuffer(dst, &contextReader{ctx: ctx, r: src}, *buf)
+}
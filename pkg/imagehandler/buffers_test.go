@@ -0,0 +1,109 @@
+package imagehandler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockingReader returns data once unblocked.
+type blockingReader struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (r *blockingReader) Read(p []byte) (int, error) {
+	close(r.started)
+	<-r.release
+	return 0, io.EOF
+}
+
+// startCopy starts a copy that holds its buffer until the returned
+// function is called.
+func startCopy(t *testing.T, b *bufferBudget) func() {
+	t.Helper()
+	src := &blockingReader{started: make(chan struct{}), release: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = b.Copy(context.Background(), io.Discard, src)
+	}()
+	<-src.started
+	return func() {
+		close(src.release)
+		<-done
+	}
+}
+
+func expectBlocked(t *testing.T, b *bufferBudget) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := b.Copy(ctx, io.Discard, strings.NewReader("x")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the copy to wait for room in the budget, got %v", err)
+	}
+}
+
+func TestBufferBudgetBlocks(t *testing.T) {
+	b := newBufferBudget(2 * copyBufferSize)
+	finish1 := startCopy(t, b)
+	finish2 := startCopy(t, b)
+	expectBlocked(t, b)
+
+	finish1()
+	if _, err := b.Copy(context.Background(), io.Discard, strings.NewReader("x")); err != nil {
+		t.Errorf("expected the copy to go ahead once a buffer was freed: %v", err)
+	}
+	finish2()
+}
+
+func TestBufferBudgetLowered(t *testing.T) {
+	b := newBufferBudget(2 * copyBufferSize)
+	finish := startCopy(t, b)
+
+	b.SetBudget(copyBufferSize)
+	expectBlocked(t, b)
+
+	finish()
+	if _, err := b.Copy(context.Background(), io.Discard, strings.NewReader("x")); err != nil {
+		t.Errorf("expected the copy to go ahead under the new budget: %v", err)
+	}
+}
+
+func TestBufferBudgetSmall(t *testing.T) {
+	b := newBufferBudget(64 * 1024)
+	size, err := b.reserve(context.Background(), copyBufferSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 64*1024 {
+		t.Errorf("expected the buffer to be cut to the budget, got %d bytes", size)
+	}
+	b.release(size)
+
+	content := bytes.Repeat([]byte("x"), 3*copyBufferSize)
+	var out bytes.Buffer
+	// bytes.Buffer reads from the source itself, so hide it to use the
+	// copy buffer
+	n, err := b.Copy(context.Background(), struct{ io.Writer }{&out}, struct{ io.Reader }{bytes.NewReader(content)})
+	if err != nil || n != int64(len(content)) || !bytes.Equal(out.Bytes(), content) {
+		t.Errorf("copy through a small buffer failed: %d bytes, %v", n, err)
+	}
+}
+
+func TestBufferBudgetDownloads(t *testing.T) {
+	b := newBufferBudget(copyBufferSize)
+	size, err := b.reserve(context.Background(), downloadBufferSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectBlocked(t, b)
+	b.release(size)
+	if _, err := b.Copy(context.Background(), io.Discard, strings.NewReader("x")); err != nil {
+		t.Errorf("expected the copy to go ahead once the download finished: %v", err)
+	}
+}
@@ -0,0 +1,413 @@
+package imagehandler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/asalkeld/image-customization-controller/pkg/tracing"
+)
+
+// indexFileName is the file in the cache directory recording the cached
+// images, so that the registry can be rebuilt after a restart.
+const indexFileName = "index.json"
+
+// indexEntry is the persisted record of a cached image.
+type indexEntry struct {
+	Name      string    `json:"name"`
+	FileName  string    `json:"fileName,omitempty"`
+	Size      int64     `json:"size"`
+	Digest    string    `json:"digest"`
+	Revision  string    `json:"revision"`
+	Arch      string    `json:"arch,omitempty"`
+	BaseImage string    `json:"baseImage,omitempty"`
+	Checksum  string    `json:"checksum,omitempty"`
+	File      string    `json:"file"`
+	Created   time.Time `json:"created,omitempty"`
+	// StorageKey is set if the image was uploaded to a storage backend.
+	StorageKey string `json:"storageKey,omitempty"`
+	// ChecksumType is the algorithm of Checksum.
+	ChecksumType ChecksumType `json:"checksumType,omitempty"`
+	// KernelArgs are those the image was generated with, needed to
+	// generate it again.
+	KernelArgs []string `json:"kernelArgs,omitempty"`
+	// Boot is the boot configuration the image was generated with.
+	Boot *BootConfig `json:"boot,omitempty"`
+}
+
+// openCachedPath opens a cached image for reading, decrypting it if cache
+// encryption is enabled. Unencrypted files are returned as an *os.File so
+// that they can be sent with sendfile.
+func (f *imageFileSystem) openCachedPath(cachePath string) (io.ReadSeekCloser, error) {
+	if f.encryptionKey != nil {
+		return openEncrypted(cachePath, f.encryptionKey)
+	}
+	return os.Open(cachePath)
+}
+
+// generate prepares a newly registered image in the background and records
+// the outcome on it. It gives up once ctx is done.
+func (f *imageFileSystem) generate(ctx context.Context, im *imageFile) {
+	ctx = trace.ContextWithSpanContext(ctx, im.spanContext)
+	if f.generationTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.generationTimeout)
+		defer cancel()
+	}
+	spanCtx, span := tracing.Start(ctx, "GenerateImage", "image", im.name, "digest", im.digest)
+	cachePath, checksum, err := f.generateImage(spanCtx, im)
+	tracing.End(span, err)
+	var key string
+	if err == nil && f.storage != nil {
+		key, err = f.uploadImage(ctx, im, cachePath)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("%w after %s", ErrGenerationTimeout, f.generationTimeout)
+	}
+	if err != nil {
+		f.cacheLog.Error(err, "image generation failed", "image", im.name)
+		err = &ErrGenerationFailed{Cause: err}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	im.generated = true
+	im.generationErr = err
+	if im.done != nil {
+		close(im.done)
+	}
+	im.checksum = checksum
+	im.storageKey = key
+	if checksum == "" && cachePath != "" {
+		im.checksum = f.checksumOfCachedFileLocked(cachePath)
+	}
+	if f.imageFileByNameLocked(im.name) != im {
+		// replaced while we were generating it
+		f.removeStoredImage(im)
+		if cachePath != "" {
+			f.removeCachedFileLocked(cachePath)
+		}
+		return
+	}
+	if cachePath == "" {
+		return
+	}
+	im.cachePath = cachePath
+	f.writeIndexLocked()
+}
+
+// generateImage checks that the image can be built and, when caching is
+// enabled, writes it to the cache directory, returning the cached path. If a
+// checksum type is configured, the checksum of the image is also returned,
+// except when an identical cached image is reused.
+func (f *imageFileSystem) generateImage(ctx context.Context, im *imageFile) (string, string, error) {
+	checksum := f.checksumType.newHash()
+	if f.cacheDir == "" {
+		if checksum == nil {
+			_, err := imageOverlays(im)
+			return "", "", err
+		}
+		reader, err := newImageReader(im)
+		if err != nil {
+			return "", "", err
+		}
+		defer reader.Close()
+		if _, err := f.buffers.Copy(ctx, checksum, reader); err != nil {
+			return "", "", err
+		}
+		return "", hex.EncodeToString(checksum.Sum(nil)), nil
+	}
+
+	// Images are stored by digest, so that hosts with identical
+	// customization share a single artifact.
+	cachePath := filepath.Join(f.cacheDir, im.digest+"-"+im.revision+".iso")
+	if _, err := os.Stat(cachePath); err == nil {
+		f.cacheLog.Info("reusing cached image with identical content", "image", im.name, "digest", im.digest)
+		cacheDedupBytes.Add(float64(im.size))
+		return cachePath, "", nil
+	}
+
+	reader, err := newImageReader(im)
+	if err != nil {
+		return "", "", err
+	}
+	defer reader.Close()
+
+	tmp, err := os.CreateTemp(f.cacheDir, im.digest+".tmp-*")
+	if err != nil {
+		return "", "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	var dst io.Writer = tmp
+	var encrypter *encryptingWriter
+	if f.encryptionKey != nil {
+		encrypter, err = newEncryptingWriter(tmp, f.encryptionKey)
+		if err != nil {
+			tmp.Close()
+			return "", "", err
+		}
+		dst = encrypter
+	}
+	if checksum != nil {
+		dst = io.MultiWriter(dst, checksum)
+	}
+	if _, err := f.buffers.Copy(ctx, dst, reader); err != nil {
+		tmp.Close()
+		return "", "", err
+	}
+	if encrypter != nil {
+		if err := encrypter.Close(); err != nil {
+			tmp.Close()
+			return "", "", err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return "", "", err
+	}
+
+	if err := os.Rename(tmp.Name(), cachePath); err != nil {
+		return "", "", err
+	}
+	if checksum == nil {
+		return cachePath, "", nil
+	}
+	return cachePath, hex.EncodeToString(checksum.Sum(nil)), nil
+}
+
+// checksumOfCachedFileLocked finds the checksum recorded for a cached file
+// shared with another image. Must be called with the lock held.
+func (f *imageFileSystem) checksumOfCachedFileLocked(cachePath string) string {
+	for _, other := range f.images.all() {
+		if other.cachePath == cachePath && other.checksum != "" {
+			return other.checksum
+		}
+	}
+	return ""
+}
+
+// removeCachedFile drops an image's reference to its cached copy. Must be
+// called with the lock held.
+func (f *imageFileSystem) removeCachedFile(im *imageFile) {
+	if im.cachePath == "" {
+		return
+	}
+	cachePath := im.cachePath
+	im.cachePath = ""
+	f.removeCachedFileLocked(cachePath)
+}
+
+// removeCachedFileLocked deletes a cached file unless another image still
+// shares it. Must be called with the lock held.
+func (f *imageFileSystem) removeCachedFileLocked(cachePath string) {
+	for _, other := range f.images.all() {
+		if other.cachePath == cachePath {
+			return
+		}
+	}
+	if err := os.Remove(cachePath); err != nil && !os.IsNotExist(err) {
+		f.cacheLog.Error(err, "removing cached image", "path", cachePath)
+		return
+	}
+	cacheEvictions.Inc()
+}
+
+func contentDigest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// imageDigest identifies the content of an image. Without kernel arguments
+// or a boot configuration it is the digest of the ignition content alone,
+// as it was before those could be set.
+func imageDigest(ignitionContent []byte, kernelArgs []string, boot BootConfig) string {
+	if len(kernelArgs) == 0 && boot.IsZero() {
+		return contentDigest(ignitionContent)
+	}
+	hash := sha256.New()
+	hash.Write(ignitionContent)
+	for _, arg := range kernelArgs {
+		hash.Write([]byte{0})
+		hash.Write([]byte(arg))
+	}
+	if !boot.IsZero() {
+		// no kernel argument holds a NUL, so this can't be confused
+		// with one
+		data, _ := json.Marshal(boot)
+		hash.Write([]byte{0, 0})
+		hash.Write(data)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// writeIndexLocked persists the list of cached images. Must be called with
+// the lock held.
+func (f *imageFileSystem) writeIndexLocked() {
+	if f.cacheDir == "" {
+		return
+	}
+	entries := []indexEntry{}
+	files := map[string]int64{}
+	for _, im := range f.images.all() {
+		// config drives are built again when registered again
+		if im.cachePath == "" || im.configDrive != nil {
+			continue
+		}
+		checksumType := ChecksumNone
+		if im.checksum != "" {
+			checksumType = f.checksumType
+		}
+		files[im.cachePath] = im.size
+		var boot *BootConfig
+		if !im.boot.IsZero() {
+			boot = &im.boot
+		}
+		entries = append(entries, indexEntry{
+			Name:      im.name,
+			FileName:  im.fileName,
+			Size:      im.size,
+			Digest:    im.digest,
+			Revision:  im.revision,
+			Arch:      im.base.Arch,
+			BaseImage: im.base.Name,
+			Checksum:  im.checksum,
+			File:      filepath.Base(im.cachePath),
+			Created:   im.createdAt,
+
+			StorageKey:   im.storageKey,
+			ChecksumType: checksumType,
+			KernelArgs:   im.kernelArgs,
+			Boot:         boot,
+		})
+	}
+	var totalSize int64
+	for _, size := range files {
+		totalSize += size
+	}
+	cacheEntries.Set(float64(len(files)))
+	cacheSizeBytes.Set(float64(totalSize))
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		f.cacheLog.Error(err, "encoding cache index")
+		return
+	}
+
+	indexPath := filepath.Join(f.cacheDir, indexFileName)
+	tmpPath := indexPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		f.cacheLog.Error(err, "writing cache index")
+		return
+	}
+	if err := os.Rename(tmpPath, indexPath); err != nil {
+		f.cacheLog.Error(err, "writing cache index")
+	}
+}
+
+// loadIndex rebuilds the registry from the cache index according to the
+// startup cache policy, skipping entries whose cached file has gone, and
+// removes leftovers of interrupted generations.
+func (f *imageFileSystem) loadIndex(policy CachePolicy) {
+	if leftovers, err := filepath.Glob(filepath.Join(f.cacheDir, "*.tmp*")); err == nil {
+		for _, path := range leftovers {
+			_ = os.Remove(path)
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(f.cacheDir, indexFileName))
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		f.cacheLog.Error(err, "reading cache index")
+		return
+	}
+	entries := []indexEntry{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		f.cacheLog.Error(err, "decoding cache index")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if policy == CachePurge {
+		for _, entry := range entries {
+			if !strings.ContainsRune(entry.File, os.PathSeparator) {
+				f.removeCachedFileLocked(filepath.Join(f.cacheDir, entry.File))
+			}
+		}
+		f.writeIndexLocked()
+		f.cacheLog.Info("purged the image cache", "count", len(entries))
+		return
+	}
+	validated := map[string]error{}
+	for _, entry := range entries {
+		if strings.ContainsRune(entry.File, os.PathSeparator) {
+			continue
+		}
+		if f.imageFileByNameLocked(entry.Name) != nil {
+			f.cacheLog.Info("dropping duplicate cache entry", "image", entry.Name)
+			continue
+		}
+		cachePath := filepath.Join(f.cacheDir, entry.File)
+		base := BaseImage{Arch: entry.Arch, Name: entry.BaseImage}
+		isoFile, err := f.baseImageForLocked(base)
+		if err != nil {
+			f.cacheLog.Info("dropping cache entry", "image", entry.Name, "error", err.Error())
+			continue
+		}
+		file, err := f.openCachedPath(cachePath)
+		if err != nil {
+			f.cacheLog.Info("dropping unreadable cache entry", "image", entry.Name, "path", cachePath, "error", err.Error())
+			continue
+		}
+		file.Close()
+		if policy == CacheValidate {
+			if _, checked := validated[cachePath]; !checked {
+				validated[cachePath] = f.validateCachedFile(entry, isoFile, cachePath)
+			}
+			if err := validated[cachePath]; err != nil {
+				f.cacheLog.Info("dropping invalid cache entry", "image", entry.Name, "path", cachePath, "error", err.Error())
+				continue
+			}
+		}
+		boot := BootConfig{}
+		if entry.Boot != nil {
+			boot = *entry.Boot
+		}
+		f.images.add(&imageFile{
+			name:       entry.Name,
+			fileName:   entry.FileName,
+			size:       entry.Size,
+			digest:     entry.Digest,
+			revision:   entry.Revision,
+			base:       base,
+			isoFile:    isoFile,
+			checksum:   entry.Checksum,
+			createdAt:  entry.Created,
+			generated:  true,
+			storageKey: entry.StorageKey,
+			cachePath:  cachePath,
+			kernelArgs: entry.KernelArgs,
+			boot:       boot,
+			embed:      f.genericEmbed,
+		})
+	}
+	for cachePath, err := range validated {
+		if err != nil {
+			f.removeCachedFileLocked(cachePath)
+		}
+	}
+	f.writeIndexLocked()
+	f.cacheLog.Info("restored cached images", "count", f.images.len())
+}
@@ -0,0 +1,166 @@
+package imagehandler
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCacheIndexRestore(t *testing.T) {
+	cacheDir := t.TempDir()
+	cachePath := filepath.Join(cacheDir, "host-xyz-45.qcow-0123456789ab")
+	if err := os.WriteFile(cachePath, []byte("aiosetnarsetin"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	before := newTestImageServer(t, Options{CacheDir: cacheDir},
+		&imageFile{
+			name:      "host-xyz-45.qcow",
+			size:      14,
+			digest:    "0123456789abcdef",
+			generated: true,
+			cachePath: cachePath,
+		},
+		&imageFile{
+			name: "host-not-cached.qcow",
+			size: 14,
+		},
+	)
+	before.writeIndexLocked()
+
+	after := newTestImageServer(t, Options{CacheDir: cacheDir})
+
+	if after.images.len() != 1 {
+		t.Fatalf("expected 1 restored image, got %d", after.images.len())
+	}
+	im := after.images.get("host-xyz-45.qcow")
+	if im.name != "host-xyz-45.qcow" || im.cachePath != cachePath || im.digest != "0123456789abcdef" {
+		t.Errorf("unexpected restored image: %+v", im)
+	}
+	if ready, err := after.ImageReady(context.Background(), "host-xyz-45.qcow"); !ready || err != nil {
+		t.Errorf("restored image not ready: %v, %v", ready, err)
+	}
+}
+
+func TestCacheIndexRestoreWrongKey(t *testing.T) {
+	cacheDir := t.TempDir()
+	key := bytes.Repeat([]byte{0x42}, 32)
+	content, err := os.ReadFile(writeEncrypted(t, key, []byte("aiosetnarsetin")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cachePath := filepath.Join(cacheDir, "host-xyz-45.qcow-0123456789ab")
+	if err := os.WriteFile(cachePath, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	before := newTestImageServer(t, Options{CacheDir: cacheDir},
+		&imageFile{
+			name:      "host-xyz-45.qcow",
+			size:      14,
+			generated: true,
+			cachePath: cachePath,
+		},
+	)
+	before.writeIndexLocked()
+
+	for _, tc := range []struct {
+		key      []byte
+		restored int
+	}{
+		{key: key, restored: 1},
+		{key: bytes.Repeat([]byte{0x43}, 32), restored: 0},
+	} {
+		after := newTestImageServer(t, Options{
+			CacheDir:           cacheDir,
+			CacheEncryptionKey: tc.key,
+		})
+		if after.images.len() != tc.restored {
+			t.Errorf("expected %d restored images with key %x, got %d", tc.restored, tc.key[0], after.images.len())
+		}
+	}
+}
+
+func TestCacheStartupPolicy(t *testing.T) {
+	cacheDir := t.TempDir()
+	isoFile := filepath.Join(t.TempDir(), "rhcos.iso")
+	if err := os.WriteFile(isoFile, []byte("base"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, revision, err := statBaseImage(isoFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("aiosetnarsetin"))
+
+	writeCache := func() *imageFileSystem {
+		images := []*imageFile{}
+		for _, name := range []string{"good", "corrupt", "stale"} {
+			cachePath := filepath.Join(cacheDir, name+".iso")
+			if err := os.WriteFile(cachePath, []byte("aiosetnarsetin"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			images = append(images, &imageFile{
+				name:      name + ".iso",
+				size:      14,
+				revision:  revision,
+				checksum:  hex.EncodeToString(sum[:]),
+				generated: true,
+				cachePath: cachePath,
+			})
+		}
+		images[2].revision = "old"
+		if err := os.WriteFile(images[1].cachePath, []byte("aiosetnarsetXX"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		before := newTestImageServer(t, Options{
+			CacheDir:     cacheDir,
+			ChecksumType: ChecksumSHA256,
+		}, images...)
+		before.writeIndexLocked()
+		return before
+	}
+	load := func(policy CachePolicy) *imageFileSystem {
+		after := newTestImageServer(t, Options{
+			CacheDir:           cacheDir,
+			IsoFile:            isoFile,
+			CacheStartupPolicy: policy,
+		})
+		return after
+	}
+
+	writeCache()
+	if after := load(CacheKeep); after.images.len() != 3 {
+		t.Errorf("expected all 3 images to be kept, got %d", after.images.len())
+	}
+
+	writeCache()
+	after := load(CacheValidate)
+	if after.images.len() != 1 || after.images.get("good.iso") == nil {
+		t.Errorf("expected only the valid image to be kept, got %d", after.images.len())
+	}
+	for _, name := range []string{"corrupt.iso", "stale.iso"} {
+		if _, err := os.Stat(filepath.Join(cacheDir, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be deleted", name)
+		}
+	}
+
+	writeCache()
+	if after := load(CachePurge); after.images.len() != 0 {
+		t.Errorf("expected no images after purging, got %d", after.images.len())
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, "good.iso")); !os.IsNotExist(err) {
+		t.Error("expected the cached files to be deleted")
+	}
+
+	before := writeCache()
+	if err := before.PurgeCache(); err != nil {
+		t.Fatal(err)
+	}
+	if after := load(CacheKeep); after.images.len() != 0 {
+		t.Errorf("expected no images after purging at shutdown, got %d", after.images.len())
+	}
+}
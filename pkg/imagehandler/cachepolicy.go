@@ -0,0 +1,119 @@
+package imagehandler
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// CachePolicy decides what happens to the images in the cache directory
+// when the image server starts or stops.
+type CachePolicy string
+
+const (
+	// CacheKeep restores cached images at startup, dropping only those
+	// whose file is missing, and leaves them in place at shutdown.
+	CacheKeep CachePolicy = "keep"
+	// CachePurge deletes all cached images, so that every image is
+	// generated afresh.
+	CachePurge CachePolicy = "purge"
+	// CacheValidate restores only the cached images that were built from
+	// the current base ISO and whose size and checksum, if one was
+	// recorded, still match. It only applies at startup.
+	CacheValidate CachePolicy = "validate"
+)
+
+// ParseCachePolicy validates a cache policy name. An empty name is
+// CacheKeep.
+func ParseCachePolicy(value string) (CachePolicy, error) {
+	switch p := CachePolicy(value); p {
+	case "":
+		return CacheKeep, nil
+	case CacheKeep, CachePurge, CacheValidate:
+		return p, nil
+	}
+	return CacheKeep, fmt.Errorf("unknown cache policy %q", value)
+}
+
+// CachePurger is implemented by image servers whose cache directory can be
+// purged, e.g. when they shut down.
+type CachePurger interface {
+	PurgeCache() error
+}
+
+var _ CachePurger = &imageFileSystem{}
+
+// PurgeCache deletes the cached copies of all images, the boot files
+// extracted from base ISOs and the cache index. Images that stay registered
+// are streamed, or generated again when they are next registered.
+func (f *imageFileSystem) PurgeCache() error {
+	if f.cacheDir == "" {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	paths := map[string]bool{}
+	for _, im := range f.images.all() {
+		if im.cachePath != "" {
+			paths[im.cachePath] = true
+			im.cachePath = ""
+		}
+	}
+	for cachePath := range paths {
+		f.removeCachedFileLocked(cachePath)
+	}
+	f.removeBootFiles(func(string) bool { return true })
+	err := os.Remove(filepath.Join(f.cacheDir, indexFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	cacheEntries.Set(0)
+	cacheSizeBytes.Set(0)
+	f.cacheLog.Info("purged the image cache", "count", len(paths))
+	return nil
+}
+
+// validateCachedFile checks that a cached image was built from the current
+// revision of its base ISO and has not been truncated or corrupted.
+func (f *imageFileSystem) validateCachedFile(entry indexEntry, isoFile, cachePath string) error {
+	_, revision, err := statBaseImage(isoFile)
+	if err != nil {
+		return err
+	}
+	if revision != entry.Revision {
+		return errors.New("base ISO has changed")
+	}
+
+	file, err := f.openCachedPath(cachePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	checksumType := entry.ChecksumType
+	if checksumType == ChecksumNone && entry.Checksum != "" {
+		// recorded before the checksum type was
+		checksumType = f.checksumType
+	}
+	checksum := checksumType.newHash()
+	if entry.Checksum == "" {
+		checksum = nil
+	}
+	var dst io.Writer = io.Discard
+	if checksum != nil {
+		dst = checksum
+	}
+	size, err := io.Copy(dst, file)
+	if err != nil {
+		return err
+	}
+	if size != entry.Size {
+		return fmt.Errorf("size is %d bytes instead of %d", size, entry.Size)
+	}
+	if checksum != nil && hex.EncodeToString(checksum.Sum(nil)) != entry.Checksum {
+		return errors.New("checksum does not match")
+	}
+	return nil
+}
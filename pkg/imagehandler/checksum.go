@@ -0,0 +1,37 @@
+package imagehandler
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+)
+
+// ChecksumType is the algorithm used to checksum generated images. Only
+// algorithms acceptable to FIPS-constrained deployments are supported.
+type ChecksumType string
+
+const (
+	ChecksumNone   ChecksumType = ""
+	ChecksumSHA256 ChecksumType = "sha256"
+	ChecksumSHA512 ChecksumType = "sha512"
+)
+
+// ParseChecksumType validates a checksum algorithm name.
+func ParseChecksumType(value string) (ChecksumType, error) {
+	switch t := ChecksumType(value); t {
+	case ChecksumNone, ChecksumSHA256, ChecksumSHA512:
+		return t, nil
+	}
+	return ChecksumNone, fmt.Errorf("unsupported checksum type %q", value)
+}
+
+func (t ChecksumType) newHash() hash.Hash {
+	switch t {
+	case ChecksumSHA256:
+		return sha256.New()
+	case ChecksumSHA512:
+		return sha512.New()
+	}
+	return nil
+}
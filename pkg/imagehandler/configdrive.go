@@ -0,0 +1,84 @@
+package imagehandler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/openshift/assisted-image-service/pkg/isoeditor"
+)
+
+// ImageFormatConfigDrive is an OpenStack config drive, a small ISO 9660
+// filesystem labelled config-2 holding the metadata and network data of a
+// host for cloud-init, instead of a bootable image.
+const ImageFormatConfigDrive ImageFormat = "config-drive"
+
+const (
+	// configDriveLabel is the volume label cloud-init looks for.
+	configDriveLabel = "config-2"
+	// configDriveRevision stands in for the base image revision in the
+	// URLs of config drives, which have no base image.
+	configDriveRevision = "config-2"
+)
+
+// buildConfigDrive creates a config drive holding files, by path.
+func buildConfigDrive(files map[string][]byte) ([]byte, error) {
+	workDir, err := os.MkdirTemp("", "config-drive-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(workDir)
+
+	contentDir := filepath.Join(workDir, "content")
+	for name, content := range files {
+		clean := strings.TrimPrefix(path.Clean("/"+name), "/")
+		if clean == "" {
+			return nil, fmt.Errorf("invalid config drive file name %q", name)
+		}
+		filePath := filepath.Join(contentDir, filepath.FromSlash(clean))
+		if err := os.MkdirAll(filepath.Dir(filePath), 0700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(filePath, content, 0600); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(contentDir, 0700); err != nil {
+		return nil, err
+	}
+
+	isoPath := filepath.Join(workDir, "config-drive.iso")
+	if err := isoeditor.Create(isoPath, contentDir, configDriveLabel); err != nil {
+		return nil, fmt.Errorf("creating config drive: %w", err)
+	}
+	return os.ReadFile(isoPath)
+}
+
+// configDriveDigest identifies the content of a config drive. The ISO
+// itself records when it was created, so it is the files that are hashed.
+func configDriveDigest(files map[string][]byte) string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	hash := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(hash, "%s\x00%d\x00", name, len(files[name]))
+		hash.Write(files[name])
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// memoryImage is a reader of an image held in memory whole.
+type memoryImage struct {
+	*bytes.Reader
+}
+
+func (memoryImage) Close() error { return nil }
@@ -0,0 +1,59 @@
+package imagehandler
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigDrive(t *testing.T) {
+	imageServer := newTestImageServer(t, Options{
+		IsoFile: "missing.iso",
+		BaseURL: "http://localhost:8080",
+	})
+	files := map[string][]byte{
+		"openstack/latest/meta_data.json":    []byte(`{"uuid":"1234"}`),
+		"openstack/latest/network_data.json": []byte(`{"links":[]}`),
+	}
+	ctx := context.Background()
+	info, err := imageServer.ServeImage(ctx, ImageSpec{Name: "host-xyz-45.iso", ConfigDrive: files})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-info.Done
+	if info.Format != ImageFormatConfigDrive || info.Size == 0 {
+		t.Errorf("unexpected image info %+v", info)
+	}
+	if ready, err := imageServer.ImageReady(ctx, "host-xyz-45.iso"); !ready || err != nil {
+		t.Fatalf("expected the config drive to be ready, got %v", err)
+	}
+
+	reader, err := newImageReader(imageServer.imageFileByName("host-xyz-45.iso"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	outPath := filepath.Join(t.TempDir(), "config-drive.iso")
+	out, err := os.Create(outPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(out, reader); err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+	if label, _, err := readVolumeIDs(outPath); err != nil || label != configDriveLabel {
+		t.Errorf("unexpected volume label %q: %v", label, err)
+	}
+	if content := readISOFile(t, outPath, "/openstack/latest/meta_data.json"); content != `{"uuid":"1234"}` {
+		t.Errorf("unexpected meta data %q", content)
+	}
+
+	digest := configDriveDigest(files)
+	files["openstack/latest/meta_data.json"] = []byte(`{"uuid":"5678"}`)
+	if configDriveDigest(files) == digest {
+		t.Error("expected the digest to change with the content")
+	}
+}
@@ -0,0 +1,45 @@
+package imagehandler
+
+import (
+	"context"
+	"io"
+	"net/http"
+)
+
+// contextReader fails reads once its context is done, so that a copy stops
+// promptly when a download is aborted or generation times out.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// contextFile is an image opened for a request, whose reads fail once the
+// request's context is done.
+type contextFile struct {
+	http.File
+	ctx context.Context
+}
+
+func (f *contextFile) Read(p []byte) (int, error) {
+	if err := f.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return f.File.Read(p)
+}
+
+// requestFileSystem opens images on behalf of a single request.
+type requestFileSystem struct {
+	f   *imageFileSystem
+	ctx context.Context
+}
+
+func (r requestFileSystem) Open(name string) (http.File, error) {
+	return r.f.open(r.ctx, name)
+}
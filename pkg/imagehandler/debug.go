@@ -0,0 +1,74 @@
+package imagehandler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// RegisteredImage describes an image registered with the server.
+type RegisteredImage struct {
+	Name      string    `json:"name"`
+	FileName  string    `json:"fileName,omitempty"`
+	Size      int64     `json:"size"`
+	Digest    string    `json:"digest"`
+	Revision  string    `json:"revision"`
+	Created   time.Time `json:"created,omitempty"`
+	Generated bool      `json:"generated"`
+	Error     string    `json:"error,omitempty"`
+	Cached    bool      `json:"cached"`
+}
+
+func (f *imageFileSystem) ListImages(ctx context.Context) ([]RegisteredImage, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	images := make([]RegisteredImage, 0, f.images.len())
+	for _, im := range f.images.all() {
+		image := RegisteredImage{
+			Name:      im.name,
+			FileName:  im.fileName,
+			Size:      im.size,
+			Digest:    im.digest,
+			Revision:  im.revision,
+			Created:   im.createdAt,
+			Generated: im.generated,
+			Cached:    im.cachePath != "",
+		}
+		if im.generationErr != nil {
+			image.Error = im.generationErr.Error()
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// NewDebugHandler returns a handler that lists the images registered with
+// server as JSON at /images, for troubleshooting. Requests must carry token
+// as a bearer token. It is meant to be served on its own listener, away from
+// the images endpoint.
+func NewDebugHandler(server ImageFileServer, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/images", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		images, err := server.ListImages(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(images)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" || !hasBearerToken(r, token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,68 @@
+package imagehandler
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// baseImageRetryInterval is how often base ISOs are looked for again while
+// the image server watches them, so that one appearing in a directory that
+// did not exist to be watched is noticed too.
+const baseImageRetryInterval = 30 * time.Second
+
+// checkMissingBaseImages returns the configured base ISOs that cannot be
+// read. The server runs degraded without them rather than failing: it is not
+// ready, and refuses the images built from them, until they appear. Base
+// ISOs going missing or reappearing since the last check are logged, and the
+// missing ones counted in the metrics.
+func (f *imageFileSystem) checkMissingBaseImages() []string {
+	missing := []string{}
+	current := map[string]bool{}
+	errs := map[string]error{}
+	for _, isoPath := range f.baseImages() {
+		if _, _, err := statBaseImage(isoPath); err != nil {
+			missing = append(missing, isoPath)
+			current[isoPath] = true
+			errs[isoPath] = err
+		}
+	}
+
+	f.mu.Lock()
+	previous := f.missingBaseImages
+	f.missingBaseImages = current
+	f.mu.Unlock()
+
+	for _, isoPath := range missing {
+		if !previous[isoPath] {
+			f.log.Error(errs[isoPath], "base image is missing, running degraded until it appears", "path", isoPath)
+		}
+	}
+	for isoPath := range previous {
+		if !current[isoPath] {
+			f.log.Info("base image found", "path", isoPath, "degraded", len(missing) > 0)
+		}
+	}
+	baseImagesMissing.Set(float64(len(missing)))
+	return missing
+}
+
+// serveBaseImageUnavailable refuses a request for an image whose base ISO is
+// missing with 503 Service Unavailable, rather than the internal error that
+// reading it would fail with, returning whether it did. Images already
+// generated into the cache are still served.
+func (f *imageFileSystem) serveBaseImageUnavailable(w http.ResponseWriter, im *imageFile) bool {
+	f.mu.RLock()
+	isoFile, cachePath := im.isoFile, im.cachePath
+	f.mu.RUnlock()
+	if isoFile == "" || cachePath != "" {
+		return false
+	}
+	if _, err := os.Stat(isoFile); err == nil {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(baseImageRetryInterval.Seconds())))
+	http.Error(w, ErrBaseISOUnavailable.Error(), http.StatusServiceUnavailable)
+	return true
+}
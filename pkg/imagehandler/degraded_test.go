@@ -0,0 +1,57 @@
+package imagehandler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMissingBaseImage(t *testing.T) {
+	isoFile := filepath.Join(t.TempDir(), "rhcos-live.iso")
+	imageServer := newTestImageServer(t, Options{
+		IsoFile: isoFile,
+		BaseURL: "http://localhost:8080",
+	})
+	spec := ImageSpec{Name: "host-xyz-45.iso", Ignition: []byte(`{}`)}
+
+	if missing := imageServer.checkMissingBaseImages(); len(missing) != 1 || missing[0] != isoFile {
+		t.Errorf("expected the base image to be missing, got %v", missing)
+	}
+	if err := imageServer.CheckReady(context.Background()); !errors.Is(err, ErrBaseISOUnavailable) {
+		t.Errorf("expected the server to be degraded, got %v", err)
+	}
+	if _, err := imageServer.ServeImage(context.Background(), spec); !errors.Is(err, ErrBaseISOUnavailable) {
+		t.Errorf("expected the image to be refused, got %v", err)
+	}
+
+	// the base image appears
+	content, err := os.ReadFile(buildLiveISO(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(isoFile, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := imageServer.CheckReady(context.Background()); err != nil {
+		t.Errorf("expected the server to recover, got %v", err)
+	}
+	info, err := imageServer.ServeImage(context.Background(), spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-info.Done
+	if status, _ := getURL(t, imageServer, info.URL); status != http.StatusOK {
+		t.Errorf("unexpected status %d", status)
+	}
+
+	// and goes missing again
+	if err := os.Remove(isoFile); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := getURL(t, imageServer, info.URL); status != http.StatusServiceUnavailable {
+		t.Errorf("expected the image to be unavailable, got status %d", status)
+	}
+}
@@ -0,0 +1,63 @@
+package imagehandler
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// downloadQueueLength is the number of download records buffered for the
+// consumer of Downloads(). Further records are dropped until it catches up.
+const downloadQueueLength = 100
+
+// Download records a client fetching an image.
+type Download struct {
+	// Name is the name the image was registered under.
+	Name       string
+	RemoteAddr string
+	Time       time.Time
+	// Bytes is the number of bytes sent, which is less than the image size
+	// for range requests and interrupted transfers.
+	Bytes    int64
+	Complete bool
+}
+
+func (f *imageFileSystem) Downloads() <-chan Download {
+	return f.downloads
+}
+
+// recordDownload logs a download of an image and passes it on to the
+// consumer of Downloads(), if there is room.
+func (f *imageFileSystem) recordDownload(log logr.Logger, im *imageFile, r *http.Request, written int64, complete bool) {
+	download := Download{
+		Name:       im.name,
+		RemoteAddr: f.clientAddr(r),
+		Time:       time.Now(),
+		Bytes:      written,
+		Complete:   complete,
+	}
+	log.Info("image downloaded", "image", download.Name, "remoteAddr", download.RemoteAddr,
+		"bytes", download.Bytes, "complete", download.Complete)
+
+	if complete {
+		f.mu.Lock()
+		im.lastDownload = &download
+		f.mu.Unlock()
+	}
+
+	select {
+	case f.downloads <- download:
+	default:
+	}
+}
+
+func (f *imageFileSystem) LastDownload(name string) (Download, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	im := f.imageFileByNameLocked(name)
+	if im == nil || im.lastDownload == nil {
+		return Download{}, false
+	}
+	return *im.lastDownload, true
+}
@@ -0,0 +1,323 @@
+package imagehandler
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Cached images are encrypted with AES-GCM in fixed-size chunks, so that
+// ranges can be decrypted without reading the whole file. Each file is
+// sealed under its own key, derived with HKDF-SHA256 from the configured
+// key and a random salt, so the chunk index can serve as the nonce without
+// nonces ever repeating under a key. The file starts with a header holding
+// the salt and the plaintext size. Every chunk is authenticated along with
+// the salt, its index and whether it is the final one, so that chunks
+// cannot be reordered, dropped or appended, and the final chunk's length
+// vouches for the size in the header.
+const (
+	encryptionMagic     = "ICCENC02"
+	encryptionChunkSize = 64 * 1024
+	encryptionSaltSize  = 32
+	encryptionHeaderLen = len(encryptionMagic) + encryptionSaltSize + 8
+)
+
+// encryptionKeyInfo binds derived keys to their use in HKDF.
+const encryptionKeyInfo = "image-customization-controller cached image"
+
+var errBadEncryptedFile = errors.New("cached image is corrupt or not encrypted with the configured key")
+
+// KeyEncoding is how an encryption key is written in its file.
+type KeyEncoding string
+
+const (
+	// KeyEncodingHex is a hex encoded key, surrounding whitespace ignored.
+	KeyEncodingHex KeyEncoding = "hex"
+	// KeyEncodingBase64 is a standard base64 encoded key, surrounding
+	// whitespace ignored.
+	KeyEncodingBase64 KeyEncoding = "base64"
+	// KeyEncodingRaw is the key bytes themselves.
+	KeyEncodingRaw KeyEncoding = "raw"
+)
+
+// ParseKeyEncoding validates a key encoding name. An empty name is
+// KeyEncodingHex.
+func ParseKeyEncoding(value string) (KeyEncoding, error) {
+	switch e := KeyEncoding(value); e {
+	case "":
+		return KeyEncodingHex, nil
+	case KeyEncodingHex, KeyEncodingBase64, KeyEncodingRaw:
+		return e, nil
+	}
+	return KeyEncodingHex, fmt.Errorf("unknown key encoding %q", value)
+}
+
+// ParseEncryptionKey reads an AES key written with encoding from the
+// content of a mounted Secret file.
+func ParseEncryptionKey(data []byte, encoding KeyEncoding) ([]byte, error) {
+	var key []byte
+	var err error
+	switch encoding {
+	case KeyEncodingHex:
+		key, err = hex.DecodeString(strings.TrimSpace(string(data)))
+	case KeyEncodingBase64:
+		key, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	case KeyEncodingRaw:
+		key = data
+	default:
+		err = fmt.Errorf("unknown key encoding %q", encoding)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("encryption key is not %s encoded: %w", encoding, err)
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	}
+	return nil, fmt.Errorf("encryption key must be 16, 24 or 32 bytes, not %d", len(key))
+}
+
+// newFileGCM returns the cipher of the cached file with salt, using an
+// AES-256 key derived with HKDF-SHA256 from key.
+func newFileGCM(key, salt []byte) (cipher.AEAD, error) {
+	fileKey := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, salt, []byte(encryptionKeyInfo)), fileKey); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of a chunk, unique within the file's key.
+func chunkNonce(chunk int64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], uint64(chunk))
+	return nonce
+}
+
+// chunkAD returns the additional data authenticated with a chunk: the start
+// of the header, the chunk's index and whether it is the final chunk.
+func chunkAD(salt []byte, chunk int64, final bool) []byte {
+	ad := make([]byte, 0, len(encryptionMagic)+len(salt)+9)
+	ad = append(ad, encryptionMagic...)
+	ad = append(ad, salt...)
+	ad = append(ad, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(ad[len(ad)-8:], uint64(chunk))
+	if final {
+		return append(ad, 1)
+	}
+	return append(ad, 0)
+}
+
+// encryptingWriter encrypts everything written to it into dst. A full
+// chunk is only sealed once more is written, since the final chunk is sealed
+// differently, and the header is written when the writer is closed, since
+// only then is the size known.
+type encryptingWriter struct {
+	dst   *os.File
+	gcm   cipher.AEAD
+	salt  []byte
+	buf   []byte
+	chunk int64
+	size  int64
+}
+
+func newEncryptingWriter(dst *os.File, key []byte) (*encryptingWriter, error) {
+	salt := make([]byte, encryptionSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	gcm, err := newFileGCM(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dst.Seek(int64(encryptionHeaderLen), io.SeekStart); err != nil {
+		return nil, err
+	}
+	return &encryptingWriter{
+		dst:  dst,
+		gcm:  gcm,
+		salt: salt,
+		buf:  make([]byte, 0, encryptionChunkSize),
+	}, nil
+}
+
+func (w *encryptingWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *encryptingWriter) flush(final bool) error {
+	sealed := w.gcm.Seal(nil, chunkNonce(w.chunk), w.buf, chunkAD(w.salt, w.chunk, final))
+	if _, err := w.dst.Write(sealed); err != nil {
+		return err
+	}
+	w.size += int64(len(w.buf))
+	w.chunk++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// Close writes the final chunk, which is empty for an empty file, and the
+// header. It does not close dst.
+func (w *encryptingWriter) Close() error {
+	if err := w.flush(true); err != nil {
+		return err
+	}
+	header := make([]byte, encryptionHeaderLen)
+	copy(header, encryptionMagic)
+	copy(header[len(encryptionMagic):], w.salt)
+	binary.BigEndian.PutUint64(header[len(encryptionMagic)+encryptionSaltSize:], uint64(w.size))
+	_, err := w.dst.WriteAt(header, 0)
+	return err
+}
+
+// decryptingReader is a seekable reader over the plaintext of an encrypted
+// cached image.
+type decryptingReader struct {
+	file   *os.File
+	gcm    cipher.AEAD
+	salt   []byte
+	size   int64
+	chunks int64
+	offset int64
+
+	chunk     int64
+	plaintext []byte
+}
+
+// openEncrypted opens an encrypted cached image, checking that it was
+// encrypted with key and has the size in its header by decrypting its
+// first and final chunks.
+func openEncrypted(path string, key []byte) (*decryptingReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newDecryptingReader(file, key)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func newDecryptingReader(file *os.File, key []byte) (*decryptingReader, error) {
+	header := make([]byte, encryptionHeaderLen)
+	if _, err := io.ReadFull(file, header); err != nil || string(header[:len(encryptionMagic)]) != encryptionMagic {
+		return nil, errBadEncryptedFile
+	}
+	salt := header[len(encryptionMagic) : len(encryptionMagic)+encryptionSaltSize]
+	gcm, err := newFileGCM(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	size := int64(binary.BigEndian.Uint64(header[len(encryptionMagic)+encryptionSaltSize:]))
+	if size < 0 {
+		return nil, errBadEncryptedFile
+	}
+	chunks := int64(1)
+	if size > 0 {
+		chunks = (size + encryptionChunkSize - 1) / encryptionChunkSize
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() != int64(encryptionHeaderLen)+size+chunks*int64(gcm.Overhead()) {
+		return nil, errBadEncryptedFile
+	}
+
+	r := &decryptingReader{file: file, gcm: gcm, salt: salt, size: size, chunks: chunks, chunk: -1}
+	if err := r.load(chunks - 1); err != nil {
+		return nil, err
+	}
+	if int64(len(r.plaintext)) != size-(chunks-1)*encryptionChunkSize {
+		return nil, errBadEncryptedFile
+	}
+	if err := r.load(0); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	chunk := r.offset / encryptionChunkSize
+	if chunk != r.chunk {
+		if err := r.load(chunk); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plaintext[r.offset-chunk*encryptionChunkSize:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *decryptingReader) load(chunk int64) error {
+	if chunk >= r.chunks {
+		return errBadEncryptedFile
+	}
+	sealedSize := int64(encryptionChunkSize + r.gcm.Overhead())
+	sealed := make([]byte, sealedSize)
+	n, err := r.file.ReadAt(sealed, int64(encryptionHeaderLen)+chunk*sealedSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	final := chunk == r.chunks-1
+	plaintext, err := r.gcm.Open(r.plaintext[:0], chunkNonce(chunk), sealed[:n], chunkAD(r.salt, chunk, final))
+	if err != nil {
+		return errBadEncryptedFile
+	}
+	r.plaintext = plaintext
+	r.chunk = chunk
+	return nil
+}
+
+func (r *decryptingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *decryptingReader) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,160 @@
+package imagehandler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeEncrypted encrypts plaintext with key into a new file.
+func writeEncrypted(t *testing.T, key, plaintext []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "image.iso")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	w, err := newEncryptingWriter(file, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	for _, size := range []int{0, 123, encryptionChunkSize, 3*encryptionChunkSize + 123} {
+		plaintext := make([]byte, size)
+		for i := range plaintext {
+			plaintext[i] = byte(i % 251)
+		}
+		r, err := openEncrypted(writeEncrypted(t, key, plaintext), key)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		all, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(all, plaintext) {
+			t.Fatalf("size %d: decrypted content does not match", size)
+		}
+	}
+
+	plaintext := make([]byte, 3*encryptionChunkSize+123)
+	for i := range plaintext {
+		plaintext[i] = byte(i % 251)
+	}
+	path := writeEncrypted(t, key, plaintext)
+	r, err := openEncrypted(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// a range spanning a chunk boundary
+	start := int64(encryptionChunkSize - 10)
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	part := make([]byte, 20)
+	if _, err := io.ReadFull(r, part); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(part, plaintext[start:start+20]) {
+		t.Error("decrypted range does not match")
+	}
+
+	if _, err := openEncrypted(path, bytes.Repeat([]byte{0x43}, 32)); err != errBadEncryptedFile {
+		t.Errorf("expected opening with the wrong key to fail, got %v", err)
+	}
+}
+
+func TestEncryptionTampering(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	plaintext := append(bytes.Repeat([]byte("image"), encryptionChunkSize), "tail"...)
+	content, err := os.ReadFile(writeEncrypted(t, key, plaintext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealedSize := encryptionChunkSize + 16
+	chunk := func(i int) []byte {
+		start := encryptionHeaderLen + i*sealedSize
+		end := start + sealedSize
+		if end > len(content) {
+			end = len(content)
+		}
+		return content[start:end]
+	}
+	concat := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	header := content[:encryptionHeaderLen]
+	truncatedHeader := append([]byte{}, header...)
+	binary.BigEndian.PutUint64(truncatedHeader[encryptionHeaderLen-8:], 2*encryptionChunkSize)
+	flipped := append([]byte{}, content...)
+	flipped[encryptionHeaderLen+sealedSize+7] ^= 1
+
+	for name, tampered := range map[string][]byte{
+		"flipped bit":         flipped,
+		"swapped chunks":      concat(header, chunk(1), chunk(0), chunk(2), chunk(3), chunk(4), chunk(5)),
+		"dropped final chunk": concat(header, chunk(0), chunk(1), chunk(2), chunk(3), chunk(4)),
+		"truncated size":      concat(truncatedHeader, chunk(0), chunk(1)),
+		"appended chunk":      concat(content, chunk(1)),
+	} {
+		path := filepath.Join(t.TempDir(), "image.iso")
+		if err := os.WriteFile(path, tampered, 0600); err != nil {
+			t.Fatal(err)
+		}
+		r, err := openEncrypted(path, key)
+		if err == nil {
+			_, err = io.ReadAll(r)
+			r.Close()
+		}
+		if err != errBadEncryptedFile {
+			t.Errorf("%s: expected the file to be rejected, got %v", name, err)
+		}
+	}
+}
+
+func TestParseEncryptionKey(t *testing.T) {
+	key := bytes.Repeat([]byte{0xab}, 16)
+	hexKey := []byte("abababababababababababababababab\n")
+	for _, tc := range []struct {
+		data     []byte
+		encoding KeyEncoding
+		valid    bool
+	}{
+		{hexKey, KeyEncodingHex, true},
+		{[]byte("q6urq6urq6urq6urq6urqw==\n"), KeyEncodingBase64, true},
+		{key, KeyEncodingRaw, true},
+		{key, KeyEncodingHex, false},
+		{hexKey, KeyEncodingRaw, false},
+		{[]byte("not base64"), KeyEncodingBase64, false},
+		{hexKey, "", false},
+	} {
+		parsed, err := ParseEncryptionKey(tc.data, tc.encoding)
+		if !tc.valid {
+			if err == nil {
+				t.Errorf("expected %q to be refused as a %s key", tc.data, tc.encoding)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s key %q: %v", tc.encoding, tc.data, err)
+		} else if !bytes.Equal(parsed, key) {
+			t.Errorf("%s key %q parsed as %x", tc.encoding, tc.data, parsed)
+		}
+	}
+}
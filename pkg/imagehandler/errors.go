@@ -0,0 +1,38 @@
+package imagehandler
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+)
+
+// ErrImageNotFound is returned for images that are not registered. It
+// matches fs.ErrNotExist too.
+var ErrImageNotFound = fmt.Errorf("image not found: %w", fs.ErrNotExist)
+
+// ErrBaseISOUnavailable is returned when the base ISO an image is built from
+// cannot be read. It usually clears once the ISO is restored.
+var ErrBaseISOUnavailable = errors.New("base ISO unavailable")
+
+// ErrIgnitionTooLarge is returned when the ignition content does not fit in
+// the embed area of the base ISO. It persists until the content changes.
+var ErrIgnitionTooLarge = errors.New("ignition too large")
+
+// ErrGenerationTimeout is returned when generating an image takes longer
+// than the configured generation timeout.
+var ErrGenerationTimeout = errors.New("image generation timed out")
+
+// ErrGenerationFailed is the error of an image whose background generation
+// failed. The image keeps failing until it is registered again with
+// different content, or removed first.
+type ErrGenerationFailed struct {
+	Cause error
+}
+
+func (e *ErrGenerationFailed) Error() string {
+	return fmt.Sprintf("image generation failed: %v", e.Cause)
+}
+
+func (e *ErrGenerationFailed) Unwrap() error {
+	return e.Cause
+}
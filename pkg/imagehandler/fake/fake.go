@@ -0,0 +1,352 @@
+// Package fake provides an in-memory imagehandler.ImageFileServer for
+// testing code that registers images, such as controllers, without base ISOs
+// or an HTTP server.
+package fake
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/asalkeld/image-customization-controller/pkg/imagehandler"
+)
+
+// DefaultBaseURL is the prefix of image URLs unless Server.BaseURL is set.
+const DefaultBaseURL = "http://images.example.com"
+
+// DefaultBaseImageVersion is the base image version reported unless
+// Server.Version is set.
+const DefaultBaseImageVersion = "fake"
+
+// downloadQueueLength is how many downloads are buffered for the consumer of
+// Downloads().
+const downloadQueueLength = 16
+
+// Server is an in-memory ImageFileServer. An image is served at its name
+// under BaseURL, and is ready as soon as it is registered unless generation
+// is held. Registering it again with the same spec leaves it as it is,
+// failed or still generating. Its size is that of its ignition content. It is safe for
+// concurrent use, and its zero value is ready to use.
+type Server struct {
+	// BaseURL is the prefix of image URLs, DefaultBaseURL if empty.
+	BaseURL string
+	// Version is the base image version, DefaultBaseImageVersion if
+	// empty. Changing it tells the code under test the base ISO was
+	// replaced.
+	Version string
+
+	mu             sync.Mutex
+	images         map[string]*image
+	registerErr    error
+	readyErr       error
+	holdGeneration bool
+	downloads      chan imagehandler.Download
+	lastDownloads  map[string]imagehandler.Download
+}
+
+type image struct {
+	spec    imagehandler.ImageSpec
+	created time.Time
+	ready   bool
+	err     error
+	done    chan struct{}
+}
+
+var _ imagehandler.ImageFileServer = &Server{}
+
+// New returns an empty Server.
+func New() *Server {
+	return &Server{}
+}
+
+// URL returns the URL an image is served at.
+func (s *Server) URL(name string) string {
+	base := s.BaseURL
+	if base == "" {
+		base = DefaultBaseURL
+	}
+	return base + "/" + name
+}
+
+// FailRegistrations makes ServeImage and ReplaceImage fail with err, until
+// called again with nil.
+func (s *Server) FailRegistrations(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.registerErr = err
+}
+
+// SetReadyError makes CheckReady fail with err, until called again with nil.
+func (s *Server) SetReadyError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readyErr = err
+}
+
+// HoldGeneration leaves the images registered from now on generating until
+// FinishGeneration is called for them, or releases them if hold is false.
+func (s *Server) HoldGeneration(hold bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.holdGeneration = hold
+}
+
+// FinishGeneration ends generation of an image, failing it with err if that
+// is not nil. It returns false if the image is not registered or was ready
+// already.
+func (s *Server) FinishGeneration(name string, err error) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	im := s.images[name]
+	if im == nil || im.ready {
+		return false
+	}
+	im.ready = true
+	if err != nil {
+		im.err = &imagehandler.ErrGenerationFailed{Cause: err}
+	}
+	close(im.done)
+	return true
+}
+
+// Download records a complete download of an image by a client, as the
+// image server would, returning false if the image is not registered.
+func (s *Server) Download(name, remoteAddr string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	im := s.images[name]
+	if im == nil {
+		return false
+	}
+	download := imagehandler.Download{
+		Name:       name,
+		RemoteAddr: remoteAddr,
+		Time:       time.Now(),
+		Bytes:      int64(len(im.spec.Ignition)),
+		Complete:   true,
+	}
+	if s.lastDownloads == nil {
+		s.lastDownloads = map[string]imagehandler.Download{}
+	}
+	s.lastDownloads[name] = download
+	select {
+	case s.downloadsLocked() <- download:
+	default:
+	}
+	return true
+}
+
+// Image returns the spec an image was last registered with.
+func (s *Server) Image(name string) (imagehandler.ImageSpec, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	im := s.images[name]
+	if im == nil {
+		return imagehandler.ImageSpec{}, false
+	}
+	return im.spec, true
+}
+
+// ImageNames returns the names of the registered images, sorted.
+func (s *Server) ImageNames() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.images))
+	for name := range s.images {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// AssertImage fails the test unless an image is registered, and returns the
+// spec it was last registered with.
+func (s *Server) AssertImage(t testing.TB, name string) imagehandler.ImageSpec {
+	t.Helper()
+	spec, ok := s.Image(name)
+	if !ok {
+		t.Fatalf("image %q is not registered; registered images are %v", name, s.ImageNames())
+	}
+	return spec
+}
+
+// AssertNoImage fails the test if an image is registered.
+func (s *Server) AssertNoImage(t testing.TB, name string) {
+	t.Helper()
+	if _, ok := s.Image(name); ok {
+		t.Errorf("image %q is registered", name)
+	}
+}
+
+// AssertImages fails the test unless exactly the named images are
+// registered.
+func (s *Server) AssertImages(t testing.TB, names ...string) {
+	t.Helper()
+	expected := append([]string{}, names...)
+	sort.Strings(expected)
+	registered := s.ImageNames()
+	if len(registered) != len(expected) {
+		t.Errorf("registered images are %v, expected %v", registered, expected)
+		return
+	}
+	for i := range expected {
+		if registered[i] != expected[i] {
+			t.Errorf("registered images are %v, expected %v", registered, expected)
+			return
+		}
+	}
+}
+
+func (s *Server) ServeImage(ctx context.Context, spec imagehandler.ImageSpec) (imagehandler.ImageInfo, error) {
+	return s.register(spec, false)
+}
+
+func (s *Server) ReplaceImage(ctx context.Context, spec imagehandler.ImageSpec) (imagehandler.ImageInfo, error) {
+	return s.register(spec, true)
+}
+
+func (s *Server) register(spec imagehandler.ImageSpec, replace bool) (imagehandler.ImageInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.registerErr != nil {
+		return imagehandler.ImageInfo{}, s.registerErr
+	}
+	if replace && s.images[spec.Name] == nil {
+		return imagehandler.ImageInfo{}, imagehandler.ErrImageNotFound
+	}
+	if s.images == nil {
+		s.images = map[string]*image{}
+	}
+	if im := s.images[spec.Name]; im != nil && !replace && reflect.DeepEqual(im.spec, spec) {
+		// as by the image server, the image is not generated again
+		return s.infoLocked(im), nil
+	}
+	im := &image{
+		spec:    spec,
+		created: time.Now(),
+		ready:   !s.holdGeneration,
+		done:    make(chan struct{}),
+	}
+	if im.ready {
+		close(im.done)
+	}
+	s.images[spec.Name] = im
+	return s.infoLocked(im), nil
+}
+
+func (s *Server) infoLocked(im *image) imagehandler.ImageInfo {
+	info := imagehandler.ImageInfo{
+		URL:    s.URL(im.spec.Name),
+		Format: imagehandler.ImageFormatISO,
+		Size:   int64(len(im.spec.Ignition)),
+		Ready:  im.ready,
+		Error:  im.err,
+	}
+	if im.spec.ConfigDrive != nil {
+		info.Format = imagehandler.ImageFormatConfigDrive
+	}
+	if !im.ready {
+		info.Done = im.done
+	}
+	return info
+}
+
+func (s *Server) GetImage(ctx context.Context, name string) (imagehandler.ImageInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	im := s.images[name]
+	if im == nil {
+		return imagehandler.ImageInfo{}, imagehandler.ErrImageNotFound
+	}
+	return s.infoLocked(im), nil
+}
+
+func (s *Server) RemoveImage(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.images[name] == nil {
+		return imagehandler.ErrImageNotFound
+	}
+	delete(s.images, name)
+	delete(s.lastDownloads, name)
+	return nil
+}
+
+func (s *Server) ImageReady(ctx context.Context, name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	im := s.images[name]
+	if im == nil {
+		return false, imagehandler.ErrImageNotFound
+	}
+	return im.ready, im.err
+}
+
+func (s *Server) ImageChecksum(name string) (string, imagehandler.ChecksumType) {
+	return "", ""
+}
+
+func (s *Server) BaseImageVersion(ctx context.Context) (string, error) {
+	return s.version(), nil
+}
+
+func (s *Server) version() string {
+	if s.Version == "" {
+		return DefaultBaseImageVersion
+	}
+	return s.Version
+}
+
+func (s *Server) Downloads() <-chan imagehandler.Download {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.downloadsLocked()
+}
+
+func (s *Server) downloadsLocked() chan imagehandler.Download {
+	if s.downloads == nil {
+		s.downloads = make(chan imagehandler.Download, downloadQueueLength)
+	}
+	return s.downloads
+}
+
+func (s *Server) ImageURLExpiry(name string) time.Time {
+	return time.Time{}
+}
+
+func (s *Server) LastDownload(name string) (imagehandler.Download, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	download, ok := s.lastDownloads[name]
+	return download, ok
+}
+
+func (s *Server) ListImages(ctx context.Context) ([]imagehandler.RegisteredImage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	images := make([]imagehandler.RegisteredImage, 0, len(s.images))
+	for name, im := range s.images {
+		image := imagehandler.RegisteredImage{
+			Name:      name,
+			Size:      int64(len(im.spec.Ignition)),
+			Revision:  s.version(),
+			Created:   im.created,
+			Generated: im.ready,
+		}
+		if im.err != nil {
+			image.Error = im.err.Error()
+		}
+		images = append(images, image)
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].Name < images[j].Name })
+	return images, nil
+}
+
+func (s *Server) CheckReady(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readyErr
+}
@@ -0,0 +1,91 @@
+package fake
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/asalkeld/image-customization-controller/pkg/imagehandler"
+)
+
+func TestServer(t *testing.T) {
+	ctx := context.Background()
+	server := New()
+
+	info, err := server.ServeImage(ctx, imagehandler.ImageSpec{Name: "host.iso", Ignition: []byte(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.URL != DefaultBaseURL+"/host.iso" || !info.Ready || info.Size != 2 {
+		t.Errorf("unexpected image %+v", info)
+	}
+	server.AssertImages(t, "host.iso")
+	if spec := server.AssertImage(t, "host.iso"); string(spec.Ignition) != `{}` {
+		t.Errorf("unexpected ignition %q", spec.Ignition)
+	}
+
+	if _, err := server.ReplaceImage(ctx, imagehandler.ImageSpec{Name: "other.iso"}); !errors.Is(err, imagehandler.ErrImageNotFound) {
+		t.Errorf("expected an unregistered image not to be replaced, got %v", err)
+	}
+
+	server.HoldGeneration(true)
+	info, err = server.ServeImage(ctx, imagehandler.ImageSpec{Name: "held.iso"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Ready || info.Done == nil {
+		t.Fatalf("expected the image to be generating, got %+v", info)
+	}
+	server.FinishGeneration("held.iso", errors.New("no space left on device"))
+	<-info.Done
+	var failed *imagehandler.ErrGenerationFailed
+	if ready, err := server.ImageReady(ctx, "held.iso"); !ready || !errors.As(err, &failed) {
+		t.Errorf("expected the generation to fail, got %v, %v", ready, err)
+	}
+
+	server.Download("host.iso", "192.0.2.1:1234")
+	if download := <-server.Downloads(); download.Name != "host.iso" || !download.Complete {
+		t.Errorf("unexpected download %+v", download)
+	}
+	if _, ok := server.LastDownload("host.iso"); !ok {
+		t.Error("expected the download to be recorded")
+	}
+
+	if err := server.RemoveImage(ctx, "host.iso"); err != nil {
+		t.Fatal(err)
+	}
+	server.AssertNoImage(t, "host.iso")
+	server.AssertImages(t, "held.iso")
+
+	server.FailRegistrations(imagehandler.ErrBaseISOUnavailable)
+	if _, err := server.ServeImage(ctx, imagehandler.ImageSpec{Name: "host.iso"}); !errors.Is(err, imagehandler.ErrBaseISOUnavailable) {
+		t.Errorf("expected the registration to fail, got %v", err)
+	}
+}
+
+func TestServeImageAgain(t *testing.T) {
+	ctx := context.Background()
+	server := New()
+	server.HoldGeneration(true)
+	spec := imagehandler.ImageSpec{Name: "host.iso", Ignition: []byte(`{}`)}
+	if _, err := server.ServeImage(ctx, spec); err != nil {
+		t.Fatal(err)
+	}
+	server.FinishGeneration("host.iso", errors.New("no space left on device"))
+
+	info, err := server.ServeImage(ctx, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Ready || info.Error == nil {
+		t.Errorf("expected the failed image to be kept, got %+v", info)
+	}
+
+	spec.Ignition = []byte(`{"ignition":{}}`)
+	if info, err = server.ServeImage(ctx, spec); err != nil {
+		t.Fatal(err)
+	}
+	if info.Ready || info.Error != nil {
+		t.Errorf("expected the changed image to be generated again, got %+v", info)
+	}
+}
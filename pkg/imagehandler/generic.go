@@ -0,0 +1,106 @@
+package imagehandler
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/openshift/assisted-image-service/pkg/isoeditor"
+	"github.com/openshift/assisted-image-service/pkg/overlay"
+
+	"github.com/asalkeld/image-customization-controller/pkg/initrd"
+)
+
+// EmbedStrategy embeds the content of images in base ISOs that are not
+// RHCOS live ISOs, and so have no ignition embed area, e.g. other
+// distributions' live media prepared with a placeholder file. The content is
+// written over the space of the placeholder in the ISO, which keeps its
+// size; any kernel arguments or boot configuration of images are refused,
+// as such ISOs have no area for them either.
+type EmbedStrategy struct {
+	// Area is the path in the ISO of the placeholder file.
+	Area string
+	// InitrdPath, if set, wraps the content in an initramfs archive holding
+	// it at this path, for a placeholder the boot menu loads as an
+	// additional initrd. Otherwise the content is written as it is.
+	InitrdPath string
+}
+
+// IsZero reports whether no strategy is set, in which case only RHCOS live
+// ISOs can be used.
+func (s EmbedStrategy) IsZero() bool {
+	return s.Area == ""
+}
+
+// ParseEmbedStrategy parses an embed strategy: "raw:<area>" writes the
+// content over the file at area in the ISO as it is, and
+// "initrd:<area>:<path>" writes an initramfs archive holding the content at
+// path. The empty string is no strategy.
+func ParseEmbedStrategy(value string) (EmbedStrategy, error) {
+	if value == "" {
+		return EmbedStrategy{}, nil
+	}
+	parts := strings.Split(value, ":")
+	strategy := EmbedStrategy{}
+	switch {
+	case len(parts) == 2 && parts[0] == "raw":
+		strategy.Area = parts[1]
+	case len(parts) == 3 && parts[0] == "initrd":
+		strategy.Area, strategy.InitrdPath = parts[1], parts[2]
+		if !path.IsAbs(strategy.InitrdPath) || path.Clean(strategy.InitrdPath) != strategy.InitrdPath {
+			return EmbedStrategy{}, fmt.Errorf("invalid initramfs path %q", strategy.InitrdPath)
+		}
+	default:
+		return EmbedStrategy{}, fmt.Errorf("unknown embed strategy %q", value)
+	}
+	if !path.IsAbs(strategy.Area) || path.Clean(strategy.Area) != strategy.Area {
+		return EmbedStrategy{}, fmt.Errorf("invalid embed area %q", strategy.Area)
+	}
+	return strategy, nil
+}
+
+// usableBaseImage verifies that images can be built from a base ISO: an
+// RHCOS live ISO with an ignition embed area, or one with the embed area of
+// the embed strategy for other ISOs.
+func (f *imageFileSystem) usableBaseImage(isoPath string) error {
+	info, err := getISOInfo(isoPath)
+	if err != nil && !f.genericEmbed.IsZero() {
+		if _, _, areaErr := isoeditor.GetISOFileInfo(f.genericEmbed.Area, isoPath); areaErr == nil {
+			return nil
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("base image %s is not usable: %w", isoPath, err)
+	}
+	if info.areaLength <= 0 {
+		return fmt.Errorf("base image %s has no ignition embed area", isoPath)
+	}
+	return nil
+}
+
+// genericOverlays returns the area of a base ISO that is not an RHCOS live
+// ISO replaced to embed the ignition content of an image with its embed
+// strategy.
+func genericOverlays(im *imageFile) ([]overlay.Overlay, error) {
+	if len(im.kernelArgs) > 0 || !im.boot.IsZero() {
+		return nil, fmt.Errorf("base image %s is not an RHCOS live ISO, so kernel arguments and boot configuration cannot be set", im.isoFile)
+	}
+	start, length, err := isoeditor.GetISOFileInfo(im.embed.Area, im.isoFile)
+	if err != nil {
+		return nil, fmt.Errorf("base image %s has no embed area %s: %w", im.isoFile, im.embed.Area, err)
+	}
+	content := im.ignitionContent
+	if im.embed.InitrdPath != "" {
+		content = initrd.NewArchive().AddFile(im.embed.InitrdPath, 0600, content).Bytes()
+	}
+	if int64(len(content)) > length {
+		return nil, fmt.Errorf("%w: content length (%d) exceeds embed area size (%d)",
+			ErrIgnitionTooLarge, len(content), length)
+	}
+	return []overlay.Overlay{{
+		Reader: bytes.NewReader(content),
+		Offset: start,
+		Length: int64(len(content)),
+	}}, nil
+}
@@ -0,0 +1,60 @@
+package imagehandler
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestGenericEmbed(t *testing.T) {
+	isoPath := createISO(t, map[string]string{
+		"boot/vmlinuz":    "kernel",
+		"boot/config.img": strings.Repeat("\x00", 512),
+	}, map[string]interface{}{})
+	if _, err := getISOInfo(isoPath); err == nil {
+		t.Fatal("expected an ISO without an ignition embed area")
+	}
+
+	for _, value := range []string{"raw:/boot/config.img", "initrd:/boot/config.img:/etc/config.ign"} {
+		embed, err := ParseEmbedStrategy(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := newTestImageServer(t, Options{GenericEmbed: embed}).usableBaseImage(isoPath); err != nil {
+			t.Errorf("%s: expected the base image to be usable: %v", value, err)
+		}
+		reader, err := newImageReader(&imageFile{isoFile: isoPath, ignitionContent: []byte(`{"ignition":{}}`), embed: embed})
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(content, []byte(`{"ignition":{}}`)) {
+			t.Errorf("%s: expected the content to be embedded", value)
+		}
+		if embed.InitrdPath != "" && !bytes.Contains(content, []byte("etc/config.ign")) {
+			t.Errorf("%s: expected the content to be wrapped in an initramfs archive", value)
+		}
+
+		if _, err := newImageReader(&imageFile{isoFile: isoPath, kernelArgs: []string{"console=ttyS0"}, embed: embed}); err == nil {
+			t.Errorf("%s: expected kernel arguments to be refused", value)
+		}
+	}
+
+	if _, err := newImageReader(&imageFile{isoFile: isoPath, ignitionContent: make([]byte, 1024),
+		embed: EmbedStrategy{Area: "/boot/config.img"}}); err == nil {
+		t.Error("expected content larger than the embed area to be refused")
+	}
+	if err := newTestImageServer(t, Options{}).usableBaseImage(isoPath); err == nil {
+		t.Error("expected the base image to be unusable without an embed strategy")
+	}
+	for _, value := range []string{"raw", "raw:boot/config.img", "initrd:/boot/config.img", "initrd:/boot/config.img:etc", "copy:/boot/config.img"} {
+		if _, err := ParseEmbedStrategy(value); err == nil {
+			t.Errorf("expected embed strategy %q to be refused", value)
+		}
+	}
+}
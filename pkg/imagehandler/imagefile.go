@@ -3,42 +3,152 @@ package imagehandler
 import (
 	"io"
 	"io/fs"
+	"mime"
+	"path"
+	"strings"
 	"time"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
-// imageFile is the http.File use in imageFileSystem.
+// imageFile is an image registered with imageFileSystem. It is shared by
+// all requests for the image, each of which reads it through a servedFile
+// of its own.
 type imageFile struct {
-	io.ReadSeekCloser
-	name              string
-	size              int64
-	ignitionContent   []byte
-	rhcosStreamReader io.ReadSeeker
-}
+	name            string
+	fileName        string
+	size            int64
+	digest          string
+	revision        string
+	base            BaseImage
+	isoFile         string
+	token           string
+	tokenIssuedAt   time.Time
+	tokenUsedAt     time.Time
+	ignitionContent []byte
+	kernelArgs      []string
+	boot            BootConfig
+	createdAt       time.Time
+	// usedAt is when the image was last registered or downloaded, which
+	// decides which images' content is evicted from memory first.
+	usedAt time.Time
+
+	// configDrive is the content of a config drive image, which is served
+	// from memory instead of being built from a base ISO.
+	configDrive []byte
+	// embed is the embed strategy used if the base ISO is not an RHCOS
+	// live ISO.
+	embed EmbedStrategy
+
+	// generated is set once background generation has finished, with
+	// generationErr holding any failure, and done is closed then. cachePath
+	// is the location of the generated image when a cache directory is
+	// configured.
+	generated     bool
+	done          chan struct{}
+	generationErr error
+	cachePath     string
+	checksum      string
 
-// file interface implementation
+	// storageKey is set once the image has been uploaded to the storage
+	// backend. storageURL is its current download URL, which is renewed
+	// after storageURLRefresh.
+	storageKey        string
+	storageURL        string
+	storageURLRefresh time.Time
 
-var _ fs.File = &imageFile{}
+	// lastDownload is the most recent complete download of the image.
+	lastDownload *Download
 
-func (f *imageFile) Read(p []byte) (n int, err error) {
-	return f.rhcosStreamReader.Read(p)
+	// spanContext is the span the image was registered in, which its
+	// background generation is traced as part of.
+	spanContext trace.SpanContext
 }
 
-func (f *imageFile) Seek(offset int64, whence int) (int64, error) {
-	return f.rhcosStreamReader.Seek(offset, whence)
+// servedFile is the http.File returned for each request for an image. It
+// reads the cached image or streams it from the base ISO through a reader
+// of its own, so that concurrent downloads of an image do not move each
+// other's position, and reports the image's own FileInfo.
+type servedFile struct {
+	io.ReadSeekCloser
+	info fs.FileInfo
 }
 
-func (f *imageFile) Write(p []byte) (n int, err error)        { return 0, NotImplementedFn("Write") }
-func (f *imageFile) Stat() (fs.FileInfo, error)               { return fs.FileInfo(f), nil }
-func (f *imageFile) Close() error                             { return nil }
-func (f *imageFile) Readdir(count int) ([]fs.FileInfo, error) { return []fs.FileInfo{}, nil }
+var _ fs.File = &servedFile{}
+
+func (s *servedFile) Stat() (fs.FileInfo, error)               { return s.info, nil }
+func (s *servedFile) Readdir(count int) ([]fs.FileInfo, error) { return []fs.FileInfo{}, nil }
 
 // fileInfo interface implementation
 
 var _ fs.FileInfo = &imageFile{}
 
-func (i *imageFile) Name() string       { return i.name }
+func (i *imageFile) Name() string       { return i.servedName() }
 func (i *imageFile) Size() int64        { return i.size }
 func (i *imageFile) Mode() fs.FileMode  { return 0444 }
-func (i *imageFile) ModTime() time.Time { return time.Now() }
+func (i *imageFile) ModTime() time.Time { return i.createdAt }
 func (i *imageFile) IsDir() bool        { return false }
 func (i *imageFile) Sys() interface{}   { return nil }
+
+// contentRevisionLength is the number of hex digits of the content digest
+// included in image URLs.
+const contentRevisionLength = 8
+
+// contentRevision identifies the content of the image in its URL,
+// so that a URL handed out for previous content stops working as soon as the
+// image is registered with new content.
+func (i *imageFile) contentRevision() string {
+	if len(i.digest) < contentRevisionLength {
+		return i.digest
+	}
+	return i.digest[:contentRevisionLength]
+}
+
+// format is the type of image served.
+func (i *imageFile) format() ImageFormat {
+	if i.configDrive != nil {
+		return ImageFormatConfigDrive
+	}
+	return ImageFormatISO
+}
+
+// contentType is the media type an image is served with: a bootable ISO is
+// an EFI-bootable ISO 9660 image, while a config drive is only read as a
+// filesystem.
+func (i *imageFile) contentType() string {
+	if i.format() == ImageFormatISO {
+		return "application/vnd.efi.iso"
+	}
+	return "application/octet-stream"
+}
+
+// contentDisposition names the file an image is saved as when downloaded,
+// with the extension of its format rather than that of the name it was
+// registered under, which may be anything, e.g. .qcow for ISOs.
+func (i *imageFile) contentDisposition() string {
+	name := i.servedName()
+	name = strings.TrimSuffix(name, path.Ext(name))
+	if i.format() == ImageFormatISO {
+		name += ".iso"
+	} else {
+		name += ".img"
+	}
+	return mime.FormatMediaType("attachment", map[string]string{"filename": name})
+}
+
+// etag is the strong entity tag of an image, identifying both its base ISO
+// and its content, so that clients can revalidate or resume a download
+// without fetching the image again.
+func (i *imageFile) etag() string {
+	return `"` + i.revision + "-" + i.digest + `"`
+}
+
+// servedName is the file name in the image's URL, which is a random
+// identifier rather than the registered name when random file names are
+// enabled.
+func (i *imageFile) servedName() string {
+	if i.fileName != "" {
+		return i.fileName
+	}
+	return i.name
+}
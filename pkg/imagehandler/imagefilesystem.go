@@ -1,48 +1,339 @@
 package imagehandler
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"io/fs"
+	"net"
 	"net/http"
 	"net/url"
-	"os"
 	"path"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/go-logr/logr"
-
-	"github.com/openshift/assisted-image-service/pkg/isoeditor"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // imageFileSystem is an http.FileSystem that creates a virtual filesystem of
 // host images. These *could* be later cached as real files.
 type imageFileSystem struct {
-	isoFile     string
-	isoFileSize int64
-	baseURL     string
-	images      []*imageFile
-	mu          *sync.Mutex
-	log         logr.Logger
+	isoFile       string
+	archIsoFiles  map[string]string
+	namedIsoFiles map[string]string
+	isoFileSize   int64
+	baseURL       string
+	cacheDir      string
+	images        imageSet
+	// imagesChangedAt is when an image was last added or removed, the
+	// modification time of the root directory.
+	imagesChangedAt time.Time
+	// missingBaseImages are the base ISOs found missing when last checked.
+	missingBaseImages map[string]bool
+	// mu guards the images and settings. Requests only read them, so they
+	// share the lock and are held up only while images are registered.
+	mu       *sync.RWMutex
+	log      logr.Logger
+	cacheLog logr.Logger
+	workers  *workerPool
+	buffers  *bufferBudget
+
+	oneTimeTokens    bool
+	tokenGracePeriod time.Duration
+	urlTTL           time.Duration
+	randomFileNames  bool
+	checksumType     ChecksumType
+	encryptionKey    []byte
+	storage          Storage
+
+	downloads chan Download
+
+	maxImagesInMemory int
+	ignitionSource    IgnitionSource
+
+	generationTimeout time.Duration
+	genericEmbed      EmbedStrategy
+
+	pathPrefix     string
+	externalURL    string
+	trustedProxies []*net.IPNet
+	// useForwardedURL gives images URLs under forwardedURL.
+	useForwardedURL bool
+	forwardedURL    string
+	urlChanged      func()
+}
+
+// Options configures an ImageFileServer.
+type Options struct {
+	// IsoFile is the path of the base RHCOS live ISO. Any base ISO can be
+	// a minimal ISO, whose root filesystem is then served from a companion
+	// file, e.g. rhcos-live-rootfs.img next to rhcos-live.iso.
+	IsoFile string
+	// ArchIsoFiles maps CPU architectures to the base ISO used for images
+	// of that architecture, instead of IsoFile.
+	ArchIsoFiles map[string]string
+	// NamedIsoFiles are alternative base ISOs, e.g. of other RHCOS versions,
+	// that images can select by name.
+	NamedIsoFiles map[string]string
+	// BaseURL is the URL prefix clients use to reach the image server.
+	BaseURL string
+	// CacheDir, if set, is a directory images are generated into ahead of
+	// download. Otherwise images are streamed on demand.
+	CacheDir string
+	// MaxConcurrentGenerations bounds the number of images generated at
+	// once, whether in the background or on demand for a download.
+	// Defaults to 1.
+	MaxConcurrentGenerations int
+	// GenerationTimeout, if set, bounds how long generating and uploading
+	// an image may take before it fails with ErrGenerationTimeout.
+	GenerationTimeout time.Duration
+	// GenericEmbed, if set, is how images embed their content in base ISOs
+	// that are not RHCOS live ISOs, as returned by ParseEmbedStrategy.
+	GenericEmbed EmbedStrategy
+	// MemoryBudget caps the bytes of copy buffers in use at once, by
+	// generation and by downloads not sent with sendfile. Zero means no
+	// limit.
+	MemoryBudget int64
+	// OneTimeTokens adds a download token to each image URL that stops
+	// working TokenGracePeriod after the image was first downloaded in
+	// full. The next registration of the image returns a fresh token.
+	OneTimeTokens    bool
+	TokenGracePeriod time.Duration
+	// URLTTL, if set, adds a download token to each image URL that stops
+	// working once it is that old. The next registration of the image
+	// returns a fresh token.
+	URLTTL time.Duration
+	// RandomFileNames serves each image under a random UUID instead of its
+	// registered name, so URLs don't reveal host names and can't be
+	// guessed.
+	RandomFileNames bool
+	// ChecksumType selects the algorithm used to checksum generated
+	// images. No checksum is calculated if it is empty.
+	ChecksumType ChecksumType
+	// CacheEncryptionKey, if set, is an AES key used to encrypt images in
+	// the cache directory. They are decrypted as they are served.
+	CacheEncryptionKey []byte
+	// Storage, if set, is a backend generated images are uploaded to. The
+	// URLs of generated images then point at the backend instead.
+	Storage Storage
+	// PathPrefix is a directory the images are served under, as returned
+	// by ParsePathPrefix.
+	PathPrefix string
+	// ExternalURL, if set, overrides BaseURL in the URLs of images, for
+	// when clients reach the server through a route, ingress or load
+	// balancer.
+	ExternalURL string
+	// TrustedProxies are the addresses of reverse proxies whose
+	// X-Forwarded-For headers are used to identify clients.
+	TrustedProxies []*net.IPNet
+	// UseForwardedURL gives images URLs under the X-Forwarded-Proto and
+	// X-Forwarded-Host of requests from TrustedProxies, unless ExternalURL
+	// is set.
+	UseForwardedURL bool
+	// URLChanged, if set, is called when the URL of images changes while
+	// the server is running, following a request through a proxy under a
+	// new URL, so that the images can be registered again. It must not
+	// block.
+	URLChanged func()
+	// MaxImagesInMemory caps the number of images whose ignition content is
+	// held in memory once they have been generated. The content of the
+	// least recently used ones is dropped and rebuilt from IgnitionSource
+	// when they are next downloaded. Zero means no limit, as does a nil
+	// IgnitionSource.
+	MaxImagesInMemory int
+	IgnitionSource    IgnitionSource
+	// CacheStartupPolicy decides which images in CacheDir are restored
+	// when the server starts.
+	CacheStartupPolicy CachePolicy
+	// Context, if set, stops image generation once it is done, when the
+	// server shuts down.
+	Context context.Context
+	// CacheLog, if set, is used to log cache management, so that it can be
+	// given its own verbosity. It defaults to a child of the server's
+	// logger.
+	CacheLog logr.Logger
 }
 
+// ImageSpec describes an image to register.
+type ImageSpec struct {
+	// Name identifies the image, and is the file name it is served under
+	// unless random file names are enabled.
+	Name string
+	// Base selects the base ISO the image is built from.
+	Base BaseImage
+	// Ignition is the ignition config embedded in the image.
+	Ignition []byte
+	// KernelArgs are appended to the default kernel arguments of the base
+	// ISO.
+	KernelArgs []string
+	// Boot rewrites the volume label and boot menu of the base ISO.
+	Boot BootConfig
+	// ConfigDrive, if set, makes the image a config drive holding these
+	// files, by path, e.g. openstack/latest/meta_data.json, rather than an
+	// image built from a base ISO. Base, Ignition, KernelArgs and Boot are
+	// ignored then.
+	ConfigDrive map[string][]byte
+}
+
+// ImageFormat is the type of image served at an image URL.
+type ImageFormat string
+
+// ImageFormatISO is a bootable live ISO.
+const ImageFormatISO ImageFormat = "iso"
+
+// ImageInfo describes a registered image at the time it was registered.
+type ImageInfo struct {
+	// URL is where the image can be downloaded once it is ready.
+	URL string
+	// IPXEURL is where an iPXE script booting the image over the network
+	// can be downloaded, empty if the image cannot be network booted.
+	IPXEURL string
+	// InsURL is where the .ins file for booting an s390x image from an
+	// LPAR's HMC can be downloaded, listing the kernel, initrd and
+	// parmfile served alongside it that a z/VM guest punches to its
+	// reader. It is set instead of IPXEURL for s390x images.
+	InsURL string
+	Format ImageFormat
+	// Size is the exact size of the image in bytes, known as soon as it is
+	// registered, or zero if unknown.
+	Size int64
+	// Ready is set once background generation has finished, with Error
+	// holding any failure. Checksum is only known after generation.
+	Ready        bool
+	Error        error
+	Checksum     string
+	ChecksumType ChecksumType
+	// URLExpiry is when the URL stops working unless the image is
+	// registered again, zero if it does not expire.
+	URLExpiry time.Time
+	// Done is closed once background generation of an image that is not
+	// Ready has finished, after which the image can be described again to
+	// find the outcome. It is nil if the image is Ready, or if the server
+	// cannot report it, in which case the image must be polled.
+	Done <-chan struct{}
+}
+
+// ImageFileServer is a registry of customized images. It can be embedded in
+// other programs as a library; the image server returned by
+// NewImageFileServer also serves the images over HTTP, see ImageHandler.
 type ImageFileServer interface {
+	// ServeImage registers an image built from the selected base ISO and
+	// describes it. An error wrapping ErrUnknownBaseImage is returned if
+	// the selected base ISO is not configured.
+	ServeImage(ctx context.Context, spec ImageSpec) (ImageInfo, error)
+
+	// ReplaceImage registers new content for an image that is already
+	// registered, and generates it again even if the content is unchanged,
+	// e.g. after its generation failed. It returns ErrImageNotFound if the
+	// image is not registered.
+	ReplaceImage(ctx context.Context, spec ImageSpec) (ImageInfo, error)
+
+	// GetImage describes a registered image. It returns ErrImageNotFound
+	// if the image is not registered.
+	GetImage(ctx context.Context, name string) (ImageInfo, error)
+
+	// RemoveImage unregisters an image, deleting its generated copies. It
+	// returns ErrImageNotFound if the image is not registered.
+	RemoveImage(ctx context.Context, name string) error
+
+	// ImageReady reports whether background generation of a registered
+	// image has finished, and the error if it failed, which wraps
+	// ErrGenerationFailed.
+	ImageReady(ctx context.Context, name string) (bool, error)
+
+	// ImageChecksum returns the checksum of a generated image and the
+	// algorithm used, or empty strings if none was calculated.
+	ImageChecksum(name string) (string, ChecksumType)
+
+	// BaseImageVersion identifies the current base ISO. It changes when
+	// the file is replaced, after which images must be registered again.
+	BaseImageVersion(ctx context.Context) (string, error)
+
+	// Downloads delivers a record of each download of an image, for
+	// auditing which client fetched it. Records are dropped if they are
+	// not consumed quickly enough.
+	Downloads() <-chan Download
+
+	// ImageURLExpiry returns the time at which the URL of a registered
+	// image stops working, or by which it should be replaced, unless the
+	// image is registered again before then. It is zero if the URL does
+	// not expire.
+	ImageURLExpiry(name string) time.Time
+
+	// LastDownload returns the most recent complete download of the
+	// currently registered image, if there has been one.
+	LastDownload(name string) (Download, bool)
+
+	// ListImages describes the registered images.
+	ListImages(ctx context.Context) ([]RegisteredImage, error)
+
+	// CheckReady returns an error if images cannot currently be served.
+	CheckReady(ctx context.Context) error
+}
+
+// ImageHandler is an ImageFileServer that serves the registered images over
+// HTTP itself.
+type ImageHandler interface {
+	ImageFileServer
+	http.Handler
 	FileSystem() http.FileSystem
-	ServeImage(name string, ignitionContent []byte) (string, error)
 }
 
-var _ ImageFileServer = &imageFileSystem{}
+var _ ImageHandler = &imageFileSystem{}
 var _ http.FileSystem = &imageFileSystem{}
 
-func NewImageFileServer(logger logr.Logger, isoFile, baseURL string) ImageFileServer {
-	return &imageFileSystem{
-		log:         logger,
-		isoFile:     isoFile,
-		isoFileSize: 0,
-		baseURL:     baseURL,
-		images:      []*imageFile{},
-		mu:          &sync.Mutex{},
+func NewImageFileServer(logger logr.Logger, opts Options) ImageHandler {
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	f := &imageFileSystem{
+		log:             logger,
+		cacheLog:        opts.CacheLog,
+		isoFile:         opts.IsoFile,
+		archIsoFiles:    opts.ArchIsoFiles,
+		namedIsoFiles:   opts.NamedIsoFiles,
+		isoFileSize:     0,
+		baseURL:         opts.BaseURL,
+		cacheDir:        opts.CacheDir,
+		imagesChangedAt: time.Now(),
+		mu:              &sync.RWMutex{},
+		workers:         newWorkerPool(ctx, opts.MaxConcurrentGenerations),
+		buffers:         newBufferBudget(opts.MemoryBudget),
+
+		oneTimeTokens:    opts.OneTimeTokens,
+		tokenGracePeriod: opts.TokenGracePeriod,
+		urlTTL:           opts.URLTTL,
+		randomFileNames:  opts.RandomFileNames,
+		checksumType:     opts.ChecksumType,
+		encryptionKey:    opts.CacheEncryptionKey,
+		storage:          opts.Storage,
+
+		downloads: make(chan Download, downloadQueueLength),
+
+		maxImagesInMemory: opts.MaxImagesInMemory,
+		ignitionSource:    opts.IgnitionSource,
+		generationTimeout: opts.GenerationTimeout,
+		genericEmbed:      opts.GenericEmbed,
+
+		pathPrefix:     opts.PathPrefix,
+		externalURL:    opts.ExternalURL,
+		trustedProxies: opts.TrustedProxies,
+
+		useForwardedURL: opts.UseForwardedURL,
+		urlChanged:      opts.URLChanged,
+	}
+	if f.cacheLog == nil {
+		f.cacheLog = logger.WithName("cache")
 	}
+	if f.cacheDir != "" {
+		f.loadIndex(opts.CacheStartupPolicy)
+	}
+	f.checkMissingBaseImages()
+	return f
 }
 
 func NotImplementedFn(name string) error { return fmt.Errorf("%s not implemented", name) }
@@ -51,74 +342,352 @@ func (f *imageFileSystem) FileSystem() http.FileSystem {
 	return f
 }
 
-func (f *imageFileSystem) ServeImage(name string, ignitionContent []byte) (string, error) {
-	if f.isoFileSize == 0 {
-		fi, err := os.Stat(f.isoFile)
+// ServeImage registers an image and describes it. The URL path includes
+// the base image version and a prefix of the digest of its content, so
+// that it changes whenever the base ISO or the content does, e.g. when
+// network data is rotated, and a download token when tokens are enabled.
+// Once the image has been uploaded to a storage backend, the backend's URL
+// is returned instead.
+func (f *imageFileSystem) ServeImage(ctx context.Context, spec ImageSpec) (ImageInfo, error) {
+	return f.registerImage(ctx, spec, false)
+}
+
+// ReplaceImage registers an image again, discarding its generated copies.
+func (f *imageFileSystem) ReplaceImage(ctx context.Context, spec ImageSpec) (ImageInfo, error) {
+	return f.registerImage(ctx, spec, true)
+}
+
+// registerImage registers an image, replacing any registered under the same
+// name unless it has the same content and replace is false. With replace
+// set, the image must already be registered.
+func (f *imageFileSystem) registerImage(ctx context.Context, spec ImageSpec, replace bool) (ImageInfo, error) {
+	name, base, ignitionContent := spec.Name, spec.Base, spec.Ignition
+	if ignitionContent == nil {
+		// nil content marks an image evicted from memory
+		ignitionContent = []byte{}
+	}
+	if replace && f.imageFileByName(name) == nil {
+		return ImageInfo{}, ErrImageNotFound
+	}
+	var isoFile, revision, digest string
+	var size int64
+	var configDrive []byte
+	kernelArgs := spec.KernelArgs
+	if spec.ConfigDrive != nil {
+		var err error
+		configDrive, err = buildConfigDrive(spec.ConfigDrive)
+		if err != nil {
+			return ImageInfo{}, err
+		}
+		size, revision, digest = int64(len(configDrive)), configDriveRevision, configDriveDigest(spec.ConfigDrive)
+	} else {
+		var err error
+		isoFile, err = f.baseImageFor(base)
+		if err != nil {
+			return ImageInfo{}, err
+		}
+		size, revision, err = statBaseImage(isoFile)
+		if err != nil {
+			return ImageInfo{}, fmt.Errorf("%w: %v", ErrBaseISOUnavailable, err)
+		}
+		if err := spec.Boot.Validate(); err != nil {
+			return ImageInfo{}, err
+		}
+		kernelArgs, err = f.rootfsKernelArgs(isoFile, revision, kernelArgs)
 		if err != nil {
-			return "", err
+			return ImageInfo{}, err
 		}
-		f.isoFileSize = fi.Size()
+		digest = imageDigest(ignitionContent, kernelArgs, spec.Boot)
+	}
+
+	u, err := f.publicBaseURL()
+	if err != nil {
+		return ImageInfo{}, err
 	}
 
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	f.images = append(f.images, &imageFile{
+	if configDrive == nil {
+		f.isoFileSize = size
+	}
+	im := f.images.get(name)
+	if im != nil {
+		if !replace && im.digest == digest && im.revision == revision && im.isoFile == isoFile {
+			if f.usesTokens() && (im.token == "" || f.tokenExpiredLocked(im)) {
+				issueToken(im)
+			}
+			if f.randomFileNames && im.fileName == "" {
+				f.images.setFileName(im, uuid.New().String()+path.Ext(name))
+			}
+			if im.ignitionContent == nil {
+				im.ignitionContent = ignitionContent
+			}
+			im.usedAt = time.Now()
+			f.trimMemoryLocked(im)
+			return f.currentImageInfoLocked(u, im)
+		}
+		f.images.remove(im)
+		f.removeCachedFile(im)
+		f.removeStoredImage(im)
+		f.writeIndexLocked()
+	} else if replace {
+		return ImageInfo{}, ErrImageNotFound
+	}
+	im = &imageFile{
 		name:            name,
-		size:            f.isoFileSize,
+		size:            size,
+		digest:          digest,
+		revision:        revision,
+		base:            base,
+		isoFile:         isoFile,
 		ignitionContent: ignitionContent,
-	})
-	u, err := url.Parse(f.baseURL)
-	if err != nil {
-		return "", err
+		kernelArgs:      kernelArgs,
+		boot:            spec.Boot,
+		configDrive:     configDrive,
+		embed:           f.genericEmbed,
+		done:            make(chan struct{}),
+		createdAt:       time.Now(),
+		usedAt:          time.Now(),
+		spanContext:     trace.SpanContextFromContext(ctx),
+	}
+	if f.usesTokens() {
+		issueToken(im)
 	}
-	u.Path = name
-	return u.String(), nil
+	if f.randomFileNames {
+		im.fileName = uuid.New().String() + path.Ext(name)
+	}
+	f.images.add(im)
+	f.imagesChangedAt = im.createdAt
+	f.trimMemoryLocked(im)
+	f.workers.Submit(func(ctx context.Context) { f.generate(ctx, im) })
+
+	return f.imageInfoLocked(u, f.imageURL(u, im), im), nil
 }
 
-func (f *imageFileSystem) imageFileByName(name string) *imageFile {
+// GetImage describes a registered image without registering it again, so
+// an expired URL is not renewed.
+func (f *imageFileSystem) GetImage(ctx context.Context, name string) (ImageInfo, error) {
+	u, err := f.publicBaseURL()
+	if err != nil {
+		return ImageInfo{}, err
+	}
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	for _, im := range f.images {
-		if im.name == name {
-			return im
+	im := f.imageFileByNameLocked(name)
+	if im == nil {
+		return ImageInfo{}, ErrImageNotFound
+	}
+	return f.currentImageInfoLocked(u, im)
+}
+
+// currentImageInfoLocked describes an image at its current URL, that of the
+// storage backend once it has been uploaded there. Must be called with the
+// lock held.
+func (f *imageFileSystem) currentImageInfoLocked(base *url.URL, im *imageFile) (ImageInfo, error) {
+	if im.storageKey != "" {
+		storedURL, err := f.storedImageURLLocked(im)
+		if err != nil {
+			return ImageInfo{}, err
 		}
+		return f.imageInfoLocked(base, storedURL, im), nil
+	}
+	return f.imageInfoLocked(base, f.imageURL(base, im), im), nil
+}
+
+// imageInfoLocked describes an image served at url, with its network boot
+// files served from base. Must be called with the lock held.
+func (f *imageFileSystem) imageInfoLocked(base *url.URL, url string, im *imageFile) ImageInfo {
+	info := ImageInfo{
+		URL:       url,
+		Format:    im.format(),
+		Size:      im.size,
+		Ready:     im.generated,
+		Error:     im.generationErr,
+		URLExpiry: f.urlExpiryLocked(im),
+	}
+	switch {
+	case im.configDrive != nil:
+	case im.s390x():
+		info.InsURL = f.bootArtifactURL(base, im, artifactIns)
+	default:
+		info.IPXEURL = f.bootArtifactURL(base, im, artifactIPXE)
+	}
+	if !im.generated {
+		info.Done = im.done
+	}
+	if im.checksum != "" {
+		info.Checksum, info.ChecksumType = im.checksum, f.checksumType
+	}
+	return info
+}
+
+func (f *imageFileSystem) imageURL(base *url.URL, im *imageFile) string {
+	return publicURL(base, f.pathPrefix, im.revision, im.contentRevision(), im.token, im.servedName())
+}
+
+// publicURL returns the URL of the path made of elem relative to base.
+func publicURL(base *url.URL, elem ...string) string {
+	u := *base
+	u.Path = path.Join(append([]string{"/", base.Path}, elem...)...)
+	// some BMCs reject URLs with query strings
+	u.RawPath = ""
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
+
+func (f *imageFileSystem) RemoveImage(ctx context.Context, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	im := f.images.get(name)
+	if im == nil {
+		return ErrImageNotFound
 	}
+	f.images.remove(im)
+	f.imagesChangedAt = time.Now()
+	f.removeCachedFile(im)
+	f.removeStoredImage(im)
+	f.writeIndexLocked()
 	return nil
 }
 
+func (f *imageFileSystem) ImageReady(ctx context.Context, name string) (bool, error) {
+	im := f.imageFileByName(name)
+	if im == nil {
+		return false, ErrImageNotFound
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return im.generated, im.generationErr
+}
+
+func (f *imageFileSystem) ImageChecksum(name string) (string, ChecksumType) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	im := f.imageFileByNameLocked(name)
+	if im == nil || im.checksum == "" {
+		return "", ChecksumNone
+	}
+	return im.checksum, f.checksumType
+}
+
+func (f *imageFileSystem) imageFileByName(name string) *imageFile {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.imageFileByNameLocked(name)
+}
+
+func (f *imageFileSystem) imageFileByNameLocked(name string) *imageFile {
+	return f.images.get(name)
+}
+
 // file interface implementation
 
-var _ fs.File = &imageFile{}
+var _ fs.File = &imageFileSystem{}
 
 func (f *imageFileSystem) Readdir(n int) ([]fs.FileInfo, error) {
-	f.mu.Lock()
-	defer f.mu.Unlock()
+	f.mu.RLock()
+	defer f.mu.RUnlock()
 	result := []fs.FileInfo{}
-	for _, im := range f.images {
+	if f.randomFileNames {
+		// listing would defeat the point of unguessable names
+		return result, nil
+	}
+	for _, im := range f.images.all() {
 		result = append(result, im)
 	}
 	return result, nil
 }
 
+// lookupImage finds the image a request path refers to. The directories in
+// the path must match the image's current revision, content and download
+// token, so URLs handed out for a previous base image, previous content or a
+// used token are rejected.
+func (f *imageFileSystem) lookupImage(name string) (*imageFile, error) {
+	name, err := sanitizePath(name)
+	if err != nil {
+		return nil, fs.ErrNotExist
+	}
+	segments := strings.Split(strings.TrimPrefix(name, "/"), "/")
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	im := f.images.served(segments[len(segments)-1])
+	if im == nil {
+		return nil, fs.ErrNotExist
+	}
+
+	expected := []string{}
+	for _, segment := range []string{im.revision, im.contentRevision(), im.token} {
+		if segment != "" {
+			expected = append(expected, segment)
+		}
+	}
+	if strings.Join(segments[:len(segments)-1], "/") != strings.Join(expected, "/") {
+		return nil, fs.ErrNotExist
+	}
+	if f.tokenExpiredLocked(im) {
+		return nil, fs.ErrNotExist
+	}
+	return im, nil
+}
+
 func (f *imageFileSystem) Open(name string) (http.File, error) {
-	f.log.Info("Open", "path", name)
+	return f.open(context.Background(), name)
+}
+
+// open opens an image for a request, stopping work on its behalf once ctx
+// is done.
+func (f *imageFileSystem) open(ctx context.Context, name string) (http.File, error) {
+	f.log.V(1).Info("Open", "path", redactPath(name))
 	if name == "/" {
 		return f, nil
 	}
-	// if we need caching and it is cached, return the real file here
-	im := f.imageFileByName(path.Base(name))
-	if im == nil {
-		return nil, fs.ErrNotExist
+	im, err := f.lookupImage(name)
+	if err != nil {
+		return nil, err
 	}
-	if im.rhcosStreamReader == nil {
-		var err error
-		im.rhcosStreamReader, err = isoeditor.NewRHCOSStreamReader(f.isoFile, im.ignitionContent)
+
+	f.mu.RLock()
+	cachePath, generationErr := im.cachePath, im.generationErr
+	f.mu.RUnlock()
+	if generationErr != nil {
+		return nil, generationErr
+	}
+	if f.cacheDir != "" {
+		if cachePath == "" {
+			cacheMisses.Inc()
+		} else {
+			cacheHits.Inc()
+		}
+	}
+	if cachePath != "" {
+		file, err := f.openCachedPath(cachePath)
 		if err != nil {
-			f.log.Error(err, "creating isoeditor.NewRHCOSStreamReader")
+			f.cacheLog.Error(err, "opening cached image", "image", im.name, "path", cachePath)
 			return nil, err
 		}
+		return &contextFile{File: &servedFile{ReadSeekCloser: file, info: im}, ctx: ctx}, nil
 	}
-	return im, nil
+
+	var reader io.ReadSeekCloser
+	err = f.workers.Do(ctx, func(ctx context.Context) error {
+		if err := f.loadIgnition(ctx, im); err != nil {
+			f.log.Error(err, "restoring evicted image content", "image", im.name)
+			return err
+		}
+		f.mu.RLock()
+		snapshot := *im
+		f.mu.RUnlock()
+		reader, err = newImageReader(&snapshot)
+		if err != nil {
+			f.log.Error(err, "creating image stream reader", "image", im.name)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &contextFile{File: &servedFile{ReadSeekCloser: reader, info: im}, ctx: ctx}, nil
 }
 
 func (f *imageFileSystem) Close() error                      { return nil }
@@ -133,9 +702,13 @@ func (f *imageFileSystem) Seek(offset int64, whence int) (int64, error) {
 
 var _ fs.FileInfo = &imageFileSystem{}
 
-func (i *imageFileSystem) Name() string       { return "/" }
-func (i *imageFileSystem) Size() int64        { return 0 }
-func (i *imageFileSystem) Mode() fs.FileMode  { return 0755 }
-func (i *imageFileSystem) ModTime() time.Time { return time.Now() }
-func (i *imageFileSystem) IsDir() bool        { return true }
-func (i *imageFileSystem) Sys() interface{}   { return nil }
+func (i *imageFileSystem) Name() string      { return "/" }
+func (i *imageFileSystem) Size() int64       { return 0 }
+func (i *imageFileSystem) Mode() fs.FileMode { return 0755 }
+func (i *imageFileSystem) ModTime() time.Time {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.imagesChangedAt
+}
+func (i *imageFileSystem) IsDir() bool      { return true }
+func (i *imageFileSystem) Sys() interface{} { return nil }
@@ -1,15 +1,68 @@
 package imagehandler
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
-	"sync"
 	"testing"
+	"time"
 
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	"github.com/asalkeld/image-customization-controller/pkg/tracing"
 )
 
+// newTestImageServer returns an image server configured by opts that logs
+// in development mode. If any images are given, they replace those
+// registered when the server started.
+func newTestImageServer(t *testing.T, opts Options, images ...*imageFile) *imageFileSystem {
+	t.Helper()
+	logger := zap.New(zap.UseDevMode(true))
+	if opts.CacheLog == nil {
+		opts.CacheLog = logger
+	}
+	f := NewImageFileServer(logger, opts).(*imageFileSystem)
+	if len(images) > 0 {
+		f.images = newImageSet(images...)
+	}
+	return f
+}
+
+// newTestISOImage returns an image streamed from a live ISO built for the
+// test, with the content it is expected to be served with.
+func newTestISOImage(t *testing.T, name string) (*imageFile, string) {
+	t.Helper()
+	isoPath := buildLiveISO(t)
+	info, err := getISOInfo(isoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(isoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ignition := []byte("asietonarst")
+	copy(content[info.areaStart:], ignition)
+	return &imageFile{
+		name:            name,
+		size:            int64(len(content)),
+		isoFile:         isoPath,
+		ignitionContent: ignition,
+	}, string(content)
+}
+
 func TestImageHandler(t *testing.T) {
 	req, err := http.NewRequest("GET", "/host-xyz-45.qcow", nil)
 	if err != nil {
@@ -17,21 +70,11 @@ func TestImageHandler(t *testing.T) {
 	}
 
 	rr := httptest.NewRecorder()
-	imageServer := &imageFileSystem{
-		log:         zap.New(zap.UseDevMode(true)),
-		isoFile:     "dummyfile.iso",
-		isoFileSize: 12345,
-		baseURL:     "http://localhost:8080",
-		images: []*imageFile{
-			{
-				name:              "host-xyz-45.qcow",
-				size:              12345,
-				ignitionContent:   []byte("asietonarst"),
-				rhcosStreamReader: strings.NewReader("aiosetnarsetin"),
-			},
-		},
-		mu: &sync.Mutex{},
-	}
+	im, expected := newTestISOImage(t, "host-xyz-45.qcow")
+	imageServer := newTestImageServer(t, Options{
+		IsoFile: im.isoFile,
+		BaseURL: "http://localhost:8080",
+	}, im)
 
 	handler := http.FileServer(imageServer.FileSystem())
 	handler.ServeHTTP(rr, req)
@@ -42,10 +85,903 @@ func TestImageHandler(t *testing.T) {
 			status, http.StatusOK)
 	}
 
-	// Check the response body is what we expect.
-	expected := `aiosetnarsetin`
+	// Check the response body is the ISO with the ignition embedded.
 	if rr.Body.String() != expected {
-		t.Errorf("handler returned unexpected body: got %v want %v",
-			rr.Body.String(), expected)
+		t.Errorf("handler returned unexpected body of %d bytes, want %d",
+			rr.Body.Len(), len(expected))
+	}
+}
+
+func TestOneTimeToken(t *testing.T) {
+	im, _ := newTestISOImage(t, "host-xyz-45.qcow")
+	im.token = "abc123"
+	imageServer := newTestImageServer(t, Options{
+		IsoFile:       im.isoFile,
+		BaseURL:       "http://localhost:8080",
+		OneTimeTokens: true,
+	}, im)
+
+	for _, tc := range []struct {
+		path     string
+		expected int
+	}{
+		{path: "/host-xyz-45.qcow", expected: http.StatusNotFound},
+		{path: "/wrong/host-xyz-45.qcow", expected: http.StatusNotFound},
+		{path: "/abc123/host-xyz-45.qcow", expected: http.StatusOK},
+		// the token is used up once the grace period is over
+		{path: "/abc123/host-xyz-45.qcow", expected: http.StatusNotFound},
+	} {
+		req, err := http.NewRequest("GET", tc.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		imageServer.ServeHTTP(rr, req)
+		if rr.Code != tc.expected {
+			t.Errorf("GET %s returned status %v, want %v", tc.path, rr.Code, tc.expected)
+		}
+	}
+}
+
+func TestURLTTL(t *testing.T) {
+	expired, _ := newTestISOImage(t, "host-xyz-45.qcow")
+	expired.token, expired.tokenIssuedAt = "abc123", time.Now().Add(-2*time.Hour)
+	fresh, _ := newTestISOImage(t, "fresh.qcow")
+	fresh.token, fresh.tokenIssuedAt = "def456", time.Now()
+	imageServer := newTestImageServer(t, Options{
+		IsoFile: fresh.isoFile,
+		BaseURL: "http://localhost:8080",
+		URLTTL:  time.Hour,
+	}, expired, fresh)
+
+	for _, tc := range []struct {
+		path     string
+		expected int
+	}{
+		{path: "/abc123/host-xyz-45.qcow", expected: http.StatusNotFound},
+		{path: "/def456/fresh.qcow", expected: http.StatusOK},
+		// not one-time tokens, so downloads can be repeated
+		{path: "/def456/fresh.qcow", expected: http.StatusOK},
+	} {
+		req := httptest.NewRequest("GET", tc.path, nil)
+		rr := httptest.NewRecorder()
+		imageServer.ServeHTTP(rr, req)
+		if rr.Code != tc.expected {
+			t.Errorf("GET %s returned status %v, want %v", tc.path, rr.Code, tc.expected)
+		}
+	}
+
+	expiry := imageServer.ImageURLExpiry("fresh.qcow")
+	if until := time.Until(expiry); until <= 59*time.Minute || until > time.Hour {
+		t.Errorf("unexpected URL expiry %v", expiry)
+	}
+	if expiry := imageServer.ImageURLExpiry("unknown.qcow"); !expiry.IsZero() {
+		t.Errorf("expected no expiry for an unknown image, got %v", expiry)
+	}
+}
+
+func TestHostilePaths(t *testing.T) {
+	im, _ := newTestISOImage(t, "host-xyz-45.qcow")
+	im.revision = "rev1"
+	imageServer := newTestImageServer(t, Options{
+		IsoFile: im.isoFile,
+		BaseURL: "http://localhost:8080",
+	}, im)
+
+	for _, path := range []string{
+		"/rev1/../rev1/host-xyz-45.qcow",
+		"/rev1/./host-xyz-45.qcow",
+		"/rev1//host-xyz-45.qcow",
+		"/rev1/%2e%2e/host-xyz-45.qcow",
+		"/rev1%2fhost-xyz-45.qcow",
+		"/rev1%252fhost-xyz-45.qcow",
+		"/rev1/%5chost-xyz-45.qcow",
+		"/rev1\\host-xyz-45.qcow",
+		"/a/b/rev1/host-xyz-45.qcow",
+		"/../../etc/passwd",
+		"/rev1/host-xyz-45.qcow%00",
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		parsed, err := url.Parse(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.URL = parsed
+		rr := httptest.NewRecorder()
+		imageServer.ServeHTTP(rr, req)
+		if rr.Code == http.StatusOK {
+			t.Errorf("GET %q succeeded, expected it to be rejected", path)
+		}
+
+		if _, err := imageServer.Open(path); err == nil {
+			t.Errorf("Open(%q) succeeded, expected it to be rejected", path)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/rev1/host-xyz-45.qcow", nil)
+	rr := httptest.NewRecorder()
+	imageServer.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("canonical path returned status %v, want %v", rr.Code, http.StatusOK)
+	}
+}
+
+func TestDownloadRecorded(t *testing.T) {
+	im, _ := newTestISOImage(t, "host-xyz-45.qcow")
+	imageServer := newTestImageServer(t, Options{
+		IsoFile: im.isoFile,
+		BaseURL: "http://localhost:8080",
+	}, im)
+
+	req := httptest.NewRequest("GET", "/host-xyz-45.qcow", nil)
+	req.RemoteAddr = "192.0.2.10:4321"
+	imageServer.ServeHTTP(httptest.NewRecorder(), req)
+
+	select {
+	case download := <-imageServer.Downloads():
+		if download.Name != "host-xyz-45.qcow" || download.RemoteAddr != req.RemoteAddr ||
+			download.Bytes != im.size || !download.Complete {
+			t.Errorf("unexpected download record %+v", download)
+		}
+	default:
+		t.Fatal("no download recorded")
+	}
+
+	req = httptest.NewRequest("GET", "/other.qcow", nil)
+	imageServer.ServeHTTP(httptest.NewRecorder(), req)
+	select {
+	case download := <-imageServer.Downloads():
+		t.Errorf("unexpected download record %+v for missing image", download)
+	default:
+	}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8, 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	urlChanges := 0
+	imageServer := newTestImageServer(t, Options{
+		BaseURL:         "http://10.1.2.3:8084",
+		TrustedProxies:  proxies,
+		UseForwardedURL: true,
+		URLChanged:      func() { urlChanges++ },
+	})
+
+	for _, tc := range []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		client     string
+	}{
+		{name: "direct", remoteAddr: "198.51.100.7:1234", client: "198.51.100.7:1234"},
+		{name: "untrusted", remoteAddr: "198.51.100.7:1234", forwarded: "203.0.113.5", client: "198.51.100.7:1234"},
+		{name: "trusted", remoteAddr: "10.0.0.1:1234", forwarded: "203.0.113.5", client: "203.0.113.5"},
+		{name: "chain", remoteAddr: "10.0.0.1:1234", forwarded: "6.6.6.6, 203.0.113.5, 192.0.2.1", client: "203.0.113.5"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			if tc.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", tc.forwarded)
+			}
+			if client := imageServer.clientAddr(req); client != tc.client {
+				t.Errorf("got client %q, want %q", client, tc.client)
+			}
+		})
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "198.51.100.7:1234"
+	req.Header.Set("X-Forwarded-Host", "evil.example.com")
+	imageServer.observeForwardedURL(req)
+	if u, _ := imageServer.publicBaseURL(); u.String() != "http://10.1.2.3:8084" {
+		t.Errorf("untrusted forwarded host changed the URL to %s", u)
+	}
+
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-Host", "images.example.com")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	imageServer.observeForwardedURL(req)
+	if u, _ := imageServer.publicBaseURL(); u.String() != "https://images.example.com" {
+		t.Errorf("got URL %s, want the forwarded one", u)
+	}
+	imageServer.observeForwardedURL(req)
+	if urlChanges != 1 {
+		t.Errorf("expected one notification of the URL change, got %d", urlChanges)
+	}
+
+	imageServer.externalURL = "https://override.example.com/images"
+	if u, _ := imageServer.publicBaseURL(); u.String() != imageServer.externalURL {
+		t.Errorf("got URL %s, want the external URL override", u)
+	}
+}
+
+func TestForwardedURLOptIn(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageServer := newTestImageServer(t, Options{
+		BaseURL:        "http://10.1.2.3:8084",
+		TrustedProxies: proxies,
+		URLChanged:     func() { t.Error("unexpected URL change") },
+	})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-Host", "images.example.com")
+	imageServer.observeForwardedURL(req)
+	if u, _ := imageServer.publicBaseURL(); u.String() != "http://10.1.2.3:8084" {
+		t.Errorf("forwarded host changed the URL to %s without being enabled", u)
+	}
+}
+
+func TestCheckReadyRejectsUnusableBaseImage(t *testing.T) {
+	notAnISO := filepath.Join(t.TempDir(), "not-an.iso")
+	if err := os.WriteFile(notAnISO, []byte("aiosetnarsetin"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, isoFile := range []string{"dummyfile.iso", notAnISO} {
+		imageServer := newTestImageServer(t, Options{IsoFile: isoFile})
+		if err := imageServer.CheckReady(context.Background()); err == nil {
+			t.Errorf("expected %s to be reported as not ready", isoFile)
+		}
+	}
+}
+
+func TestDebugHandler(t *testing.T) {
+	imageServer := newTestImageServer(t, Options{},
+		&imageFile{
+			name:            "host-xyz-45.qcow",
+			size:            14,
+			digest:          "0123456789abcdef",
+			ignitionContent: []byte("asietonarst"),
+			generated:       true,
+		},
+	)
+	handler := NewDebugHandler(imageServer, "s3cret")
+
+	for _, auth := range []string{"", "Bearer wrong", "s3cret"} {
+		req := httptest.NewRequest("GET", "/images", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q returned status %v, want %v", auth, rr.Code, http.StatusUnauthorized)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/images", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("returned status %v, want %v", rr.Code, http.StatusOK)
+	}
+	images := []RegisteredImage{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &images); err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[0].Name != "host-xyz-45.qcow" || !images[0].Generated || images[0].Cached {
+		t.Errorf("unexpected images listed: %+v", images)
+	}
+	if strings.Contains(rr.Body.String(), "asietonarst") {
+		t.Error("ignition content must not be listed")
+	}
+}
+
+func TestPathPrefix(t *testing.T) {
+	prefix, err := ParsePathPrefix("/images/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	im, _ := newTestISOImage(t, "host-xyz-45.iso")
+	im.revision = "rev1"
+	imageServer := newTestImageServer(t, Options{PathPrefix: prefix}, im)
+
+	base, _ := url.Parse("http://localhost:8080/?x=y")
+	if u := imageServer.imageURL(base, imageServer.images.get("host-xyz-45.iso")); u != "http://localhost:8080/images/rev1/host-xyz-45.iso" {
+		t.Errorf("unexpected URL %s", u)
+	}
+
+	for path, expected := range map[string]int{
+		"/images/rev1/host-xyz-45.iso": http.StatusOK,
+		"/rev1/host-xyz-45.iso":        http.StatusNotFound,
+		"/imagesrev1/host-xyz-45.iso":  http.StatusNotFound,
+	} {
+		rr := httptest.NewRecorder()
+		imageServer.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Code != expected {
+			t.Errorf("GET %s returned status %v, want %v", path, rr.Code, expected)
+		}
+	}
+
+	if _, err := ParsePathPrefix("/a/../b"); err == nil {
+		t.Error("expected a non-canonical prefix to be rejected")
+	}
+}
+
+type fakeStorage struct {
+	objects map[string]string
+	urls    int
+}
+
+func (s *fakeStorage) Upload(ctx context.Context, key string, content io.Reader, size int64) error {
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	s.objects[key] = string(data)
+	return nil
+}
+
+func (s *fakeStorage) Delete(ctx context.Context, key string) error {
+	delete(s.objects, key)
+	return nil
+}
+
+func (s *fakeStorage) URL(key string) (string, time.Time, error) {
+	s.urls++
+	return "https://bucket.example.com/" + key + "?sig=" + string(rune('0'+s.urls)), time.Now().Add(time.Hour), nil
+}
+
+func TestStorageUpload(t *testing.T) {
+	cachePath := filepath.Join(t.TempDir(), "cached.iso")
+	if err := os.WriteFile(cachePath, []byte("aiosetnarsetin"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	storage := &fakeStorage{objects: map[string]string{}}
+	imageServer := newTestImageServer(t, Options{Storage: storage})
+	im := &imageFile{name: "host-xyz-45.iso", size: 14, digest: "abc", revision: "1"}
+
+	key, err := imageServer.uploadImage(context.Background(), im, cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "abc-1/host-xyz-45.iso" || storage.objects[key] != "aiosetnarsetin" {
+		t.Fatalf("unexpected upload %q: %v", key, storage.objects)
+	}
+	im.storageKey = key
+
+	first, err := imageServer.storedImageURLLocked(im)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := imageServer.storedImageURLLocked(im)
+	if first != second || storage.urls != 1 {
+		t.Errorf("expected the presigned URL to be reused, got %s and %s", first, second)
+	}
+
+	im.storageURLRefresh = time.Now().Add(-time.Second)
+	if third, _ := imageServer.storedImageURLLocked(im); third == first {
+		t.Error("expected the presigned URL to be renewed")
+	}
+
+	imageServer.removeStoredImage(im)
+	if im.storageKey != "" {
+		t.Error("expected the storage key to be cleared")
+	}
+}
+
+func TestBaseImageSelection(t *testing.T) {
+	imageServer := newTestImageServer(t, Options{
+		IsoFile:       "default.iso",
+		ArchIsoFiles:  map[string]string{"aarch64": "aarch64.iso"},
+		NamedIsoFiles: map[string]string{"rhcos-4.9": "rhcos-4.9.iso"},
+	})
+	for _, tc := range []struct {
+		base     BaseImage
+		expected string
+	}{
+		{BaseImage{}, "default.iso"},
+		{BaseImage{Arch: "x86_64"}, "default.iso"},
+		{BaseImage{Arch: "aarch64"}, "aarch64.iso"},
+		{BaseImage{Arch: "aarch64", Name: "rhcos-4.9"}, "rhcos-4.9.iso"},
+	} {
+		if isoFile, err := imageServer.baseImageFor(tc.base); err != nil || isoFile != tc.expected {
+			t.Errorf("%+v: got %q (%v), want %q", tc.base, isoFile, err, tc.expected)
+		}
+	}
+
+	if _, err := imageServer.ServeImage(context.Background(), ImageSpec{Name: "host.iso", Base: BaseImage{Name: "missing"}}); !errors.Is(err, ErrUnknownBaseImage) {
+		t.Errorf("expected an unknown base image error, got %v", err)
+	}
+}
+
+func TestWatchBaseImages(t *testing.T) {
+	isoPath := filepath.Join(t.TempDir(), "rhcos.iso")
+	if err := os.WriteFile(isoPath, []byte("original"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	imageServer := newTestImageServer(t, Options{IsoFile: isoPath},
+		&imageFile{name: "host-xyz-45.iso", isoFile: isoPath, generated: true},
+		&imageFile{name: "other.iso", isoFile: "other.iso", generated: true},
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		if err := imageServer.WatchBaseImages(ctx, func(string) {}); err != nil {
+			t.Error(err)
+		}
+	}()
+	// give the watcher time to start
+	time.Sleep(100 * time.Millisecond)
+
+	if err := os.WriteFile(isoPath+".tmp", []byte("replacement"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(isoPath+".tmp", isoPath); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if imageServer.imageFileByName("host-xyz-45.iso") == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if imageServer.imageFileByName("host-xyz-45.iso") != nil {
+		t.Error("expected the image of the replaced base ISO to be unregistered")
+	}
+	if imageServer.imageFileByName("other.iso") == nil {
+		t.Error("expected the image of another base ISO to stay registered")
+	}
+}
+
+func TestMemoryEviction(t *testing.T) {
+	content := map[string][]byte{
+		"first.iso":  []byte("first"),
+		"second.iso": []byte("second"),
+	}
+	fetched := []string{}
+	imageServer := newTestImageServer(t, Options{
+		MaxImagesInMemory: 1,
+		IgnitionSource: func(ctx context.Context, name string) ([]byte, error) {
+			fetched = append(fetched, name)
+			return content[name], nil
+		},
+	})
+	for i, name := range []string{"first.iso", "second.iso"} {
+		imageServer.images.add(&imageFile{
+			name:            name,
+			digest:          contentDigest(content[name]),
+			ignitionContent: content[name],
+			generated:       true,
+			usedAt:          time.Now().Add(time.Duration(i) * time.Second),
+		})
+	}
+
+	imageServer.mu.Lock()
+	imageServer.trimMemoryLocked(nil)
+	imageServer.mu.Unlock()
+	first, second := imageServer.images.get("first.iso"), imageServer.images.get("second.iso")
+	if first.ignitionContent != nil || second.ignitionContent == nil {
+		t.Fatal("expected the least recently used image to be evicted")
+	}
+
+	if err := imageServer.loadIgnition(context.Background(), first); err != nil {
+		t.Fatal(err)
+	}
+	if string(first.ignitionContent) != "first" || second.ignitionContent != nil {
+		t.Error("expected the evicted image to be restored in place of the other")
+	}
+	if len(fetched) != 1 || fetched[0] != "first.iso" {
+		t.Errorf("unexpected content fetches %v", fetched)
+	}
+
+	content["second.iso"] = []byte("changed")
+	if err := imageServer.loadIgnition(context.Background(), second); !errors.Is(err, errImageContentChanged) {
+		t.Errorf("expected changed content to be rejected, got %v", err)
+	}
+}
+
+func TestContentRotation(t *testing.T) {
+	isoFile := filepath.Join(t.TempDir(), "rhcos.iso")
+	if err := os.WriteFile(isoFile, []byte("aiosetnarsetin"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	imageServer := newTestImageServer(t, Options{
+		IsoFile: isoFile,
+		BaseURL: "http://localhost:8080",
+	})
+
+	ctx := context.Background()
+	oldSpec := ImageSpec{Name: "host-xyz-45.iso", Ignition: []byte(`{"old":"network"}`)}
+	info, err := imageServer.ServeImage(ctx, oldSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Format != ImageFormatISO || info.Size != int64(len("aiosetnarsetin")) {
+		t.Errorf("unexpected image info %+v", info)
+	}
+	first := info.URL
+	if again, _ := imageServer.ServeImage(ctx, oldSpec); again.URL != first {
+		t.Errorf("expected the URL to be stable for the same content, got %s and %s", first, again.URL)
+	}
+	info, err = imageServer.ServeImage(ctx, ImageSpec{Name: "host-xyz-45.iso", Ignition: []byte(`{"new":"network"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := info.URL
+	if second == first {
+		t.Fatalf("expected a new URL for new content, got %s", second)
+	}
+
+	for u, expected := range map[string]error{first: fs.ErrNotExist, second: nil} {
+		parsed, _ := url.Parse(u)
+		if _, err := imageServer.lookupImage(parsed.Path); !errors.Is(err, expected) {
+			t.Errorf("lookup of %s returned %v, want %v", u, err, expected)
+		}
+	}
+}
+
+func TestTokenURL(t *testing.T) {
+	isoFile := filepath.Join(t.TempDir(), "rhcos.iso")
+	if err := os.WriteFile(isoFile, []byte("aiosetnarsetin"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	imageServer := newTestImageServer(t, Options{
+		IsoFile:       isoFile,
+		BaseURL:       "http://localhost:8080",
+		OneTimeTokens: true,
+	})
+
+	info, err := imageServer.ServeImage(context.Background(), ImageSpec{Name: "host-xyz-45.iso", Ignition: []byte(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := info.URL
+	parsed, err := url.Parse(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if segments := strings.Split(strings.TrimPrefix(parsed.Path, "/"), "/"); len(segments) != 4 {
+		t.Fatalf("expected revisions, a token and the name in %s", u)
+	}
+	if _, err := imageServer.lookupImage(parsed.Path); err != nil {
+		t.Errorf("lookup of %s returned %v", u, err)
+	}
+}
+
+func TestGenerationSpan(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	isoFile := filepath.Join(t.TempDir(), "rhcos.iso")
+	if err := os.WriteFile(isoFile, []byte("aiosetnarsetin"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	imageServer := newTestImageServer(t, Options{
+		IsoFile: isoFile,
+		BaseURL: "http://localhost:8080",
+	})
+	ctx, span := tracing.Start(context.Background(), "Reconcile")
+	_, err := imageServer.ServeImage(ctx, ImageSpec{Name: "host-xyz-45.iso", Ignition: []byte(`{}`)})
+	span.End()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// generation finishes in the background, after the reconcile; images
+	// of other tests may still be generated too
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, ended := range recorder.Ended() {
+			if ended.Name() != "GenerateImage" || ended.SpanContext().TraceID() != span.SpanContext().TraceID() {
+				continue
+			}
+			if ended.Parent().SpanID() != span.SpanContext().SpanID() {
+				t.Errorf("generation traced outside of the reconcile that registered the image")
+			}
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Error("no generation span in the trace of the reconcile that registered the image")
+}
+
+func TestBaseImageRevision(t *testing.T) {
+	isoPath := filepath.Join(t.TempDir(), "rhcos.iso")
+	content := make([]byte, volumeDescriptorOffset+volumeDescriptorSize)
+	copy(content[volumeDescriptorOffset:], "rhcos-49.84")
+	if err := os.WriteFile(isoPath, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, first, err := statBaseImage(isoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, _ := os.Stat(isoPath)
+
+	// a different build copied over the file, preserving its timestamp
+	copy(content[volumeDescriptorOffset:], "rhcos-410.84")
+	if err := os.WriteFile(isoPath, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(isoPath, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if _, second, _ := statBaseImage(isoPath); second == first {
+		t.Error("expected the revision to change with the ISO's volume descriptor")
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	isoFile := filepath.Join(t.TempDir(), "rhcos.iso")
+	if err := os.WriteFile(isoFile, []byte("aiosetnarsetin"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(isoFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	isoInfoCache.Lock()
+	isoInfoCache.entries[isoFile] = isoInfo{size: fi.Size(), modTime: fi.ModTime(), areaLength: 4}
+	isoInfoCache.Unlock()
+
+	imageServer := newTestImageServer(t, Options{
+		IsoFile: isoFile,
+		BaseURL: "http://localhost:8080",
+	})
+	ctx := context.Background()
+
+	if err := imageServer.RemoveImage(ctx, "other.iso"); !errors.Is(err, ErrImageNotFound) || !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected an unknown image to be reported, got %v", err)
+	}
+
+	if _, err := imageServer.ServeImage(ctx, ImageSpec{Name: "host-xyz-45.iso", Ignition: []byte("too large")}); err != nil {
+		t.Fatal(err)
+	}
+	var ready bool
+	for i := 0; i < 50 && !ready; i++ {
+		ready, err = imageServer.ImageReady(ctx, "host-xyz-45.iso")
+		time.Sleep(10 * time.Millisecond)
+	}
+	failed := &ErrGenerationFailed{}
+	if !errors.As(err, &failed) || !errors.Is(err, ErrIgnitionTooLarge) {
+		t.Errorf("expected the generation to fail as the ignition is too large, got %v", err)
+	}
+
+	imageServer.isoFile = filepath.Join(t.TempDir(), "missing.iso")
+	if _, err := imageServer.ServeImage(ctx, ImageSpec{Name: "host-xyz-45.iso"}); !errors.Is(err, ErrBaseISOUnavailable) {
+		t.Errorf("expected the base ISO to be unavailable, got %v", err)
+	}
+}
+
+func TestReplaceImage(t *testing.T) {
+	isoFile := filepath.Join(t.TempDir(), "rhcos.iso")
+	if err := os.WriteFile(isoFile, []byte("aiosetnarsetin"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	imageServer := newTestImageServer(t, Options{
+		IsoFile: isoFile,
+		BaseURL: "http://localhost:8080",
+	})
+	ctx := context.Background()
+	spec := ImageSpec{Name: "host-xyz-45.iso", Ignition: []byte(`{}`)}
+
+	if _, err := imageServer.ReplaceImage(ctx, spec); !errors.Is(err, ErrImageNotFound) {
+		t.Errorf("expected replacing an unknown image to fail, got %v", err)
+	}
+	if _, err := imageServer.GetImage(ctx, spec.Name); !errors.Is(err, ErrImageNotFound) {
+		t.Errorf("expected an unknown image to be reported, got %v", err)
+	}
+
+	info, err := imageServer.ServeImage(ctx, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Ready || info.Done == nil {
+		t.Fatalf("expected a pending image, got %+v", info)
+	}
+	select {
+	case <-info.Done:
+	case <-time.After(time.Second):
+		t.Fatal("expected generation to finish")
+	}
+	if got, err := imageServer.GetImage(ctx, spec.Name); err != nil || !got.Ready || got.Done != nil {
+		t.Errorf("expected the image to be ready once generation finished, got %+v, %v", got, err)
+	}
+	registered := imageServer.imageFileByName(spec.Name)
+	if _, err := imageServer.ServeImage(ctx, spec); err != nil || imageServer.imageFileByName(spec.Name) != registered {
+		t.Errorf("expected registering the same content to keep the image, got %v", err)
+	}
+	replaced, err := imageServer.ReplaceImage(ctx, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imageServer.imageFileByName(spec.Name) == registered {
+		t.Error("expected the image to be replaced")
+	}
+	if replaced.URL != info.URL {
+		t.Errorf("expected the URL to stay the same for the same content, got %s and %s", info.URL, replaced.URL)
+	}
+	if got, err := imageServer.GetImage(ctx, spec.Name); err != nil || got.URL != info.URL {
+		t.Errorf("unexpected image info %+v, %v", got, err)
+	}
+	if images, _ := imageServer.ListImages(ctx); len(images) != 1 {
+		t.Errorf("expected a single image to be registered, got %+v", images)
+	}
+}
+
+func TestContentHeaders(t *testing.T) {
+	imageServer := newTestImageServer(t, Options{
+		IsoFile: buildLiveISO(t),
+		BaseURL: "http://localhost:8080",
+	})
+	for _, tc := range []struct {
+		spec        ImageSpec
+		contentType string
+		disposition string
+	}{
+		{
+			spec:        ImageSpec{Name: "host-xyz-45.qcow", Ignition: []byte(`{}`)},
+			contentType: "application/vnd.efi.iso",
+			disposition: `attachment; filename=host-xyz-45.iso`,
+		},
+		{
+			spec:        ImageSpec{Name: "host-xyz-46.qcow", ConfigDrive: map[string][]byte{"openstack/latest/meta_data.json": []byte(`{}`)}},
+			contentType: "application/octet-stream",
+			disposition: `attachment; filename=host-xyz-46.img`,
+		},
+	} {
+		info, err := imageServer.ServeImage(context.Background(), tc.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-info.Done
+		u, err := url.Parse(info.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, method := range []string{http.MethodHead, http.MethodGet} {
+			rr := httptest.NewRecorder()
+			imageServer.ServeHTTP(rr, httptest.NewRequest(method, u.Path, nil))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("%s %s returned status %v", method, tc.spec.Name, rr.Code)
+			}
+			if contentType := rr.Header().Get("Content-Type"); contentType != tc.contentType {
+				t.Errorf("%s %s: unexpected Content-Type %q", method, tc.spec.Name, contentType)
+			}
+			if disposition := rr.Header().Get("Content-Disposition"); disposition != tc.disposition {
+				t.Errorf("%s %s: unexpected Content-Disposition %q", method, tc.spec.Name, disposition)
+			}
+		}
+	}
+}
+
+func TestETag(t *testing.T) {
+	imageServer := newTestImageServer(t, Options{
+		IsoFile: buildLiveISO(t),
+		BaseURL: "http://localhost:8080",
+	})
+	serve := func(ignition string) *url.URL {
+		info, err := imageServer.ServeImage(context.Background(), ImageSpec{Name: "host-xyz-45.iso", Ignition: []byte(ignition)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-info.Done
+		u, err := url.Parse(info.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+	get := func(u *url.URL, header, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, u.Path, nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		rr := httptest.NewRecorder()
+		imageServer.ServeHTTP(rr, req)
+		return rr
+	}
+
+	u := serve(`{}`)
+	rr := get(u, "", "")
+	etag := rr.Header().Get("ETag")
+	if rr.Code != http.StatusOK || !strings.HasPrefix(etag, `"`) || strings.HasPrefix(etag, `W/`) {
+		t.Fatalf("expected a strong ETag, got %q (%d)", etag, rr.Code)
+	}
+	if rr := get(u, "If-None-Match", etag); rr.Code != http.StatusNotModified || rr.Body.Len() != 0 {
+		t.Errorf("expected the image not to be sent again, got %d", rr.Code)
+	}
+	req := httptest.NewRequest(http.MethodGet, u.Path, nil)
+	req.Header.Set("Range", "bytes=0-9")
+	req.Header.Set("If-Range", etag)
+	rr = httptest.NewRecorder()
+	imageServer.ServeHTTP(rr, req)
+	if rr.Code != http.StatusPartialContent || rr.Body.Len() != 10 {
+		t.Errorf("expected the download to resume, got %d with %d bytes", rr.Code, rr.Body.Len())
+	}
+
+	u = serve(`{"ignition":{}}`)
+	if rr := get(u, "If-None-Match", etag); rr.Code != http.StatusOK || rr.Header().Get("ETag") == etag {
+		t.Errorf("expected new content to have a new ETag, got %q (%d)", rr.Header().Get("ETag"), rr.Code)
+	}
+}
+
+func TestLastModified(t *testing.T) {
+	imageServer := newTestImageServer(t, Options{
+		IsoFile: buildLiveISO(t),
+		BaseURL: "http://localhost:8080",
+	})
+	info, err := imageServer.ServeImage(context.Background(), ImageSpec{Name: "host-xyz-45.iso", Ignition: []byte(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-info.Done
+	u, err := url.Parse(info.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{u.Path, "/"} {
+		rr := httptest.NewRecorder()
+		imageServer.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		lastModified := rr.Header().Get("Last-Modified")
+		if rr.Code != http.StatusOK || lastModified == "" {
+			t.Fatalf("GET %s: expected a Last-Modified time, got %q (%d)", path, lastModified, rr.Code)
+		}
+		time.Sleep(time.Second)
+
+		rr = httptest.NewRecorder()
+		imageServer.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		if modified := rr.Header().Get("Last-Modified"); modified != lastModified {
+			t.Errorf("GET %s: Last-Modified changed from %q to %q", path, lastModified, modified)
+		}
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("If-Modified-Since", lastModified)
+		rr = httptest.NewRecorder()
+		imageServer.ServeHTTP(rr, req)
+		if rr.Code != http.StatusNotModified {
+			t.Errorf("GET %s: expected an unmodified response, got %d", path, rr.Code)
+		}
+	}
+}
+
+func TestHeadBeforeGeneration(t *testing.T) {
+	notAnISO := filepath.Join(t.TempDir(), "not-an.iso")
+	if err := os.WriteFile(notAnISO, []byte("aiosetnarsetin"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	imageServer := newTestImageServer(t, Options{
+		IsoFile: notAnISO,
+		BaseURL: "http://localhost:8080",
+	},
+		&imageFile{
+			name:            "host-xyz-45.iso",
+			size:            12345,
+			isoFile:         notAnISO,
+			ignitionContent: []byte("asietonarst"),
+		},
+		&imageFile{
+			name:          "failed.iso",
+			size:          12345,
+			isoFile:       notAnISO,
+			generated:     true,
+			generationErr: errors.New("no space left on device"),
+		},
+	)
+
+	// the base ISO is not even an ISO, so the image cannot be read
+	rr := httptest.NewRecorder()
+	imageServer.ServeHTTP(rr, httptest.NewRequest(http.MethodHead, "/host-xyz-45.iso", nil))
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Length") != "12345" || rr.Body.Len() != 0 {
+		t.Errorf("unexpected HEAD response %d with Content-Length %q", rr.Code, rr.Header().Get("Content-Length"))
+	}
+
+	rr = httptest.NewRecorder()
+	imageServer.ServeHTTP(rr, httptest.NewRequest(http.MethodHead, "/failed.iso", nil))
+	if rr.Code == http.StatusOK {
+		t.Error("expected HEAD of an image whose generation failed to fail")
 	}
 }
@@ -0,0 +1,80 @@
+package imagehandler
+
+import "sort"
+
+// imageSet holds the registered images, indexed by their names and by the
+// file names they are served under, which differ when random file names are
+// enabled, so that requests find their image without scanning them all. It
+// is guarded by the lock of its imageFileSystem, and the zero value is an
+// empty set.
+type imageSet struct {
+	byName       map[string]*imageFile
+	byServedName map[string]*imageFile
+}
+
+// newImageSet returns a set holding images.
+func newImageSet(images ...*imageFile) imageSet {
+	s := imageSet{}
+	for _, im := range images {
+		s.add(im)
+	}
+	return s
+}
+
+// add registers an image, replacing any of the same name.
+func (s *imageSet) add(im *imageFile) {
+	if s.byName == nil {
+		s.byName = map[string]*imageFile{}
+		s.byServedName = map[string]*imageFile{}
+	}
+	if old := s.byName[im.name]; old != nil {
+		s.remove(old)
+	}
+	s.byName[im.name] = im
+	s.byServedName[im.servedName()] = im
+}
+
+// remove unregisters an image.
+func (s *imageSet) remove(im *imageFile) {
+	if s.byName[im.name] == im {
+		delete(s.byName, im.name)
+	}
+	if s.byServedName[im.servedName()] == im {
+		delete(s.byServedName, im.servedName())
+	}
+}
+
+// setFileName changes the file name an image is served under.
+func (s *imageSet) setFileName(im *imageFile, fileName string) {
+	if s.byServedName[im.servedName()] == im {
+		delete(s.byServedName, im.servedName())
+	}
+	im.fileName = fileName
+	if s.byName[im.name] == im {
+		s.byServedName[im.servedName()] = im
+	}
+}
+
+// get returns the image registered under name, or nil.
+func (s *imageSet) get(name string) *imageFile {
+	return s.byName[name]
+}
+
+// served returns the image served under the file name, or nil.
+func (s *imageSet) served(fileName string) *imageFile {
+	return s.byServedName[fileName]
+}
+
+func (s *imageSet) len() int {
+	return len(s.byName)
+}
+
+// all returns the images, sorted by name.
+func (s *imageSet) all() []*imageFile {
+	images := make([]*imageFile, 0, len(s.byName))
+	for _, im := range s.byName {
+		images = append(images, im)
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].name < images[j].name })
+	return images
+}
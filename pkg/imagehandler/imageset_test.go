@@ -0,0 +1,39 @@
+package imagehandler
+
+import "testing"
+
+func TestImageSet(t *testing.T) {
+	first := &imageFile{name: "first.iso"}
+	second := &imageFile{name: "second.iso", fileName: "abc.iso"}
+	s := newImageSet(second, first)
+
+	if s.len() != 2 {
+		t.Fatalf("expected 2 images, got %d", s.len())
+	}
+	if all := s.all(); all[0] != first || all[1] != second {
+		t.Errorf("images not sorted by name: %v", all)
+	}
+	if s.served("abc.iso") != second || s.served("second.iso") != nil {
+		t.Error("image not found by its served name")
+	}
+
+	s.setFileName(second, "def.iso")
+	if s.served("def.iso") != second || s.served("abc.iso") != nil {
+		t.Error("served name not updated")
+	}
+
+	replacement := &imageFile{name: "first.iso"}
+	s.add(replacement)
+	if s.get("first.iso") != replacement || s.served("first.iso") != replacement || s.len() != 2 {
+		t.Error("image not replaced")
+	}
+
+	s.remove(first)
+	if s.get("first.iso") != replacement {
+		t.Error("removing a replaced image unregistered its replacement")
+	}
+	s.remove(replacement)
+	if s.get("first.iso") != nil || s.served("first.iso") != nil || s.len() != 1 {
+		t.Error("image not removed")
+	}
+}
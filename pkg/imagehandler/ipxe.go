@@ -0,0 +1,408 @@
+package imagehandler
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/openshift/assisted-image-service/pkg/isoeditor"
+)
+
+// bootArtifact is a file served alongside an image so that hosts can boot
+// it over the network instead of from virtual media.
+type bootArtifact string
+
+const (
+	// artifactIPXE is an iPXE script booting the kernel and initrd.
+	artifactIPXE bootArtifact = "ipxe"
+	// artifactKernel is the kernel of the base ISO.
+	artifactKernel bootArtifact = "kernel"
+	// artifactInitrd is the initramfs of the base ISO with its root
+	// filesystem and the ignition content of the image appended.
+	artifactInitrd bootArtifact = "initrd"
+)
+
+// The iPXE script of an image is served at /ipxe/<image path>, and its
+// kernel and initrd at /images/<image path>/kernel and initrd, along with
+// the s390x boot files of s390x images, where the image path holds the same
+// revision and token directories as the image's URL.
+const (
+	ipxePathPrefix   = "/ipxe"
+	imagesPathPrefix = "/images"
+)
+
+// The PXE boot files of the RHCOS live ISO.
+const (
+	pxeKernelPath = "/images/pxeboot/vmlinuz"
+	pxeInitrdPath = "/images/pxeboot/initrd.img"
+	pxeRootfsPath = "/images/pxeboot/rootfs.img"
+)
+
+// pxeKernelArgs are the kernel arguments of a network boot when the base ISO
+// does not record its own.
+var pxeKernelArgs = []string{"ignition.firstboot", "ignition.platform.id=metal"}
+
+// parseBootArtifactPath splits a request path for a network boot file into
+// the file and the path of its image.
+func parseBootArtifactPath(name string) (bootArtifact, string, bool) {
+	if strings.HasPrefix(name, ipxePathPrefix+"/") {
+		return artifactIPXE, strings.TrimPrefix(name, ipxePathPrefix), true
+	}
+	if !strings.HasPrefix(name, imagesPathPrefix+"/") {
+		return "", "", false
+	}
+	for _, artifact := range []bootArtifact{artifactKernel, artifactInitrd, artifactParmfile, artifactIns, artifactAddrSize} {
+		if suffix := "/" + string(artifact); strings.HasSuffix(name, suffix) {
+			return artifact, strings.TrimSuffix(strings.TrimPrefix(name, imagesPathPrefix), suffix), true
+		}
+	}
+	return "", "", false
+}
+
+// bootArtifactURL returns the URL of a network boot file of an image.
+func (f *imageFileSystem) bootArtifactURL(base *url.URL, im *imageFile, artifact bootArtifact) string {
+	if artifact == artifactIPXE {
+		return publicURL(base, f.pathPrefix, ipxePathPrefix, im.revision, im.contentRevision(), im.token, im.servedName())
+	}
+	return publicURL(base, f.pathPrefix, imagesPathPrefix, im.revision, im.contentRevision(), im.token, im.servedName(), string(artifact))
+}
+
+// serveBootArtifact sends a network boot file of the image at imagePath.
+// The initrd carries the image's ignition content, so a complete download
+// of it is recorded, and uses up a one-time token, as one of the image
+// does. The other files can be fetched any number of times until then.
+func (f *imageFileSystem) serveBootArtifact(w http.ResponseWriter, r *http.Request, artifact bootArtifact, imagePath string) {
+	im, err := f.lookupImage(imagePath)
+	if err != nil || im.configDrive != nil || !im.servesBootArtifact(artifact) {
+		http.NotFound(w, r)
+		return
+	}
+	if f.serveBaseImageUnavailable(w, im) {
+		return
+	}
+	log := f.log.WithValues("image", im.name, "artifact", artifact)
+	if err := f.loadIgnition(r.Context(), im); err != nil {
+		log.Error(err, "restoring evicted image content")
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if artifact != artifactKernel && artifact != artifactInitrd {
+		content, err := f.generateBootArtifact(im, artifact)
+		if err != nil {
+			log.Error(err, "creating network boot file")
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if artifact == artifactAddrSize {
+			w.Header().Set("Content-Type", "application/octet-stream")
+		} else {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		}
+		http.ServeContent(w, r, string(artifact), time.Time{}, bytes.NewReader(content))
+		return
+	}
+
+	f.mu.RLock()
+	ignitionContent := im.ignitionContent
+	f.mu.RUnlock()
+	reader, err := f.openBootArtifact(im, ignitionContent, artifact)
+	if err != nil {
+		log.Error(err, "opening network boot file")
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if artifact == artifactKernel {
+		http.ServeContent(w, r, string(artifact), time.Time{}, reader)
+		return
+	}
+
+	size, err := reader.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = reader.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		log.Error(err, "opening network boot file")
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	cw := &countingWriter{ResponseWriter: w}
+	http.ServeContent(cw, r, string(artifact), time.Time{}, reader)
+	if r.Method != http.MethodGet || !cw.sentContent() {
+		return
+	}
+	complete := cw.complete(size)
+	if f.oneTimeTokens && complete {
+		f.markDownloaded(im)
+	}
+	f.recordDownload(log, im, r, cw.written, complete)
+}
+
+// servesBootArtifact reports whether a network boot file is served for an
+// image: s390x hosts are booted with the files of an .ins file rather than
+// an iPXE script.
+func (im *imageFile) servesBootArtifact(artifact bootArtifact) bool {
+	switch artifact {
+	case artifactIPXE:
+		return !im.s390x()
+	case artifactParmfile, artifactIns, artifactAddrSize:
+		return im.s390x()
+	}
+	return true
+}
+
+// generateBootArtifact returns the content of a network boot file that is
+// created for an image rather than read from its base ISO.
+func (f *imageFileSystem) generateBootArtifact(im *imageFile, artifact bootArtifact) ([]byte, error) {
+	switch artifact {
+	case artifactIPXE:
+		return f.ipxeScript(im)
+	case artifactParmfile:
+		return parmfile(im)
+	case artifactIns:
+		return insFile(), nil
+	case artifactAddrSize:
+		return f.initrdAddrSize(im)
+	}
+	return nil, fmt.Errorf("unknown network boot file %s", artifact)
+}
+
+// networkBootKernelArgs returns the kernel arguments of an image booted
+// over the network: those of its base ISO, except those finding the ISO,
+// and its own.
+func networkBootKernelArgs(im *imageFile) ([]string, error) {
+	info, err := getISOInfo(im.isoFile)
+	if err != nil {
+		return nil, err
+	}
+	args := pxeKernelArgs
+	if info.kargsErr == nil {
+		args = []string{}
+		for _, arg := range strings.Fields(info.defaultKargs) {
+			if !strings.HasPrefix(arg, "coreos.liveiso=") {
+				args = append(args, arg)
+			}
+		}
+	}
+	return append(append([]string{}, args...), im.kernelArgs...), nil
+}
+
+// ipxeScript returns an iPXE script booting the kernel and initrd of an
+// image with its kernel arguments.
+func (f *imageFileSystem) ipxeScript(im *imageFile) ([]byte, error) {
+	args, err := networkBootKernelArgs(im)
+	if err != nil {
+		return nil, err
+	}
+	base, err := f.publicBaseURL()
+	if err != nil {
+		return nil, err
+	}
+	f.mu.RLock()
+	kernelURL := f.bootArtifactURL(base, im, artifactKernel)
+	initrdURL := f.bootArtifactURL(base, im, artifactInitrd)
+	f.mu.RUnlock()
+
+	args = append([]string{"initrd=initrd"}, args...)
+
+	script := &bytes.Buffer{}
+	fmt.Fprintln(script, "#!ipxe")
+	fmt.Fprintf(script, "kernel %s %s\n", kernelURL, strings.Join(args, " "))
+	fmt.Fprintf(script, "initrd --name initrd %s\n", initrdURL)
+	fmt.Fprintln(script, "boot")
+	return script.Bytes(), nil
+}
+
+// openBootArtifact opens the kernel or initrd of an image.
+func (f *imageFileSystem) openBootArtifact(im *imageFile, ignitionContent []byte, artifact bootArtifact) (io.ReadSeekCloser, error) {
+	file, base, err := f.openBaseBootFile(im, artifact)
+	if err != nil {
+		return nil, err
+	}
+	if artifact == artifactKernel || len(ignitionContent) == 0 {
+		return &imageReader{ReadSeeker: base, isoFile: file}, nil
+	}
+	parts := concatenation{}.
+		append(base).
+		append(io.NewSectionReader(bytes.NewReader(ignitionContent), 0, int64(len(ignitionContent))))
+	return &imageReader{ReadSeeker: io.NewSectionReader(parts, 0, parts.size()), isoFile: file}, nil
+}
+
+// pxebootCachePrefix names the boot files extracted from base ISOs into the
+// cache directory, followed by the revision of the base ISO.
+const pxebootCachePrefix = "pxeboot-"
+
+// openBaseBootFile opens the kernel of an image's base ISO, or its
+// initramfs and root filesystem for the initrd. When caching is enabled
+// they are extracted into the cache directory on first use, so that the
+// ISO is not searched for them on every download.
+func (f *imageFileSystem) openBaseBootFile(im *imageFile, artifact bootArtifact) (*os.File, *io.SectionReader, error) {
+	if f.cacheDir == "" {
+		return readBaseBootFile(im.isoFile, artifact)
+	}
+	cachePath := filepath.Join(f.cacheDir, pxebootCachePrefix+im.revision+"-"+string(artifact))
+	file, err := os.Open(cachePath)
+	if os.IsNotExist(err) {
+		if err := f.extractBootFile(im, artifact, cachePath); err != nil {
+			return nil, nil, err
+		}
+		file, err = os.Open(cachePath)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, io.NewSectionReader(file, 0, fi.Size()), nil
+}
+
+// extractBootFile writes a boot file of an image's base ISO to cachePath,
+// and removes those extracted from base ISOs no image is built from any
+// more.
+func (f *imageFileSystem) extractBootFile(im *imageFile, artifact bootArtifact, cachePath string) error {
+	isoFile, reader, err := readBaseBootFile(im.isoFile, artifact)
+	if err != nil {
+		return err
+	}
+	defer isoFile.Close()
+
+	tmp, err := os.CreateTemp(f.cacheDir, pxebootCachePrefix+im.revision+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, reader); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), cachePath); err != nil {
+		return err
+	}
+	f.cacheLog.Info("extracted network boot file", "artifact", artifact, "revision", im.revision)
+
+	f.mu.RLock()
+	revisions := map[string]bool{}
+	for _, other := range f.images.all() {
+		revisions[other.revision] = true
+	}
+	f.mu.RUnlock()
+	f.removeBootFiles(func(revision string) bool { return !revisions[revision] })
+	return nil
+}
+
+// removeBootFiles deletes the boot files extracted into the cache directory
+// from base ISOs whose revision is stale.
+func (f *imageFileSystem) removeBootFiles(stale func(revision string) bool) {
+	paths, err := filepath.Glob(filepath.Join(f.cacheDir, pxebootCachePrefix+"*"))
+	if err != nil {
+		return
+	}
+	for _, cachePath := range paths {
+		name := strings.TrimPrefix(filepath.Base(cachePath), pxebootCachePrefix)
+		if strings.Contains(name, ".tmp") {
+			// being extracted
+			continue
+		}
+		revision := strings.SplitN(name, "-", 2)[0]
+		if !stale(revision) {
+			continue
+		}
+		if err := os.Remove(cachePath); err != nil && !os.IsNotExist(err) {
+			f.cacheLog.Error(err, "removing extracted network boot file", "path", cachePath)
+		}
+	}
+}
+
+// readBaseBootFile opens the kernel of a base ISO, or its initramfs and
+// root filesystem for the initrd.
+func readBaseBootFile(isoPath string, artifact bootArtifact) (*os.File, *io.SectionReader, error) {
+	isoFile, err := os.Open(isoPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if artifact == artifactKernel {
+		start, length, err := isoeditor.GetISOFileInfo(pxeKernelPath, isoPath)
+		if err != nil {
+			isoFile.Close()
+			return nil, nil, fmt.Errorf("base image %s has no %s: %w", isoPath, pxeKernelPath, err)
+		}
+		return isoFile, io.NewSectionReader(isoFile, start, length), nil
+	}
+
+	paths := []string{pxeInitrdPath, pxeRootfsPath}
+	parts := concatenation{}
+	for i, filePath := range paths {
+		start, length, err := isoeditor.GetISOFileInfo(filePath, isoPath)
+		if err != nil {
+			if i == 0 {
+				isoFile.Close()
+				return nil, nil, fmt.Errorf("base image %s has no %s: %w", isoPath, filePath, err)
+			}
+			// older ISOs have no separate root filesystem
+			continue
+		}
+		parts = parts.append(io.NewSectionReader(isoFile, start, length))
+	}
+	return isoFile, io.NewSectionReader(parts, 0, parts.size()), nil
+}
+
+// cpioAlignment is the alignment of the archives concatenated in an initrd.
+const cpioAlignment = 4
+
+// concatenation reads parts one after the other, each padded with zeros to
+// cpioAlignment so that the kernel finds every archive in an initrd.
+type concatenation []*io.SectionReader
+
+func (c concatenation) append(part *io.SectionReader) concatenation {
+	c = append(c, part)
+	if pad := (cpioAlignment - part.Size()%cpioAlignment) % cpioAlignment; pad > 0 {
+		c = append(c, io.NewSectionReader(bytes.NewReader(make([]byte, pad)), 0, pad))
+	}
+	return c
+}
+
+func (c concatenation) size() int64 {
+	size := int64(0)
+	for _, part := range c {
+		size += part.Size()
+	}
+	return size
+}
+
+func (c concatenation) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for _, part := range c {
+		if len(p) == 0 {
+			break
+		}
+		if off >= part.Size() {
+			off -= part.Size()
+			continue
+		}
+		read, err := part.ReadAt(p, off)
+		n += read
+		p = p[read:]
+		off = 0
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+	}
+	if len(p) > 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
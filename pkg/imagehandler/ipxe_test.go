@@ -0,0 +1,159 @@
+package imagehandler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// getURL requests the path of rawURL from an image server.
+func getURL(t *testing.T, imageServer *imageFileSystem, rawURL string) (int, string) {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	imageServer.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, u.Path, nil))
+	return rr.Code, rr.Body.String()
+}
+
+func TestIPXE(t *testing.T) {
+	imageServer := newTestImageServer(t, Options{
+		IsoFile: buildLiveISO(t),
+		BaseURL: "http://localhost:8080",
+	})
+	info, err := imageServer.ServeImage(context.Background(), ImageSpec{
+		Name:       "host-xyz-45.iso",
+		Ignition:   []byte(`{}`),
+		KernelArgs: []string{"console=ttyS0"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-info.Done
+
+	get := func(rawURL string) (int, string) {
+		return getURL(t, imageServer, rawURL)
+	}
+	status, script := get(info.IPXEURL)
+	if status != http.StatusOK || !strings.HasPrefix(script, "#!ipxe\n") {
+		t.Fatalf("unexpected iPXE script (%d) %q", status, script)
+	}
+	var kernelURL, initrdURL string
+	for _, line := range strings.Split(script, "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) > 1 && fields[0] == "kernel":
+			kernelURL = fields[1]
+			if args := strings.Join(fields[2:], " "); args != "initrd=initrd ignition.firstboot console=ttyS0" {
+				t.Errorf("unexpected kernel arguments %q", args)
+			}
+		case len(fields) > 3 && fields[0] == "initrd":
+			initrdURL = fields[3]
+		}
+	}
+	if status, kernel := get(kernelURL); status != http.StatusOK || kernel != "kernel" {
+		t.Errorf("unexpected kernel (%d) %q", status, kernel)
+	}
+	if status, initrd := get(initrdURL); status != http.StatusOK || initrd != "initrd\x00\x00rootfs\x00\x00{}\x00\x00" {
+		t.Errorf("unexpected initrd (%d) %q", status, initrd)
+	}
+
+	if status, _ := get(strings.Replace(kernelURL, info.URL[strings.LastIndex(info.URL, "/")+1:], "other.iso", 1)); status != http.StatusNotFound {
+		t.Errorf("expected the kernel of an unknown image not to be found, got %d", status)
+	}
+}
+
+func TestBootFilesCached(t *testing.T) {
+	isoPath := buildLiveISO(t)
+	imageServer := newTestImageServer(t, Options{
+		IsoFile:  isoPath,
+		BaseURL:  "http://localhost:8080",
+		CacheDir: t.TempDir(),
+	})
+	info, err := imageServer.ServeImage(context.Background(), ImageSpec{Name: "host-xyz-45.iso", Ignition: []byte(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-info.Done
+	im := imageServer.imageFileByName("host-xyz-45.iso")
+	base, err := url.Parse(info.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base.Path = "/"
+	kernelURL := imageServer.bootArtifactURL(base, im, artifactKernel)
+	initrdURL := imageServer.bootArtifactURL(base, im, artifactInitrd)
+	for _, rawURL := range []string{kernelURL, initrdURL} {
+		if status, _ := getURL(t, imageServer, rawURL); status != http.StatusOK {
+			t.Fatalf("unexpected status %d for %s", status, rawURL)
+		}
+	}
+	cached, err := filepath.Glob(filepath.Join(imageServer.cacheDir, pxebootCachePrefix+"*"))
+	if err != nil || len(cached) != 2 {
+		t.Fatalf("expected the kernel and initrd to be extracted, got %v", cached)
+	}
+
+	// served from the cache once extracted
+	if err := os.Remove(isoPath); err != nil {
+		t.Fatal(err)
+	}
+	if status, kernel := getURL(t, imageServer, kernelURL); status != http.StatusOK || kernel != "kernel" {
+		t.Errorf("unexpected kernel (%d) %q", status, kernel)
+	}
+	if status, initrd := getURL(t, imageServer, initrdURL); status != http.StatusOK || initrd != "initrd\x00\x00rootfs\x00\x00{}\x00\x00" {
+		t.Errorf("unexpected initrd (%d) %q", status, initrd)
+	}
+
+	if err := imageServer.PurgeCache(); err != nil {
+		t.Fatal(err)
+	}
+	if cached, _ := filepath.Glob(filepath.Join(imageServer.cacheDir, pxebootCachePrefix+"*")); len(cached) != 0 {
+		t.Errorf("expected the extracted files to be purged, got %v", cached)
+	}
+}
+
+func TestBootFilesUseOneTimeToken(t *testing.T) {
+	imageServer := newTestImageServer(t, Options{
+		IsoFile:       buildLiveISO(t),
+		BaseURL:       "http://localhost:8080",
+		OneTimeTokens: true,
+	})
+	info, err := imageServer.ServeImage(context.Background(), ImageSpec{Name: "host-xyz-45.iso", Ignition: []byte(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-info.Done
+	im := imageServer.imageFileByName("host-xyz-45.iso")
+	base, err := url.Parse(info.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base.Path = "/"
+	kernelURL := imageServer.bootArtifactURL(base, im, artifactKernel)
+	initrdURL := imageServer.bootArtifactURL(base, im, artifactInitrd)
+
+	for i := 0; i < 2; i++ {
+		if status, _ := getURL(t, imageServer, kernelURL); status != http.StatusOK {
+			t.Fatalf("expected the kernel to be served until the initrd is downloaded, got %d", status)
+		}
+	}
+	if status, _ := getURL(t, imageServer, initrdURL); status != http.StatusOK {
+		t.Fatalf("unexpected status %d for the initrd", status)
+	}
+	if _, ok := imageServer.LastDownload("host-xyz-45.iso"); !ok {
+		t.Error("expected the initrd download to be recorded")
+	}
+	// the token is used up once the grace period is over
+	for _, rawURL := range []string{initrdURL, kernelURL, info.URL} {
+		if status, _ := getURL(t, imageServer, rawURL); status != http.StatusNotFound {
+			t.Errorf("expected %s not to be found with a used token, got %d", rawURL, status)
+		}
+	}
+}
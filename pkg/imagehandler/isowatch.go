@@ -0,0 +1,139 @@
+package imagehandler
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// baseImageSettleDelay is how long a base ISO must go without changes
+// before it is checked, so that a file still being copied into place is not
+// mistaken for a truncated one.
+const baseImageSettleDelay = 2 * time.Second
+
+// BaseImageWatcher is implemented by image servers that notice their base
+// ISOs being replaced on disk.
+type BaseImageWatcher interface {
+	// WatchBaseImages watches the base ISOs until ctx is done. When one
+	// is replaced, the images built from it are unregistered, so that
+	// their stale URLs stop working, and changed is called once the new
+	// file has been validated, so that they can be registered again.
+	// Missing base ISOs are looked for again periodically, and changed
+	// is called once they appear.
+	WatchBaseImages(ctx context.Context, changed func(isoPath string)) error
+}
+
+var _ BaseImageWatcher = &imageFileSystem{}
+
+func (f *imageFileSystem) WatchBaseImages(ctx context.Context, changed func(isoPath string)) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	revisions := map[string]string{}
+	watched := map[string]bool{}
+	// Directories are watched rather than files, as replacing a file, or
+	// the symlink swap of a Kubernetes volume update, ends a watch on it.
+	watchDirs := func() {
+		for _, isoPath := range f.baseImages() {
+			if _, ok := revisions[isoPath]; !ok {
+				_, revisions[isoPath], _ = statBaseImage(isoPath)
+			}
+			dir := filepath.Dir(isoPath)
+			if watched[dir] {
+				continue
+			}
+			if err := watcher.Add(dir); err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					// reported as a missing base image, and
+					// watched once it appears
+					continue
+				}
+				f.log.Error(err, "unable to watch base image directory", "directory", dir)
+				continue
+			}
+			watched[dir] = true
+		}
+	}
+	watchDirs()
+	check := func() {
+		// base images may have been reconfigured since
+		watchDirs()
+		f.checkMissingBaseImages()
+		for isoPath, last := range revisions {
+			revisions[isoPath] = f.checkBaseImage(isoPath, last, changed)
+		}
+	}
+
+	settle := time.NewTimer(0)
+	<-settle.C
+	retry := time.NewTicker(baseImageRetryInterval)
+	defer retry.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-watcher.Errors:
+			f.log.Error(err, "watching base images")
+		case <-watcher.Events:
+			settle.Reset(baseImageSettleDelay)
+		case <-settle.C:
+			check()
+		case <-retry.C:
+			check()
+		}
+	}
+}
+
+// checkBaseImage handles a possibly replaced base ISO, returning its current
+// revision.
+func (f *imageFileSystem) checkBaseImage(isoPath, lastRevision string, changed func(isoPath string)) string {
+	_, revision, err := statBaseImage(isoPath)
+	if revision == lastRevision {
+		return revision
+	}
+
+	removed := f.unregisterImagesOf(isoPath)
+	log := f.log.WithValues("path", isoPath, "revision", revision, "unregisteredImages", removed)
+	if err != nil {
+		log.Error(err, "base image is missing")
+		return revision
+	}
+	if err := f.usableBaseImage(isoPath); err != nil {
+		log.Error(err, "replaced base image is not usable")
+		return revision
+	}
+	log.Info("base image replaced")
+	changed(isoPath)
+	return revision
+}
+
+// unregisterImagesOf drops the images built from a base ISO, along with
+// their generated copies, returning how many there were.
+func (f *imageFileSystem) unregisterImagesOf(isoPath string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	removed := []*imageFile{}
+	for _, im := range f.images.all() {
+		if im.isoFile == isoPath {
+			f.images.remove(im)
+			removed = append(removed, im)
+		}
+	}
+	if len(removed) == 0 {
+		return 0
+	}
+	f.imagesChangedAt = time.Now()
+	for _, im := range removed {
+		f.removeCachedFile(im)
+		f.removeStoredImage(im)
+	}
+	f.writeIndexLocked()
+	return len(removed)
+}
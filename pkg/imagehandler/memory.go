@@ -0,0 +1,100 @@
+package imagehandler
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+)
+
+// ignitionFetchTimeout bounds how long a download waits for the ignition
+// content of an evicted image to be rebuilt.
+const ignitionFetchTimeout = time.Minute
+
+// errImageContentChanged is returned when the rebuilt ignition content of an
+// evicted image no longer matches the registered one. The download fails
+// until the image is registered again with the new content.
+var errImageContentChanged = errors.New("image content has changed since it was registered")
+
+// IgnitionSource rebuilds the ignition content of a registered image, for
+// images whose content was evicted from memory.
+type IgnitionSource func(ctx context.Context, name string) ([]byte, error)
+
+// downloadInProgress returns true if an image is being downloaded.
+func downloadInProgress(name string) bool {
+	activeDownloads.Lock()
+	defer activeDownloads.Unlock()
+	return activeDownloads.count[name] > 0
+}
+
+// trimMemoryLocked drops the ignition content and stream readers of the
+// least recently used images while more than maxImagesInMemory hold them.
+// Only generated images that are not being downloaded are evicted, and never
+// keep; their content is rebuilt from the IgnitionSource if they are
+// downloaded again. Must be called with the lock held.
+func (f *imageFileSystem) trimMemoryLocked(keep *imageFile) {
+	if f.maxImagesInMemory <= 0 || f.ignitionSource == nil {
+		return
+	}
+	resident := []*imageFile{}
+	for _, im := range f.images.all() {
+		if im.ignitionContent != nil {
+			resident = append(resident, im)
+		}
+	}
+	excess := len(resident) - f.maxImagesInMemory
+	if excess <= 0 {
+		return
+	}
+	sort.Slice(resident, func(i, j int) bool {
+		return resident[i].usedAt.Before(resident[j].usedAt)
+	})
+	for _, im := range resident {
+		if excess == 0 {
+			break
+		}
+		if im == keep || !im.generated || downloadInProgress(im.name) {
+			continue
+		}
+		f.log.V(1).Info("evicting image content from memory", "image", im.name)
+		im.ignitionContent = nil
+		memoryEvictions.Inc()
+		excess--
+	}
+}
+
+// loadIgnition makes sure an image's ignition content is in memory,
+// rebuilding it if it was evicted.
+func (f *imageFileSystem) loadIgnition(ctx context.Context, im *imageFile) error {
+	f.mu.Lock()
+	im.usedAt = time.Now()
+	// config drives are never evicted
+	loaded := im.ignitionContent != nil || im.configDrive != nil
+	f.mu.Unlock()
+	if loaded {
+		return nil
+	}
+	if f.ignitionSource == nil {
+		return errors.New("image content is not available")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ignitionFetchTimeout)
+	defer cancel()
+	content, err := f.ignitionSource(ctx, im.name)
+	if err != nil {
+		return err
+	}
+	if imageDigest(content, im.kernelArgs, im.boot) != im.digest {
+		return errImageContentChanged
+	}
+	f.log.V(1).Info("restored evicted image content", "image", im.name)
+	memoryRestores.Inc()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if im.ignitionContent == nil {
+		im.ignitionContent = content
+	}
+	f.trimMemoryLocked(im)
+	return nil
+}
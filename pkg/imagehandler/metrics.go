@@ -0,0 +1,92 @@
+package imagehandler
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const imageLabel = "image"
+
+var (
+	generationQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "image_customization_generation_queue_depth",
+		Help: "Number of images waiting for a generation worker.",
+	})
+	generationsInProgress = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "image_customization_generations_in_progress",
+		Help: "Number of images currently being generated.",
+	})
+
+	baseImagesMissing = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "image_customization_base_images_missing",
+		Help: "Number of configured base ISOs that cannot be read. While it is not zero the image server is degraded: " +
+			"it is not ready, and images built from the missing ISOs are refused until they appear.",
+	})
+
+	cacheSizeBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "image_customization_cache_size_bytes",
+		Help: "Total size of the generated images in the cache directory.",
+	})
+	cacheEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "image_customization_cache_entries",
+		Help: "Number of generated images in the cache directory.",
+	})
+	cacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "image_customization_cache_hits_total",
+		Help: "Downloads served from the cache. The hit ratio is hits / (hits + misses).",
+	})
+	cacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "image_customization_cache_misses_total",
+		Help: "Downloads streamed because the image was not (yet) cached.",
+	})
+	cacheEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "image_customization_cache_evictions_total",
+		Help: "Generated images removed from the cache.",
+	})
+	cacheDedupBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "image_customization_cache_dedup_saved_bytes_total",
+		Help: "Bytes of generation avoided by reusing an identical cached image.",
+	})
+
+	memoryEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "image_customization_memory_evictions_total",
+		Help: "Images whose ignition content was dropped from memory, to be rebuilt when next downloaded.",
+	})
+	memoryRestores = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "image_customization_memory_restores_total",
+		Help: "Downloads that rebuilt the ignition content of an evicted image.",
+	})
+
+	downloadsActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "image_customization_downloads_active",
+		Help: "Number of downloads of an image in progress.",
+	}, []string{imageLabel})
+	downloadTransferredBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "image_customization_download_transferred_bytes",
+		Help: "Bytes sent so far by the downloads of an image in progress. " +
+			"Cached images sent with sendfile only report progress once the transfer is over.",
+	}, []string{imageLabel})
+	downloadTotalBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "image_customization_download_total_bytes",
+		Help: "Bytes to be sent by the downloads of an image in progress.",
+	}, []string{imageLabel})
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		generationQueueDepth,
+		generationsInProgress,
+		baseImagesMissing,
+		cacheSizeBytes,
+		cacheEntries,
+		cacheHits,
+		cacheMisses,
+		cacheEvictions,
+		cacheDedupBytes,
+		memoryEvictions,
+		memoryRestores,
+		downloadsActive,
+		downloadTransferredBytes,
+		downloadTotalBytes,
+	)
+}
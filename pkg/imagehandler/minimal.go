@@ -0,0 +1,96 @@
+package imagehandler
+
+import (
+	"net/http"
+	"os"
+	"strings"
+)
+
+// A minimal ISO is a live ISO without its root filesystem, which the live
+// system downloads from the URL in the coreos.live.rootfs_url kernel
+// argument instead, e.g. as extracted with coreos-installer iso extract
+// minimal-iso. Its root filesystem is read from a companion file next to the
+// ISO, named by rootfsFile, and served at
+// /rootfs/<base image revision>/rootfs.img.
+const (
+	rootfsPathPrefix = "/rootfs"
+	rootfsFileName   = "rootfs.img"
+	rootfsKernelArg  = "coreos.live.rootfs_url"
+)
+
+// rootfsFile returns the path of the companion root filesystem of a minimal
+// ISO, e.g. rhcos-live-rootfs.img for rhcos-live.iso.
+func rootfsFile(isoPath string) string {
+	return strings.TrimSuffix(isoPath, ".iso") + "-" + rootfsFileName
+}
+
+// minimalRootfs returns the companion root filesystem of a base ISO if it
+// is a minimal ISO, one with no root filesystem of its own and a companion
+// file.
+func minimalRootfs(isoPath string) (string, bool) {
+	info, err := getISOInfo(isoPath)
+	if err != nil || info.hasRootfs {
+		return "", false
+	}
+	rootfsPath := rootfsFile(isoPath)
+	if _, err := os.Stat(rootfsPath); err != nil {
+		return "", false
+	}
+	return rootfsPath, true
+}
+
+// rootfsKernelArgs returns the kernel arguments of an image built from
+// isoPath, which point the live system at the root filesystem served for
+// the base ISO if it is a minimal ISO.
+func (f *imageFileSystem) rootfsKernelArgs(isoPath, revision string, kernelArgs []string) ([]string, error) {
+	if _, minimal := minimalRootfs(isoPath); !minimal {
+		return kernelArgs, nil
+	}
+	base, err := f.publicBaseURL()
+	if err != nil {
+		return nil, err
+	}
+	rootfsURL := publicURL(base, f.pathPrefix, rootfsPathPrefix, revision, rootfsFileName)
+	return append(append([]string{}, kernelArgs...), rootfsKernelArg+"="+rootfsURL), nil
+}
+
+// parseRootfsPath returns the base image revision of a request path for the
+// root filesystem of a minimal ISO.
+func parseRootfsPath(name string) (string, bool) {
+	segments := strings.Split(strings.TrimPrefix(name, "/"), "/")
+	if len(segments) != 3 || "/"+segments[0] != rootfsPathPrefix || segments[2] != rootfsFileName {
+		return "", false
+	}
+	return segments[1], true
+}
+
+// serveRootfs sends the root filesystem of the minimal base ISO with the
+// given revision. It is the same for every image, so no token is needed.
+func (f *imageFileSystem) serveRootfs(w http.ResponseWriter, r *http.Request, revision string) {
+	for _, isoPath := range f.baseImages() {
+		if _, isoRevision, err := statBaseImage(isoPath); err != nil || isoRevision != revision {
+			continue
+		}
+		rootfsPath, minimal := minimalRootfs(isoPath)
+		if !minimal {
+			break
+		}
+		file, err := os.Open(rootfsPath)
+		if err != nil {
+			f.log.Error(err, "opening root filesystem", "path", rootfsPath)
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer file.Close()
+		fi, err := file.Stat()
+		if err != nil {
+			f.log.Error(err, "opening root filesystem", "path", rootfsPath)
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, rootfsFileName, fi.ModTime(), file)
+		return
+	}
+	http.NotFound(w, r)
+}
@@ -0,0 +1,77 @@
+package imagehandler
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+// buildMinimalISO creates a minimal ISO laid out like the RHCOS one, with a
+// companion root filesystem.
+func buildMinimalISO(t *testing.T) string {
+	t.Helper()
+	kargs := "coreos.liveiso=rhcos ignition.firstboot"
+	area := kargs + strings.Repeat("#", 256-len(kargs))
+	grub := "menuentry 'RHEL CoreOS (Live)' --class fedora {\n\tlinux /images/pxeboot/vmlinuz " + area + "\n}\n"
+	files := map[string]string{
+		"images/ignition.img":       strings.Repeat("\x00", 64),
+		"images/pxeboot/vmlinuz":    "kernel",
+		"images/pxeboot/initrd.img": "initrd",
+		"EFI/redhat/grub.cfg":       grub,
+	}
+	embed := map[string]interface{}{
+		"default": kargs,
+		"files":   []map[string]interface{}{{"path": "EFI/redhat/grub.cfg", "offset": strings.Index(grub, area)}},
+		"size":    256,
+	}
+	isoPath := createISO(t, files, embed)
+	if err := os.WriteFile(rootfsFile(isoPath), []byte("rootfs"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return isoPath
+}
+
+func TestMinimalISO(t *testing.T) {
+	imageServer := newTestImageServer(t, Options{
+		IsoFile: buildMinimalISO(t),
+		BaseURL: "http://localhost:8080",
+	})
+	info, err := imageServer.ServeImage(context.Background(), ImageSpec{Name: "host-xyz-45.iso", Ignition: []byte(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-info.Done
+	im := imageServer.imageFileByName("host-xyz-45.iso")
+	if len(im.kernelArgs) != 1 || !strings.HasPrefix(im.kernelArgs[0], rootfsKernelArg+"=http://localhost:8080/rootfs/") {
+		t.Fatalf("expected the root filesystem URL in the kernel arguments, got %q", im.kernelArgs)
+	}
+	rootfsURL := strings.TrimPrefix(im.kernelArgs[0], rootfsKernelArg+"=")
+	if status, rootfs := getURL(t, imageServer, rootfsURL); status != http.StatusOK || rootfs != "rootfs" {
+		t.Errorf("unexpected root filesystem (%d) %q", status, rootfs)
+	}
+	if status, _ := getURL(t, imageServer, "http://localhost:8080/rootfs/00000000/rootfs.img"); status != http.StatusNotFound {
+		t.Errorf("expected the root filesystem of an unknown base image not to be found, got %d", status)
+	}
+
+	reader, err := newImageReader(im)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "coreos.liveiso=rhcos ignition.firstboot "+im.kernelArgs[0]+"#") {
+		t.Error("expected the root filesystem URL in the kernel arguments of the image")
+	}
+
+	// a full ISO serves its own root filesystem
+	imageServer.isoFile = buildLiveISO(t)
+	if args, err := imageServer.rootfsKernelArgs(imageServer.isoFile, "", nil); err != nil || len(args) != 0 {
+		t.Errorf("unexpected kernel arguments %q for a full ISO: %v", args, err)
+	}
+}
@@ -0,0 +1,69 @@
+package imagehandler
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// activeDownloads counts the downloads in progress for each image, so that
+// an image's series can be removed when the last one finishes. It also
+// serializes all updates to the download gauges.
+var activeDownloads = struct {
+	sync.Mutex
+	count map[string]int
+}{count: map[string]int{}}
+
+// downloadProgress tracks a single download in the download gauges.
+type downloadProgress struct {
+	image       string
+	total       int64
+	transferred int64
+}
+
+func startDownloadProgress(image string) *downloadProgress {
+	activeDownloads.Lock()
+	defer activeDownloads.Unlock()
+	activeDownloads.count[image]++
+	downloadsActive.WithLabelValues(image).Inc()
+	return &downloadProgress{image: image}
+}
+
+// setTotal records the size of the response from its Content-Length.
+func (p *downloadProgress) setTotal(header http.Header) {
+	total, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	if err != nil || total <= 0 {
+		return
+	}
+	activeDownloads.Lock()
+	defer activeDownloads.Unlock()
+	downloadTotalBytes.WithLabelValues(p.image).Add(float64(total - p.total))
+	p.total = total
+}
+
+func (p *downloadProgress) add(n int64) {
+	if n <= 0 {
+		return
+	}
+	activeDownloads.Lock()
+	defer activeDownloads.Unlock()
+	p.transferred += n
+	downloadTransferredBytes.WithLabelValues(p.image).Add(float64(n))
+}
+
+// finish removes the download from the gauges.
+func (p *downloadProgress) finish() {
+	activeDownloads.Lock()
+	defer activeDownloads.Unlock()
+	activeDownloads.count[p.image]--
+	if activeDownloads.count[p.image] > 0 {
+		downloadsActive.WithLabelValues(p.image).Dec()
+		downloadTotalBytes.WithLabelValues(p.image).Sub(float64(p.total))
+		downloadTransferredBytes.WithLabelValues(p.image).Sub(float64(p.transferred))
+		return
+	}
+	delete(activeDownloads.count, p.image)
+	downloadsActive.DeleteLabelValues(p.image)
+	downloadTotalBytes.DeleteLabelValues(p.image)
+	downloadTransferredBytes.DeleteLabelValues(p.image)
+}
@@ -0,0 +1,134 @@
+package imagehandler
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ParseTrustedProxies parses a comma-separated list of IP addresses and CIDR
+// ranges of reverse proxies whose X-Forwarded-* headers are believed.
+func ParseTrustedProxies(value string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy address %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy range %q: %w", entry, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func (f *imageFileSystem) isTrustedProxy(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := HostIP(strings.TrimSpace(host))
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range f.trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr returns the address of the client that made a request. Behind
+// trusted proxies this is the last address in X-Forwarded-For that is not
+// itself a trusted proxy, since anything before it could be forged.
+func (f *imageFileSystem) clientAddr(r *http.Request) string {
+	if !f.isTrustedProxy(r.RemoteAddr) {
+		return r.RemoteAddr
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if addr != "" && !f.isTrustedProxy(addr) {
+			return addr
+		}
+	}
+	return r.RemoteAddr
+}
+
+// observeForwardedURL records the URL at which a trusted proxy exposes the
+// image server, from the X-Forwarded-Proto and X-Forwarded-Host headers of a
+// request, if forwarded URLs are used. Images registered from then on are
+// given URLs under it, and urlChanged is called so that those registered
+// already are registered again.
+func (f *imageFileSystem) observeForwardedURL(r *http.Request) {
+	if !f.useForwardedURL || !f.isTrustedProxy(r.RemoteAddr) {
+		return
+	}
+	host := firstHeaderValue(r, "X-Forwarded-Host")
+	if host == "" {
+		return
+	}
+	proto := firstHeaderValue(r, "X-Forwarded-Proto")
+	if proto == "" {
+		proto = "http"
+	}
+	if proto != "http" && proto != "https" {
+		return
+	}
+	u, err := url.Parse(proto + "://" + host)
+	if err != nil || u.Host != host || u.User != nil || u.Path != "" || u.RawQuery != "" {
+		return
+	}
+
+	f.mu.Lock()
+	if f.forwardedURL == u.String() {
+		f.mu.Unlock()
+		return
+	}
+	f.log.Info("images are exposed through a reverse proxy", "url", u.String())
+	f.forwardedURL = u.String()
+	externalURL := f.externalURL
+	f.mu.Unlock()
+
+	if f.urlChanged != nil && externalURL == "" {
+		f.urlChanged()
+	}
+}
+
+func firstHeaderValue(r *http.Request, key string) string {
+	return strings.TrimSpace(strings.SplitN(r.Header.Get(key), ",", 2)[0])
+}
+
+// publicBaseURL returns the URL prefix clients reach the image server at:
+// the configured external URL if there is one, otherwise the URL observed
+// through a trusted reverse proxy, falling back to the base URL.
+func (f *imageFileSystem) publicBaseURL() (*url.URL, error) {
+	f.mu.RLock()
+	base := f.baseURL
+	if f.forwardedURL != "" {
+		base = f.forwardedURL
+	}
+	if f.externalURL != "" {
+		base = f.externalURL
+	}
+	f.mu.RUnlock()
+	return ParseBaseURL(base)
+}
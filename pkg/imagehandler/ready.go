@@ -0,0 +1,44 @@
+package imagehandler
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// CheckReady verifies that images can be served: each base ISO must be a
+// readable ISO9660 image with an ignition embed area, or the embed area of
+// the embed strategy for other ISOs, and the cache
+// directory, if any, must be writable. It is suitable as a readyz check.
+// Missing base ISOs are reported with ErrBaseISOUnavailable.
+func (f *imageFileSystem) CheckReady(ctx context.Context) error {
+	if missing := f.checkMissingBaseImages(); len(missing) > 0 {
+		return fmt.Errorf("%w: %s", ErrBaseISOUnavailable, strings.Join(missing, ", "))
+	}
+	for _, isoPath := range f.baseImages() {
+		if err := f.usableBaseImage(isoPath); err != nil {
+			return err
+		}
+	}
+
+	if f.cacheDir == "" {
+		return nil
+	}
+	// Leftovers are removed on startup along with those of interrupted
+	// generations.
+	probe, err := os.CreateTemp(f.cacheDir, "readyz.tmp-*")
+	if err != nil {
+		return fmt.Errorf("cache directory is not writable: %w", err)
+	}
+	name := probe.Name()
+	_, err = probe.Write([]byte("ok"))
+	if closeErr := probe.Close(); err == nil {
+		err = closeErr
+	}
+	os.Remove(name)
+	if err != nil {
+		return fmt.Errorf("cache directory is not writable: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package imagehandler
+
+// Settings are the options of an image server that can be changed while it
+// is running, with the same meaning as in Options.
+type Settings struct {
+	BaseURL                  string
+	ExternalURL              string
+	ArchIsoFiles             map[string]string
+	NamedIsoFiles            map[string]string
+	MaxConcurrentGenerations int
+	MemoryBudget             int64
+}
+
+// Reconfigurable is implemented by image servers whose Settings can be
+// changed while they are running.
+type Reconfigurable interface {
+	Reconfigure(settings Settings)
+}
+
+var _ Reconfigurable = &imageFileSystem{}
+
+// Reconfigure applies new settings. Registered images keep their generated
+// content; the URLs returned when they are next registered reflect the new
+// base URLs, and images whose base ISO changed are generated again then.
+func (f *imageFileSystem) Reconfigure(settings Settings) {
+	f.workers.Resize(settings.MaxConcurrentGenerations)
+	f.buffers.SetBudget(settings.MemoryBudget)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.baseURL = settings.BaseURL
+	f.externalURL = settings.ExternalURL
+	f.archIsoFiles = settings.ArchIsoFiles
+	f.namedIsoFiles = settings.NamedIsoFiles
+	f.log.Info("reconfigured", "baseURL", f.baseURL, "externalURL", f.externalURL,
+		"maxConcurrentGenerations", settings.MaxConcurrentGenerations, "memoryBudget", settings.MemoryBudget)
+}
@@ -0,0 +1,245 @@
+package imagehandler
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// remoteRequestTimeout bounds each call to a remote image server.
+const remoteRequestTimeout = 30 * time.Second
+
+// RemoteOptions configures an ImageFileServer that delegates to a remote
+// image server.
+type RemoteOptions struct {
+	// URL is the base URL of the remote server's registration API.
+	URL string
+	// Token, if set, is sent as a bearer token.
+	Token string
+	// TLSConfig is used for HTTPS connections to the server.
+	TLSConfig *tls.Config
+}
+
+// remoteImageServer is an ImageFileServer that registers images with an
+// external image server over its registration API and publishes the URLs it
+// returns. It serves nothing itself.
+type remoteImageServer struct {
+	log    logr.Logger
+	base   *url.URL
+	token  string
+	client *http.Client
+
+	mu       sync.Mutex
+	statuses map[string]ImageStatus
+}
+
+var _ ImageFileServer = &remoteImageServer{}
+
+// NewRemoteImageServer returns an ImageFileServer that delegates to the
+// image server at opts.URL.
+func NewRemoteImageServer(logger logr.Logger, opts RemoteOptions) (ImageFileServer, error) {
+	base, err := ParseBaseURL(opts.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image server URL: %w", err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = opts.TLSConfig
+	return &remoteImageServer{
+		log:      logger,
+		base:     base,
+		token:    opts.Token,
+		client:   &http.Client{Transport: transport, Timeout: remoteRequestTimeout},
+		statuses: map[string]ImageStatus{},
+	}, nil
+}
+
+// do sends a request to the remote server and decodes its JSON response.
+func (s *remoteImageServer) do(ctx context.Context, method, apiPath string, body interface{}, result interface{}) error {
+	u := *s.base
+	u.Path = path.Join("/", s.base.Path, apiPath)
+
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrImageNotFound
+	}
+	if resp.StatusCode == http.StatusUnprocessableEntity {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%w: %s", ErrUnknownBaseImage, strings.TrimSpace(string(message)))
+	}
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%w: %s", ErrBaseISOUnavailable,
+			strings.TrimPrefix(strings.TrimSpace(string(message)), ErrBaseISOUnavailable.Error()+": "))
+	}
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("image server returned %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func (s *remoteImageServer) imagePath(name string) string {
+	return apiImagesPath + "/" + url.PathEscape(name)
+}
+
+func (s *remoteImageServer) record(status ImageStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statuses[status.Name] = status
+}
+
+func (s *remoteImageServer) ServeImage(ctx context.Context, spec ImageSpec) (ImageInfo, error) {
+	return s.register(ctx, spec, false)
+}
+
+func (s *remoteImageServer) ReplaceImage(ctx context.Context, spec ImageSpec) (ImageInfo, error) {
+	return s.register(ctx, spec, true)
+}
+
+func (s *remoteImageServer) register(ctx context.Context, spec ImageSpec, replace bool) (ImageInfo, error) {
+	req := RegistrationRequest{
+		Architecture: spec.Base.Arch,
+		BaseImage:    spec.Base.Name,
+		Ignition:     spec.Ignition,
+		KernelArgs:   spec.KernelArgs,
+		ConfigDrive:  spec.ConfigDrive,
+		Replace:      replace,
+	}
+	if !spec.Boot.IsZero() {
+		req.Boot = &spec.Boot
+	}
+	status := ImageStatus{}
+	err := s.do(ctx, http.MethodPut, s.imagePath(spec.Name), req, &status)
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	if status.URL == "" {
+		return ImageInfo{}, errors.New("image server returned no URL")
+	}
+	status.Name = spec.Name
+	s.record(status)
+	return status.imageInfo(), nil
+}
+
+func (s *remoteImageServer) GetImage(ctx context.Context, name string) (ImageInfo, error) {
+	status := ImageStatus{}
+	if err := s.do(ctx, http.MethodGet, s.imagePath(name), nil, &status); err != nil {
+		return ImageInfo{}, err
+	}
+	status.Name = name
+	s.record(status)
+	return status.imageInfo(), nil
+}
+
+func (s *remoteImageServer) RemoveImage(ctx context.Context, name string) error {
+	status := ImageStatus{}
+	err := s.do(ctx, http.MethodDelete, s.imagePath(name), nil, &status)
+	s.mu.Lock()
+	delete(s.statuses, name)
+	s.mu.Unlock()
+	return err
+}
+
+func (s *remoteImageServer) ImageReady(ctx context.Context, name string) (bool, error) {
+	status := ImageStatus{}
+	if err := s.do(ctx, http.MethodGet, s.imagePath(name), nil, &status); err != nil {
+		return false, err
+	}
+	status.Name = name
+	s.record(status)
+	if status.Error != "" {
+		return true, errors.New(status.Error)
+	}
+	return status.Ready, nil
+}
+
+func (s *remoteImageServer) ImageChecksum(name string) (string, ChecksumType) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := s.statuses[name]
+	if status.Checksum == "" {
+		return "", ChecksumNone
+	}
+	return status.Checksum, status.ChecksumType
+}
+
+func (s *remoteImageServer) ImageURLExpiry(name string) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if expiry := s.statuses[name].URLExpiry; expiry != nil {
+		return *expiry
+	}
+	return time.Time{}
+}
+
+func (s *remoteImageServer) health(ctx context.Context) (HealthResponse, error) {
+	health := HealthResponse{}
+	if err := s.do(ctx, http.MethodGet, apiHealthPath, nil, &health); err != nil {
+		return health, err
+	}
+	if health.Error != "" {
+		return health, errors.New(health.Error)
+	}
+	return health, nil
+}
+
+func (s *remoteImageServer) BaseImageVersion(ctx context.Context) (string, error) {
+	health, err := s.health(ctx)
+	return health.BaseImageVersion, err
+}
+
+func (s *remoteImageServer) CheckReady(ctx context.Context) error {
+	if _, err := s.health(ctx); err != nil {
+		return fmt.Errorf("image server is not ready: %w", err)
+	}
+	return nil
+}
+
+func (s *remoteImageServer) ListImages(ctx context.Context) ([]RegisteredImage, error) {
+	images := []RegisteredImage{}
+	if err := s.do(ctx, http.MethodGet, apiImagesPath, nil, &images); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+// Downloads never delivers anything, as downloads happen on the remote
+// server.
+func (s *remoteImageServer) Downloads() <-chan Download { return nil }
+
+func (s *remoteImageServer) LastDownload(name string) (Download, bool) { return Download{}, false }
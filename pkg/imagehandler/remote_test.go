@@ -0,0 +1,132 @@
+package imagehandler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+func TestRemoteImageServer(t *testing.T) {
+	registered := map[string]RegistrationRequest{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3cret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/api/v1/images/host-xyz-45.iso":
+			req := RegistrationRequest{}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			registered["host-xyz-45.iso"] = req
+			_ = json.NewEncoder(w).Encode(ImageStatus{URL: "http://images.example.com/host-xyz-45.iso"})
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v1/images/host-xyz-45.iso":
+			_ = json.NewEncoder(w).Encode(ImageStatus{Ready: true, Checksum: "abc", ChecksumType: ChecksumSHA256})
+		case r.URL.Path == "/api/v1/health":
+			_ = json.NewEncoder(w).Encode(HealthResponse{BaseImageVersion: "0123abcd"})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	server, err := NewRemoteImageServer(zap.New(zap.UseDevMode(true)), RemoteOptions{URL: ts.URL, Token: "s3cret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	info, err := server.ServeImage(ctx, ImageSpec{Name: "host-xyz-45.iso", Base: BaseImage{Arch: "x86_64"}, Ignition: []byte("asietonarst")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.URL != "http://images.example.com/host-xyz-45.iso" || info.Format != ImageFormatISO {
+		t.Errorf("unexpected image info %+v", info)
+	}
+	if req := registered["host-xyz-45.iso"]; string(req.Ignition) != "asietonarst" || req.Architecture != "x86_64" {
+		t.Errorf("unexpected registration %+v", req)
+	}
+
+	if ready, err := server.ImageReady(ctx, "host-xyz-45.iso"); !ready || err != nil {
+		t.Errorf("expected image to be ready, got %v, %v", ready, err)
+	}
+	if checksum, checksumType := server.ImageChecksum("host-xyz-45.iso"); checksum != "abc" || checksumType != ChecksumSHA256 {
+		t.Errorf("unexpected checksum %s %s", checksumType, checksum)
+	}
+	if version, err := server.BaseImageVersion(ctx); version != "0123abcd" || err != nil {
+		t.Errorf("unexpected base image version %q, %v", version, err)
+	}
+	if _, err := server.ImageReady(ctx, "other.iso"); err == nil {
+		t.Error("expected an unknown image to be reported")
+	}
+}
+
+func TestRemoteAPIHandler(t *testing.T) {
+	imageServer := newTestImageServer(t, Options{
+		IsoFile:      "default.iso",
+		BaseURL:      "http://localhost:8080",
+		ChecksumType: ChecksumSHA256,
+	},
+		&imageFile{
+			name:            "host-xyz-45.iso",
+			ignitionContent: []byte("asietonarst"),
+			generated:       true,
+			checksum:        "abc",
+		},
+	)
+	ts := httptest.NewServer(NewAPIHandler(imageServer, "s3cret"))
+	defer ts.Close()
+	ctx := context.Background()
+
+	unauthorized, err := NewRemoteImageServer(zap.New(zap.UseDevMode(true)), RemoteOptions{URL: ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unauthorized.ImageReady(ctx, "host-xyz-45.iso"); err == nil {
+		t.Error("expected a request without the token to be rejected")
+	}
+
+	server, err := NewRemoteImageServer(zap.New(zap.UseDevMode(true)), RemoteOptions{URL: ts.URL, Token: "s3cret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ready, err := server.ImageReady(ctx, "host-xyz-45.iso"); !ready || err != nil {
+		t.Errorf("expected image to be ready, got %v, %v", ready, err)
+	}
+	if checksum, checksumType := server.ImageChecksum("host-xyz-45.iso"); checksum != "abc" || checksumType != ChecksumSHA256 {
+		t.Errorf("unexpected checksum %s %s", checksumType, checksum)
+	}
+	if _, err := server.ImageReady(ctx, "other.iso"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected an unknown image to be reported, got %v", err)
+	}
+	if _, err := server.ServeImage(ctx, ImageSpec{Name: "other.iso", Base: BaseImage{Name: "missing"}, Ignition: []byte("{}")}); !errors.Is(err, ErrUnknownBaseImage) {
+		t.Errorf("expected an unknown base image error, got %v", err)
+	}
+	if images, err := server.ListImages(ctx); err != nil || len(images) != 1 || images[0].Name != "host-xyz-45.iso" {
+		t.Errorf("unexpected images listed: %+v, %v", images, err)
+	}
+	if info, err := server.GetImage(ctx, "host-xyz-45.iso"); err != nil || info.URL == "" || info.Checksum != "abc" {
+		t.Errorf("unexpected image info %+v, %v", info, err)
+	}
+	if _, err := server.ReplaceImage(ctx, ImageSpec{Name: "other.iso", Ignition: []byte("{}")}); !errors.Is(err, ErrImageNotFound) {
+		t.Errorf("expected replacing an unknown image to fail, got %v", err)
+	}
+
+	if err := server.RemoveImage(ctx, "host-xyz-45.iso"); err != nil {
+		t.Errorf("unexpected error removing image: %v", err)
+	}
+	if _, err := imageServer.ImageReady(ctx, "host-xyz-45.iso"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected the image to be unregistered, got %v", err)
+	}
+	if err := server.RemoveImage(ctx, "host-xyz-45.iso"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected removing an unknown image to fail, got %v", err)
+	}
+}
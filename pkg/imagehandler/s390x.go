@@ -0,0 +1,105 @@
+package imagehandler
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// s390xArch is the architecture of IBM Z hosts, which boot from an LPAR's
+// HMC or a z/VM guest's reader rather than with iPXE.
+const s390xArch = "s390x"
+
+// The s390x boot files of an image, served alongside its kernel and initrd.
+const (
+	// artifactParmfile holds the kernel arguments of the image.
+	artifactParmfile bootArtifact = "parmfile"
+	// artifactIns lists the files an LPAR loads and their load addresses.
+	artifactIns bootArtifact = "generic.ins"
+	// artifactAddrSize holds the load address and size of the initrd.
+	artifactAddrSize bootArtifact = "initrd.addrsize"
+)
+
+// The load addresses of the s390x boot files, as in the generic.ins of the
+// RHCOS live ISO.
+const (
+	s390xKernelAddr   = 0x00000000
+	s390xInitrdAddr   = 0x02000000
+	s390xParmfileAddr = 0x00010480
+	s390xAddrSizeAddr = 0x00010408
+)
+
+// A parmfile is read in lines of at most parmfileLineLength characters, and
+// holds at most parmfileMaxSize bytes of kernel arguments.
+const (
+	parmfileLineLength = 80
+	parmfileMaxSize    = 896
+)
+
+// s390x reports whether an image is for s390x hosts.
+func (im *imageFile) s390x() bool {
+	return im.base.Arch == s390xArch
+}
+
+// parmfile returns the kernel arguments of an s390x image, wrapped into
+// lines of a parmfile.
+func parmfile(im *imageFile) ([]byte, error) {
+	args, err := networkBootKernelArgs(im)
+	if err != nil {
+		return nil, err
+	}
+	lines := []string{}
+	line := ""
+	for _, arg := range args {
+		if len(arg) > parmfileLineLength {
+			return nil, fmt.Errorf("kernel argument %q is longer than a parmfile line", arg)
+		}
+		if line != "" && len(line)+1+len(arg) > parmfileLineLength {
+			lines = append(lines, line)
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += arg
+	}
+	lines = append(lines, line)
+	content := strings.Join(lines, "\n") + "\n"
+	if len(content) > parmfileMaxSize {
+		return nil, fmt.Errorf("kernel arguments length (%d) exceeds parmfile size (%d)", len(content), parmfileMaxSize)
+	}
+	return []byte(content), nil
+}
+
+// insFile returns the .ins file of an s390x image, listing its boot files
+// by their names alongside it.
+func insFile() []byte {
+	return []byte(fmt.Sprintf("* image customization controller\n%s 0x%08x\n%s 0x%08x\n%s 0x%08x\n%s 0x%08x\n",
+		artifactKernel, s390xKernelAddr,
+		artifactInitrd, s390xInitrdAddr,
+		artifactParmfile, s390xParmfileAddr,
+		artifactAddrSize, s390xAddrSizeAddr))
+}
+
+// initrdAddrSize returns the load address and size of the initrd of an
+// s390x image, as big-endian 64-bit integers. The size includes the
+// ignition content appended to the initramfs of the base ISO.
+func (f *imageFileSystem) initrdAddrSize(im *imageFile) ([]byte, error) {
+	f.mu.RLock()
+	ignitionContent := im.ignitionContent
+	f.mu.RUnlock()
+	reader, err := f.openBootArtifact(im, ignitionContent, artifactInitrd)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	size, err := reader.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	content := make([]byte, 16)
+	binary.BigEndian.PutUint64(content[:8], s390xInitrdAddr)
+	binary.BigEndian.PutUint64(content[8:], uint64(size))
+	return content, nil
+}
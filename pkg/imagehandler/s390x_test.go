@@ -0,0 +1,78 @@
+package imagehandler
+
+import (
+	"context"
+	"encoding/binary"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// buildS390xLiveISO creates a minimal ISO laid out like the s390x RHCOS
+// live ISO, which has no EFI boot loader and its kernel arguments embed
+// area in the parmfile it boots from as a CD.
+func buildS390xLiveISO(t *testing.T) string {
+	t.Helper()
+	kargs := "coreos.liveiso=rhcos ignition.firstboot"
+	area := kargs + strings.Repeat("#", 64-len(kargs))
+	return createISO(t, map[string]string{
+		"images/ignition.img":       strings.Repeat("\x00", 64),
+		"images/pxeboot/vmlinuz":    "kernel",
+		"images/pxeboot/initrd.img": "initrd",
+		"images/pxeboot/rootfs.img": "rootfs",
+		"images/cdboot.prm":         area + "\n",
+	}, map[string]interface{}{
+		"default": kargs,
+		"files":   []map[string]interface{}{{"path": "images/cdboot.prm", "offset": 0}},
+		"size":    64,
+	})
+}
+
+func TestS390x(t *testing.T) {
+	imageServer := newTestImageServer(t, Options{
+		IsoFile: buildS390xLiveISO(t),
+		BaseURL: "http://localhost:8080",
+	})
+	info, err := imageServer.ServeImage(context.Background(), ImageSpec{
+		Name:       "host-xyz-45.iso",
+		Base:       BaseImage{Arch: s390xArch},
+		Ignition:   []byte(`{}`),
+		KernelArgs: []string{"rd.neednet=1", "ip=" + strings.Repeat("1", 70)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-info.Done
+	if info.IPXEURL != "" || !strings.HasSuffix(info.InsURL, "/generic.ins") {
+		t.Fatalf("expected an .ins file instead of an iPXE script, got %+v", info)
+	}
+
+	get := func(name string) (int, string) {
+		return getURL(t, imageServer, strings.TrimSuffix(info.InsURL, "generic.ins")+name)
+	}
+	status, ins := get("generic.ins")
+	if expected := "kernel 0x00000000\ninitrd 0x02000000\nparmfile 0x00010480\ninitrd.addrsize 0x00010408\n"; status != http.StatusOK || !strings.HasSuffix(ins, expected) {
+		t.Errorf("unexpected .ins file (%d) %q", status, ins)
+	}
+	status, parm := get("parmfile")
+	if expected := "ignition.firstboot rd.neednet=1\nip=" + strings.Repeat("1", 70) + "\n"; status != http.StatusOK || parm != expected {
+		t.Errorf("unexpected parmfile (%d) %q", status, parm)
+	}
+	status, initrd := get("initrd")
+	if status != http.StatusOK {
+		t.Fatalf("unexpected initrd status %d", status)
+	}
+	status, addrSize := get("initrd.addrsize")
+	if status != http.StatusOK || len(addrSize) != 16 ||
+		binary.BigEndian.Uint64([]byte(addrSize[:8])) != s390xInitrdAddr ||
+		binary.BigEndian.Uint64([]byte(addrSize[8:])) != uint64(len(initrd)) {
+		t.Errorf("unexpected initrd.addrsize (%d) %x", status, addrSize)
+	}
+	if status, _ := getURL(t, imageServer, strings.Replace(info.InsURL, "/images/", "/ipxe/", 1)); status != http.StatusNotFound {
+		t.Errorf("expected no iPXE script for an s390x image, got %d", status)
+	}
+
+	if _, err := parmfile(&imageFile{isoFile: imageServer.isoFile, kernelArgs: []string{strings.Repeat("x", 81)}}); err == nil {
+		t.Error("expected a kernel argument longer than a parmfile line to be refused")
+	}
+}
@@ -0,0 +1,55 @@
+package imagehandler
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// maxPathSegments is the deepest path we serve: base image revision, content
+// revision, token and name.
+const maxPathSegments = 4
+
+var (
+	errInvalidPath = errors.New("invalid image path")
+	errTooDeep     = fmt.Errorf("%w: too many segments", errInvalidPath)
+)
+
+// sanitizePath checks that a request path is already in canonical form and
+// could only refer to one of our images. Rather than cleaning up hostile
+// input (which risks mapping it to something it wasn't meant to reach), any
+// path that is not canonical is rejected.
+func sanitizePath(name string) (string, error) {
+	if !strings.HasPrefix(name, "/") || path.Clean(name) != name {
+		return "", errInvalidPath
+	}
+	// encoded or alternative separators, and NUL bytes
+	if strings.ContainsAny(name, "%\\\x00") {
+		return "", errInvalidPath
+	}
+	segments := strings.Split(name[1:], "/")
+	for _, segment := range segments {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", errInvalidPath
+		}
+	}
+	if len(segments) > maxPathSegments {
+		return name, errTooDeep
+	}
+	return name, nil
+}
+
+// ParsePathPrefix validates a directory prefix for image URLs, returning it
+// in the form "/a/b", or "" for none.
+func ParsePathPrefix(value string) (string, error) {
+	value = strings.Trim(value, "/")
+	if value == "" {
+		return "", nil
+	}
+	prefix, err := sanitizePath("/" + value)
+	if err != nil && !errors.Is(err, errTooDeep) {
+		return "", fmt.Errorf("invalid path prefix %q", value)
+	}
+	return prefix, nil
+}
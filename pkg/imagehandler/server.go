@@ -0,0 +1,153 @@
+package imagehandler
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/go-logr/logr"
+)
+
+// ServeHTTP sends images that have been generated into the cache with
+// http.ServeContent over the *os.File itself, so that the kernel can copy
+// it to the socket (sendfile) instead of every byte passing through Go
+// buffers. Encrypted cached images are decrypted on the way out instead.
+// Everything else is served from the virtual filesystem, which stops reading
+// once the request is aborted. Downloads that pass through Go buffers wait
+// for room in the memory budget.
+func (f *imageFileSystem) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.ContainsAny(r.URL.RawPath, "%") {
+		http.NotFound(w, r)
+		return
+	}
+	if f.pathPrefix != "" {
+		if !strings.HasPrefix(r.URL.Path, f.pathPrefix+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = strings.TrimPrefix(r.URL.Path, f.pathPrefix)
+		r2.URL.RawPath = ""
+		r = r2
+	}
+
+	name := r.URL.Path
+	if artifact, imagePath, ok := parseBootArtifactPath(name); ok {
+		f.serveBootArtifact(w, r, artifact, imagePath)
+		return
+	}
+	if revision, ok := parseRootfsPath(name); ok {
+		f.serveRootfs(w, r, revision)
+		return
+	}
+	if name != "/" {
+		if _, err := sanitizePath(name); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	log := f.log.WithValues("requestID", newRequestID())
+	log.V(1).Info("request", "method", r.Method, "path", redactPath(name), "remoteAddr", f.clientAddr(r))
+	f.observeForwardedURL(r)
+
+	cw := &countingWriter{ResponseWriter: w}
+	if name != "/" {
+		if im, err := f.lookupImage(name); err == nil {
+			if f.serveBaseImageUnavailable(w, im) {
+				return
+			}
+			// rather than guessed by the file server from the name
+			w.Header().Set("Content-Type", im.contentType())
+			w.Header().Set("Content-Disposition", im.contentDisposition())
+			// conditional requests are answered by http.ServeContent
+			w.Header().Set("ETag", im.etag())
+			if r.Method == http.MethodHead && f.serveHead(w, r, im) {
+				return
+			}
+			if r.Method == http.MethodGet {
+				cw.progress = startDownloadProgress(im.name)
+				defer cw.progress.finish()
+			}
+		}
+	}
+	if file, im := f.openCached(log, name); file != nil {
+		defer file.Close()
+		cacheHits.Inc()
+		if _, sendfile := file.(*os.File); !sendfile {
+			size, err := f.buffers.reserve(r.Context(), downloadBufferSize)
+			if err != nil {
+				return
+			}
+			defer f.buffers.release(size)
+		}
+		http.ServeContent(cw, r, im.servedName(), im.ModTime(), file)
+	} else {
+		if name != "/" {
+			size, err := f.buffers.reserve(r.Context(), downloadBufferSize)
+			if err != nil {
+				return
+			}
+			defer f.buffers.release(size)
+		}
+		http.FileServer(requestFileSystem{f: f, ctx: r.Context()}).ServeHTTP(cw, r)
+	}
+
+	if r.Method != http.MethodGet || name == "/" || !cw.sentContent() {
+		return
+	}
+	im, err := f.lookupImage(name)
+	if err != nil {
+		return
+	}
+	complete := cw.complete(im.size)
+	if f.oneTimeTokens && complete {
+		f.markDownloaded(im)
+	}
+	f.recordDownload(log, im, r, cw.written, complete)
+}
+
+// serveHead answers a HEAD request for an image from the size it was
+// registered with, without opening it, so that clients such as BMCs
+// checking the size before a download need not wait for the image to be
+// generated. The size is exact, since content is only ever written over
+// padded areas of the base ISO. It returns false for an image whose
+// generation failed, for the failure to be reported as for a download.
+func (f *imageFileSystem) serveHead(w http.ResponseWriter, r *http.Request, im *imageFile) bool {
+	f.mu.RLock()
+	size, generationErr := im.size, im.generationErr
+	f.mu.RUnlock()
+	if generationErr != nil {
+		return false
+	}
+	// only seeked, to find the size
+	content := io.NewSectionReader(strings.NewReader(""), 0, size)
+	http.ServeContent(w, r, im.servedName(), im.ModTime(), content)
+	return true
+}
+
+func newRequestID() string {
+	return newToken()[:16]
+}
+
+// openCached opens the cached copy of the image at name, if there is one.
+func (f *imageFileSystem) openCached(log logr.Logger, name string) (io.ReadSeekCloser, *imageFile) {
+	im, err := f.lookupImage(name)
+	if err != nil {
+		return nil, nil
+	}
+
+	f.mu.RLock()
+	cachePath := im.cachePath
+	f.mu.RUnlock()
+	if cachePath == "" {
+		return nil, nil
+	}
+
+	file, err := f.openCachedPath(cachePath)
+	if err != nil {
+		log.Error(err, "opening cached image", "image", im.name, "path", cachePath)
+		return nil, nil
+	}
+	return file, im
+}
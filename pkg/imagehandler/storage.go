@@ -0,0 +1,94 @@
+package imagehandler
+
+import (
+	"context"
+	"io"
+	"path"
+	"time"
+
+	"github.com/asalkeld/image-customization-controller/pkg/tracing"
+)
+
+// Storage is a backend generated images are published to, so that hosts
+// download them from there rather than from the image server.
+type Storage interface {
+	// Upload stores size bytes read from content under key.
+	Upload(ctx context.Context, key string, content io.Reader, size int64) error
+	// Delete removes the object stored under key.
+	Delete(ctx context.Context, key string) error
+	// URL returns a URL to download the object stored under key, and the
+	// time it stops working, which is zero if it does not expire.
+	URL(key string) (string, time.Time, error)
+}
+
+// storageKey is the key an image is stored under. It ends in the served
+// name, since some BMCs expect the URL to end in .iso.
+func storageKey(im *imageFile) string {
+	return path.Join(im.digest+"-"+im.revision, im.servedName())
+}
+
+// uploadImage publishes a generated image to the storage backend.
+func (f *imageFileSystem) uploadImage(ctx context.Context, im *imageFile, cachePath string) (string, error) {
+	key := storageKey(im)
+	ctx, span := tracing.Start(ctx, "UploadImage", "image", im.name, "key", key)
+
+	var reader io.ReadCloser
+	var err error
+	if cachePath != "" {
+		reader, err = f.openCachedPath(cachePath)
+	} else {
+		reader, err = newImageReader(im)
+	}
+	if err == nil {
+		defer reader.Close()
+		err = f.storage.Upload(ctx, key, &contextReader{ctx: ctx, r: reader}, im.size)
+	}
+	tracing.End(span, err)
+	if err != nil {
+		return "", err
+	}
+	f.cacheLog.Info("uploaded image to storage", "image", im.name, "key", key)
+	return key, nil
+}
+
+// storedImageURLLocked returns the storage URL of an uploaded image. The URL
+// is reused until half its lifetime has passed, or indefinitely if it does
+// not expire, so that the image's URL only changes occasionally. Must be called with the lock held.
+func (f *imageFileSystem) storedImageURLLocked(im *imageFile) (string, error) {
+	now := time.Now()
+	if im.storageURL != "" && (im.storageURLRefresh.IsZero() || now.Before(im.storageURLRefresh)) {
+		return im.storageURL, nil
+	}
+	u, expiry, err := f.storage.URL(im.storageKey)
+	if err != nil {
+		return "", err
+	}
+	im.storageURL = u
+	im.storageURLRefresh = time.Time{}
+	if !expiry.IsZero() {
+		im.storageURLRefresh = now.Add(expiry.Sub(now) / 2)
+	}
+	return u, nil
+}
+
+// storageDeleteTimeout bounds the deletion of an image from the storage
+// backend, which nothing waits for.
+const storageDeleteTimeout = time.Minute
+
+// removeStoredImage deletes an image's object from the storage backend in
+// the background. Must be called with the lock held.
+func (f *imageFileSystem) removeStoredImage(im *imageFile) {
+	if im.storageKey == "" {
+		return
+	}
+	key := im.storageKey
+	im.storageKey = ""
+	im.storageURL = ""
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), storageDeleteTimeout)
+		defer cancel()
+		if err := f.storage.Delete(ctx, key); err != nil {
+			f.cacheLog.Error(err, "removing image from storage", "key", key)
+		}
+	}()
+}
@@ -0,0 +1,244 @@
+package imagehandler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openshift/assisted-image-service/pkg/isoeditor"
+	"github.com/openshift/assisted-image-service/pkg/overlay"
+)
+
+// ignitionImagePath is the embed area in the RHCOS live ISO.
+const ignitionImagePath = "/images/ignition.img"
+
+// kargsInfoPath describes where the RHCOS live ISO's boot configuration
+// files reserve space for the kernel arguments.
+const kargsInfoPath = "/coreos/kargs.json"
+
+// kargsEmbedInfo is the content of kargsInfoPath. Each file has an area of
+// size bytes at offset, holding the default arguments padded with '#'.
+type kargsEmbedInfo struct {
+	Default string `json:"default"`
+	Files   []struct {
+		Path   string `json:"path"`
+		Offset int64  `json:"offset"`
+	} `json:"files"`
+	Size int64 `json:"size"`
+}
+
+// imageReader streams the base ISO with the ignition content overlaid on its
+// embed area. Unlike isoeditor.NewRHCOSStreamReader it owns the ISO file
+// handle, so it can be closed.
+type imageReader struct {
+	io.ReadSeeker
+	isoFile *os.File
+}
+
+func (r *imageReader) Close() error {
+	return r.isoFile.Close()
+}
+
+// isoInfo is the result of analysing a base ISO, which is the same for every
+// image built from it.
+type isoInfo struct {
+	size       int64
+	modTime    time.Time
+	areaStart  int64
+	areaLength int64
+
+	// defaultKargs are the kernel arguments of the ISO, and kargsOffsets
+	// the locations in the ISO of the kargsLength byte areas holding
+	// them, as described by kargsInfo. kargsErr records why the ISO has no
+	// such areas, if it hasn't.
+	defaultKargs string
+	kargsOffsets []int64
+	kargsLength  int64
+	kargsInfo    isoFileArea
+	kargsErr     error
+
+	// volumeLabel is the volume ID of the ISO, stored in volumeFields.
+	// volumeErr records why they could not be found.
+	volumeLabel  string
+	volumeFields []volumeIDField
+	volumeErr    error
+	// bootFiles are the boot configuration files of the ISO.
+	bootFiles []isoFileArea
+	// arch is the architecture the ISO boots on, if known.
+	arch string
+	// hasRootfs is set if the ISO holds its root filesystem, as all but
+	// minimal ISOs do.
+	hasRootfs bool
+}
+
+// isoInfoCache holds the analysis of each base ISO, so that it is parsed
+// once rather than for every image.
+var isoInfoCache = struct {
+	sync.Mutex
+	entries map[string]isoInfo
+}{entries: map[string]isoInfo{}}
+
+// getISOInfo returns the embed area of the base ISO, reusing a previous
+// analysis unless the file has changed since.
+func getISOInfo(isoPath string) (isoInfo, error) {
+	fi, err := os.Stat(isoPath)
+	if err != nil {
+		return isoInfo{}, err
+	}
+
+	isoInfoCache.Lock()
+	defer isoInfoCache.Unlock()
+	if info, ok := isoInfoCache.entries[isoPath]; ok &&
+		info.size == fi.Size() && info.modTime.Equal(fi.ModTime()) {
+		return info, nil
+	}
+
+	areaStart, areaLength, err := isoeditor.GetISOFileInfo(ignitionImagePath, isoPath)
+	if err != nil {
+		return isoInfo{}, err
+	}
+	info := isoInfo{
+		size:       fi.Size(),
+		modTime:    fi.ModTime(),
+		areaStart:  areaStart,
+		areaLength: areaLength,
+	}
+	info.kargsErr = readKargsInfo(isoPath, &info)
+	info.volumeLabel, info.volumeFields, info.volumeErr = readVolumeIDs(isoPath)
+	info.bootFiles = findBootFiles(isoPath)
+	info.arch = isoArchitecture(isoPath)
+	_, _, rootfsErr := isoeditor.GetISOFileInfo(pxeRootfsPath, isoPath)
+	info.hasRootfs = rootfsErr == nil
+	isoInfoCache.entries[isoPath] = info
+	return info, nil
+}
+
+// readKargsInfo finds the kernel arguments embed areas of the base ISO,
+// recording the default arguments, the offsets of the areas in the ISO and
+// their length in info.
+func readKargsInfo(isoPath string, info *isoInfo) error {
+	start, length, err := isoeditor.GetISOFileInfo(kargsInfoPath, isoPath)
+	if err != nil {
+		return err
+	}
+	isoFile, err := os.Open(isoPath)
+	if err != nil {
+		return err
+	}
+	defer isoFile.Close()
+	data := make([]byte, length)
+	if _, err := isoFile.ReadAt(data, start); err != nil {
+		return err
+	}
+	embed := kargsEmbedInfo{}
+	if err := json.Unmarshal(data, &embed); err != nil {
+		return fmt.Errorf("invalid %s: %w", kargsInfoPath, err)
+	}
+
+	offsets := []int64{}
+	for _, file := range embed.Files {
+		fileStart, _, err := isoeditor.GetISOFileInfo("/"+strings.TrimPrefix(file.Path, "/"), isoPath)
+		if err != nil {
+			return err
+		}
+		offsets = append(offsets, fileStart+file.Offset)
+	}
+	info.defaultKargs, info.kargsOffsets, info.kargsLength = embed.Default, offsets, embed.Size
+	info.kargsInfo = isoFileArea{path: kargsInfoPath, start: start, length: length}
+	return nil
+}
+
+// imageOverlays returns the areas of the base ISO that are replaced to embed
+// the ignition content and kernel arguments of an image and apply its boot
+// configuration, verifying that the ISO has areas large enough for them.
+// The kernel arguments are appended to the ISO's defaults; without any, the
+// kernel arguments areas are left alone unless the volume label changes.
+func imageOverlays(im *imageFile) ([]overlay.Overlay, error) {
+	if im.configDrive != nil {
+		return nil, nil
+	}
+	isoPath := im.isoFile
+	if err := im.boot.Validate(); err != nil {
+		return nil, err
+	}
+	info, err := getISOInfo(isoPath)
+	if err != nil && !im.embed.IsZero() {
+		// not an RHCOS live ISO
+		return genericOverlays(im)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info.areaLength < int64(len(im.ignitionContent)) {
+		return nil, fmt.Errorf("%w: ignition length (%d) exceeds embed area size (%d)",
+			ErrIgnitionTooLarge, len(im.ignitionContent), info.areaLength)
+	}
+	overlays := []overlay.Overlay{{
+		Reader: bytes.NewReader(im.ignitionContent),
+		Offset: info.areaStart,
+		Length: int64(len(im.ignitionContent)),
+	}}
+
+	relabel := im.boot.VolumeLabel != "" && info.volumeLabel != "" && im.boot.VolumeLabel != info.volumeLabel
+	var area []byte
+	if len(im.kernelArgs) > 0 || (relabel && info.kargsErr == nil) {
+		if info.kargsErr != nil {
+			return nil, fmt.Errorf("base image %s has no kernel arguments embed area: %w", isoPath, info.kargsErr)
+		}
+		kargs := strings.TrimSpace(info.defaultKargs + " " + strings.Join(im.kernelArgs, " "))
+		if relabel {
+			kargs = strings.ReplaceAll(kargs, info.volumeLabel, im.boot.VolumeLabel)
+		}
+		if int64(len(kargs)) > info.kargsLength {
+			return nil, fmt.Errorf("kernel arguments length (%d) exceeds embed area size (%d)", len(kargs), info.kargsLength)
+		}
+		area = []byte(kargs + strings.Repeat("#", int(info.kargsLength)-len(kargs)))
+	}
+
+	bootOverlays, kargsOffsets, err := bootConfigOverlays(isoPath, info, im.boot, area)
+	if err != nil {
+		return nil, err
+	}
+	overlays = append(overlays, bootOverlays...)
+	if area == nil {
+		return overlays, nil
+	}
+	for _, offset := range kargsOffsets {
+		overlays = append(overlays, overlay.Overlay{
+			Reader: bytes.NewReader(area),
+			Offset: offset,
+			Length: info.kargsLength,
+		})
+	}
+	return overlays, nil
+}
+
+func newImageReader(im *imageFile) (io.ReadSeekCloser, error) {
+	if im.configDrive != nil {
+		return memoryImage{bytes.NewReader(im.configDrive)}, nil
+	}
+	overlays, err := imageOverlays(im)
+	if err != nil {
+		return nil, err
+	}
+
+	isoFile, err := os.Open(im.isoFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var contentReader io.ReadSeeker = isoFile
+	for _, o := range overlays {
+		contentReader, err = overlay.NewOverlayReader(contentReader, o)
+		if err != nil {
+			isoFile.Close()
+			return nil, fmt.Errorf("failed to create overlay reader: %w", err)
+		}
+	}
+	return &imageReader{ReadSeeker: contentReader, isoFile: isoFile}, nil
+}
@@ -0,0 +1,215 @@
+package imagehandler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/openshift/assisted-image-service/pkg/isoeditor"
+)
+
+// buildLiveISO creates a minimal ISO laid out like the RHCOS live ISO, with
+// an ignition embed area and kernel arguments embed areas in its grub and
+// isolinux boot menus.
+func buildLiveISO(t *testing.T) string {
+	t.Helper()
+	kargs := "coreos.liveiso=rhcos ignition.firstboot"
+	area := kargs + strings.Repeat("#", 64-len(kargs))
+	grub := "set default=\"1\"\nset timeout=5\n# the live system\nmenuentry 'RHEL CoreOS (Live)' --class fedora {\n" +
+		"\tlinux /images/pxeboot/vmlinuz " + area + "\n}\n"
+	isolinux := "default vesamenu.c32\ntimeout 600\nlabel linux\n  menu label ^RHEL CoreOS (Live)\n  menu default\n" +
+		"  append initrd=/images/pxeboot/initrd.img " + area + "\nlabel check\n  menu label ^Check\n"
+	files := map[string]string{
+		"images/ignition.img":       strings.Repeat("\x00", 64),
+		"images/pxeboot/vmlinuz":    "kernel",
+		"images/pxeboot/initrd.img": "initrd",
+		"images/pxeboot/rootfs.img": "rootfs",
+		"EFI/BOOT/BOOTX64.EFI":      "shim",
+		"EFI/redhat/grub.cfg":       grub,
+		"isolinux/isolinux.cfg":     isolinux,
+	}
+	embed := map[string]interface{}{
+		"default": kargs,
+		"files": []map[string]interface{}{
+			{"path": "EFI/redhat/grub.cfg", "offset": strings.Index(grub, area)},
+			{"path": "isolinux/isolinux.cfg", "offset": strings.Index(isolinux, area)},
+		},
+		"size": 64,
+	}
+	return createISO(t, files, embed)
+}
+
+// createISO creates an ISO with files, and a kargsInfoPath describing its
+// kernel arguments embed areas.
+func createISO(t *testing.T, files map[string]string, embed map[string]interface{}) string {
+	t.Helper()
+	workDir := t.TempDir()
+	data, err := json.Marshal(embed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files["coreos/kargs.json"] = string(data)
+	for name, content := range files {
+		path := filepath.Join(workDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	isoPath := filepath.Join(t.TempDir(), "rhcos.iso")
+	if err := isoeditor.Create(isoPath, workDir, "rhcos"); err != nil {
+		t.Fatal(err)
+	}
+	return isoPath
+}
+
+func TestKernelArgs(t *testing.T) {
+	isoPath := buildLiveISO(t)
+	info, err := getISOInfo(isoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.kargsErr != nil || len(info.kargsOffsets) != 2 {
+		t.Fatalf("expected a kernel arguments embed area, got %+v", info)
+	}
+
+	reader, err := newImageReader(&imageFile{
+		isoFile:         isoPath,
+		ignitionContent: []byte(`{}`),
+		kernelArgs:      []string{"ip=dhcp6", "console=ttyS0"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	area := string(content[info.kargsOffsets[0] : info.kargsOffsets[0]+info.kargsLength])
+	if expected := "coreos.liveiso=rhcos ignition.firstboot ip=dhcp6 console=ttyS0"; strings.TrimRight(area, "#") != expected {
+		t.Errorf("unexpected kernel arguments %q", area)
+	}
+	if ignition := string(content[info.areaStart : info.areaStart+2]); ignition != "{}" {
+		t.Errorf("unexpected ignition content %q", ignition)
+	}
+
+	if _, err := newImageReader(&imageFile{isoFile: isoPath, kernelArgs: []string{strings.Repeat("x", 64)}}); err == nil {
+		t.Error("expected kernel arguments larger than the embed area to be refused")
+	}
+	if imageDigest([]byte(`{}`), nil, BootConfig{}) != contentDigest([]byte(`{}`)) ||
+		imageDigest([]byte(`{}`), []string{"a b"}, BootConfig{}) == imageDigest([]byte(`{}`), []string{"a", "b"}, BootConfig{}) {
+		t.Error("expected the digest to identify the kernel arguments")
+	}
+}
+
+func TestGenerationTimeout(t *testing.T) {
+	imageServer := newTestImageServer(t, Options{
+		IsoFile:           buildLiveISO(t),
+		BaseURL:           "http://localhost:8080",
+		CacheDir:          t.TempDir(),
+		GenerationTimeout: time.Nanosecond,
+	})
+	ctx := context.Background()
+	info, err := imageServer.ServeImage(ctx, ImageSpec{Name: "host-xyz-45.iso", Ignition: []byte(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-info.Done
+	_, err = imageServer.ImageReady(ctx, "host-xyz-45.iso")
+	if !errors.Is(err, ErrGenerationTimeout) {
+		t.Errorf("expected generation to time out, got %v", err)
+	}
+
+	imageServer.generationTimeout = 0
+	info, err = imageServer.ReplaceImage(ctx, ImageSpec{Name: "host-xyz-45.iso", Ignition: []byte(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-info.Done
+	if ready, err := imageServer.ImageReady(ctx, "host-xyz-45.iso"); !ready || err != nil {
+		t.Fatalf("expected the image to be generated, got %v", err)
+	}
+
+	// a download stops once its request is aborted
+	imageServer.cacheDir = ""
+	im := imageServer.imageFileByName("host-xyz-45.iso")
+	im.cachePath = ""
+	requestCtx, cancel := context.WithCancel(ctx)
+	file, err := imageServer.open(requestCtx, imageServer.imageURL(&url.URL{}, im))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	if _, err := file.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if _, err := file.Read(buf); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected reads to fail once the request is aborted, got %v", err)
+	}
+}
+
+func TestConcurrentDownloads(t *testing.T) {
+	imageServer := newTestImageServer(t, Options{
+		IsoFile: buildLiveISO(t),
+		BaseURL: "http://localhost:8080",
+	})
+	info, err := imageServer.ServeImage(context.Background(), ImageSpec{Name: "host-xyz-45.iso", Ignition: []byte(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-info.Done
+	status, expected := getURL(t, imageServer, info.URL)
+	if status != http.StatusOK || int64(len(expected)) != info.Size {
+		t.Fatalf("unexpected image (%d) of %d bytes", status, len(expected))
+	}
+
+	// each download streams the image through a reader of its own
+	wg := sync.WaitGroup{}
+	bodies := make([]string, 8)
+	for i := range bodies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			u, _ := url.Parse(info.URL)
+			rr := httptest.NewRecorder()
+			imageServer.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, u.Path, nil))
+			bodies[i] = rr.Body.String()
+		}(i)
+	}
+	wg.Wait()
+	for i, body := range bodies {
+		if body != expected {
+			t.Errorf("download %d differs from the image (%d of %d bytes)", i, len(body), len(expected))
+		}
+	}
+}
+
+func TestImageWithoutIgnition(t *testing.T) {
+	imageServer := newTestImageServer(t, Options{
+		IsoFile: buildLiveISO(t),
+		BaseURL: "http://localhost:8080",
+	})
+	// e.g. a host configured by DHCP, with nothing else to embed
+	info, err := imageServer.ServeImage(context.Background(), ImageSpec{Name: "host-xyz-45.iso", KernelArgs: []string{"quiet"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-info.Done
+	if status, content := getURL(t, imageServer, info.URL); status != http.StatusOK || int64(len(content)) != info.Size {
+		t.Errorf("unexpected image (%d) of %d bytes", status, len(content))
+	}
+}
@@ -0,0 +1,129 @@
+package imagehandler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// fedoraCoreOSStreamURL is where the metadata of the Fedora CoreOS stream
+// with a name is published.
+const fedoraCoreOSStreamURL = "https://builds.coreos.fedoraproject.org/streams/%s.json"
+
+// maxStreamMetadataSize bounds the stream metadata read, which is tens of
+// kilobytes.
+const maxStreamMetadataSize = 8 << 20
+
+// StreamSource resolves the live ISO of an architecture from CoreOS stream
+// metadata, the JSON document listing the artifacts of the current release
+// of a stream, and downloads it, verifying its digest. The ISO follows new
+// releases of the stream each time it is fetched.
+type StreamSource struct {
+	// Stream is the URL of the stream metadata, or the name of a Fedora
+	// CoreOS stream, e.g. stable.
+	Stream string
+	// Arch is the architecture whose ISO is selected, e.g. x86_64.
+	Arch string
+	// Client is used for the downloads, or http.DefaultClient if nil.
+	Client *http.Client
+}
+
+// streamMetadata is the part of the stream metadata locating live ISOs.
+type streamMetadata struct {
+	Architectures map[string]struct {
+		Artifacts map[string]struct {
+			Formats map[string]struct {
+				Disk *struct {
+					Location string `json:"location"`
+					SHA256   string `json:"sha256"`
+				} `json:"disk"`
+			} `json:"formats"`
+		} `json:"artifacts"`
+	} `json:"architectures"`
+}
+
+// MetadataURL returns the URL of the stream metadata.
+func (s *StreamSource) MetadataURL() string {
+	if strings.Contains(s.Stream, "://") {
+		return s.Stream
+	}
+	return fmt.Sprintf(fedoraCoreOSStreamURL, s.Stream)
+}
+
+// Path returns the path the ISO is found at in dir, a link to the
+// download of the stream's current release.
+func (s *StreamSource) Path(dir string) string {
+	name := strings.TrimSuffix(path.Base(s.MetadataURL()), ".json")
+	return filepath.Join(dir, fmt.Sprintf("%s-%s.iso", name, s.Arch))
+}
+
+func (s *StreamSource) Fetch(ctx context.Context, dir string) (string, error) {
+	source, err := s.resolve(ctx)
+	if err != nil {
+		return "", err
+	}
+	downloaded, err := source.Fetch(ctx, dir)
+	if err != nil {
+		return "", err
+	}
+
+	link := s.Path(dir)
+	previous, _ := os.Readlink(link)
+	if previous == filepath.Base(downloaded) {
+		return link, nil
+	}
+	tmpLink := link + ".tmp"
+	_ = os.Remove(tmpLink)
+	if err := os.Symlink(filepath.Base(downloaded), tmpLink); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmpLink, link); err != nil {
+		os.Remove(tmpLink)
+		return "", err
+	}
+	if previous != "" && !strings.ContainsRune(previous, os.PathSeparator) {
+		// the download of the previous release
+		_ = os.Remove(filepath.Join(dir, previous))
+	}
+	return link, nil
+}
+
+// resolve finds the live ISO of the architecture in the stream metadata.
+func (s *StreamSource) resolve(ctx context.Context) (*URLSource, error) {
+	metadataURL := s.MetadataURL()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metadataURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("downloading %s returned %s", metadataURL, resp.Status)
+	}
+	metadata := streamMetadata{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxStreamMetadataSize)).Decode(&metadata); err != nil {
+		return nil, fmt.Errorf("invalid stream metadata %s: %w", metadataURL, err)
+	}
+
+	disk := metadata.Architectures[s.Arch].Artifacts["metal"].Formats["iso"].Disk
+	if disk == nil || disk.Location == "" {
+		return nil, fmt.Errorf("stream metadata %s has no live ISO for %s", metadataURL, s.Arch)
+	}
+	if disk.SHA256 == "" {
+		return nil, fmt.Errorf("stream metadata %s has no digest of the live ISO for %s", metadataURL, s.Arch)
+	}
+	return &URLSource{URL: disk.Location, SHA256: disk.SHA256, Client: s.Client}, nil
+}
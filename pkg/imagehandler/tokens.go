@@ -0,0 +1,147 @@
+package imagehandler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func newToken() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// redactPath hides download tokens in a request path before it is logged.
+// Tokens are the only path segment of that length made of hex digits.
+func redactPath(name string) string {
+	segments := strings.Split(name, "/")
+	for i, segment := range segments {
+		if len(segment) == 32 && strings.Trim(segment, "0123456789abcdef") == "" {
+			segments[i] = "<token>"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// usesTokens returns true if image URLs carry a download token.
+func (f *imageFileSystem) usesTokens() bool {
+	return f.oneTimeTokens || f.urlTTL > 0
+}
+
+// issueToken gives an image a fresh download token.
+func issueToken(im *imageFile) {
+	im.token = newToken()
+	im.tokenIssuedAt = time.Now()
+	im.tokenUsedAt = time.Time{}
+}
+
+// tokenExpiredLocked returns true once an image's download token has been
+// used and its grace period for resumed downloads is over, or it has
+// outlived the URL TTL. Must be called with the lock held.
+func (f *imageFileSystem) tokenExpiredLocked(im *imageFile) bool {
+	if im.token == "" {
+		return false
+	}
+	if f.urlTTL > 0 && time.Since(im.tokenIssuedAt) > f.urlTTL {
+		return true
+	}
+	return f.oneTimeTokens && !im.tokenUsedAt.IsZero() &&
+		time.Since(im.tokenUsedAt) > f.tokenGracePeriod
+}
+
+func (f *imageFileSystem) ImageURLExpiry(name string) time.Time {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	im := f.imageFileByNameLocked(name)
+	if im == nil {
+		return time.Time{}
+	}
+	return f.urlExpiryLocked(im)
+}
+
+// urlExpiryLocked returns when the current URL of an image expires. Must be
+// called with the lock held.
+func (f *imageFileSystem) urlExpiryLocked(im *imageFile) time.Time {
+	switch {
+	case im.storageKey != "":
+		return im.storageURLRefresh
+	case im.token != "" && f.urlTTL > 0:
+		return im.tokenIssuedAt.Add(f.urlTTL)
+	}
+	return time.Time{}
+}
+
+// markDownloaded starts the grace period of an image's download token after
+// the first complete download.
+func (f *imageFileSystem) markDownloaded(im *imageFile) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if im.token != "" && im.tokenUsedAt.IsZero() {
+		im.tokenUsedAt = time.Now()
+	}
+}
+
+// countingWriter records the status and number of body bytes of a response.
+// If progress is set, the download gauges are updated as it goes.
+type countingWriter struct {
+	http.ResponseWriter
+	status   int
+	written  int64
+	progress *downloadProgress
+}
+
+func (w *countingWriter) WriteHeader(status int) {
+	w.status = status
+	if w.progress != nil && (status == http.StatusOK || status == http.StatusPartialContent) {
+		w.progress.setTotal(w.Header())
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	if w.progress != nil {
+		w.progress.add(int64(n))
+	}
+	return n, err
+}
+
+// ReadFrom passes through to the underlying writer so that sendfile can
+// still be used for cached images.
+func (w *countingWriter) ReadFrom(src io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	var n int64
+	var err error
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		n, err = io.Copy(w.ResponseWriter, src)
+	}
+	w.written += n
+	if w.progress != nil {
+		w.progress.add(n)
+	}
+	return n, err
+}
+
+// sentContent returns true if any of the requested image was sent.
+func (w *countingWriter) sentContent() bool {
+	return (w.status == http.StatusOK || w.status == http.StatusPartialContent) && w.written > 0
+}
+
+// complete returns true if the response was a full download of size bytes.
+func (w *countingWriter) complete(size int64) bool {
+	return w.status == http.StatusOK && w.written >= size
+}
@@ -0,0 +1,134 @@
+package imagehandler
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// workerPool runs image generation jobs with bounded concurrency. Jobs
+// submitted while all workers are busy wait in an unbounded queue, so
+// submission never blocks. Once the pool's context is done, the workers
+// stop and queued jobs are dropped.
+type workerPool struct {
+	ctx     context.Context
+	mu      sync.Mutex
+	cond    *sync.Cond
+	jobs    []func(context.Context)
+	workers int
+	target  int
+}
+
+func newWorkerPool(ctx context.Context, workers int) *workerPool {
+	p := &workerPool{ctx: ctx}
+	p.cond = sync.NewCond(&p.mu)
+	p.Resize(workers)
+	if ctx.Done() != nil {
+		go p.stopWhenDone()
+	}
+	return p
+}
+
+func (p *workerPool) stopWhenDone() {
+	<-p.ctx.Done()
+	p.mu.Lock()
+	p.jobs = nil
+	generationQueueDepth.Set(0)
+	p.mu.Unlock()
+	p.cond.Broadcast()
+}
+
+// Resize changes the number of workers. Surplus workers exit once they have
+// finished their current job.
+func (p *workerPool) Resize(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.target = workers
+	for ; p.workers < p.target && p.ctx.Err() == nil; p.workers++ {
+		go p.work()
+	}
+	p.cond.Broadcast()
+}
+
+// Submit queues a job to be run by the next free worker. The job is passed
+// the pool's context.
+func (p *workerPool) Submit(job func(context.Context)) {
+	p.mu.Lock()
+	if p.ctx.Err() != nil {
+		p.mu.Unlock()
+		return
+	}
+	p.jobs = append(p.jobs, job)
+	generationQueueDepth.Set(float64(len(p.jobs)))
+	p.mu.Unlock()
+	p.cond.Signal()
+}
+
+// Do runs job on the next free worker and waits for it to finish, returning
+// its error. The job is passed a context that is done once either ctx or the
+// pool's context is. If either is done before a worker picks the job up,
+// the job is skipped and the context's error returned.
+func (p *workerPool) Do(ctx context.Context, job func(context.Context) error) error {
+	const (
+		queued int32 = iota
+		running
+		abandoned
+	)
+	state := queued
+	result := make(chan error, 1)
+	p.Submit(func(poolCtx context.Context) {
+		if !atomic.CompareAndSwapInt32(&state, queued, running) {
+			return
+		}
+		jobCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			select {
+			case <-poolCtx.Done():
+				cancel()
+			case <-jobCtx.Done():
+			}
+		}()
+		result <- job(jobCtx)
+	})
+
+	var err error
+	select {
+	case err = <-result:
+		return err
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-p.ctx.Done():
+		err = p.ctx.Err()
+	}
+	if atomic.CompareAndSwapInt32(&state, queued, abandoned) {
+		return err
+	}
+	return <-result
+}
+
+func (p *workerPool) work() {
+	for {
+		p.mu.Lock()
+		for len(p.jobs) == 0 && p.workers <= p.target && p.ctx.Err() == nil {
+			p.cond.Wait()
+		}
+		if p.workers > p.target || p.ctx.Err() != nil {
+			p.workers--
+			p.mu.Unlock()
+			return
+		}
+		job := p.jobs[0]
+		p.jobs[0] = nil
+		p.jobs = p.jobs[1:]
+		generationQueueDepth.Set(float64(len(p.jobs)))
+		p.mu.Unlock()
+
+		generationsInProgress.Inc()
+		job(p.ctx)
+		generationsInProgress.Dec()
+	}
+}
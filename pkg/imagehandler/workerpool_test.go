@@ -0,0 +1,72 @@
+package imagehandler
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolStopsOnShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := newWorkerPool(ctx, 1)
+
+	started := make(chan struct{})
+	stopped := make(chan error, 1)
+	p.Submit(func(ctx context.Context) {
+		close(started)
+		<-ctx.Done()
+		stopped <- ctx.Err()
+	})
+	ran := make(chan struct{}, 1)
+	p.Submit(func(context.Context) { ran <- struct{}{} })
+	<-started
+
+	cancel()
+	select {
+	case err := <-stopped:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("unexpected error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("running job not cancelled")
+	}
+
+	p.Submit(func(context.Context) { ran <- struct{}{} })
+	if err := p.Do(context.Background(), func(context.Context) error { return nil }); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected Do to fail once the pool is stopped, got %v", err)
+	}
+	select {
+	case <-ran:
+		t.Error("expected queued jobs to be dropped")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWorkerPoolDo(t *testing.T) {
+	p := newWorkerPool(context.Background(), 1)
+
+	release := make(chan struct{})
+	p.Submit(func(context.Context) { <-release })
+
+	// the only worker is busy, so the job waits until the request is gone
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	ran := false
+	err := p.Do(ctx, func(context.Context) error {
+		ran = true
+		return nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the request deadline, got %v", err)
+	}
+	close(release)
+
+	failed := errors.New("failed")
+	if err := p.Do(context.Background(), func(context.Context) error { return failed }); err != failed {
+		t.Errorf("expected the job's error, got %v", err)
+	}
+	if ran {
+		t.Error("expected the abandoned job to be skipped")
+	}
+}
@@ -0,0 +1,71 @@
+package initrd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+
+	"github.com/ulikunitz/xz"
+)
+
+// Compression is the compression of an initramfs archive. Linux unpacks
+// concatenated archives compressed differently, but some boot loaders and
+// firmwares only pass on, or have room for, some forms.
+type Compression string
+
+const (
+	CompressionNone Compression = "none"
+	CompressionGzip Compression = "gzip"
+	CompressionXZ   Compression = "xz"
+)
+
+// xzDictCap is the LZMA2 dictionary size of xz archives. The kernel's
+// decompressor allocates it up front, so it is kept as small as the
+// kernel's own build scripts use.
+const xzDictCap = 1 << 20
+
+// ParseCompression validates a compression name.
+func ParseCompression(value string) (Compression, error) {
+	switch c := Compression(value); c {
+	case CompressionNone, CompressionGzip, CompressionXZ:
+		return c, nil
+	}
+	return "", fmt.Errorf("unknown initrd compression %q", value)
+}
+
+// Encode renders the archive with a compression. The empty Compression is
+// the same as CompressionNone.
+func (a *Archive) Encode(compression Compression) ([]byte, error) {
+	data := a.Bytes()
+	buf := &bytes.Buffer{}
+	switch compression {
+	case "", CompressionNone:
+		return data, nil
+	case CompressionGzip:
+		w, err := gzip.NewWriterLevel(buf, gzip.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	case CompressionXZ:
+		// the kernel only verifies CRC32 checksums
+		w, err := xz.WriterConfig{CheckSum: xz.CRC32, DictCap: xzDictCap}.NewWriter(buf)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown initrd compression %q", compression)
+	}
+	return buf.Bytes(), nil
+}
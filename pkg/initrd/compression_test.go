@@ -0,0 +1,40 @@
+package initrd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/ulikunitz/xz"
+)
+
+func TestEncode(t *testing.T) {
+	archive := NewArchive().AddFile("etc/hostname", 0644, []byte("host-0"))
+	decompressors := map[Compression]func(io.Reader) (io.Reader, error){
+		CompressionNone: func(r io.Reader) (io.Reader, error) { return r, nil },
+		CompressionGzip: func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		CompressionXZ:   func(r io.Reader) (io.Reader, error) { return xz.NewReader(r) },
+	}
+	for compression, decompress := range decompressors {
+		data, err := archive.Encode(compression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader, err := decompress(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: %v", compression, err)
+		}
+		content, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("%s: %v", compression, err)
+		}
+		if !bytes.Equal(content, archive.Bytes()) {
+			t.Errorf("%s: the archive does not decompress to its content", compression)
+		}
+	}
+
+	if _, err := ParseCompression("bzip2"); err == nil {
+		t.Error("expected an unsupported compression to be refused")
+	}
+}
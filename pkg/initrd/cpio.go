@@ -0,0 +1,97 @@
+// Package initrd builds initramfs archives, which Linux unpacks on top of the
+// ramdisk it boots from.
+package initrd
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	// newcMagic identifies the "new" (SVR4) portable cpio format, the one
+	// the kernel accepts.
+	newcMagic = "070701"
+	trailer   = "TRAILER!!!"
+
+	modeDir  = 0040000
+	modeFile = 0100000
+)
+
+// Archive collects the files of an initramfs archive.
+type Archive struct {
+	files map[string]file
+}
+
+type file struct {
+	mode     int
+	contents []byte
+}
+
+func NewArchive() *Archive {
+	return &Archive{files: map[string]file{}}
+}
+
+// AddFile adds a file, replacing any previous file at the same path. Parent
+// directories are created as needed.
+func (a *Archive) AddFile(filePath string, mode int, contents []byte) *Archive {
+	a.files[strings.TrimPrefix(path.Clean("/"+filePath), "/")] = file{mode: mode, contents: contents}
+	return a
+}
+
+// IsEmpty returns true if no files have been added.
+func (a *Archive) IsEmpty() bool {
+	return len(a.files) == 0
+}
+
+// Bytes renders the archive in the newc cpio format, uncompressed.
+func (a *Archive) Bytes() []byte {
+	dirs := map[string]bool{}
+	names := []string{}
+	for name := range a.files {
+		names = append(names, name)
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+	for dir := range dirs {
+		names = append(names, dir)
+	}
+	// parents sort before their contents
+	sort.Strings(names)
+
+	buf := &bytes.Buffer{}
+	for i, name := range names {
+		if f, ok := a.files[name]; ok {
+			writeEntry(buf, i+1, modeFile|f.mode, name, f.contents)
+		} else {
+			writeEntry(buf, i+1, modeDir|0755, name, nil)
+		}
+	}
+	writeEntry(buf, 0, 0, trailer, nil)
+	return buf.Bytes()
+}
+
+func writeEntry(buf *bytes.Buffer, ino, mode int, name string, contents []byte) {
+	nlink := 1
+	if mode&modeDir != 0 {
+		nlink = 2
+	}
+	fmt.Fprintf(buf, "%s%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X",
+		newcMagic, ino, mode, 0, 0, nlink, 0, len(contents), 0, 0, 0, 0, len(name)+1, 0)
+	buf.WriteString(name)
+	buf.WriteByte(0)
+	pad(buf)
+	buf.Write(contents)
+	pad(buf)
+}
+
+// pad aligns the archive to four bytes, as each header and file body must
+// be.
+func pad(buf *bytes.Buffer) {
+	for buf.Len()%4 != 0 {
+		buf.WriteByte(0)
+	}
+}
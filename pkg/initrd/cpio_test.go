@@ -0,0 +1,67 @@
+package initrd
+
+import (
+	"strconv"
+	"testing"
+)
+
+type entry struct {
+	name     string
+	mode     int64
+	contents string
+}
+
+// readArchive parses a newc archive.
+func readArchive(t *testing.T, data []byte) []entry {
+	t.Helper()
+	entries := []entry{}
+	align := func(offset int) int { return (offset + 3) &^ 3 }
+	field := func(header []byte, i int) int64 {
+		value, err := strconv.ParseInt(string(header[6+8*i:14+8*i]), 16, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return value
+	}
+	for offset := 0; offset < len(data); {
+		header := data[offset : offset+110]
+		if string(header[:6]) != newcMagic {
+			t.Fatalf("bad magic at %d", offset)
+		}
+		size, nameSize := int(field(header, 6)), int(field(header, 11))
+		name := string(data[offset+110 : offset+110+nameSize-1])
+		start := align(offset + 110 + nameSize)
+		if name == trailer {
+			break
+		}
+		entries = append(entries, entry{name: name, mode: field(header, 1), contents: string(data[start : start+size])})
+		offset = align(start + size)
+	}
+	return entries
+}
+
+func TestArchive(t *testing.T) {
+	archive := NewArchive()
+	if !archive.IsEmpty() {
+		t.Error("expected a new archive to be empty")
+	}
+	archive.AddFile("/etc/NetworkManager/system-connections/eth0.nmconnection", 0600, []byte("[connection]\n"))
+	archive.AddFile("etc/hostname", 0644, []byte("host-0"))
+
+	entries := readArchive(t, archive.Bytes())
+	expected := []entry{
+		{"etc", modeDir | 0755, ""},
+		{"etc/NetworkManager", modeDir | 0755, ""},
+		{"etc/NetworkManager/system-connections", modeDir | 0755, ""},
+		{"etc/NetworkManager/system-connections/eth0.nmconnection", modeFile | 0600, "[connection]\n"},
+		{"etc/hostname", modeFile | 0644, "host-0"},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+	for i := range expected {
+		if entries[i] != expected[i] {
+			t.Errorf("entry %d: expected %+v, got %+v", i, expected[i], entries[i])
+		}
+	}
+}
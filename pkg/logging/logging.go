@@ -0,0 +1,35 @@
+// Package logging lets each component of the controller have its own
+// verbosity on top of a shared root logger.
+package logging
+
+import (
+	"github.com/go-logr/logr"
+)
+
+// verbosityLogger discards messages more verbose than its maximum level.
+type verbosityLogger struct {
+	logr.Logger
+	level    int
+	maxLevel int
+}
+
+// WithVerbosity returns a logger that only passes on V(n) messages with n up
+// to maxLevel. The root logger must itself be enabled for those levels.
+func WithVerbosity(log logr.Logger, maxLevel int) logr.Logger {
+	return &verbosityLogger{Logger: log, maxLevel: maxLevel}
+}
+
+func (l *verbosityLogger) V(level int) logr.Logger {
+	if l.level+level > l.maxLevel {
+		return logr.Discard()
+	}
+	return &verbosityLogger{Logger: l.Logger.V(level), level: l.level + level, maxLevel: l.maxLevel}
+}
+
+func (l *verbosityLogger) WithValues(keysAndValues ...interface{}) logr.Logger {
+	return &verbosityLogger{Logger: l.Logger.WithValues(keysAndValues...), level: l.level, maxLevel: l.maxLevel}
+}
+
+func (l *verbosityLogger) WithName(name string) logr.Logger {
+	return &verbosityLogger{Logger: l.Logger.WithName(name), level: l.level, maxLevel: l.maxLevel}
+}
@@ -0,0 +1,33 @@
+package logging
+
+import (
+	"testing"
+
+	"github.com/go-logr/logr"
+)
+
+// recorder is a logr.Logger that counts the messages it is given.
+type recorder struct {
+	logr.Logger
+	count *int
+}
+
+func (r recorder) Info(msg string, keysAndValues ...interface{}) { *r.count++ }
+func (r recorder) V(level int) logr.Logger                       { return r }
+func (r recorder) WithValues(kv ...interface{}) logr.Logger      { return r }
+func (r recorder) WithName(name string) logr.Logger              { return r }
+
+func TestWithVerbosity(t *testing.T) {
+	count := 0
+	log := WithVerbosity(recorder{Logger: logr.Discard(), count: &count}, 1)
+
+	log.Info("always")
+	log.V(1).Info("verbose")
+	log.V(2).Info("too verbose")
+	log.WithName("child").V(1).V(1).Info("too verbose")
+	log.WithValues("key", "value").V(1).Info("verbose")
+
+	if count != 3 {
+		t.Errorf("expected 3 messages to be logged, got %d", count)
+	}
+}
@@ -0,0 +1,23 @@
+package objectstore
+
+import (
+	"net/http"
+	"time"
+)
+
+const (
+	// transferTimeout bounds a whole request, including an image body,
+	// which can take a while for a large ISO on a slow link.
+	transferTimeout = time.Hour
+	// responseTimeout bounds the wait for the response headers once a
+	// request has been sent.
+	responseTimeout = time.Minute
+)
+
+// newHTTPClient returns a client whose requests fail, rather than hang,
+// once the server stops responding.
+func newHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = responseTimeout
+	return &http.Client{Transport: transport, Timeout: transferTimeout}
+}
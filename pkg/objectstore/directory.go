@@ -0,0 +1,122 @@
+package objectstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Directory stores objects as files in a local directory, typically a
+// volume shared with the Ironic conductor, so that it can read images
+// without another hop over the provisioning network.
+type Directory struct {
+	dir     string
+	baseURL *url.URL
+}
+
+// NewDirectory returns a store writing to dir. Objects are published under
+// baseURL, which defaults to a file:// URL of the directory for when the
+// conductor mounts the volume at the same path.
+func NewDirectory(dir string, baseURL string) (*Directory, error) {
+	if !filepath.IsAbs(dir) {
+		return nil, fmt.Errorf("export directory %q must be an absolute path", dir)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	if baseURL == "" {
+		baseURL = (&url.URL{Scheme: "file", Path: filepath.ToSlash(dir)}).String()
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "file" && u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("export URL %q must be a file, http or https URL", baseURL)
+	}
+	return &Directory{dir: dir, baseURL: u}, nil
+}
+
+// filePath returns the path an object is stored at, rejecting keys that
+// would escape the directory.
+func (d *Directory) filePath(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if clean == "/" || clean != "/"+key {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return filepath.Join(d.dir, filepath.FromSlash(clean)), nil
+}
+
+// Upload writes size bytes read from content to a file. The file is
+// written under a temporary name and renamed, so the conductor never sees a
+// partial image.
+func (d *Directory) Upload(ctx context.Context, key string, content io.Reader, size int64) error {
+	filePath, err := d.filePath(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	written, err := io.Copy(tmp, content)
+	if err == nil && size >= 0 && written != size {
+		err = fmt.Errorf("wrote %d bytes of an image of %d bytes", written, size)
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filePath)
+}
+
+// Delete removes an object's file, and its directory once empty.
+func (d *Directory) Delete(ctx context.Context, key string) error {
+	filePath, err := d.filePath(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for dir := filepath.Dir(filePath); dir != d.dir && strings.HasPrefix(dir, d.dir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// URL returns the URL of an object's file, which does not expire.
+func (d *Directory) URL(key string) (string, time.Time, error) {
+	if _, err := d.filePath(key); err != nil {
+		return "", time.Time{}, err
+	}
+	u := *d.baseURL
+	u.Path = path.Join("/", u.Path, key)
+	u.RawPath = ""
+	return u.String(), time.Time{}, nil
+}
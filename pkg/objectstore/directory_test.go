@@ -0,0 +1,48 @@
+package objectstore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDirectory(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewDirectory(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := "abc-1/host.iso"
+	if err := store.Upload(context.Background(), key, strings.NewReader("aiosetnarsetin"), 14); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "abc-1", "host.iso"))
+	if err != nil || string(data) != "aiosetnarsetin" {
+		t.Fatalf("unexpected exported file %q: %v", data, err)
+	}
+	if u, _, _ := store.URL(key); u != "file://"+dir+"/abc-1/host.iso" {
+		t.Errorf("unexpected URL %s", u)
+	}
+
+	if err := store.Upload(context.Background(), "../escape.iso", strings.NewReader("x"), 1); err == nil {
+		t.Error("expected a key outside the directory to be rejected")
+	}
+
+	if err := store.Delete(context.Background(), key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "abc-1")); !os.IsNotExist(err) {
+		t.Error("expected the empty image directory to be removed")
+	}
+
+	store, err = NewDirectory(dir, "http://localhost:8088/images/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, _, _ := store.URL(key); u != "http://localhost:8088/images/abc-1/host.iso" {
+		t.Errorf("unexpected URL %s", u)
+	}
+}
@@ -0,0 +1,548 @@
+package objectstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	ociEmptyMediaType    = "application/vnd.oci.empty.v1+json"
+	// ArtifactType identifies the images pushed to a registry.
+	ArtifactType = "application/vnd.metal3.preprovisioningimage.v1"
+	isoMediaType = "application/x-iso9660-image"
+	// manifestLookupTimeout bounds the lookup of an image's digest, needed
+	// for its blob URL, when it was not pushed by this process.
+	manifestLookupTimeout = 10 * time.Second
+)
+
+// emptyConfig is the config blob of artifacts that have no configuration.
+var emptyConfig = []byte("{}")
+
+// URL styles for images pushed to a registry.
+const (
+	// OCIURLBlob publishes the registry's URL for the image blob, so that
+	// hosts download it straight from the registry. The repository must
+	// allow anonymous pulls.
+	OCIURLBlob = "blob"
+	// OCIURLReference publishes an oci://registry/repository:tag reference,
+	// for consumers that pull artifacts themselves.
+	OCIURLReference = "oci"
+)
+
+// OCIConfig configures pushing images to a registry.
+type OCIConfig struct {
+	// Repository is the registry host and repository path, e.g.
+	// registry.example.com:5000/metal3/images.
+	Repository string
+	// Insecure uses plain HTTP to reach the registry.
+	Insecure bool
+	Username string
+	Password string
+	// URLStyle is OCIURLBlob or OCIURLReference.
+	URLStyle string
+}
+
+// OCI stores images as single-layer OCI artifacts in a registry, tagged by
+// their key.
+type OCI struct {
+	config     OCIConfig
+	scheme     string
+	registry   string
+	repository string
+	actions    string
+	client     *http.Client
+
+	mu          sync.Mutex
+	auth        string
+	blobDigests map[string]string
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Data        []byte            `json:"data,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	ArtifactType  string          `json:"artifactType"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+// NewOCI returns a store for the configured repository.
+func NewOCI(config OCIConfig) (*OCI, error) {
+	switch config.URLStyle {
+	case OCIURLBlob, OCIURLReference:
+	default:
+		return nil, fmt.Errorf("unknown OCI URL style %q", config.URLStyle)
+	}
+	return newOCI(config, "pull,push,delete")
+}
+
+// NewOCIPuller returns a client that only pulls artifacts from the
+// configured repository, e.g. base ISOs. The URL style is ignored.
+func NewOCIPuller(config OCIConfig) (*OCI, error) {
+	return newOCI(config, "pull")
+}
+
+func newOCI(config OCIConfig, actions string) (*OCI, error) {
+	registry, repository, found := cut(config.Repository, "/")
+	if !found || registry == "" || repository == "" || strings.Contains(config.Repository, "://") {
+		return nil, fmt.Errorf("OCI repository %q must be of the form registry/repository", config.Repository)
+	}
+	if repository != strings.ToLower(repository) {
+		return nil, fmt.Errorf("OCI repository %q must be lower case", config.Repository)
+	}
+	scheme := "https"
+	if config.Insecure {
+		scheme = "http"
+	}
+	return &OCI{
+		config:      config,
+		scheme:      scheme,
+		registry:    registry,
+		repository:  repository,
+		actions:     actions,
+		client:      newHTTPClient(),
+		blobDigests: map[string]string{},
+	}, nil
+}
+
+// ParseOCIReference splits a registry/repository:tag or
+// registry/repository@digest reference, optionally prefixed with oci://,
+// into the repository and the tag or digest.
+func ParseOCIReference(ref string) (string, string, error) {
+	ref = strings.TrimPrefix(ref, "oci://")
+	slash := strings.LastIndex(ref, "/")
+	if i := strings.Index(ref, "@"); i > slash && slash > 0 {
+		return ref[:i], ref[i+1:], nil
+	}
+	if i := strings.LastIndex(ref, ":"); i > slash && slash > 0 {
+		return ref[:i], ref[i+1:], nil
+	}
+	return "", "", fmt.Errorf("OCI reference %q must be of the form registry/repository:tag or registry/repository@digest", ref)
+}
+
+// tag is the tag an object is stored under. Keys can contain characters
+// tags can't, so they are hashed.
+func tag(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (o *OCI) endpoint(format string, args ...interface{}) string {
+	return fmt.Sprintf("%s://%s/v2/%s/", o.scheme, o.registry, o.repository) + fmt.Sprintf(format, args...)
+}
+
+// Upload pushes size bytes read from content as the layer of an artifact
+// tagged with the key.
+func (o *OCI) Upload(ctx context.Context, key string, content io.Reader, size int64) error {
+	if err := o.authorize(ctx); err != nil {
+		return err
+	}
+	configDigest, _, err := o.pushBlob(ctx, bytes.NewReader(emptyConfig))
+	if err != nil {
+		return err
+	}
+	layerDigest, written, err := o.pushBlob(ctx, content)
+	if err != nil {
+		return err
+	}
+	if size >= 0 && written != size {
+		return fmt.Errorf("pushed %d bytes of an image of %d bytes", written, size)
+	}
+
+	manifest, err := json.Marshal(ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestMediaType,
+		ArtifactType:  ArtifactType,
+		Config: ociDescriptor{
+			MediaType: ociEmptyMediaType,
+			Digest:    configDigest,
+			Size:      int64(len(emptyConfig)),
+			Data:      emptyConfig,
+		},
+		Layers: []ociDescriptor{{
+			MediaType:   isoMediaType,
+			Digest:      layerDigest,
+			Size:        written,
+			Annotations: map[string]string{"org.opencontainers.image.title": key[strings.LastIndex(key, "/")+1:]},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, o.endpoint("manifests/%s", tag(key)), bytes.NewReader(manifest))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", ociManifestMediaType)
+	resp, err := o.do(req, http.StatusCreated)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	o.mu.Lock()
+	o.blobDigests[key] = layerDigest
+	o.mu.Unlock()
+	return nil
+}
+
+// pushBlob uploads a blob in a single chunk, calculating its digest as it is
+// sent, and returns the digest and size.
+func (o *OCI) pushBlob(ctx context.Context, content io.Reader) (string, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.endpoint("blobs/uploads/"), nil)
+	if err != nil {
+		return "", 0, err
+	}
+	resp, err := o.do(req, http.StatusAccepted)
+	if err != nil {
+		return "", 0, err
+	}
+	resp.Body.Close()
+	location, err := o.location(resp)
+	if err != nil {
+		return "", 0, err
+	}
+
+	hash := sha256.New()
+	counter := &countingReader{Reader: io.TeeReader(content, hash)}
+	req, err = http.NewRequestWithContext(ctx, http.MethodPatch, location.String(), counter)
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err = o.do(req, http.StatusAccepted)
+	if err != nil {
+		return "", 0, err
+	}
+	resp.Body.Close()
+	if location, err = o.location(resp); err != nil {
+		return "", 0, err
+	}
+
+	digest := "sha256:" + hex.EncodeToString(hash.Sum(nil))
+	query := location.Query()
+	query.Set("digest", digest)
+	location.RawQuery = query.Encode()
+	req, err = http.NewRequestWithContext(ctx, http.MethodPut, location.String(), nil)
+	if err != nil {
+		return "", 0, err
+	}
+	resp, err = o.do(req, http.StatusCreated)
+	if err != nil {
+		return "", 0, err
+	}
+	resp.Body.Close()
+	return digest, counter.n, nil
+}
+
+// location resolves the upload location returned by the registry.
+func (o *OCI) location(resp *http.Response) (*url.URL, error) {
+	location, err := resp.Location()
+	if err != nil {
+		return nil, fmt.Errorf("registry did not return an upload location: %w", err)
+	}
+	return location, nil
+}
+
+// Delete removes the artifact tagged with the key. The registry garbage
+// collects its blobs.
+func (o *OCI) Delete(ctx context.Context, key string) error {
+	if err := o.authorize(ctx); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, o.endpoint("manifests/%s", tag(key)), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", ociManifestMediaType)
+	resp, err := o.do(req, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	manifestDigest := resp.Header.Get("Docker-Content-Digest")
+	if manifestDigest == "" {
+		return errors.New("registry did not return the manifest digest")
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodDelete, o.endpoint("manifests/%s", manifestDigest), nil)
+	if err != nil {
+		return err
+	}
+	resp, err = o.do(req, http.StatusAccepted)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	o.mu.Lock()
+	delete(o.blobDigests, key)
+	o.mu.Unlock()
+	return nil
+}
+
+// URL returns the URL of the artifact tagged with the key, which does not
+// expire.
+func (o *OCI) URL(key string) (string, time.Time, error) {
+	if o.config.URLStyle == OCIURLReference {
+		return fmt.Sprintf("oci://%s/%s:%s", o.registry, o.repository, tag(key)), time.Time{}, nil
+	}
+	o.mu.Lock()
+	digest, ok := o.blobDigests[key]
+	o.mu.Unlock()
+	if !ok {
+		var err error
+		if digest, err = o.lookupBlobDigest(key); err != nil {
+			return "", time.Time{}, err
+		}
+	}
+	return o.endpoint("blobs/%s", digest), time.Time{}, nil
+}
+
+// lookupBlobDigest reads the digest of an image from its manifest.
+func (o *OCI) lookupBlobDigest(key string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), manifestLookupTimeout)
+	defer cancel()
+	if err := o.authorize(ctx); err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, o.endpoint("manifests/%s", tag(key)), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", ociManifestMediaType)
+	resp, err := o.do(req, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	manifest := ociManifest{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&manifest); err != nil {
+		return "", err
+	}
+	if len(manifest.Layers) != 1 {
+		return "", fmt.Errorf("artifact %s has %d layers", tag(key), len(manifest.Layers))
+	}
+
+	o.mu.Lock()
+	o.blobDigests[key] = manifest.Layers[0].Digest
+	o.mu.Unlock()
+	return manifest.Layers[0].Digest, nil
+}
+
+// Resolve returns the digest of the image layer of the artifact a tag or
+// digest refers to. The artifact must have a single layer, or a single ISO
+// layer.
+func (o *OCI) Resolve(ctx context.Context, reference string) (string, error) {
+	if err := o.authorize(ctx); err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, o.endpoint("manifests/%s", reference), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", ociManifestMediaType)
+	resp, err := o.do(req, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	manifest := ociManifest{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&manifest); err != nil {
+		return "", err
+	}
+	if len(manifest.Layers) == 1 {
+		return manifest.Layers[0].Digest, nil
+	}
+	digest := ""
+	for _, layer := range manifest.Layers {
+		if layer.MediaType != isoMediaType {
+			continue
+		}
+		if digest != "" {
+			return "", fmt.Errorf("artifact %s has several ISO layers", reference)
+		}
+		digest = layer.Digest
+	}
+	if digest == "" {
+		return "", fmt.Errorf("artifact %s has no ISO layer", reference)
+	}
+	return digest, nil
+}
+
+// OpenBlob downloads the blob with a digest from the repository.
+func (o *OCI) OpenBlob(ctx context.Context, digest string) (io.ReadCloser, error) {
+	if err := o.authorize(ctx); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, o.endpoint("blobs/%s", digest), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := o.do(req, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// do sends an authorized request, returning an error unless the registry
+// responds with the expected status.
+func (o *OCI) do(req *http.Request, expected int) (*http.Response, error) {
+	o.mu.Lock()
+	auth := o.auth
+	o.mu.Unlock()
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != expected {
+		defer resp.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("registry %s %s returned %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return resp, nil
+}
+
+// authorize obtains the credentials to push to the repository, following
+// the challenge returned by the registry. Bearer tokens are short-lived, so
+// this is done before each operation.
+func (o *OCI) authorize(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s://%s/v2/", o.scheme, o.registry), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		return nil
+	}
+
+	scheme, params := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+	var auth string
+	switch strings.ToLower(scheme) {
+	case "basic":
+		req.SetBasicAuth(o.config.Username, o.config.Password)
+		auth = req.Header.Get("Authorization")
+	case "bearer":
+		token, err := o.fetchToken(ctx, params)
+		if err != nil {
+			return err
+		}
+		auth = "Bearer " + token
+	default:
+		return fmt.Errorf("unsupported registry authentication scheme %q", scheme)
+	}
+	o.mu.Lock()
+	o.auth = auth
+	o.mu.Unlock()
+	return nil
+}
+
+// fetchToken requests a bearer token from the registry's token service.
+func (o *OCI) fetchToken(ctx context.Context, params map[string]string) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return "", fmt.Errorf("invalid registry token realm %q", params["realm"])
+	}
+	query := realm.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	query.Set("scope", "repository:"+o.repository+":"+o.actions)
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if o.config.Username != "" {
+		req.SetBasicAuth(o.config.Username, o.config.Password)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("registry token service returned %s", resp.Status)
+	}
+	body := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	if body.AccessToken != "" {
+		return body.AccessToken, nil
+	}
+	return "", errors.New("registry token service returned no token")
+}
+
+// parseChallenge splits a WWW-Authenticate header into its scheme and
+// parameters.
+func parseChallenge(header string) (string, map[string]string) {
+	params := map[string]string{}
+	scheme, rest, _ := cut(strings.TrimSpace(header), " ")
+	for rest != "" {
+		var name, value string
+		name, rest, _ = cut(strings.TrimLeft(rest, " ,"), "=")
+		if strings.HasPrefix(rest, `"`) {
+			value, rest, _ = cut(rest[1:], `"`)
+		} else {
+			value, rest, _ = cut(rest, ",")
+		}
+		if name != "" {
+			params[strings.ToLower(strings.TrimSpace(name))] = value
+		}
+	}
+	return scheme, params
+}
+
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// cut slices s around the first instance of sep.
+func cut(s, sep string) (string, string, bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
@@ -0,0 +1,236 @@
+package objectstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRegistry implements enough of the OCI distribution API, with token
+// authentication, to push and delete artifacts.
+type fakeRegistry struct {
+	mu        sync.Mutex
+	uploads   map[string][]byte
+	blobs     map[string][]byte
+	manifests map[string][]byte
+	server    *httptest.Server
+}
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	r := &fakeRegistry{uploads: map[string][]byte{}, blobs: map[string][]byte{}, manifests: map[string][]byte{}}
+	r.server = httptest.NewServer(http.HandlerFunc(r.serve))
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+func (r *fakeRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if req.URL.Path == "/token" {
+		scope := req.URL.Query().Get("scope")
+		if user, pass, _ := req.BasicAuth(); user != "user" || pass != "secret" ||
+			(scope != "repository:metal3/images:pull,push,delete" && scope != "repository:metal3/images:pull") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, `{"token": "t0ken"}`)
+		return
+	}
+	if req.Header.Get("Authorization") != "Bearer t0ken" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry"`, r.server.URL))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/v2/metal3/images/")
+	switch {
+	case req.URL.Path == "/v2/":
+	case req.Method == http.MethodPost && path == "blobs/uploads/":
+		w.Header().Set("Location", "/v2/metal3/images/blobs/uploads/1")
+		r.uploads["1"] = nil
+		w.WriteHeader(http.StatusAccepted)
+	case req.Method == http.MethodPatch && strings.HasPrefix(path, "blobs/uploads/"):
+		data, _ := io.ReadAll(req.Body)
+		r.uploads["1"] = append(r.uploads["1"], data...)
+		w.Header().Set("Location", "/v2/metal3/images/blobs/uploads/1?state=x")
+		w.WriteHeader(http.StatusAccepted)
+	case req.Method == http.MethodPut && strings.HasPrefix(path, "blobs/uploads/"):
+		sum := sha256.Sum256(r.uploads["1"])
+		digest := "sha256:" + hex.EncodeToString(sum[:])
+		if req.URL.Query().Get("digest") != digest || req.URL.Query().Get("state") != "x" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.blobs[digest] = r.uploads["1"]
+		w.WriteHeader(http.StatusCreated)
+	case req.Method == http.MethodGet && strings.HasPrefix(path, "blobs/"):
+		data, ok := r.blobs[strings.TrimPrefix(path, "blobs/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(data)
+	case strings.HasPrefix(path, "manifests/"):
+		reference := strings.TrimPrefix(path, "manifests/")
+		switch req.Method {
+		case http.MethodPut:
+			data, _ := io.ReadAll(req.Body)
+			r.manifests[reference] = data
+			w.WriteHeader(http.StatusCreated)
+		case http.MethodGet, http.MethodHead:
+			data, ok := r.manifests[reference]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Docker-Content-Digest", "sha256:manifest-"+reference)
+			_, _ = w.Write(data)
+		case http.MethodDelete:
+			for tag := range r.manifests {
+				if reference == "sha256:manifest-"+tag {
+					delete(r.manifests, tag)
+					w.WriteHeader(http.StatusAccepted)
+					return
+				}
+			}
+			w.WriteHeader(http.StatusNotFound)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestOCIPushAndDelete(t *testing.T) {
+	registry := newFakeRegistry(t)
+	repository := strings.TrimPrefix(registry.server.URL, "http://") + "/metal3/images"
+	store, err := NewOCI(OCIConfig{
+		Repository: repository,
+		Insecure:   true,
+		Username:   "user",
+		Password:   "secret",
+		URLStyle:   OCIURLBlob,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := "abc-1/host.iso"
+	if err := store.Upload(context.Background(), key, strings.NewReader("aiosetnarsetin"), 14); err != nil {
+		t.Fatal(err)
+	}
+	manifest := ociManifest{}
+	if err := json.Unmarshal(registry.manifests[tag(key)], &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Layers) != 1 || string(registry.blobs[manifest.Layers[0].Digest]) != "aiosetnarsetin" {
+		t.Fatalf("unexpected manifest %+v", manifest)
+	}
+	if manifest.Layers[0].Annotations["org.opencontainers.image.title"] != "host.iso" {
+		t.Errorf("unexpected layer annotations %v", manifest.Layers[0].Annotations)
+	}
+
+	expected := registry.server.URL + "/v2/metal3/images/blobs/" + manifest.Layers[0].Digest
+	if u, _, err := store.URL(key); err != nil || u != expected {
+		t.Errorf("got URL %s (%v), want %s", u, err, expected)
+	}
+	// a restarted server finds the blob from the manifest
+	store.blobDigests = map[string]string{}
+	if u, _, err := store.URL(key); err != nil || u != expected {
+		t.Errorf("got URL %s (%v) after restart, want %s", u, err, expected)
+	}
+
+	store.config.URLStyle = OCIURLReference
+	if u, _, _ := store.URL(key); u != "oci://"+repository+":"+tag(key) {
+		t.Errorf("unexpected reference %s", u)
+	}
+
+	if err := store.Delete(context.Background(), key); err != nil {
+		t.Fatal(err)
+	}
+	if len(registry.manifests) != 0 {
+		t.Error("expected the manifest to be deleted")
+	}
+}
+
+func TestOCIRequestsTimeOut(t *testing.T) {
+	store, err := NewOCI(OCIConfig{Repository: "registry.example.com/metal3/images", URLStyle: OCIURLBlob})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport, ok := store.client.Transport.(*http.Transport)
+	if store.client.Timeout == 0 || !ok || transport.ResponseHeaderTimeout == 0 {
+		t.Error("expected requests to an unresponsive registry to time out")
+	}
+}
+
+func TestOCIPull(t *testing.T) {
+	registry := newFakeRegistry(t)
+	repository := strings.TrimPrefix(registry.server.URL, "http://") + "/metal3/images"
+	config := OCIConfig{
+		Repository: repository,
+		Insecure:   true,
+		Username:   "user",
+		Password:   "secret",
+		URLStyle:   OCIURLBlob,
+	}
+	store, err := NewOCI(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := store.Upload(ctx, "rhcos.iso", strings.NewReader("aiosetnarsetin"), 14); err != nil {
+		t.Fatal(err)
+	}
+
+	config.URLStyle = ""
+	puller, err := NewOCIPuller(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := puller.Resolve(ctx, tag("rhcos.iso"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("aiosetnarsetin"))
+	if digest != "sha256:"+hex.EncodeToString(sum[:]) {
+		t.Errorf("unexpected digest %s", digest)
+	}
+	blob, err := puller.OpenBlob(ctx, digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	if data, _ := io.ReadAll(blob); string(data) != "aiosetnarsetin" {
+		t.Errorf("unexpected content %q", data)
+	}
+	if _, err := puller.Resolve(ctx, "missing"); err == nil {
+		t.Error("expected an unknown tag to fail")
+	}
+}
+
+func TestParseOCIReference(t *testing.T) {
+	for ref, expected := range map[string][2]string{
+		"oci://quay.io/openshift/rhcos:4.9":               {"quay.io/openshift/rhcos", "4.9"},
+		"registry.example.com:5000/rhcos:latest":          {"registry.example.com:5000/rhcos", "latest"},
+		"registry.example.com:5000/rhcos@sha256:0123abcd": {"registry.example.com:5000/rhcos", "sha256:0123abcd"},
+	} {
+		repository, reference, err := ParseOCIReference(ref)
+		if err != nil || repository != expected[0] || reference != expected[1] {
+			t.Errorf("%s: got %s, %s, %v", ref, repository, reference, err)
+		}
+	}
+	for _, ref := range []string{"rhcos:4.9", "registry.example.com:5000/rhcos"} {
+		if _, _, err := ParseOCIReference(ref); err == nil {
+			t.Errorf("%s: expected an error", ref)
+		}
+	}
+}
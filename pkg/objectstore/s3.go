@@ -0,0 +1,225 @@
+// Package objectstore stores generated images in S3-compatible object
+// storage, an OCI registry or a shared directory, so that they can be
+// downloaded from there rather than from the image server.
+package objectstore
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	signingAlgorithm = "AWS4-HMAC-SHA256"
+	unsignedPayload  = "UNSIGNED-PAYLOAD"
+	amzDateFormat    = "20060102T150405Z"
+	// maxURLExpiry is the longest validity S3 accepts for presigned URLs.
+	maxURLExpiry = 7 * 24 * time.Hour
+)
+
+// S3Config configures access to an S3 bucket.
+type S3Config struct {
+	// Endpoint is the URL of the S3 service, e.g. https://s3.amazonaws.com.
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prefix is prepended to the key of every object.
+	Prefix string
+	// PathStyle addresses the bucket in the URL path rather than as a
+	// subdomain, as many S3-compatible services require.
+	PathStyle       bool
+	AccessKeyID     string
+	SecretAccessKey string
+	// URLExpiry is how long presigned download URLs remain valid.
+	URLExpiry time.Duration
+}
+
+// S3 stores objects in an S3 bucket, authenticating requests with AWS
+// Signature Version 4.
+type S3 struct {
+	config   S3Config
+	endpoint *url.URL
+	client   *http.Client
+	now      func() time.Time
+}
+
+// NewS3 returns a store for the configured bucket.
+func NewS3(config S3Config) (*S3, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" || endpoint.Host == "" {
+		return nil, fmt.Errorf("S3 endpoint %q must be an http or https URL", config.Endpoint)
+	}
+	if config.Bucket == "" || config.Region == "" {
+		return nil, errors.New("an S3 bucket and region are required")
+	}
+	if config.AccessKeyID == "" || config.SecretAccessKey == "" {
+		return nil, errors.New("S3 credentials are required")
+	}
+	if config.URLExpiry <= 0 || config.URLExpiry > maxURLExpiry {
+		return nil, fmt.Errorf("S3 URL expiry must be between 1s and %s", maxURLExpiry)
+	}
+	return &S3{config: config, endpoint: endpoint, client: newHTTPClient(), now: time.Now}, nil
+}
+
+// objectURL returns the unsigned URL of an object.
+func (s *S3) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	key = strings.TrimPrefix(s.config.Prefix+key, "/")
+	if s.config.PathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.config.Bucket + "/" + key
+	} else {
+		u.Host = s.config.Bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	}
+	return &u
+}
+
+// Upload stores size bytes read from content as an object.
+func (s *S3) Upload(ctx context.Context, key string, content io.Reader, size int64) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL(key).String(), content)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	return s.do(req)
+}
+
+// Delete removes an object.
+func (s *S3) Delete(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.objectURL(key).String(), nil)
+	if err != nil {
+		return err
+	}
+	return s.do(req)
+}
+
+// URL returns a presigned URL to download an object, and when it expires.
+func (s *S3) URL(key string) (string, time.Time, error) {
+	now := s.now().UTC()
+	u := s.objectURL(key)
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", signingAlgorithm)
+	query.Set("X-Amz-Credential", s.config.AccessKeyID+"/"+s.scope(now))
+	query.Set("X-Amz-Date", now.Format(amzDateFormat))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(s.config.URLExpiry.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+	u.RawQuery = canonicalQuery(query)
+
+	headers := http.Header{}
+	signature := s.signature(now, http.MethodGet, u, headers, u.Host, unsignedPayload)
+	u.RawQuery += "&X-Amz-Signature=" + signature
+	return u.String(), now.Add(s.config.URLExpiry), nil
+}
+
+func (s *S3) do(req *http.Request) error {
+	s.sign(req, unsignedPayload)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("S3 %s %s returned %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// sign adds an Authorization header to a request.
+func (s *S3) sign(req *http.Request, payloadHash string) {
+	now := s.now().UTC()
+	req.Header.Set("X-Amz-Date", now.Format(amzDateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := http.Header{}
+	for _, name := range []string{"Content-Type", "X-Amz-Content-Sha256", "X-Amz-Date"} {
+		if value := req.Header.Get(name); value != "" {
+			headers.Set(name, value)
+		}
+	}
+	signature := s.signature(now, req.Method, req.URL, headers, req.URL.Host, payloadHash)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		signingAlgorithm, s.config.AccessKeyID, s.scope(now), signedHeaders(headers), signature))
+}
+
+func (s *S3) scope(now time.Time) string {
+	return now.Format("20060102") + "/" + s.config.Region + "/s3/aws4_request"
+}
+
+// signature calculates the Signature Version 4 signature of a request with
+// the given headers, in addition to host.
+func (s *S3) signature(now time.Time, method string, u *url.URL, headers http.Header, host string, payloadHash string) string {
+	headers = headers.Clone()
+	headers.Set("Host", host)
+
+	names := []string{}
+	for name := range headers {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + strings.TrimSpace(headers.Get(name)) + "\n"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		u.EscapedPath(),
+		u.RawQuery,
+		canonicalHeaders,
+		strings.Join(names, ";"),
+		payloadHash,
+	}, "\n")
+	stringToSign := strings.Join([]string{
+		signingAlgorithm,
+		now.Format(amzDateFormat),
+		s.scope(now),
+		hexSHA256(canonicalRequest),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.config.SecretAccessKey), now.Format("20060102"))
+	key = hmacSHA256(key, s.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func signedHeaders(headers http.Header) string {
+	names := []string{"host"}
+	for name := range headers {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+	return strings.Join(names, ";")
+}
+
+// canonicalQuery encodes query parameters sorted by name, with spaces as %20
+// as Signature Version 4 requires.
+func canonicalQuery(query url.Values) string {
+	return strings.ReplaceAll(query.Encode(), "+", "%20")
+}
+
+func hexSHA256(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,74 @@
+// Package sharding divides PreprovisioningImages between replicas of the
+// service, so that each image is generated, cached and served by just one of
+// them.
+package sharding
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// Shard identifies one of Count replicas. The zero Shard owns everything.
+type Shard struct {
+	Index int
+	Count int
+}
+
+// Parse returns the shard of a replica from its index, which is either a
+// number or the name of a StatefulSet pod ending in its ordinal, e.g.
+// "image-customization-2".
+func Parse(index string, count int) (Shard, error) {
+	if count < 1 {
+		return Shard{}, fmt.Errorf("shard count must be at least 1, not %d", count)
+	}
+	if count == 1 {
+		return Shard{}, nil
+	}
+	ordinal := index
+	if i := strings.LastIndex(index, "-"); i >= 0 {
+		ordinal = index[i+1:]
+	}
+	n, err := strconv.Atoi(ordinal)
+	if err != nil || n < 0 {
+		return Shard{}, fmt.Errorf("%q is neither a shard index nor a StatefulSet pod name", index)
+	}
+	if n >= count {
+		return Shard{}, fmt.Errorf("shard index %d is out of range for %d shards", n, count)
+	}
+	return Shard{Index: n, Count: count}, nil
+}
+
+// Owns reports whether the shard is responsible for the image with the
+// given key, normally its namespace/name.
+func (s Shard) Owns(key string) bool {
+	if s.Count <= 1 {
+		return true
+	}
+	return Of(key, s.Count) == s.Index
+}
+
+// Of returns the index of the shard owning key out of count. It uses jump
+// consistent hashing, so that changing the number of shards moves only the
+// images that must move.
+func Of(key string, count int) int {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	k := h.Sum64()
+
+	b, j := int64(-1), int64(0)
+	for j < int64(count) {
+		b = j
+		k = k*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((k>>33)+1)))
+	}
+	return int(b)
+}
+
+func (s Shard) String() string {
+	if s.Count <= 1 {
+		return "unsharded"
+	}
+	return fmt.Sprintf("%d/%d", s.Index, s.Count)
+}
@@ -0,0 +1,65 @@
+package sharding
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		index    string
+		count    int
+		expected Shard
+		hasError bool
+	}{
+		{index: "", count: 1, expected: Shard{}},
+		{index: "2", count: 3, expected: Shard{Index: 2, Count: 3}},
+		{index: "image-customization-1", count: 3, expected: Shard{Index: 1, Count: 3}},
+		{index: "image-customization-3", count: 3, hasError: true},
+		{index: "image-customization", count: 3, hasError: true},
+		{index: "0", count: 0, hasError: true},
+	} {
+		shard, err := Parse(tc.index, tc.count)
+		if tc.hasError {
+			if err == nil {
+				t.Errorf("%q/%d: expected an error", tc.index, tc.count)
+			}
+			continue
+		}
+		if err != nil || shard != tc.expected {
+			t.Errorf("%q/%d: got %v (%v), want %v", tc.index, tc.count, shard, err, tc.expected)
+		}
+	}
+}
+
+func TestOwnership(t *testing.T) {
+	const images = 1000
+	owners := map[string]int{}
+	counts := make([]int, 4)
+	for i := 0; i < images; i++ {
+		key := fmt.Sprintf("metal3/host-%d", i)
+		owned := 0
+		for index := 0; index < 4; index++ {
+			if (Shard{Index: index, Count: 4}).Owns(key) {
+				owners[key] = index
+				counts[index]++
+				owned++
+			}
+		}
+		if owned != 1 {
+			t.Fatalf("%s is owned by %d shards", key, owned)
+		}
+	}
+	for index, count := range counts {
+		if count < images/8 {
+			t.Errorf("shard %d owns only %d of %d images", index, count, images)
+		}
+	}
+
+	// Adding a shard only moves images to the new shard.
+	for key, owner := range owners {
+		if moved := Of(key, 5); moved != owner && moved != 4 {
+			t.Errorf("%s moved from shard %d to %d", key, owner, moved)
+		}
+	}
+}
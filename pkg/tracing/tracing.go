@@ -0,0 +1,88 @@
+// Package tracing records OpenTelemetry spans around the steps of building
+// and serving an image, so that slow provisioning can be followed from
+// reconcile to download. Spans are exported with OTLP and propagated in the
+// W3C Trace Context format, so they can be correlated with those of other
+// components, such as Ironic.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName identifies the spans of this module.
+const instrumentationName = "github.com/asalkeld/image-customization-controller"
+
+// Setup exports spans over OTLP/HTTP to the collector configured by the
+// standard OTEL_EXPORTER_OTLP_* environment variables, and propagates W3C
+// Trace Context. Spans are discarded until it is called. It returns a
+// function that flushes the remaining spans and stops exporting.
+func Setup(ctx context.Context, serviceName string) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create the OTLP exporter: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(),
+		resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName)))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
+
+// Start begins a span as a child of any span in ctx, with optional
+// key/value attributes, and returns a context containing it.
+func Start(ctx context.Context, name string, keysAndValues ...interface{}) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attributes(keysAndValues)...))
+}
+
+// SetAttributes adds key/value attributes to a span.
+func SetAttributes(span trace.Span, keysAndValues ...interface{}) {
+	span.SetAttributes(attributes(keysAndValues)...)
+}
+
+// End records err, if any, on a span and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// attributes converts logr-style key/value pairs to span attributes.
+func attributes(keysAndValues []interface{}) []attribute.KeyValue {
+	attrs := make([]attribute.KeyValue, 0, len(keysAndValues)/2)
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		key := attribute.Key(fmt.Sprint(keysAndValues[i]))
+		switch value := keysAndValues[i+1].(type) {
+		case string:
+			attrs = append(attrs, key.String(value))
+		case bool:
+			attrs = append(attrs, key.Bool(value))
+		case int:
+			attrs = append(attrs, key.Int(value))
+		case int64:
+			attrs = append(attrs, key.Int64(value))
+		default:
+			attrs = append(attrs, key.String(fmt.Sprint(value)))
+		}
+	}
+	return attrs
+}